@@ -0,0 +1,63 @@
+//go:build acme
+
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMECertificate obtains and renews certificates for the hosts from Let's Encrypt, caching them in cacheDir.
+// Challenges are answered over HTTP-01 on httpAddr and TLS-ALPN-01 on tlsAddr, either of which may be empty.
+// Clients which do not send a server name are given the certificate of the first host.
+func newACMECertificate(hosts []string, email, cacheDir, httpAddr, tlsAddr string) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	if httpAddr != "" {
+		listener, err := net.Listen("tcp", httpAddr)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			log.Fatal(http.Serve(listener, manager.HTTPHandler(nil)))
+		}()
+		log.Println("ANSWERING ACME HTTP CHALLENGES ON", httpAddr)
+	}
+	if tlsAddr != "" {
+		listener, err := tls.Listen("tcp", tlsAddr, manager.TLSConfig())
+		if err != nil {
+			return nil, err
+		}
+		go serveTLSALPN(listener)
+		log.Println("ANSWERING ACME TLS-ALPN CHALLENGES ON", tlsAddr)
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			hello.ServerName = hosts[0]
+		}
+		return manager.GetCertificate(hello)
+	}, nil
+}
+
+// serveTLSALPN completes the handshakes of challenge connections, which carry no further data.
+func serveTLSALPN(listener net.Listener) {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			log.Println("ERROR", err, "WHILE ACCEPTING ACME CHALLENGE")
+			return
+		}
+		go func() {
+			defer c.Close()
+			c.(*tls.Conn).Handshake()
+		}()
+	}
+}
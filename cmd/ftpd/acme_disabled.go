@@ -0,0 +1,13 @@
+//go:build !acme
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// newACMECertificate is only available in builds with the acme tag, which pulls in the ACME client.
+func newACMECertificate(hosts []string, email, cacheDir, httpAddr, tlsAddr string) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	return nil, errors.New("ACME support requires building with -tags acme")
+}
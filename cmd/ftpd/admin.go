@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/lnsp/ftpd/pkg/ftp/admin"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+)
+
+// serveAdmin starts the admin API in the background, using HTTPS if a FTPS certificate is configured.
+// The listener is bound right away, so privileges can be dropped afterwards.
+func serveAdmin(addr, token string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), h *handler.Handler, store config.FTPUserConfig, logs *admin.LogBuffer) {
+	if token == "" {
+		log.Fatal("the admin API requires an admin token")
+	}
+	manager, _ := store.(config.Manager)
+	api := admin.New(h, manager, token)
+	api.Logs = logs
+	server := &http.Server{Addr: addr, Handler: api}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if getCertificate != nil {
+		listener = tls.NewListener(listener, &tls.Config{GetCertificate: getCertificate, NextProtos: []string{"h2", "http/1.1"}})
+	}
+	go func() {
+		log.Fatal(server.Serve(listener))
+	}()
+	log.Println("ADMIN API LISTENING ON", addr, "WITH CONSOLE AT /console")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	benchOpLogin = "login"
+	benchOpList  = "list"
+	benchOpRetr  = "retr"
+	benchOpStor  = "stor"
+)
+
+// benchClient is a minimal FTP client used to generate load.
+type benchClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialBench(addr, user, password string) (*benchClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	client := &benchClient{conn, bufio.NewReader(conn)}
+	if _, err := client.expect(220); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := client.command(331, "USER "+user); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := client.command(230, "PASS "+password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// expect reads a reply and checks its status code.
+func (c *benchClient) expect(code int) (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	for len(line) > 3 && line[3] == '-' {
+		next, err := c.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(next, line[:3]+" ") {
+			line = next
+		}
+	}
+	if !strings.HasPrefix(line, strconv.Itoa(code)) {
+		return "", errors.New("unexpected reply: " + strings.TrimSpace(line))
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func (c *benchClient) command(code int, cmd string) (string, error) {
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", cmd); err != nil {
+		return "", err
+	}
+	return c.expect(code)
+}
+
+// passive opens a passive data connection.
+func (c *benchClient) passive() (net.Conn, error) {
+	reply, err := c.command(227, "PASV")
+	if err != nil {
+		return nil, err
+	}
+	start, end := strings.Index(reply, "("), strings.Index(reply, ")")
+	if start < 0 || end < start {
+		return nil, errors.New("malformed PASV reply: " + reply)
+	}
+	fields := strings.Split(reply[start+1:end], ",")
+	if len(fields) != 6 {
+		return nil, errors.New("malformed PASV reply: " + reply)
+	}
+	p1, _ := strconv.Atoi(fields[4])
+	p2, _ := strconv.Atoi(fields[5])
+	return net.Dial("tcp", net.JoinHostPort(strings.Join(fields[:4], "."), strconv.Itoa(p1*256+p2)))
+}
+
+// transfer runs a data transfer command and returns the number of bytes moved.
+func (c *benchClient) transfer(cmd string, upload []byte) (int64, error) {
+	data, err := c.passive()
+	if err != nil {
+		return 0, err
+	}
+	defer data.Close()
+	if _, err := c.command(125, cmd); err != nil {
+		return 0, err
+	}
+	var n int64
+	if upload != nil {
+		written, err := data.Write(upload)
+		if err != nil {
+			return 0, err
+		}
+		n = int64(written)
+		data.Close()
+	} else if n, err = io.Copy(ioutil.Discard, data); err != nil {
+		return 0, err
+	}
+	_, err = c.expect(226)
+	return n, err
+}
+
+func (c *benchClient) Close() {
+	c.command(200, "QUIT")
+	c.conn.Close()
+}
+
+// benchResult collects latencies and transferred bytes of a single operation type.
+type benchResult struct {
+	latencies []time.Duration
+	bytes     int64
+	errors    int
+}
+
+type benchStats struct {
+	mu      sync.Mutex
+	results map[string]*benchResult
+}
+
+func (s *benchStats) record(op string, d time.Duration, n int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[op]
+	if !ok {
+		result = &benchResult{}
+		s.results[op] = result
+	}
+	if err != nil {
+		result.errors++
+		return
+	}
+	result.latencies = append(result.latencies, d)
+	result.bytes += n
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func (s *benchStats) print(elapsed time.Duration) {
+	ops := make([]string, 0, len(s.results))
+	for op := range s.results {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	fmt.Printf("%-6s %8s %6s %10s %10s %10s %12s\n", "OP", "COUNT", "ERRORS", "P50", "P90", "P99", "THROUGHPUT")
+	for _, op := range ops {
+		result := s.results[op]
+		sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+		fmt.Printf("%-6s %8d %6d %10s %10s %10s %9.2f MB/s\n", op, len(result.latencies), result.errors,
+			percentile(result.latencies, 0.5), percentile(result.latencies, 0.9), percentile(result.latencies, 0.99),
+			float64(result.bytes)/elapsed.Seconds()/1e6)
+	}
+}
+
+// parseBenchMix parses weighted operations like "list=4,retr=4,stor=1,login=1".
+func parseBenchMix(mix string) ([]string, error) {
+	var ops []string
+	for _, entry := range strings.Split(mix, ",") {
+		tokens := strings.SplitN(entry, "=", 2)
+		weight := 1
+		if len(tokens) == 2 {
+			var err error
+			if weight, err = strconv.Atoi(tokens[1]); err != nil || weight < 0 {
+				return nil, errors.New("invalid weight in mix: " + entry)
+			}
+		}
+		switch tokens[0] {
+		case benchOpLogin, benchOpList, benchOpRetr, benchOpStor:
+		default:
+			return nil, errors.New("unknown operation in mix: " + tokens[0])
+		}
+		for i := 0; i < weight; i++ {
+			ops = append(ops, tokens[0])
+		}
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("empty operation mix")
+	}
+	return ops, nil
+}
+
+// runBench simulates concurrent clients against a target server.
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	var (
+		target   = flags.String("target", "127.0.0.1:2121", "Address of the server under test")
+		user     = flags.String("user", "anonymous", "User to log in as")
+		password = flags.String("password", "", "Password of the user")
+		clients  = flags.Int("clients", 10, "Number of concurrent clients")
+		requests = flags.Int("requests", 100, "Number of operations per client")
+		mix      = flags.String("mix", "list=4,retr=4,stor=1,login=1", "Weighted mix of operations")
+		file     = flags.String("file", "", "Remote file downloaded by retr operations")
+		size     = flags.Int("size", 1<<20, "Size of files uploaded by stor operations")
+	)
+	flags.Parse(args)
+
+	ops, err := parseBenchMix(*mix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *file == "" && strings.Contains(*mix, benchOpRetr) {
+		log.Fatal("retr operations require -file")
+	}
+	upload := make([]byte, *size)
+	rand.Read(upload)
+	stats := &benchStats{results: make(map[string]*benchResult)}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			opStart := time.Now()
+			client, err := dialBench(*target, *user, *password)
+			stats.record(benchOpLogin, time.Since(opStart), 0, err)
+			if err != nil {
+				return
+			}
+			for n := 0; n < *requests; n++ {
+				op := ops[rand.Intn(len(ops))]
+				opStart := time.Now()
+				var (
+					bytes int64
+					err   error
+				)
+				switch op {
+				case benchOpLogin:
+					client.Close()
+					client, err = dialBench(*target, *user, *password)
+				case benchOpList:
+					bytes, err = client.transfer("LIST", nil)
+				case benchOpRetr:
+					bytes, err = client.transfer("RETR "+*file, nil)
+				case benchOpStor:
+					bytes, err = client.transfer(fmt.Sprintf("STOR bench-%d-%d", id, n), upload)
+				}
+				stats.record(op, time.Since(opStart), bytes, err)
+				if client == nil {
+					return
+				}
+			}
+			client.Close()
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	stats.print(elapsed)
+	fmt.Printf("elapsed %s\n", elapsed)
+	for _, result := range stats.results {
+		if result.errors > 0 {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+// runCheck validates a user configuration file and exits with status 1 if it has errors, or warnings with -strict.
+func runCheck(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	var (
+		file        = flags.String("config", "", "User configuration file to check")
+		createHomes = flags.Bool("create-homes", false, "Accept missing home directories, which the server creates with -create-homes")
+		strict      = flags.Bool("strict", false, "Fail on warnings as well")
+	)
+	flags.Parse(args)
+	if *file == "" {
+		log.Fatal("check requires -config")
+	}
+	problems := config.CheckFile(*file, *createHomes)
+	failed := false
+	for _, problem := range problems {
+		fmt.Println(problem)
+		if problem.Severity == config.Error || *strict {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println(*file, "OK")
+}
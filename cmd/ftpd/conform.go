@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/lnsp/ftpd/pkg/ftp/conformance"
+)
+
+// runConform checks a running server against RFC 959 and exits with status 1 if any case fails.
+func runConform(args []string) {
+	flags := flag.NewFlagSet("conform", flag.ExitOnError)
+	var (
+		target   = flags.String("target", "127.0.0.1:2121", "Address of the server under test")
+		user     = flags.String("user", "anonymous", "User to log in as, must be allowed to upload and delete files")
+		password = flags.String("password", "", "Password of the user")
+		run      = flags.String("run", ".", "Run only the cases matching this regular expression")
+		timeout  = flags.Duration("timeout", conformance.DefaultTimeout, "Time limit of each case")
+	)
+	flags.Parse(args)
+	match, err := regexp.Compile(*run)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var cases []conformance.Case
+	for _, test := range conformance.Cases {
+		if match.MatchString(test.Name) {
+			cases = append(cases, test)
+		}
+	}
+	results := conformance.Run(conformance.Options{
+		Addr:     *target,
+		User:     *user,
+		Password: *password,
+		Timeout:  *timeout,
+	}, cases)
+	failed := 0
+	for _, result := range results {
+		fmt.Println(result)
+		if !result.Passed() {
+			failed++
+		}
+	}
+	fmt.Printf("%d of %d cases passed\n", len(results)-failed, len(results))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+)
+
+// envPrefix is prepended to the upper-cased flag names to form environment variable names.
+const envPrefix = "FTPD_"
+
+// envName returns the environment variable for a flag, e.g. FTPD_TLS_CERT for -tls-cert.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyEnvironment sets flags from FTPD_* environment variables.
+// Flags given on the command line take precedence.
+func applyEnvironment() {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			log.Fatal("invalid value of " + envName(f.Name) + ": " + err.Error())
+		}
+	})
+}
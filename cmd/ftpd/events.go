@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+)
+
+// publishers create the message queue publishers compiled in with build tags, keyed by URL scheme.
+var publishers = map[string]func(target *url.URL) (handler.Publisher, error){}
+
+// newPublisher connects to the message queue at the URL, e.g. nats://localhost:4222 or kafka://broker1:9092,broker2:9092.
+func newPublisher(rawURL string) (handler.Publisher, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	create, ok := publishers[target.Scheme]
+	if !ok {
+		return nil, errors.New("unsupported event queue " + target.Scheme + ", build with -tags nats or kafka")
+	}
+	return create(target)
+}
@@ -0,0 +1,40 @@
+//go:build kafka
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaWriteTimeout limits the time spent on publishing a single event.
+const kafkaWriteTimeout = 10 * time.Second
+
+func init() {
+	publishers["kafka"] = newKafkaPublisher
+}
+
+// kafkaPublisher publishes events as Kafka messages, creating missing topics.
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// newKafkaPublisher creates a publisher for the comma-separated brokers in the URL host.
+func newKafkaPublisher(target *url.URL) (handler.Publisher, error) {
+	return &kafkaPublisher{&kafka.Writer{
+		Addr:                   kafka.TCP(strings.Split(target.Host, ",")...),
+		Balancer:               &kafka.LeastBytes{},
+		AllowAutoTopicCreation: true,
+	}}, nil
+}
+
+func (p *kafkaPublisher) Publish(topic string, message []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaWriteTimeout)
+	defer cancel()
+	return p.writer.WriteMessages(ctx, kafka.Message{Topic: topic, Value: message})
+}
@@ -0,0 +1,31 @@
+//go:build nats
+
+package main
+
+import (
+	"net/url"
+
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+	"github.com/nats-io/nats.go"
+)
+
+func init() {
+	publishers["nats"] = newNATSPublisher
+}
+
+// natsPublisher publishes events as NATS messages, using the topic as subject.
+type natsPublisher struct {
+	conn *nats.Conn
+}
+
+func newNATSPublisher(target *url.URL) (handler.Publisher, error) {
+	conn, err := nats.Connect(target.String())
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{conn}, nil
+}
+
+func (p *natsPublisher) Publish(topic string, message []byte) error {
+	return p.conn.Publish(topic, message)
+}
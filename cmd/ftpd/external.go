@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// stunTimeout limits the time waiting for the STUN server.
+const stunTimeout = 5 * time.Second
+
+// stunMagicCookie is part of every STUN message header (RFC 5389).
+const stunMagicCookie = 0x2112A442
+
+// detectPublicIP looks for a public IPv4 address on the network interfaces and otherwise
+// asks the STUN server for the address the host is seen with from the internet.
+func detectPublicIP(stunServer string) (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			network, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip := network.IP.To4(); ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+				return ip.String(), nil
+			}
+		}
+	}
+	if stunServer == "" {
+		return "", errors.New("no public address found on network interfaces")
+	}
+	return queryStun(stunServer)
+}
+
+// queryStun sends a STUN binding request and returns the mapped IPv4 address of the response.
+func queryStun(server string) (string, error) {
+	conn, err := net.Dial("udp4", server)
+	if err != nil {
+		return "", errors.New("could not reach STUN server: " + err.Error())
+	}
+	defer conn.Close()
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:2], 0x0001)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	if _, err := rand.Read(request[8:20]); err != nil {
+		return "", err
+	}
+	conn.SetDeadline(time.Now().Add(stunTimeout))
+	if _, err := conn.Write(request); err != nil {
+		return "", errors.New("could not query STUN server: " + err.Error())
+	}
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		return "", errors.New("could not query STUN server: " + err.Error())
+	}
+	response = response[:n]
+	if n < 20 || binary.BigEndian.Uint16(response[0:2]) != 0x0101 || string(response[8:20]) != string(request[8:20]) {
+		return "", errors.New("invalid STUN response")
+	}
+	for attrs := response[20:]; len(attrs) >= 4; {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		// Only IPv4 is of use for PASV replies.
+		if attrLen >= 8 && value[1] == 0x01 {
+			ip := net.IP(append([]byte(nil), value[4:8]...))
+			switch attrType {
+			case 0x0020:
+				binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)^stunMagicCookie)
+				return ip.String(), nil
+			case 0x0001:
+				return ip.String(), nil
+			}
+		}
+		next := 4 + (attrLen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	return "", errors.New("STUN response has no mapped address")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/gateway"
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+)
+
+const (
+	gatewayReadTimeout = 10 * time.Second
+	gatewayIdleTimeout = 2 * time.Minute
+)
+
+// serveGateway starts the read-only HTTP gateway in the background, using HTTPS if a FTPS certificate is configured.
+// It shares the users and the file system settings of the FTP handler.
+func serveGateway(addr, anonymous string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), h *handler.Handler, cfg config.FTPUserConfig, filter *ftp.AddressFilter, logger *slog.Logger) {
+	gw := gateway.New(cfg)
+	gw.FileSystem = h.FileSystem
+	gw.HideDotfiles = h.HideDotfiles
+	gw.Template = h.Template
+	gw.EncryptionKey = h.EncryptionKey
+	gw.EncryptNames = h.EncryptNames
+	gw.AnonymousUser = anonymous
+	gw.Filter = filter
+	gw.Handler = h
+	gw.Logger = logger
+	// Downloads may take long, so only reading requests and idle keep-alive connections are limited.
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           gw,
+		ReadHeaderTimeout: gatewayReadTimeout,
+		ReadTimeout:       gatewayReadTimeout,
+		IdleTimeout:       gatewayIdleTimeout,
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if getCertificate != nil {
+		listener = tls.NewListener(listener, &tls.Config{GetCertificate: getCertificate, NextProtos: []string{"h2", "http/1.1"}})
+	}
+	go func() {
+		log.Fatal(server.Serve(listener))
+	}()
+	log.Println("HTTP GATEWAY LISTENING ON", addr)
+}
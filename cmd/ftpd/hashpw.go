@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"golang.org/x/term"
+)
+
+// runHashPassword prints the hash of a password for the password key of configuration files,
+// using the hash flags of the server. The password is read from the terminal without echo or from the first line of stdin.
+func runHashPassword(args []string) {
+	flag.CommandLine.Parse(args)
+	configurePasswordHasher()
+	password, err := readPassword(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hashed, err := config.HashPassword(password)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(hashed)
+}
+
+// readPassword reads a password, asking twice on terminals to catch typos.
+func readPassword(input *os.File) (string, error) {
+	fd := int(input.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(input).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return "", errors.New("empty password")
+		}
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(password) == 0 {
+		return "", errors.New("empty password")
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(repeated) != string(password) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+)
+
+// newLogger creates a structured logger writing text or JSON records of at least the given level to out.
+// It returns nil for the plain log format.
+func newLogger(format, level string, out io.Writer) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, errors.New("unknown log level: " + level)
+	}
+	opts := &slog.HandlerOptions{Level: minLevel}
+	switch format {
+	case "plain":
+		return nil, nil
+	case "text":
+		return slog.New(slog.NewTextHandler(out, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, opts)), nil
+	default:
+		return nil, errors.New("unknown log format: " + format)
+	}
+}
@@ -4,60 +4,591 @@ Easy-to-setup FTP server with user auth, EPLF directory listings and support for
 package main
 
 import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"io"
+	"io/ioutil"
 	"log"
-	"runtime"
+	"log/slog"
+	"net"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/admin"
 	"github.com/lnsp/ftpd/pkg/ftp/config"
 	"github.com/lnsp/ftpd/pkg/ftp/handler"
+	"github.com/lnsp/ftpd/pkg/ftp/sftp"
 	"github.com/lnsp/ftpd/pkg/ftp/tcp"
 )
 
 const (
 	modTimeFormat       = "20060102150405"
 	defaultTransferType = "AN"
-	transferBufferSize  = 4096
 	badLoginDelay       = 3 * time.Second
+	recentLogLines      = 500
 )
 
 var (
 	enableEPLF         = flag.Bool("eplf", false, "Enable EPLF (Easy parsed LIST Format)")
 	serverPort         = flag.Int("port", 2121, "Change the public control port")
 	serverMOTD         = flag.String("motd", "FTP Service ready", "Set the message of the day")
+	bannerFile         = flag.String("banner-file", "", "Read the welcome banner from this file instead of -motd, may span several lines")
+	logFormat          = flag.String("log-format", "plain", "Log as \"plain\" lines, structured \"text\" or \"json\"")
+	logLevel           = flag.String("log-level", "info", "Minimum level of structured logs: debug, info, warn or error")
+	logSecrets         = flag.Bool("log-secrets", false, "Log passwords of requests in plaintext, for debugging only")
+	progressInterval   = flag.Duration("progress-interval", 0, "Log the progress of transfers running longer than this interval, 0 disables it")
+	traceUsers         = flag.String("trace-users", "", "Comma-separated users allowed to trace their session with SITE DEBUG")
+	messagesFile       = flag.String("messages", "", "Override reply texts with the messages keyed by status code in this YAML, JSON or TOML file")
+	auditLog           = flag.String("audit-log", "", "Append a JSON line for every command and its outcome to this file")
 	serverIP           = flag.String("ip", "127.0.0.1", "Change the public IP")
-	serverSystemName   = flag.String("system", runtime.GOOS, "Change the system name")
+	listenAddrs        = flag.String("listen", "", "Comma-separated addresses to listen on instead of -ip and -port, e.g. 0.0.0.0:21,[::]:21")
+	tlsListenAddrs     = flag.String("tls-listen", "", "Comma-separated addresses to listen on with implicit TLS, e.g. :990")
+	maxConnections     = flag.Int("max-connections", 0, "Reject clients with 421 beyond this many concurrent connections, 0 disables the limit")
+	maxConnsPerIP      = flag.Int("max-connections-per-ip", 0, "Reject clients with 421 beyond this many concurrent connections from one IP, 0 disables the limit")
+	allowClients       = flag.String("allow-clients", "", "Comma-separated networks clients may connect from, e.g. 10.0.0.0/8, all if empty")
+	denyClients        = flag.String("deny-clients", "", "Comma-separated networks clients may not connect from")
+	allowFXP           = flag.Bool("allow-fxp", false, "Allow PORT and EPRT to target and passive data connections to come from other hosts than the client, e.g. for server-to-server transfers")
+	proxyProtocol      = flag.Bool("proxy-protocol", false, "Expect a PROXY protocol v1 or v2 header on control connections")
+	proxyTrusted       = flag.String("proxy-trusted", "", "Comma-separated networks allowed to send PROXY protocol headers, e.g. 10.0.0.0/8, all if empty")
+	serverSystemName   = flag.String("system", "UNIX", "Change the system name reported by SYST")
+	serverSystemType   = flag.String("system-type", "L8", "Change the system type reported by SYST")
+	strict             = flag.Bool("strict", false, "Reject protocol violations instead of tolerating them")
+	stealth            = flag.Bool("stealth", false, "Report only generic system information and banner")
 	serverUserConfig   = flag.String("config", "", "Enable a user configuration by file")
 	serverUserConfigWb = flag.Bool("writeback", false, "Write back updated user configuration")
+	virtualHosts       = flag.String("vhosts", "", "Comma-separated virtual hosts with their own user configuration, e.g. ftp.a.com=a.yml,ftp.b.com=b.yml")
+	watchConfig        = flag.Bool("watch-config", false, "Reload the user configuration file whenever it changes")
+	passwordHash       = flag.String("password-hash", "bcrypt", "Hash new passwords with \"bcrypt\" or \"argon2id\"")
+	bcryptCost         = flag.Int("bcrypt-cost", 10, "Cost of bcrypt password hashes")
+	argon2Time         = flag.Uint("argon2-time", 3, "Number of passes of argon2id password hashes")
+	argon2Memory       = flag.Uint("argon2-memory", 64*1024, "Memory in KiB used by argon2id password hashes")
+	argon2Threads      = flag.Uint("argon2-threads", 4, "Parallelism of argon2id password hashes")
+	sqlDriver          = flag.String("sql-driver", "", "Load users from a database using this driver (postgres, mysql or sqlite3)")
+	sqlDSN             = flag.String("sql-dsn", "", "Data source name of the user database")
+	sqlCacheTTL        = flag.Duration("sql-cache-ttl", time.Minute, "Cache user database lookups for this long")
+	authHook           = flag.String("auth-hook", "", "Delegate authentication to this program or HTTP endpoint")
+	authHookTimeout    = flag.Duration("auth-hook-timeout", 10*time.Second, "Time to wait for the auth hook")
+	jwtSecretFile      = flag.String("jwt-secret-file", "", "Accept JSON Web Tokens signed with the secret in this file as passwords")
+	jwks               = flag.String("jwks", "", "Accept JSON Web Tokens signed with a key from this JWKS file or URL as passwords")
+	maintenance        = flag.Bool("maintenance", false, "Start with write commands paused")
+	hideDotfiles       = flag.Bool("hide-dotfiles", false, "Hide dotfiles from listings and transfers")
+	commandTimeout     = flag.Duration("command-timeout", 0, "Abort commands including their transfers after this long, 0 disables the limit")
+	commandRate        = flag.Int64("command-rate", 0, "Throttle sessions sending more commands per second and disconnect persistent abusers, 0 disables the limit")
+	bandwidthLimit     = flag.Int64("bandwidth-limit", 0, "Limit the total bandwidth of all transfers in bytes per second, 0 disables the limit")
+	publicIP           = flag.String("public-ip", "", "IPv4 address announced in PASV replies to clients outside of private networks, \"auto\" to detect it")
+	stunServer         = flag.String("stun-server", "stun.l.google.com:19302", "STUN server used by -public-ip auto if no interface has a public address")
+	passiveBase        = flag.Int("passive-base", 0, "First port of the passive port range, any free port is used if 0")
+	passiveRange       = flag.Int("passive-range", 100, "Number of ports in the passive port range")
+	passivePool        = flag.Int("passive-pool", 0, "Keep this many passive listeners bound between transfers, 0 disables the pool")
+	idleTimeout        = flag.Duration("idle-timeout", 0, "Close control connections without commands for this long with 421, 0 disables the limit")
+	dataTimeout        = flag.Duration("data-timeout", 0, "Abort data connections which are not established or stall for this long, 0 disables the limit")
+	passiveTimeout     = flag.Duration("passive-timeout", time.Minute, "Close passive listeners the client does not connect to for this long, 0 disables the limit")
+	maxCommandLength   = flag.Int("max-command-length", tcp.DefaultMaxCommandLength, "Close control connections sending command lines longer than this many bytes")
+	transferBufferSize = flag.Int("transfer-buffer-size", tcp.DefaultTransferBufferSize, "Size in bytes of the pooled buffers copying data over data connections and the smallest chunk of storage I/O")
+	tcpKeepAlive       = flag.Duration("tcp-keepalive", 0, "Interval of TCP keep-alive probes on control and data connections, 0 keeps the default, negative disables them")
+	tcpNoDelay         = flag.Bool("tcp-nodelay", true, "Send small writes on control and data connections immediately instead of using Nagle's algorithm")
+	tcpReadBuffer      = flag.Int("tcp-read-buffer", 0, "Kernel receive buffer size in bytes of control and data connections, 0 keeps the default")
+	tcpWriteBuffer     = flag.Int("tcp-write-buffer", 0, "Kernel send buffer size in bytes of control and data connections, 0 keeps the default")
+	shutdownTimeout    = flag.Duration("shutdown-timeout", 30*time.Second, "Time to let running transfers finish on shutdown")
+	webhooks           = flag.String("webhooks", "", "Comma-separated URLs receiving JSON events of uploads, deletes, renames and failed logins")
+	webhookSecretFile  = flag.String("webhook-secret-file", "", "Sign webhook events with HMAC-SHA256 using the secret in this file")
+	webhookRetries     = flag.Int("webhook-retries", 3, "Retries of failed webhook deliveries")
+	eventsURL          = flag.String("events-url", "", "Publish upload, download and delete events to NATS or Kafka, e.g. nats://localhost:4222")
+	eventsTopic        = flag.String("events-topic", "ftp.{host}.{event}", "Topic of published events, {host} is the virtual host and {event} the kind of event")
+	shutdownWebhook    = flag.String("shutdown-webhook", "", "Post a JSON shutdown report to this URL")
+	checksumStore      = flag.String("checksum-store", "", "Persist upload checksums in a \"sidecar\" file or \"xattr\"")
+	sessionIDs         = flag.String("session-ids", "ulid", "Generate session IDs as \"ulid\" or \"sequential\" numbers")
+	encryptionKeyFile  = flag.String("encryption-key-file", "", "Encrypt stored files with the hex encoded 256 bit key in this file")
+	encryptNames       = flag.Bool("encrypt-names", false, "Encrypt file names in addition to file contents")
+	template           = flag.String("template", "", "Present this read-only directory below every home directory, keeping changes per user")
+	createHomes        = flag.Bool("create-homes", false, "Create missing home directories on first login")
+	homeMode           = flag.String("home-mode", "0755", "Permissions of created home directories")
+	homeSkeleton       = flag.String("home-skeleton", "", "Copy the contents of this directory into created home directories")
+	fileMode           = flag.String("file-mode", "0644", "Permissions of uploaded files")
+	dirMode            = flag.String("dir-mode", "0755", "Permissions of directories created by clients")
+	runAs              = flag.String("run-as", "", "Switch to this user after binding the listeners, e.g. to serve port 21 without root")
+	chrootDir          = flag.String("chroot", "", "Confine the process to this directory after binding the listeners")
+	umask              = flag.String("umask", "", "Set the process umask, e.g. 0002 to keep group-writable modes")
+	adminAddr          = flag.String("admin-addr", "", "Serve the HTTP admin API on this address")
+	adminToken         = flag.String("admin-token", "", "Bearer token of the admin API, preferably set with FTPD_ADMIN_TOKEN")
+	tlsCert            = flag.String("tls-cert", "", "Enable FTPS with this PEM encoded certificate")
+	tlsKey             = flag.String("tls-key", "", "Private key of the FTPS certificate")
+	tlsReloadInterval  = flag.Duration("tls-reload-interval", time.Minute, "Check the FTPS certificate for changes this often, 0 only reloads on SIGHUP")
+	acmeHosts          = flag.String("acme-hosts", "", "Obtain the FTPS certificate for these comma-separated host names from Let's Encrypt")
+	acmeEmail          = flag.String("acme-email", "", "Contact address of the ACME account")
+	acmeCache          = flag.String("acme-cache", "acme-cache", "Directory caching ACME certificates and account keys")
+	acmeHTTP           = flag.String("acme-http", ":80", "Address answering ACME HTTP-01 challenges, empty to disable")
+	acmeTLS            = flag.String("acme-tls", "", "Address answering ACME TLS-ALPN-01 challenges, e.g. :443")
+	tlsRequireReuse    = flag.Bool("tls-require-reuse", false, "Reject TLS data connections which do not resume the TLS session of the control connection")
+	tlsReuseExempt     = flag.String("tls-reuse-exempt", "", "Comma-separated networks of clients exempt from -tls-require-reuse, e.g. for clients without session resumption")
+	tlsClientCA        = flag.String("tls-client-ca", "", "Verify client certificates against these CAs to log in users without password")
+	canaries           = flag.String("canaries", "", "Comma-separated path patterns raising an alert when downloaded or deleted")
+	singleUser         = flag.String("user", "", "Serve a single user with full permissions instead of using a user configuration")
+	singlePassword     = flag.String("password", "", "Password of the single user, preferably set with FTPD_PASSWORD")
+	singleHome         = flag.String("home", "/", "Home directory of the single user")
+	sftpListen         = flag.String("sftp-listen", "", "Comma-separated addresses serving the same users over SFTP, e.g. :2222")
+	sftpHostKey        = flag.String("sftp-host-key", "", "PEM encoded private SSH host key of the SFTP listeners")
+	httpAddr           = flag.String("http-addr", "", "Serve the files of users read-only over HTTP on this address")
+	httpAnonymous      = flag.String("http-anonymous", "", "Serve HTTP requests without credentials as this user")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hashpw" {
+		runHashPassword(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		runCheck(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "conform" {
+		runConform(os.Args[2:])
+		return
+	}
 	flag.Parse()
+	applyEnvironment()
+	var logOutput io.Writer = os.Stderr
+	var recentLogs *admin.LogBuffer
+	if *adminAddr != "" {
+		recentLogs = admin.NewLogBuffer(os.Stderr, recentLogLines)
+		logOutput = recentLogs
+		log.SetOutput(logOutput)
+	}
+	logger, err := newLogger(*logFormat, *logLevel, logOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if logger != nil {
+		slog.SetDefault(logger)
+	}
 
-	cfg := config.NewDefaultConfig("/")
+	configurePasswordHasher()
+
+	var (
+		backends   []config.FTPUserConfig
+		reloadable *config.Reloadable
+	)
 	if *serverUserConfig != "" {
 		log.Println("LOADING CONFIG", *serverUserConfig, "WRITEBACK", *serverUserConfigWb)
+		fileConfig, err := config.NewFileConfig(*serverUserConfig, *serverUserConfigWb)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloadable = config.NewReloadable(fileConfig)
+		if *watchConfig {
+			if err := reloadable.WatchFile(*serverUserConfig, *serverUserConfigWb); err != nil {
+				log.Fatal(err)
+			}
+		}
+		backends = append(backends, reloadable)
+	}
+	if *singleUser != "" {
+		log.Println("SERVING SINGLE USER", *singleUser)
+		singleConfig, err := config.NewSingleUserConfig(*singleUser, *singlePassword, *singleHome)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backends = append(backends, singleConfig)
+	}
+	if *authHook != "" {
+		log.Println("DELEGATING AUTH TO", *authHook)
+		backends = append(backends, config.NewHookConfig(*authHook, *authHookTimeout))
+	}
+	if *sqlDriver != "" {
+		log.Println("LOADING USERS FROM", *sqlDriver, "DATABASE")
+		sqlConfig, err := config.NewSQLConfig(*sqlDriver, *sqlDSN, *sqlCacheTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backends = append(backends, sqlConfig)
+	}
+	cfg := config.NewDefaultConfig("/")
+	switch len(backends) {
+	case 0:
+	case 1:
+		cfg = backends[0]
+	default:
+		cfg = config.NewMulti(backends...)
+	}
+
+	store := cfg
+	if *jwtSecretFile != "" || *jwks != "" {
+		var secret []byte
+		if *jwtSecretFile != "" {
+			raw, err := ioutil.ReadFile(*jwtSecretFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			secret = []byte(strings.TrimSpace(string(raw)))
+		}
+		jwtConfig, err := config.NewJWTConfig(cfg, secret, *jwks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg = jwtConfig
+	}
+
+	motd := *serverMOTD
+	if *bannerFile != "" {
+		buffer, err := ioutil.ReadFile(*bannerFile)
+		if err != nil {
+			log.Fatal("could not read banner: " + err.Error())
+		}
+		motd = strings.TrimRight(string(buffer), "\r\n")
+	}
+	connHandler := handler.New(*serverIP, *serverSystemName, motd, cfg, *enableEPLF)
+	connHandler.SystemType = *serverSystemType
+	connHandler.Stealth = *stealth
+	connHandler.Strict = *strict
+	connHandler.HideDotfiles = *hideDotfiles
+	connHandler.TransferBufferSize = *transferBufferSize
+	switch *checksumStore {
+	case "", "sidecar", "xattr":
+		connHandler.ChecksumStore = *checksumStore
+	default:
+		log.Fatal("unknown checksum store: " + *checksumStore)
+	}
+	if *canaries != "" {
+		connHandler.Canaries = strings.Split(*canaries, ",")
+	}
+	if *webhooks != "" {
+		var secret []byte
+		if *webhookSecretFile != "" {
+			raw, err := ioutil.ReadFile(*webhookSecretFile)
+			if err != nil {
+				log.Fatal("could not read webhook secret: " + err.Error())
+			}
+			secret = []byte(strings.TrimSpace(string(raw)))
+		}
+		webhook := handler.NewWebhook(strings.Split(*webhooks, ","), secret, *webhookRetries)
+		connHandler.Hooks = handler.CombineHooks(connHandler.Hooks, webhook.Hooks())
+	}
+	if *eventsURL != "" {
+		publisher, err := newPublisher(*eventsURL)
+		if err != nil {
+			log.Fatal("could not connect to event queue: " + err.Error())
+		}
+		events := handler.NewEventStream(publisher, *eventsTopic)
+		connHandler.Hooks = handler.CombineHooks(connHandler.Hooks, events.Hooks())
+	}
+	connHandler.ProgressInterval = *progressInterval
+	if *traceUsers != "" {
+		connHandler.TraceUsers = strings.Split(*traceUsers, ",")
+	}
+	if *auditLog != "" {
+		auditFile, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatal("could not open audit log: " + err.Error())
+		}
+		defer auditFile.Close()
+		connHandler.Audit = handler.NewAuditLog(auditFile)
+	}
+	if *encryptionKeyFile != "" {
+		key, err := readEncryptionKey(*encryptionKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		connHandler.EncryptionKey = key
+	}
+	connHandler.EncryptNames = *encryptNames
+	connHandler.Template = *template
+	connHandler.CommandTimeout = *commandTimeout
+	connHandler.IdleTimeout = *idleTimeout
+	if *publicIP == "auto" {
+		ip, err := detectPublicIP(*stunServer)
+		if err != nil {
+			log.Fatal("could not detect public IP: " + err.Error())
+		}
+		log.Println("ANNOUNCING PUBLIC IP", ip)
+		connHandler.PassivePublicHost = ip
+	} else if *publicIP != "" {
+		if ip := net.ParseIP(*publicIP); ip == nil || ip.To4() == nil {
+			log.Fatal("invalid public IP: " + *publicIP)
+		}
+		connHandler.PassivePublicHost = *publicIP
+	}
+	connHandler.CommandRate = *commandRate
+	connHandler.BandwidthLimit = *bandwidthLimit
+	clientFilter := newClientFilter(*allowClients, *denyClients)
+	connHandler.ClientFilter = clientFilter
+	connHandler.AllowFXP = *allowFXP
+	connHandler.CreateHomes = *createHomes
+	connHandler.HomeSkeleton = *homeSkeleton
+	connHandler.HomeMode = parseModeFlag("home mode", *homeMode)
+	connHandler.FileMode = parseModeFlag("file mode", *fileMode)
+	connHandler.DirMode = parseModeFlag("directory mode", *dirMode)
+	if *umask != "" {
+		setUmask(parseModeFlag("umask", *umask))
+	}
+	var (
+		cert           *certificate
+		getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	)
+	if *tlsCert != "" && *acmeHosts != "" {
+		log.Fatal("-tls-cert and -acme-hosts cannot be combined")
+	}
+	if *tlsCert != "" {
 		var err error
-		cfg, err = config.NewYAMLConfig(*serverUserConfig, *serverUserConfigWb)
+		if cert, err = loadCertificate(*tlsCert, *tlsKey); err != nil {
+			log.Fatal(err)
+		}
+		if *tlsReloadInterval > 0 {
+			cert.watch(*tlsReloadInterval)
+		}
+		getCertificate = cert.GetCertificate
+	}
+	if *acmeHosts != "" {
+		var err error
+		getCertificate, err = newACMECertificate(strings.Split(*acmeHosts, ","), *acmeEmail, *acmeCache, *acmeHTTP, *acmeTLS)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	if getCertificate != nil {
+		tlsConfig, err := loadTLSConfig(getCertificate, *tlsClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		connHandler.TLSConfig = tlsConfig
+	}
+	if *virtualHosts != "" {
+		connHandler.VirtualHosts = loadVirtualHosts(*virtualHosts, *serverUserConfigWb)
+	}
+	connHandler.SetMaintenance(*maintenance)
+	watchMaintenanceSignals(connHandler)
+	watchReloadSignals(func() {
+		if reloadable != nil {
+			reloadable.ReloadFile(*serverUserConfig, *serverUserConfigWb)
+		}
+		if cert != nil {
+			cert.reloadAndLog()
+		}
+	})
+	addr := net.JoinHostPort(*serverIP, strconv.Itoa(*serverPort))
+	factory := tcp.NewFactory(addr)
+	factory.DataTimeout = *dataTimeout
+	factory.PassiveTimeout = *passiveTimeout
+	factory.AllowFXP = *allowFXP
+	factory.RequireTLSReuse = *tlsRequireReuse
+	if *tlsReuseExempt != "" {
+		factory.TLSReuseExempt = parseNetworks(*tlsReuseExempt)
+	}
+	factory.MaxCommandLength = *maxCommandLength
+	factory.TransferBufferSize = *transferBufferSize
+	factory.ControlSocket = tcp.SocketOptions{
+		KeepAlive:   *tcpKeepAlive,
+		Nagle:       !*tcpNoDelay,
+		ReadBuffer:  *tcpReadBuffer,
+		WriteBuffer: *tcpWriteBuffer,
+	}
+	factory.DataSocket = factory.ControlSocket
+	factory.Logger = logger
+	factory.LogSecrets = *logSecrets
+	if *messagesFile != "" {
+		custom, err := config.LoadMessages(*messagesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if factory.Messages, err = ftp.NewMessages(custom); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *passiveBase > 0 {
+		if *passiveRange <= 0 || *passiveBase+*passiveRange > 65536 {
+			log.Fatal("invalid passive port range")
+		}
+		factory.PassivePorts = tcp.NewPortRange(*passiveBase, *passiveRange)
+	}
+	if *passivePool > 0 {
+		factory.PassivePool = tcp.NewListenerPool(*passivePool, factory.PassivePorts)
+		if err := factory.PassivePool.Prefill(*serverIP); err != nil {
+			log.Println("ERROR", err, "WHILE BINDING PASSIVE LISTENERS")
+		}
+	}
+	switch *sessionIDs {
+	case "ulid":
+	case "sequential":
+		factory.IDs = &ftp.SequentialGenerator{}
+	default:
+		log.Fatal("unknown session ID generator: " + *sessionIDs)
+	}
+	server := ftp.NewServer(ftp.ServerOptions{
+		Handler:       connHandler,
+		UserConfig:    cfg,
+		Transport:     factory,
+		MaxConns:      *maxConnections,
+		MaxConnsPerIP: *maxConnsPerIP,
+		Filter:        clientFilter,
+	})
+	addrs := []string{addr}
+	if *listenAddrs != "" {
+		addrs = strings.Split(*listenAddrs, ",")
+	}
+	var tlsAddrs []string
+	if *tlsListenAddrs != "" {
+		if connHandler.TLSConfig == nil {
+			log.Fatal("implicit TLS requires -tls-cert and -tls-key or -acme-hosts")
+		}
+		tlsAddrs = strings.Split(*tlsListenAddrs, ",")
+	}
+	var trusted []*net.IPNet
+	if *proxyTrusted != "" {
+		trusted = parseNetworks(*proxyTrusted)
+	}
+	listeners := make([]net.Listener, 0, len(addrs)+len(tlsAddrs))
+	for _, a := range append(addrs, tlsAddrs...) {
+		listener, err := net.Listen("tcp", a)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *proxyProtocol {
+			listener = tcp.NewProxyListener(listener, trusted)
+		}
+		listeners = append(listeners, listener)
+	}
+	var (
+		sftpServer    *sftp.Server
+		sftpListeners []net.Listener
+	)
+	if *sftpListen != "" {
+		if sftpServer, err = newSFTPServer(cfg, connHandler, *sftpHostKey, clientFilter, logger); err != nil {
+			log.Fatal(err)
+		}
+		for _, a := range strings.Split(*sftpListen, ",") {
+			listener, err := net.Listen("tcp", a)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sftpListeners = append(sftpListeners, listener)
+		}
+	}
+	done := watchShutdownSignals(server, connHandler, *shutdownTimeout, *shutdownWebhook)
+	if *adminAddr != "" {
+		serveAdmin(*adminAddr, *adminToken, getCertificate, connHandler, store, recentLogs)
+	}
+	if *httpAddr != "" {
+		serveGateway(*httpAddr, *httpAnonymous, getCertificate, connHandler, cfg, clientFilter, logger)
+	}
+	if *runAs != "" || *chrootDir != "" {
+		if err := dropPrivileges(*runAs, *chrootDir); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("DROPPED PRIVILEGES TO", *runAs, "CHROOT", *chrootDir)
+	}
+	errs := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		if i < len(addrs) {
+			log.Println("LISTENING ON", listener.Addr())
+			go func(l net.Listener) { errs <- server.Serve(l) }(listener)
+		} else {
+			log.Println("LISTENING WITH IMPLICIT TLS ON", listener.Addr())
+			go func(l net.Listener) { errs <- server.ServeTLS(l, connHandler.TLSConfig) }(listener)
+		}
+	}
+	for _, listener := range sftpListeners {
+		log.Println("LISTENING FOR SFTP ON", listener.Addr())
+		go func(l net.Listener) {
+			if err := sftpServer.Serve(l); err != ftp.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(listener)
+	}
+	for range listeners {
+		if err := <-errs; err != ftp.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	if sftpServer != nil {
+		sftpServer.Close()
+	}
+	<-done
+}
 
-	connHandler := handler.New(*serverIP, *serverSystemName, *serverMOTD, cfg, *enableEPLF)
-	factory := tcp.NewFactory(*serverIP + ":" + strconv.Itoa(*serverPort))
-	err := factory.Listen()
+// readEncryptionKey reads a hex encoded 256 bit key from a file.
+func readEncryptionKey(file string) ([]byte, error) {
+	buffer, err := ioutil.ReadFile(file)
 	if err != nil {
-		log.Fatal(err)
+		return nil, errors.New("could not read encryption key: " + err.Error())
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buffer)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encryption key must be 64 hex characters")
+	}
+	return key, nil
+}
+
+// parseModeFlag parses octal permissions given on the command line.
+func parseModeFlag(name, value string) os.FileMode {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		log.Fatal("invalid " + name + ": " + value)
+	}
+	return os.FileMode(mode)
+}
+
+// parseNetworks parses a comma-separated list of CIDR networks given on the command line.
+func parseNetworks(value string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(value, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			log.Fatal("invalid network: " + cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// newClientFilter builds the client address filter, or nil if no networks are given.
+func newClientFilter(allow, deny string) *ftp.AddressFilter {
+	if allow == "" && deny == "" {
+		return nil
+	}
+	filter := &ftp.AddressFilter{}
+	if allow != "" {
+		filter.Allow = parseNetworks(allow)
 	}
-	log.Println("LISTENING ON", *serverIP+":"+strconv.Itoa(*serverPort))
-	for {
-		conn, err := factory.Accept(cfg)
+	if deny != "" {
+		filter.Deny = parseNetworks(deny)
+	}
+	return filter
+}
+
+// loadVirtualHosts loads the user configuration of each name=file pair given on the command line.
+func loadVirtualHosts(value string, rewrite bool) map[string]*handler.VirtualHost {
+	vhosts := make(map[string]*handler.VirtualHost)
+	for _, pair := range strings.Split(value, ",") {
+		name, file, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Fatal("invalid virtual host: " + pair)
+		}
+		cfg, err := config.NewFileConfig(file, rewrite)
 		if err != nil {
-			log.Print(err)
-			continue
+			log.Fatal(err)
 		}
-		go connHandler.Handle(conn)
+		log.Println("SERVING VIRTUAL HOST", name, "FROM", file)
+		vhosts[strings.ToLower(name)] = &handler.VirtualHost{UserConfig: cfg}
+	}
+	return vhosts
+}
+
+// configurePasswordHasher selects the hash of new passwords from the flags.
+func configurePasswordHasher() {
+	switch *passwordHash {
+	case "bcrypt":
+		config.PasswordHasher = config.BcryptHasher{Cost: *bcryptCost}
+	case "argon2id":
+		config.PasswordHasher = config.NewArgon2idHasher(uint32(*argon2Time), uint32(*argon2Memory), uint8(*argon2Threads))
+	default:
+		log.Fatal("unknown password hash: " + *passwordHash)
 	}
 }
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+)
+
+// watchMaintenanceSignals pauses writes on SIGUSR1 and resumes them on SIGUSR2.
+func watchMaintenanceSignals(h *handler.Handler) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			h.SetMaintenance(sig == syscall.SIGUSR1)
+			log.Println("MAINTENANCE MODE", h.InMaintenance())
+		}
+	}()
+}
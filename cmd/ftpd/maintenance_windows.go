@@ -0,0 +1,6 @@
+package main
+
+import "github.com/lnsp/ftpd/pkg/ftp/handler"
+
+// watchMaintenanceSignals is not supported on Windows, which lacks SIGUSR1 and SIGUSR2.
+func watchMaintenanceSignals(h *handler.Handler) {}
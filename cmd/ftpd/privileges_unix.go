@@ -0,0 +1,51 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges optionally confines the process to a directory and switches to an unprivileged account.
+// It is called once all listeners are bound, so ports below 1024 can be used without running as root.
+func dropPrivileges(account, chroot string) error {
+	var uid, gid int
+	if account != "" {
+		u, err := user.Lookup(account)
+		if err != nil {
+			if u, err = user.LookupId(account); err != nil {
+				return errors.New("could not find user " + account + ": " + err.Error())
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return err
+		}
+	}
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return errors.New("could not chroot: " + err.Error())
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if account == "" {
+		return nil
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return errors.New("could not set groups: " + err.Error())
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return errors.New("could not set gid: " + err.Error())
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return errors.New("could not set uid: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// dropPrivileges is not supported on Windows, which has no setuid or chroot.
+func dropPrivileges(account, chroot string) error {
+	return errors.New("dropping privileges is not supported on Windows")
+}
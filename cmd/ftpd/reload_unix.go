@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReloadSignals calls reload on SIGHUP. Running sessions are not affected.
+func watchReloadSignals(reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			log.Println("RELOADING ON", sig)
+			reload()
+		}
+	}()
+}
@@ -0,0 +1,4 @@
+package main
+
+// watchReloadSignals is not supported on Windows, which lacks SIGHUP.
+func watchReloadSignals(reload func()) {}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log/slog"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+	"github.com/lnsp/ftpd/pkg/ftp/sftp"
+)
+
+// newSFTPServer serves the users of cfg over SFTP with the file system settings of the FTP handler.
+func newSFTPServer(cfg config.FTPUserConfig, h *handler.Handler, hostKeyFile string, filter *ftp.AddressFilter, logger *slog.Logger) (*sftp.Server, error) {
+	if hostKeyFile == "" {
+		return nil, errors.New("-sftp-listen requires -sftp-host-key")
+	}
+	buffer, err := ioutil.ReadFile(hostKeyFile)
+	if err != nil {
+		return nil, errors.New("could not read SFTP host key: " + err.Error())
+	}
+	hostKey, err := ssh.ParsePrivateKey(buffer)
+	if err != nil {
+		return nil, errors.New("could not parse SFTP host key: " + err.Error())
+	}
+	server := sftp.NewServer(cfg, hostKey)
+	server.FileSystem = h.FileSystem
+	server.HideDotfiles = h.HideDotfiles
+	server.CreateHomes = h.CreateHomes
+	server.HomeMode = h.HomeMode
+	server.FileMode = h.FileMode
+	server.DirMode = h.DirMode
+	server.Template = h.Template
+	server.EncryptionKey = h.EncryptionKey
+	server.EncryptNames = h.EncryptNames
+	server.Handler = h
+	server.Filter = filter
+	server.Logger = logger
+	return server, nil
+}
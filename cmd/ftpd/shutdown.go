@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+)
+
+// watchShutdownSignals stops the server on SIGINT or SIGTERM and emits a shutdown report.
+// Running transfers may finish within the timeout. The returned channel is closed once the report has been sent.
+func watchShutdownSignals(server *ftp.Server, h *handler.Handler, timeout time.Duration, webhook string) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-signals
+		start := time.Now()
+		log.Println("SHUTTING DOWN ON", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err == context.DeadlineExceeded {
+			log.Println("SHUTDOWN TIMEOUT, CLOSED REMAINING SESSIONS")
+		} else if err != nil {
+			log.Println("ERROR", err, "WHILE CLOSING SERVER")
+		}
+		report := h.Report(time.Since(start))
+		buffer, err := json.Marshal(report)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("SHUTDOWN REPORT", string(buffer))
+		if webhook != "" {
+			postShutdownReport(webhook, buffer)
+		}
+	}()
+	return done
+}
+
+// postShutdownReport sends the JSON encoded report to a webhook.
+func postShutdownReport(url string, report []byte) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(report))
+	if err != nil {
+		log.Println("ERROR", err, "WHILE POSTING SHUTDOWN REPORT")
+		return
+	}
+	resp.Body.Close()
+}
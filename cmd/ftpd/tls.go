@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// certificate holds the server certificate, which can be replaced while the server is running.
+type certificate struct {
+	certFile, keyFile string
+	current           atomic.Value
+	modified          time.Time
+}
+
+// loadCertificate loads the certificate and its key.
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload replaces the certificate with the current contents of the files.
+// On errors the previous certificate stays in use.
+func (c *certificate) reload() error {
+	modified := c.lastModified()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.New("could not load certificate: " + err.Error())
+	}
+	c.current.Store(&cert)
+	c.modified = modified
+	return nil
+}
+
+// lastModified returns the latest modification time of the certificate and key file.
+func (c *certificate) lastModified() time.Time {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// watch reloads the certificate whenever its files change, checking every interval.
+func (c *certificate) watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if !c.lastModified().After(c.modified) {
+				continue
+			}
+			c.reloadAndLog()
+		}
+	}()
+}
+
+// reloadAndLog reloads the certificate and logs the outcome.
+func (c *certificate) reloadAndLog() {
+	if err := c.reload(); err != nil {
+		log.Println("ERROR", err, "WHILE RELOADING CERTIFICATE, KEEPING LAST GOOD CERTIFICATE")
+		return
+	}
+	log.Println("RELOADED CERTIFICATE", c.certFile)
+}
+
+// GetCertificate hands out the active certificate to TLS handshakes.
+func (c *certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current.Load().(*tls.Certificate), nil
+}
+
+// loadTLSConfig creates the server TLS config using the certificate source and, if given, the CAs used to verify client certificates.
+func loadTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+	buffer, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, errors.New("could not read client CAs: " + err.Error())
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(buffer) {
+		return nil, errors.New("no client CAs found in " + clientCAFile)
+	}
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, nil
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// setUmask replaces the umask of the process, which is applied to all created files and directories.
+func setUmask(mask os.FileMode) {
+	syscall.Umask(int(mask))
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// setUmask is not supported on Windows, which has no umask.
+func setUmask(mask os.FileMode) {
+	log.Println("IGNORING UMASK ON WINDOWS")
+}
@@ -0,0 +1,187 @@
+/*
+Package admin provides a HTTP API to manage users, groups and sessions of a running server.
+*/
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+)
+
+// maxBodySize limits the size of user and group documents.
+const maxBodySize = 1 << 20
+
+// Server serves the admin API. All requests need to present the admin token as bearer token.
+//
+//	GET    /sessions          list active sessions
+//	DELETE /sessions/{id}     disconnect a session
+//	GET    /users             list users
+//	GET    /users/{name}      show a user
+//	PUT    /users/{name}      create or replace a user
+//	DELETE /users/{name}      delete a user
+//	GET    /groups            list groups
+//	GET    /groups/{name}     show a group
+//	PUT    /groups/{name}     create or replace a group
+//	DELETE /groups/{name}     delete a group
+//	GET    /stats             show the transfer counters since the start
+//	GET    /logs              show the recent log lines
+//
+// The web console at /console is served without token and asks for it to call the API.
+type Server struct {
+	// Logs provides the recent log lines, /logs is unavailable if it is nil.
+	Logs *LogBuffer
+
+	handler *handler.Handler
+	users   config.Manager
+	token   string
+	started time.Time
+}
+
+// New creates an admin API for the handler. Users and groups can only be managed if users is not nil.
+func New(h *handler.Handler, users config.Manager, token string) *Server {
+	return &Server{handler: h, users: users, token: token, started: time.Now()}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Trim(r.URL.Path, "/") == "console" {
+		serveConsole(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		respondError(w, http.StatusUnauthorized, "invalid admin token")
+		return
+	}
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
+	name := ""
+	if len(parts) == 2 {
+		name = parts[1]
+	}
+	switch parts[0] {
+	case "sessions":
+		s.serveSessions(w, r, name)
+	case "stats":
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		respondJSON(w, http.StatusOK, s.handler.Report(time.Since(s.started)))
+	case "logs":
+		s.serveLogs(w, r)
+	case "users", "groups":
+		if s.users == nil {
+			respondError(w, http.StatusNotImplemented, config.ErrReadOnlyStore.Error())
+			return
+		}
+		if parts[0] == "groups" {
+			s.serveEntries(w, r, name, s.users.ListGroups, s.users.GetGroup, s.users.PutGroup, s.users.DeleteGroup)
+			return
+		}
+		s.serveEntries(w, r, name, s.users.ListUsers, s.users.GetUser, s.users.PutUser, s.users.DeleteUser)
+	default:
+		respondError(w, http.StatusNotFound, "unknown resource")
+	}
+}
+
+// authorized checks the bearer token of the request.
+func (s *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) serveSessions(w http.ResponseWriter, r *http.Request, id string) {
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		respondJSON(w, http.StatusOK, s.handler.Sessions())
+	case id != "" && r.Method == http.MethodDelete:
+		if !s.handler.Disconnect(id) {
+			respondError(w, http.StatusNotFound, "unknown session")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) serveLogs(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case s.Logs == nil:
+		respondError(w, http.StatusNotImplemented, "logs are not recorded")
+	case r.Method != http.MethodGet:
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		respondJSON(w, http.StatusOK, s.Logs.Lines())
+	}
+}
+
+// serveEntries handles the CRUD operations on users or groups.
+func (s *Server) serveEntries(w http.ResponseWriter, r *http.Request, name string,
+	list func() ([]byte, error), get func(string) ([]byte, error),
+	put func(string, []byte) error, remove func(string) error) {
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		respondRaw(w, list)
+	case name != "" && r.Method == http.MethodGet:
+		respondRaw(w, func() ([]byte, error) { return get(name) })
+	case name != "" && r.Method == http.MethodPut:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := put(name, body); err != nil {
+			respondStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case name != "" && r.Method == http.MethodDelete:
+		if err := remove(name); err != nil {
+			respondStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// respondRaw responds with a JSON document produced by the store.
+func respondRaw(w http.ResponseWriter, produce func() ([]byte, error)) {
+	buffer, err := produce()
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buffer)
+}
+
+// respondStoreError maps errors of the user store to HTTP status codes.
+func respondStoreError(w http.ResponseWriter, err error) {
+	switch err {
+	case config.ErrNotFound:
+		respondError(w, http.StatusNotFound, err.Error())
+	case config.ErrReadOnlyStore:
+		respondError(w, http.StatusNotImplemented, err.Error())
+	default:
+		respondError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+func respondJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func respondError(w http.ResponseWriter, status int, message string) {
+	respondJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,24 @@
+package admin
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// consolePage is the web console. It keeps the admin token in the session storage of the browser
+// and calls the API with it, so the page itself needs no authentication.
+//
+//go:embed console.html
+var consolePage []byte
+
+func serveConsole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(consolePage)
+}
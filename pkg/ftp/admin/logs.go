@@ -0,0 +1,46 @@
+package admin
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// LogBuffer passes log output on and keeps its most recent lines for the console.
+type LogBuffer struct {
+	out   io.Writer
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// NewLogBuffer creates a buffer keeping the last size lines written to out.
+func NewLogBuffer(out io.Writer, size int) *LogBuffer {
+	return &LogBuffer{out: out, lines: make([]string, size)}
+}
+
+// Write passes p on and records its lines. Loggers write whole lines, so lines are not joined across writes.
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		if len(line) == 0 || len(b.lines) == 0 {
+			continue
+		}
+		b.lines[b.next] = string(line)
+		b.next = (b.next + 1) % len(b.lines)
+		b.full = b.full || b.next == 0
+	}
+	b.mu.Unlock()
+	return b.out.Write(p)
+}
+
+// Lines returns the recorded lines, oldest first.
+func (b *LogBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]string{}, b.lines[:b.next]...)
+	}
+	return append(append([]string{}, b.lines[b.next:]...), b.lines[:b.next]...)
+}
@@ -0,0 +1,29 @@
+package ftp
+
+import "sync"
+
+// DefaultTransferBufferSize is the size of the buffers copying data during transfers unless configured otherwise.
+const DefaultTransferBufferSize = 32 * 1024
+
+// bufferPools recycles transfer buffers by size, so many concurrent transfers do not churn the garbage collector.
+// Few sizes are in use, the configured one and the sizes the storage tuner doubles and halves it to.
+var bufferPools sync.Map // map[int]*sync.Pool of *[]byte
+
+// GetBuffer returns a buffer of the given size from the pool.
+func GetBuffer(size int) *[]byte {
+	pool, ok := bufferPools.Load(size)
+	if !ok {
+		pool, _ = bufferPools.LoadOrStore(size, &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}})
+	}
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+// PutBuffer returns a buffer to the pool once the data in it has been consumed.
+func PutBuffer(buf *[]byte) {
+	if pool, ok := bufferPools.Load(len(*buf)); ok {
+		pool.(*sync.Pool).Put(buf)
+	}
+}
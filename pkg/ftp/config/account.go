@@ -0,0 +1,32 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+const expiryDateFormat = "2006-01-02"
+
+var (
+	// ErrAccountDisabled is returned for accounts which have been disabled.
+	ErrAccountDisabled = errors.New("account disabled")
+	// ErrAccountExpired is returned for accounts past their expiry date.
+	ErrAccountExpired = errors.New("account expired")
+)
+
+// AccountStatus is implemented by users which can be disabled or expire.
+type AccountStatus interface {
+	CheckAccount(now time.Time) error
+}
+
+// parseExpiry parses an RFC 3339 timestamp or a date. Accounts expiring on a date are valid until the end of that day.
+func parseExpiry(value string) (time.Time, error) {
+	if expires, err := time.Parse(time.RFC3339, value); err == nil {
+		return expires, nil
+	}
+	expires, err := time.ParseInLocation(expiryDateFormat, value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expires.AddDate(0, 0, 1), nil
+}
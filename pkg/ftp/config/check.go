@@ -0,0 +1,218 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Severity tells whether a Problem keeps the configuration from working.
+type Severity int
+
+const (
+	// Warning marks a weak or suspicious setting.
+	Warning Severity = iota
+	// Error marks a setting which keeps the configuration from loading or a user from logging in.
+	Error
+)
+
+// Problem is an issue found by CheckFile.
+type Problem struct {
+	Severity Severity
+	Message  string
+}
+
+func (p Problem) String() string {
+	if p.Severity == Error {
+		return "error: " + p.Message
+	}
+	return "warning: " + p.Message
+}
+
+// CheckFile validates a configuration file before it is deployed. Unlike loading it, all problems are reported
+// and settings are checked against the system, e.g. whether home directories exist.
+// Missing home directories are only warned about if the server creates them on first login.
+func CheckFile(file string, createHomes bool) []Problem {
+	var c checker
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		c.fail("could not read config: " + err.Error())
+		return c.problems
+	}
+	format := detectFormat(file)
+	cfg := &yamlUserConfiguration{Users: make(map[string]yamlUserEntry), Groups: make(map[string]yamlGroupEntry), format: format}
+	if err := format.unmarshal(buffer, cfg); err != nil {
+		c.fail("could not unmarshal config: " + err.Error())
+		return c.problems
+	}
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		for _, name := range duplicateJSONUsers(buffer) {
+			c.fail("user " + name + " is defined more than once, only the last definition is used")
+		}
+	}
+	groups, err := resolveGroups(cfg.Groups)
+	if err != nil {
+		// Check the groups as declared, so their own problems are reported as well.
+		c.fail(err.Error())
+		groups = cfg.Groups
+	}
+	groupNames := make([]string, 0, len(groups))
+	for name := range groups {
+		groupNames = append(groupNames, name)
+	}
+	sort.Strings(groupNames)
+	for _, name := range groupNames {
+		group := groups[name]
+		if err := group.compile(); err != nil {
+			c.fail("invalid group " + name + ": " + err.Error())
+		}
+	}
+	if _, ok := cfg.Groups[cfg.Default]; cfg.Default != "" && !ok {
+		c.fail("unknown default group " + cfg.Default)
+	}
+	if len(cfg.Users) == 0 {
+		c.warn("no users are defined, nobody can log in")
+	}
+	lowerNames := make(map[string]string)
+	certNames := make(map[string]string)
+	userNames := make([]string, 0, len(cfg.Users))
+	for name := range cfg.Users {
+		userNames = append(userNames, name)
+	}
+	sort.Strings(userNames)
+	for _, name := range userNames {
+		user := cfg.Users[name]
+		if user.UserGroup == "" && cfg.Default == "" {
+			c.fail("user " + name + " has no group and no default group is set")
+		} else if _, ok := cfg.Groups[user.UserGroup]; user.UserGroup != "" && !ok {
+			c.fail("unknown group " + user.UserGroup + " of user " + name)
+		}
+		if err := user.prepare(name); err != nil {
+			c.fail(err.Error())
+		}
+		if other, ok := lowerNames[strings.ToLower(name)]; ok {
+			c.warn("users " + other + " and " + name + " only differ in case, clients may not tell them apart")
+		}
+		lowerNames[strings.ToLower(name)] = name
+		if user.CertCN != "" {
+			if other, ok := certNames[user.CertCN]; ok {
+				c.fail("users " + other + " and " + name + " share the certificate name " + user.CertCN + ", certificate logins are ambiguous")
+			}
+			certNames[user.CertCN] = name
+		}
+		c.checkHome(name, expandHome(user.Home, name), createHomes)
+		if user.Skeleton != "" {
+			if info, err := os.Stat(user.Skeleton); err != nil || !info.IsDir() {
+				c.fail("template " + user.Skeleton + " of user " + name + " is not a directory")
+			}
+		}
+		c.checkPassword(name, user)
+		if user.fileMode&0002 != 0 {
+			c.warn("file mode " + user.RawFileMode + " of user " + name + " makes uploads world-writable")
+		}
+		if user.dirMode&0002 != 0 {
+			c.warn("directory mode " + user.RawDirMode + " of user " + name + " makes directories world-writable")
+		}
+		if !user.Disabled && !user.expires.IsZero() && !time.Now().Before(user.expires) {
+			c.warn("account of user " + name + " expired on " + user.Expires)
+		}
+	}
+	return c.problems
+}
+
+// checker collects the problems of a configuration.
+type checker struct {
+	problems []Problem
+}
+
+func (c *checker) fail(message string) {
+	c.problems = append(c.problems, Problem{Error, message})
+}
+
+func (c *checker) warn(message string) {
+	c.problems = append(c.problems, Problem{Warning, message})
+}
+
+// checkHome checks that the home directory exists and is not writable by everyone.
+func (c *checker) checkHome(name, home string, createHomes bool) {
+	if home == "" {
+		c.fail("user " + name + " has no home directory")
+		return
+	}
+	info, err := os.Stat(home)
+	switch {
+	case os.IsNotExist(err) && createHomes:
+		c.warn("home directory " + home + " of user " + name + " does not exist yet, it is created on first login")
+	case err != nil:
+		c.fail("home directory " + home + " of user " + name + " is not accessible: " + err.Error())
+	case !info.IsDir():
+		c.fail("home directory " + home + " of user " + name + " is not a directory")
+	case info.Mode().Perm()&0002 != 0 && info.Mode()&os.ModeSticky == 0:
+		c.warn("home directory " + home + " of user " + name + " is writable by everyone")
+	}
+}
+
+// checkPassword warns about plain text, missing and weak passwords and rejects hashes no hasher can verify.
+func (c *checker) checkPassword(name string, user yamlUserEntry) {
+	if user.RawPassword != "" {
+		c.warn("user " + name + " has a plain text password, replace it by a hash from ftpd hashpw")
+		return
+	}
+	if user.Hash == "" {
+		if user.CertCN == "" && user.CertSHA256 == "" {
+			c.warn("user " + name + " has no password and accepts any password")
+		}
+		return
+	}
+	for _, hasher := range knownHashers {
+		if !hasher.Recognizes(user.Hash) {
+			continue
+		}
+		if _, ok := hasher.(BcryptHasher); ok {
+			if cost, err := bcrypt.Cost([]byte(user.Hash)); err == nil && cost < bcrypt.DefaultCost {
+				c.warn("password hash of user " + name + " uses the weak bcrypt cost " + strconv.Itoa(cost))
+			}
+		}
+		return
+	}
+	c.fail("password hash of user " + name + " has an unknown format, the user cannot log in")
+}
+
+// duplicateJSONUsers returns the names of users defined more than once, which JSON decoding silently merges.
+// YAML and TOML reject duplicate keys when they are decoded.
+func duplicateJSONUsers(buffer []byte) []string {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(buffer, &top); err != nil || top["users"] == nil {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(top["users"]))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var duplicates []string
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return duplicates
+		}
+		name, _ := token.(string)
+		if seen[name] {
+			duplicates = append(duplicates, name)
+		}
+		seen[name] = true
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return duplicates
+		}
+	}
+	return duplicates
+}
@@ -1,11 +1,17 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"io/ioutil"
-
-	"github.com/go-yaml/yaml"
-	"golang.org/x/crypto/bcrypt"
+	"os"
+	osuser "os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type FTPUser interface {
@@ -14,6 +20,16 @@ type FTPUser interface {
 	Group() FTPGroup
 }
 
+// RemoteAuthenticator is implemented by users which need the client address to authenticate.
+type RemoteAuthenticator interface {
+	AuthRemote(password, remoteAddr string) bool
+}
+
+// CertificateAuthenticator is implemented by users which may log in with a verified TLS client certificate.
+type CertificateAuthenticator interface {
+	AuthCertificate(cert *x509.Certificate) bool
+}
+
 type FTPGroup interface {
 	CanCreateFile(path string) bool
 	CanCreateDir(path string) bool
@@ -21,6 +37,7 @@ type FTPGroup interface {
 	CanListDir(path string) bool
 	CanDeleteFile(path string) bool
 	CanDeleteDir(path string) bool
+	AllowsName(name string) bool
 }
 
 type FTPUserConfig interface {
@@ -28,6 +45,143 @@ type FTPUserConfig interface {
 	FindGroup(name string) FTPGroup
 }
 
+// ErrReadOnlyStore is returned when a user store cannot persist changes.
+var ErrReadOnlyStore = errors.New("user store is read-only")
+
+// PasswordChanger is implemented by user stores which can persist password changes.
+type PasswordChanger interface {
+	ChangePassword(name, password string) error
+}
+
+// RateLimiter is implemented by users with bandwidth limits in bytes per second.
+// A limit of zero means unlimited.
+type RateLimiter interface {
+	RateLimits() (upload, download int64)
+}
+
+// SystemAccount is implemented by users which are mapped to a system uid and gid.
+type SystemAccount interface {
+	SystemIDs() (uid, gid int, ok bool)
+}
+
+// CommandFilter is implemented by users which may only run some FTP commands.
+type CommandFilter interface {
+	AllowsCommand(command string) bool
+}
+
+// FileModes is implemented by users with own permissions for created files and directories.
+// A zero mode falls back to the server default.
+type FileModes interface {
+	FileModes() (file, dir os.FileMode)
+}
+
+// Templated is implemented by users with an own template directory merged read-only into their home.
+// An empty template falls back to the server template.
+type Templated interface {
+	Template() string
+}
+
+// EncryptedStorage is implemented by users whose files are encrypted with an own 32 byte key.
+// A nil key falls back to the server key.
+type EncryptedStorage interface {
+	EncryptionKey() []byte
+}
+
+// Honeypot is implemented by decoy users, which are logged into a fake file system with any password.
+type Honeypot interface {
+	Honeypot() bool
+}
+
+// HiddenFiles is implemented by users which may see dotfiles while they are hidden from others.
+type HiddenFiles interface {
+	ShowHidden() bool
+}
+
+// Greeter is implemented by users with an own message confirming their login.
+type Greeter interface {
+	Greeting() string
+}
+
+// primaryGroup looks up the primary group of a system user, falling back to a group with the same id.
+func primaryGroup(uid int) int {
+	account, err := osuser.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return uid
+	}
+	gid, err := strconv.Atoi(account.Gid)
+	if err != nil {
+		return uid
+	}
+	return gid
+}
+
+// NoPermissions is a group which denies every operation.
+var NoPermissions FTPGroup = noPermissions{}
+
+type noPermissions struct{}
+
+func (noPermissions) CanCreateFile(path string) bool {
+	return false
+}
+
+func (noPermissions) CanCreateDir(path string) bool {
+	return false
+}
+
+func (noPermissions) CanEditFile(path string) bool {
+	return false
+}
+
+func (noPermissions) CanListDir(path string) bool {
+	return false
+}
+
+func (noPermissions) CanDeleteFile(path string) bool {
+	return false
+}
+
+func (noPermissions) CanDeleteDir(path string) bool {
+	return false
+}
+
+func (noPermissions) AllowsName(name string) bool {
+	return false
+}
+
+// allowsCommand checks a command against an allow list, where nil allows every command, and a deny list.
+func allowsCommand(allow, deny []string, command string) bool {
+	if allow != nil && !containsCommand(allow, command) {
+		return false
+	}
+	return !containsCommand(deny, command)
+}
+
+func containsCommand(commands []string, command string) bool {
+	for _, c := range commands {
+		if strings.EqualFold(c, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMode parses an octal permission like "0640". An empty string yields zero.
+func parseMode(raw string) (os.FileMode, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.New("expected octal permissions like 0640")
+	}
+	return os.FileMode(mode), nil
+}
+
+// expandHome replaces the {user} placeholder of a home directory template with the user name.
+func expandHome(home, name string) string {
+	return strings.Replace(home, "{user}", name, -1)
+}
+
 func NewDefaultConfig(basedir string) FTPUserConfig {
 	cfg := defaultUserConfiguration(basedir)
 	return &cfg
@@ -79,12 +233,38 @@ func (cfg *defaultUserConfiguration) CanDeleteDir(path string) bool {
 	return true
 }
 
+func (cfg *defaultUserConfiguration) AllowsName(name string) bool {
+	return true
+}
+
 type yamlUserEntry struct {
-	Home        string `yaml:"home"`
-	Hash        string `yaml:"hash"`
-	RawPassword string `yaml:"password"`
-	UserGroup   string `yaml:"group"`
-	context     *yamlUserConfiguration
+	Home         string       `yaml:"home" json:"home" toml:"home"`
+	Hash         string       `yaml:"hash" json:"hash" toml:"hash"`
+	RawPassword  string       `yaml:"password,omitempty" json:"password,omitempty" toml:"password,omitempty"`
+	UserGroup    string       `yaml:"group,omitempty" json:"group,omitempty" toml:"group,omitempty"`
+	Hidden       bool         `yaml:"show_hidden,omitempty" json:"show_hidden,omitempty" toml:"show_hidden,omitempty"`
+	Decoy        bool         `yaml:"honeypot,omitempty" json:"honeypot,omitempty" toml:"honeypot,omitempty"`
+	Key          string       `yaml:"encryption_key,omitempty" json:"encryption_key,omitempty" toml:"encryption_key,omitempty"`
+	Skeleton     string       `yaml:"template,omitempty" json:"template,omitempty" toml:"template,omitempty"`
+	CertCN       string       `yaml:"cert_cn,omitempty" json:"cert_cn,omitempty" toml:"cert_cn,omitempty"`
+	CertSHA256   string       `yaml:"cert_sha256,omitempty" json:"cert_sha256,omitempty" toml:"cert_sha256,omitempty"`
+	TOTPSecret   string       `yaml:"totp_secret,omitempty" json:"totp_secret,omitempty" toml:"totp_secret,omitempty"`
+	Disabled     bool         `yaml:"disabled,omitempty" json:"disabled,omitempty" toml:"disabled,omitempty"`
+	Expires      string       `yaml:"expires,omitempty" json:"expires,omitempty" toml:"expires,omitempty"`
+	UploadRate   int64        `yaml:"upload_rate,omitempty" json:"upload_rate,omitempty" toml:"upload_rate,omitzero"`
+	DownloadRate int64        `yaml:"download_rate,omitempty" json:"download_rate,omitempty" toml:"download_rate,omitzero"`
+	UID          *int         `yaml:"uid,omitempty" json:"uid,omitempty" toml:"uid,omitempty"`
+	GID          *int         `yaml:"gid,omitempty" json:"gid,omitempty" toml:"gid,omitempty"`
+	AllowCmds    optionalList `yaml:"allow_commands,omitempty" json:"allow_commands" toml:"allow_commands"`
+	DenyCmds     optionalList `yaml:"deny_commands,omitempty" json:"deny_commands" toml:"deny_commands"`
+	RawFileMode  string       `yaml:"file_mode,omitempty" json:"file_mode,omitempty" toml:"file_mode,omitempty"`
+	RawDirMode   string       `yaml:"dir_mode,omitempty" json:"dir_mode,omitempty" toml:"dir_mode,omitempty"`
+	LoginMessage string       `yaml:"login_message,omitempty" json:"login_message,omitempty" toml:"login_message,omitempty"`
+	fileMode     os.FileMode
+	dirMode      os.FileMode
+	expires      time.Time
+	key          []byte
+	context      *yamlUserConfiguration
 }
 
 func (user *yamlUserEntry) HomeDir() string {
@@ -95,20 +275,241 @@ func (user *yamlUserEntry) Auth(password string) bool {
 	if user.Hash == "" && user.RawPassword == "" {
 		return true
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(password)); err != nil {
+	return VerifyPassword(user.Hash, password)
+}
+
+// AuthCertificate matches the certificate by common name or SHA-256 fingerprint.
+func (user *yamlUserEntry) AuthCertificate(cert *x509.Certificate) bool {
+	if user.CertCN != "" && cert.Subject.CommonName == user.CertCN {
+		return true
+	}
+	if user.CertSHA256 == "" {
 		return false
 	}
-	return true
+	fingerprint := sha256.Sum256(cert.Raw)
+	return strings.EqualFold(strings.Replace(user.CertSHA256, ":", "", -1), hex.EncodeToString(fingerprint[:]))
+}
+
+func (user *yamlUserEntry) CheckAccount(now time.Time) error {
+	if user.Disabled {
+		return ErrAccountDisabled
+	}
+	if !user.expires.IsZero() && !now.Before(user.expires) {
+		return ErrAccountExpired
+	}
+	return nil
+}
+
+func (user *yamlUserEntry) RequiresCode() bool {
+	return user.TOTPSecret != ""
+}
+
+func (user *yamlUserEntry) VerifyCode(code string) bool {
+	return verifyTOTP(user.TOTPSecret, code, time.Now())
+}
+
+// SystemIDs returns the system account of the user. A missing gid defaults to the primary group of the uid.
+func (user *yamlUserEntry) SystemIDs() (uid, gid int, ok bool) {
+	if user.UID == nil {
+		return 0, 0, false
+	}
+	if user.GID != nil {
+		return *user.UID, *user.GID, true
+	}
+	return *user.UID, primaryGroup(*user.UID), true
+}
+
+// groupName returns the group of the user or the default group if none is set.
+func (user *yamlUserEntry) groupName() string {
+	if user.UserGroup == "" {
+		return user.context.Default
+	}
+	return user.UserGroup
+}
+
+// RateLimits returns the limits of the user, falling back to the limits of its group.
+func (user *yamlUserEntry) RateLimits() (upload, download int64) {
+	upload, download = user.UploadRate, user.DownloadRate
+	if group, ok := user.context.group(user.groupName()); ok {
+		if upload == 0 {
+			upload = group.UploadRate
+		}
+		if download == 0 {
+			download = group.DownloadRate
+		}
+	}
+	return upload, download
+}
+
+func (user *yamlUserEntry) FileModes() (file, dir os.FileMode) {
+	return user.fileMode, user.dirMode
+}
+
+// Greeting returns the login message of the user, falling back to the message of its group.
+func (user *yamlUserEntry) Greeting() string {
+	if user.LoginMessage != "" {
+		return user.LoginMessage
+	}
+	if group, ok := user.context.group(user.groupName()); ok {
+		return group.LoginMessage
+	}
+	return ""
+}
+
+// AllowsCommand checks the command against the command lists of the user, falling back to the lists of its group.
+func (user *yamlUserEntry) AllowsCommand(command string) bool {
+	allow, deny := user.AllowCmds, user.DenyCmds
+	if group, ok := user.context.group(user.groupName()); ok {
+		if allow == nil {
+			allow = group.AllowCmds
+		}
+		if deny == nil {
+			deny = group.DenyCmds
+		}
+	}
+	return allowsCommand(allow, deny, command)
 }
 
 func (user *yamlUserEntry) Group() FTPGroup {
-	return user.context.FindGroup(user.UserGroup)
+	group, ok := user.context.group(user.groupName())
+	if !ok {
+		return nil
+	}
+	group.home = user.Home
+	return group
+}
+
+func (user *yamlUserEntry) ShowHidden() bool {
+	return user.Hidden
+}
+
+func (user *yamlUserEntry) Honeypot() bool {
+	return user.Decoy
+}
+
+func (user *yamlUserEntry) EncryptionKey() []byte {
+	return user.key
+}
+
+func (user *yamlUserEntry) Template() string {
+	return user.Skeleton
+}
+
+// optionalList is a list which is only omitted when unset, so an empty list can override an inherited one.
+type optionalList []string
+
+func (l optionalList) IsZero() bool {
+	return l == nil
 }
 
 type yamlGroupEntry struct {
-	CreateFlags []string `create`
-	HandleFlags []string `handle`
-	DeleteFlags []string `delete`
+	CreateFlags  optionalList `yaml:"create,omitempty" json:"create" toml:"create"`
+	HandleFlags  optionalList `yaml:"handle,omitempty" json:"handle" toml:"handle"`
+	DeleteFlags  optionalList `yaml:"delete,omitempty" json:"delete" toml:"delete"`
+	AllowNames   optionalList `yaml:"allow,omitempty" json:"allow" toml:"allow"`
+	DenyNames    optionalList `yaml:"deny,omitempty" json:"deny" toml:"deny"`
+	Parent       string       `yaml:"parent,omitempty" json:"parent,omitempty" toml:"parent,omitempty"`
+	UploadRate   int64        `yaml:"upload_rate,omitempty" json:"upload_rate,omitempty" toml:"upload_rate,omitzero"`
+	DownloadRate int64        `yaml:"download_rate,omitempty" json:"download_rate,omitempty" toml:"download_rate,omitzero"`
+	AllowCmds    optionalList `yaml:"allow_commands,omitempty" json:"allow_commands" toml:"allow_commands"`
+	DenyCmds     optionalList `yaml:"deny_commands,omitempty" json:"deny_commands" toml:"deny_commands"`
+	LoginMessage string       `yaml:"login_message,omitempty" json:"login_message,omitempty" toml:"login_message,omitempty"`
+	allow        []namePattern
+	deny         []namePattern
+	create       []pathRule
+	handle       []pathRule
+	remove       []pathRule
+	home         string
+}
+
+// resolveGroups returns the groups with the settings they inherit from their parents filled in.
+// Settings declared by a group override the inherited ones, an empty list overrides as well.
+func resolveGroups(raw map[string]yamlGroupEntry) (map[string]yamlGroupEntry, error) {
+	resolved := make(map[string]yamlGroupEntry, len(raw))
+	var resolve func(name string, visiting map[string]bool) (yamlGroupEntry, error)
+	resolve = func(name string, visiting map[string]bool) (yamlGroupEntry, error) {
+		if group, ok := resolved[name]; ok {
+			return group, nil
+		}
+		group, ok := raw[name]
+		if !ok {
+			return group, errors.New("unknown group " + name)
+		}
+		if group.Parent != "" {
+			if visiting[name] {
+				return group, errors.New("cyclic inheritance of group " + name)
+			}
+			visiting[name] = true
+			parent, err := resolve(group.Parent, visiting)
+			if err != nil {
+				return group, errors.New("invalid parent of group " + name + ": " + err.Error())
+			}
+			group.inherit(parent)
+		}
+		resolved[name] = group
+		return group, nil
+	}
+	for name := range raw {
+		if _, err := resolve(name, make(map[string]bool)); err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
+
+// inherit copies all settings the group does not declare itself from parent.
+func (group *yamlGroupEntry) inherit(parent yamlGroupEntry) {
+	if group.CreateFlags == nil {
+		group.CreateFlags = parent.CreateFlags
+	}
+	if group.HandleFlags == nil {
+		group.HandleFlags = parent.HandleFlags
+	}
+	if group.DeleteFlags == nil {
+		group.DeleteFlags = parent.DeleteFlags
+	}
+	if group.AllowNames == nil {
+		group.AllowNames = parent.AllowNames
+	}
+	if group.DenyNames == nil {
+		group.DenyNames = parent.DenyNames
+	}
+	if group.UploadRate == 0 {
+		group.UploadRate = parent.UploadRate
+	}
+	if group.DownloadRate == 0 {
+		group.DownloadRate = parent.DownloadRate
+	}
+	if group.AllowCmds == nil {
+		group.AllowCmds = parent.AllowCmds
+	}
+	if group.DenyCmds == nil {
+		group.DenyCmds = parent.DenyCmds
+	}
+	if group.LoginMessage == "" {
+		group.LoginMessage = parent.LoginMessage
+	}
+}
+
+// compile parses the name patterns and path rules of the group.
+func (group *yamlGroupEntry) compile() error {
+	var err error
+	if group.allow, err = compileNamePatterns(group.AllowNames); err != nil {
+		return errors.New("invalid allow pattern: " + err.Error())
+	}
+	if group.deny, err = compileNamePatterns(group.DenyNames); err != nil {
+		return errors.New("invalid deny pattern: " + err.Error())
+	}
+	if group.create, err = compilePathRules(group.CreateFlags); err != nil {
+		return err
+	}
+	if group.handle, err = compilePathRules(group.HandleFlags); err != nil {
+		return err
+	}
+	if group.remove, err = compilePathRules(group.DeleteFlags); err != nil {
+		return err
+	}
+	return nil
 }
 
 func (group *yamlGroupEntry) CanCreate(path string) bool {
@@ -124,114 +525,218 @@ func (group *yamlGroupEntry) CanDelete(path string) bool {
 }
 
 type yamlUserConfiguration struct {
-	Users  map[string]yamlUserEntry  `yaml:"users"`
-	Groups map[string]yamlGroupEntry `yaml:"groups"`
+	Users     map[string]yamlUserEntry  `yaml:"users" json:"users" toml:"users"`
+	Default   string                    `yaml:"default_group,omitempty" json:"default_group,omitempty" toml:"default_group,omitempty"`
+	Groups    map[string]yamlGroupEntry `yaml:"groups" json:"groups" toml:"groups"`
+	groups    map[string]yamlGroupEntry
+	file      string
+	writeback bool
+	format    configFormat
+	mu        sync.RWMutex
 }
 
 func (cfg *yamlUserConfiguration) FindUser(name string) FTPUser {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
 	user, ok := cfg.Users[name]
 	if !ok {
 		return nil
 	}
+	user.Home = expandHome(user.Home, name)
 	user.context = cfg
 	return &user
 }
 
 func (cfg *yamlUserConfiguration) FindGroup(name string) FTPGroup {
-	group, ok := cfg.Groups[name]
+	group, ok := cfg.group(name)
 	if !ok {
 		return nil
 	}
-	return &group
+	return group
+}
+
+// group returns a copy of the named group.
+func (cfg *yamlUserConfiguration) group(name string) (*yamlGroupEntry, bool) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	group, ok := cfg.groups[name]
+	return &group, ok
 }
 
 func (group *yamlGroupEntry) CanCreateFile(path string) bool {
-	for _, key := range group.CreateFlags {
-		if key == "file" {
-			return true
-		}
-	}
-	return false
+	return permits(group.create, "file", group.home, path)
 }
 
 func (group *yamlGroupEntry) CanCreateDir(path string) bool {
-	for _, key := range group.CreateFlags {
-		if key == "dir" {
-			return true
-		}
-	}
-	return false
+	return permits(group.create, "dir", group.home, path)
 }
 
 func (group *yamlGroupEntry) CanListDir(path string) bool {
-	for _, key := range group.HandleFlags {
-		if key == "dir" {
-			return true
-		}
-	}
-	return false
+	return permits(group.handle, "dir", group.home, path)
 }
 
 func (group *yamlGroupEntry) CanEditFile(path string) bool {
-	for _, key := range group.HandleFlags {
-		if key == "file" {
-			return true
-		}
-	}
-	return false
+	return permits(group.handle, "file", group.home, path)
 }
 
 func (group *yamlGroupEntry) CanDeleteFile(path string) bool {
-	for _, key := range group.DeleteFlags {
-		if key == "file" {
-			return true
-		}
-	}
-	return false
+	return permits(group.remove, "file", group.home, path)
 }
 
 func (group *yamlGroupEntry) CanDeleteDir(path string) bool {
-	for _, key := range group.DeleteFlags {
-		if key == "dir" {
-			return true
-		}
+	return permits(group.remove, "dir", group.home, path)
+}
+
+func (group *yamlGroupEntry) AllowsName(name string) bool {
+	if len(group.allow) > 0 && !matchAnyName(group.allow, name) {
+		return false
 	}
-	return false
+	return !matchAnyName(group.deny, name)
 }
 
 func NewYAMLConfig(file string, rewrite bool) (FTPUserConfig, error) {
-	config := &yamlUserConfiguration{make(map[string]yamlUserEntry), make(map[string]yamlGroupEntry)}
+	return newFileConfig(file, yamlFormat, rewrite)
+}
+
+// NewFileConfig loads a user configuration in YAML, JSON or TOML, detected by the file extension.
+// All formats share the same schema.
+func NewFileConfig(file string, rewrite bool) (FTPUserConfig, error) {
+	return newFileConfig(file, detectFormat(file), rewrite)
+}
+
+func newFileConfig(file string, format configFormat, rewrite bool) (FTPUserConfig, error) {
+	config := &yamlUserConfiguration{Users: make(map[string]yamlUserEntry), Groups: make(map[string]yamlGroupEntry), format: format}
 
 	buffer, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, errors.New("could not read config: " + err.Error())
 	}
-	if err := yaml.Unmarshal(buffer, config); err != nil {
+	if err := format.unmarshal(buffer, config); err != nil {
 		return nil, errors.New("could not unmarshal config: " + err.Error())
 	}
+	if err := config.prepare(); err != nil {
+		return nil, err
+	}
 	if !rewrite {
 		return config, nil
 	}
 
-	for name, user := range config.Users {
+	changed, err := config.hashPasswords()
+	if err != nil {
+		return nil, err
+	}
+	config.file = file
+	config.writeback = true
+	if !changed {
+		return config, nil
+	}
+	if err := config.save(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// prepare resolves and compiles the groups and validates the users.
+func (cfg *yamlUserConfiguration) prepare() error {
+	var err error
+	if cfg.groups, err = resolveGroups(cfg.Groups); err != nil {
+		return err
+	}
+	for name, group := range cfg.groups {
+		if err := group.compile(); err != nil {
+			return errors.New("invalid group " + name + ": " + err.Error())
+		}
+		cfg.groups[name] = group
+	}
+	if _, ok := cfg.groups[cfg.Default]; cfg.Default != "" && !ok {
+		return errors.New("unknown default group " + cfg.Default)
+	}
+	for name, user := range cfg.Users {
+		if user.UserGroup == "" && cfg.Default == "" {
+			return errors.New("user " + name + " has no group and no default group is set")
+		} else if _, ok := cfg.groups[user.UserGroup]; user.UserGroup != "" && !ok {
+			return errors.New("unknown group " + user.UserGroup + " of user " + name)
+		}
+		if err := user.prepare(name); err != nil {
+			return err
+		}
+		cfg.Users[name] = user
+	}
+	return nil
+}
+
+// prepare parses the encryption key, file modes and expiry date of the user.
+func (user *yamlUserEntry) prepare(name string) error {
+	var err error
+	if user.Key != "" {
+		if user.key, err = hex.DecodeString(user.Key); err != nil || len(user.key) != 32 {
+			return errors.New("encryption key of user " + name + " must be 64 hex characters")
+		}
+	}
+	if user.fileMode, err = parseMode(user.RawFileMode); err != nil {
+		return errors.New("invalid file mode of user " + name + ": " + err.Error())
+	}
+	if user.dirMode, err = parseMode(user.RawDirMode); err != nil {
+		return errors.New("invalid directory mode of user " + name + ": " + err.Error())
+	}
+	if user.Expires != "" {
+		if user.expires, err = parseExpiry(user.Expires); err != nil {
+			return errors.New("invalid expiry date of user " + name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// hashPasswords replaces plain text passwords by hashes and reports whether any has been replaced.
+func (cfg *yamlUserConfiguration) hashPasswords() (bool, error) {
+	changed := false
+	for name, user := range cfg.Users {
 		if user.RawPassword == "" {
 			continue
 		}
-		hashed, err := bcrypt.GenerateFromPassword([]byte(user.RawPassword), bcrypt.DefaultCost)
+		hashed, err := HashPassword(user.RawPassword)
 		if err != nil {
-			return nil, errors.New("could not generate password hash: " + err.Error())
+			return false, err
 		}
 		user.RawPassword = ""
-		user.Hash = string(hashed)
-		config.Users[name] = user
+		user.Hash = hashed
+		cfg.Users[name] = user
+		changed = true
 	}
+	return changed, nil
+}
 
-	buffer, err = yaml.Marshal(config)
+// save writes the configuration back to its file.
+// Comments and keys unknown to the server are preserved and the file is replaced atomically.
+func (cfg *yamlUserConfiguration) save() error {
+	previous, _ := ioutil.ReadFile(cfg.file)
+	buffer, err := cfg.format.merge(previous, cfg)
 	if err != nil {
-		return nil, errors.New("could not marshal config: " + err.Error())
+		return errors.New("could not marshal config: " + err.Error())
 	}
-	if err := ioutil.WriteFile(file, buffer, 0644); err != nil {
-		return nil, errors.New("could not write back config: " + err.Error())
+	if err := writeFileAtomic(cfg.file, buffer); err != nil {
+		return errors.New("could not write back config: " + err.Error())
 	}
-	return config, nil
+	return nil
+}
+
+// ChangePassword hashes the new password and writes it back to the configuration file.
+func (cfg *yamlUserConfiguration) ChangePassword(name, password string) error {
+	if !cfg.writeback {
+		return ErrReadOnlyStore
+	}
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	user, ok := cfg.Users[name]
+	if !ok {
+		return errors.New("unknown user " + name)
+	}
+	user.RawPassword = ""
+	user.Hash = hashed
+	cfg.Users[name] = user
+	return cfg.save()
 }
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFormat is a file format for user configurations.
+type configFormat struct {
+	unmarshal func(data []byte, v interface{}) error
+	marshal   func(v interface{}) ([]byte, error)
+	// merge encodes v into the previous contents of the file, preserving what the server does not manage.
+	merge func(previous []byte, v interface{}) ([]byte, error)
+}
+
+var (
+	yamlFormat = configFormat{yaml.Unmarshal, marshalYAML, mergeYAML}
+	jsonFormat = configFormat{json.Unmarshal, marshalJSON, mergeGeneric(json.Unmarshal, marshalJSON)}
+	tomlFormat = configFormat{toml.Unmarshal, toml.Marshal, mergeGeneric(toml.Unmarshal, toml.Marshal)}
+)
+
+func marshalJSON(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// detectFormat picks the configuration format by file extension, defaulting to YAML.
+func detectFormat(file string) configFormat {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return jsonFormat
+	case ".toml":
+		return tomlFormat
+	default:
+		return yamlFormat
+	}
+}
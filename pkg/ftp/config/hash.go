@@ -0,0 +1,124 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher creates and verifies password hashes of a single format.
+type Hasher interface {
+	// Hash generates an encoded hash of the password.
+	Hash(password string) (string, error)
+	// Verify checks the password against an encoded hash.
+	Verify(hash, password string) bool
+	// Recognizes reports whether the encoded hash uses the format of the hasher.
+	Recognizes(hash string) bool
+}
+
+// BcryptHasher hashes passwords with bcrypt.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hashed), err
+}
+
+func (h BcryptHasher) Verify(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (h BcryptHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Argon2idHasher hashes passwords with argon2id, encoded in the PHC string format
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>.
+// Hashes are verified with the parameters stored in them, so hashes imported from other systems keep working.
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// NewArgon2idHasher creates an argon2id hasher with the given time and memory (KiB) cost.
+func NewArgon2idHasher(time, memory uint32, threads uint8) Argon2idHasher {
+	return Argon2idHasher{Time: time, Memory: memory, Threads: threads, KeyLen: 32, SaltLen: 16}
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Verify(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+	var (
+		version, memory, time uint32
+		threads               uint8
+	)
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func (h Argon2idHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+var (
+	// PasswordHasher hashes new and changed passwords.
+	PasswordHasher Hasher = BcryptHasher{Cost: bcrypt.DefaultCost}
+	// knownHashers verify existing hashes regardless of the configured PasswordHasher.
+	knownHashers = []Hasher{BcryptHasher{}, Argon2idHasher{}}
+)
+
+// HashPassword hashes a password with the configured PasswordHasher.
+func HashPassword(password string) (string, error) {
+	hashed, err := PasswordHasher.Hash(password)
+	if err != nil {
+		return "", errors.New("could not generate password hash: " + err.Error())
+	}
+	return hashed, nil
+}
+
+// VerifyPassword checks a password against a hash in any known format.
+func VerifyPassword(hash, password string) bool {
+	for _, hasher := range append([]Hasher{PasswordHasher}, knownHashers...) {
+		if hasher.Recognizes(hash) {
+			return hasher.Verify(hash, password)
+		}
+	}
+	return false
+}
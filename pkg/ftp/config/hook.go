@@ -0,0 +1,174 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hookRequest is sent to the external auth hook.
+type hookRequest struct {
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// hookResponse is returned by the external auth hook on success.
+type hookResponse struct {
+	Home          string         `json:"home"`
+	ShowHidden    bool           `json:"show_hidden,omitempty"`
+	EncryptionKey string         `json:"encryption_key,omitempty"`
+	Template      string         `json:"template,omitempty"`
+	Permissions   yamlGroupEntry `json:"permissions"`
+	key           []byte
+}
+
+// hookMaxResponse limits the size of responses read from auth hook endpoints.
+const hookMaxResponse = 1 << 20
+
+type hookUserConfiguration struct {
+	target  string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// hookUser is a handle to a user which is only populated once the hook accepted a login.
+// The account returned by the hook belongs to that login, as it may depend on the client address,
+// so other logins of the same name do not change it.
+type hookUser struct {
+	name    string
+	context *hookUserConfiguration
+	mu      sync.RWMutex
+	account *hookResponse
+}
+
+func (user *hookUser) result() *hookResponse {
+	user.mu.RLock()
+	defer user.mu.RUnlock()
+	if user.account != nil {
+		return user.account
+	}
+	return &hookResponse{}
+}
+
+func (user *hookUser) HomeDir() string {
+	return user.result().Home
+}
+
+func (user *hookUser) Auth(password string) bool {
+	return user.AuthRemote(password, "")
+}
+
+// AuthRemote asks the hook to validate the credentials and remembers the returned account on success.
+func (user *hookUser) AuthRemote(password, remoteAddr string) bool {
+	request, err := json.Marshal(hookRequest{user.name, password, remoteAddr})
+	if err != nil {
+		return false
+	}
+	response, err := user.context.call(request)
+	if err != nil {
+		log.Println("AUTH HOOK REJECTED USER", user.name, err)
+		return false
+	}
+	result := &hookResponse{}
+	if err := json.Unmarshal(response, result); err != nil || result.Home == "" {
+		log.Println("ERROR", "MALFORMED AUTH HOOK RESPONSE FOR USER", user.name)
+		return false
+	}
+	if err := result.Permissions.compile(); err != nil {
+		log.Println("ERROR", err, "IN AUTH HOOK PERMISSIONS FOR USER", user.name)
+		return false
+	}
+	result.Permissions.home = result.Home
+	if result.EncryptionKey != "" {
+		if result.key, err = hex.DecodeString(result.EncryptionKey); err != nil || len(result.key) != 32 {
+			log.Println("ERROR", "INVALID AUTH HOOK ENCRYPTION KEY FOR USER", user.name)
+			return false
+		}
+	}
+	user.mu.Lock()
+	user.account = result
+	user.mu.Unlock()
+	return true
+}
+
+func (user *hookUser) Group() FTPGroup {
+	return &user.result().Permissions
+}
+
+func (user *hookUser) RateLimits() (upload, download int64) {
+	permissions := &user.result().Permissions
+	return permissions.UploadRate, permissions.DownloadRate
+}
+
+func (user *hookUser) AllowsCommand(command string) bool {
+	permissions := &user.result().Permissions
+	return allowsCommand(permissions.AllowCmds, permissions.DenyCmds, command)
+}
+
+func (user *hookUser) Greeting() string {
+	return user.result().Permissions.LoginMessage
+}
+
+func (user *hookUser) ShowHidden() bool {
+	return user.result().ShowHidden
+}
+
+func (user *hookUser) EncryptionKey() []byte {
+	return user.result().key
+}
+
+func (user *hookUser) Template() string {
+	return user.result().Template
+}
+
+// call sends the request to the hook and returns its response.
+// Programs receive the request on stdin and reject logins with a non-zero exit status,
+// HTTP endpoints receive it as POST body and reject logins with a non-2xx status.
+func (cfg *hookUserConfiguration) call(request []byte) ([]byte, error) {
+	if strings.HasPrefix(cfg.target, "http://") || strings.HasPrefix(cfg.target, "https://") {
+		resp, err := cfg.client.Post(cfg.target, "application/json", bytes.NewReader(request))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, errors.New("status " + resp.Status)
+		}
+		var response bytes.Buffer
+		_, err = response.ReadFrom(io.LimitReader(resp.Body, hookMaxResponse))
+		return response.Bytes(), err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cfg.target)
+	cmd.Stdin = bytes.NewReader(request)
+	return cmd.Output()
+}
+
+func (cfg *hookUserConfiguration) FindUser(name string) FTPUser {
+	return &hookUser{name: name, context: cfg}
+}
+
+func (cfg *hookUserConfiguration) FindGroup(name string) FTPGroup {
+	return nil
+}
+
+// NewHookConfig delegates authentication to an external program or HTTP endpoint.
+// The hook receives the user name, password and client address and returns the home directory and permissions.
+func NewHookConfig(target string, timeout time.Duration) FTPUserConfig {
+	return &hookUserConfiguration{
+		target:  target,
+		timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookAccountPerLogin(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request hookRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(map[string]string{"home": "/home/" + request.RemoteAddr})
+	}))
+	defer server.Close()
+	cfg := NewHookConfig(server.URL, time.Second)
+
+	first := cfg.FindUser("alice").(RemoteAuthenticator)
+	second := cfg.FindUser("alice").(RemoteAuthenticator)
+	if !first.AuthRemote("secret", "a") || !second.AuthRemote("secret", "b") {
+		t.Fatal("hook rejected the logins")
+	}
+	if home := first.(FTPUser).HomeDir(); home != "/home/a" {
+		t.Errorf("first login has home %q after the second login, want /home/a", home)
+	}
+	if home := second.(FTPUser).HomeDir(); home != "/home/b" {
+		t.Errorf("second login has home %q, want /home/b", home)
+	}
+	if home := cfg.FindUser("alice").HomeDir(); home != "" {
+		t.Errorf("user without login has home %q", home)
+	}
+}
+
+func TestHookResponseLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"home": "/home/alice", "template": "` + strings.Repeat("x", hookMaxResponse) + `"}`))
+	}))
+	defer server.Close()
+	if NewHookConfig(server.URL, time.Second).FindUser("alice").Auth("secret") {
+		t.Error("hook accepted an oversized response")
+	}
+}
@@ -0,0 +1,466 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const jwksRefreshInterval = time.Minute
+
+var (
+	errJWTMalformed  = errors.New("malformed token")
+	errJWTSignature  = errors.New("invalid token signature")
+	errJWTUnknownKey = errors.New("unknown token key")
+)
+
+// jwtClaims are the registered and custom claims checked by the verifier.
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Expires   int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Paths     []string `json:"paths"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// jwtVerifier validates tokens signed with a shared secret or a key from a JWKS.
+type jwtVerifier struct {
+	secret  []byte
+	jwks    string
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// loadKeys reads the JWKS from a file or URL.
+func (v *jwtVerifier) loadKeys() error {
+	var (
+		buffer []byte
+		err    error
+	)
+	if strings.HasPrefix(v.jwks, "http://") || strings.HasPrefix(v.jwks, "https://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+		var resp *http.Response
+		if resp, err = client.Get(v.jwks); err != nil {
+			return errors.New("could not fetch JWKS: " + err.Error())
+		}
+		defer resp.Body.Close()
+		buffer, err = ioutil.ReadAll(resp.Body)
+	} else {
+		buffer, err = ioutil.ReadFile(v.jwks)
+	}
+	if err != nil {
+		return errors.New("could not read JWKS: " + err.Error())
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(buffer, &set); err != nil {
+		return errors.New("could not unmarshal JWKS: " + err.Error())
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+	return nil
+}
+
+// key looks up a JWKS key, refetching the set if the key is unknown.
+func (v *jwtVerifier) key(id string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[id]; ok {
+		return key, nil
+	}
+	if v.jwks == "" || time.Since(v.fetched) < jwksRefreshInterval {
+		return nil, errJWTUnknownKey
+	}
+	if err := v.loadKeys(); err != nil {
+		return nil, err
+	}
+	if key, ok := v.keys[id]; ok {
+		return key, nil
+	}
+	return nil, errJWTUnknownKey
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + jwk.Curve)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + jwk.KeyType)
+}
+
+// looksLikeJWT reports whether a password has the shape of a compact JWT.
+func looksLikeJWT(password string) bool {
+	return strings.Count(password, ".") == 2 && strings.HasPrefix(password, "eyJ")
+}
+
+// verify checks the signature of a token and returns its claims.
+func (v *jwtVerifier) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	if len(header.Algorithm) != 5 {
+		return nil, errors.New("unsupported algorithm " + header.Algorithm)
+	}
+	var hash crypto.Hash
+	switch header.Algorithm[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return nil, errors.New("unsupported algorithm " + header.Algorithm)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Algorithm[:2] {
+	case "HS":
+		if v.secret == nil {
+			return nil, errors.New("unsupported algorithm " + header.Algorithm)
+		}
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errJWTSignature
+		}
+	case "RS", "ES":
+		key, err := v.key(header.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		digest := hash.New()
+		digest.Write(signed)
+		if err := verifySignature(header.Algorithm[:2], key, hash, digest.Sum(nil), signature); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported algorithm " + header.Algorithm)
+	}
+	claims := &jwtClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if claims.Expires == 0 || now >= claims.Expires {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+	return claims, nil
+}
+
+func verifySignature(family string, key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) error {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if family == "RS" && rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if family == "ES" && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(pub, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errJWTSignature
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errJWTMalformed
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errJWTMalformed
+	}
+	return nil
+}
+
+type jwtUserConfiguration struct {
+	FTPUserConfig
+	verifier *jwtVerifier
+}
+
+// jwtUser accepts a token in place of the password and restricts the session to the paths granted by it.
+type jwtUser struct {
+	FTPUser
+	name     string
+	verifier *jwtVerifier
+	paths    []string
+	token    bool
+}
+
+func (user *jwtUser) Auth(password string) bool {
+	return user.AuthRemote(password, "")
+}
+
+func (user *jwtUser) AuthRemote(password, remoteAddr string) bool {
+	if !looksLikeJWT(password) {
+		if remote, ok := user.FTPUser.(RemoteAuthenticator); ok {
+			return remote.AuthRemote(password, remoteAddr)
+		}
+		return user.FTPUser.Auth(password)
+	}
+	claims, err := user.verifier.verify(password)
+	if err != nil || claims.Subject != user.name {
+		return false
+	}
+	user.paths = claims.Paths
+	user.token = true
+	return true
+}
+
+func (user *jwtUser) CheckAccount(now time.Time) error {
+	if account, ok := user.FTPUser.(AccountStatus); ok {
+		return account.CheckAccount(now)
+	}
+	return nil
+}
+
+// RequiresCode asks for the second factor of the user unless a token has been presented.
+func (user *jwtUser) RequiresCode() bool {
+	factor, ok := user.FTPUser.(SecondFactor)
+	return ok && !user.token && factor.RequiresCode()
+}
+
+func (user *jwtUser) VerifyCode(code string) bool {
+	factor, ok := user.FTPUser.(SecondFactor)
+	return ok && factor.VerifyCode(code)
+}
+
+func (user *jwtUser) AuthCertificate(cert *x509.Certificate) bool {
+	authenticator, ok := user.FTPUser.(CertificateAuthenticator)
+	return ok && authenticator.AuthCertificate(cert)
+}
+
+func (user *jwtUser) SystemIDs() (uid, gid int, ok bool) {
+	if account, ok := user.FTPUser.(SystemAccount); ok {
+		return account.SystemIDs()
+	}
+	return 0, 0, false
+}
+
+func (user *jwtUser) RateLimits() (upload, download int64) {
+	if limiter, ok := user.FTPUser.(RateLimiter); ok {
+		return limiter.RateLimits()
+	}
+	return 0, 0
+}
+
+func (user *jwtUser) FileModes() (file, dir os.FileMode) {
+	if modes, ok := user.FTPUser.(FileModes); ok {
+		return modes.FileModes()
+	}
+	return 0, 0
+}
+
+func (user *jwtUser) Greeting() string {
+	if greeter, ok := user.FTPUser.(Greeter); ok {
+		return greeter.Greeting()
+	}
+	return ""
+}
+
+func (user *jwtUser) Template() string {
+	if templated, ok := user.FTPUser.(Templated); ok {
+		return templated.Template()
+	}
+	return ""
+}
+
+func (user *jwtUser) EncryptionKey() []byte {
+	if storage, ok := user.FTPUser.(EncryptedStorage); ok {
+		return storage.EncryptionKey()
+	}
+	return nil
+}
+
+func (user *jwtUser) Honeypot() bool {
+	honeypot, ok := user.FTPUser.(Honeypot)
+	return ok && honeypot.Honeypot()
+}
+
+func (user *jwtUser) ShowHidden() bool {
+	hidden, ok := user.FTPUser.(HiddenFiles)
+	return ok && hidden.ShowHidden()
+}
+
+func (user *jwtUser) AllowsCommand(command string) bool {
+	filter, ok := user.FTPUser.(CommandFilter)
+	return !ok || filter.AllowsCommand(command)
+}
+
+func (user *jwtUser) Group() FTPGroup {
+	group := user.FTPUser.Group()
+	if user.paths == nil || group == nil {
+		return group
+	}
+	return &jwtGroup{group, user.HomeDir(), user.paths}
+}
+
+// jwtGroup limits a group to paths relative to the home directory.
+type jwtGroup struct {
+	FTPGroup
+	home  string
+	paths []string
+}
+
+// allows checks if path lies within one of the granted paths.
+// With ancestors set, directories leading to a granted path are allowed as well.
+func (group *jwtGroup) allows(path string, ancestors bool) bool {
+	rel, err := filepath.Rel(group.home, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	for _, granted := range group.paths {
+		granted = filepath.Clean(strings.TrimPrefix(granted, "/"))
+		if granted == "." || rel == granted || strings.HasPrefix(rel, granted+string(filepath.Separator)) {
+			return true
+		}
+		if ancestors && (rel == "." || strings.HasPrefix(granted, rel+string(filepath.Separator))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (group *jwtGroup) CanCreateFile(path string) bool {
+	return group.allows(path, false) && group.FTPGroup.CanCreateFile(path)
+}
+
+func (group *jwtGroup) CanCreateDir(path string) bool {
+	return group.allows(path, false) && group.FTPGroup.CanCreateDir(path)
+}
+
+func (group *jwtGroup) CanEditFile(path string) bool {
+	return group.allows(path, false) && group.FTPGroup.CanEditFile(path)
+}
+
+func (group *jwtGroup) CanListDir(path string) bool {
+	return group.allows(path, true) && group.FTPGroup.CanListDir(path)
+}
+
+func (group *jwtGroup) CanDeleteFile(path string) bool {
+	return group.allows(path, false) && group.FTPGroup.CanDeleteFile(path)
+}
+
+func (group *jwtGroup) CanDeleteDir(path string) bool {
+	return group.allows(path, false) && group.FTPGroup.CanDeleteDir(path)
+}
+
+func (cfg *jwtUserConfiguration) ChangePassword(name, password string) error {
+	changer, ok := cfg.FTPUserConfig.(PasswordChanger)
+	if !ok {
+		return ErrReadOnlyStore
+	}
+	return changer.ChangePassword(name, password)
+}
+
+func (cfg *jwtUserConfiguration) FindUser(name string) FTPUser {
+	user := cfg.FTPUserConfig.FindUser(name)
+	if user == nil {
+		return nil
+	}
+	return &jwtUser{FTPUser: user, name: name, verifier: cfg.verifier}
+}
+
+// NewJWTConfig lets users of base authenticate with a JSON Web Token instead of their password.
+// Tokens are verified with the shared secret (HS256/384/512) or keys from a JWKS file or URL (RS and ES algorithms).
+// The token subject must match the user name and an optional paths claim restricts access below the home directory.
+func NewJWTConfig(base FTPUserConfig, secret []byte, jwks string) (FTPUserConfig, error) {
+	verifier := &jwtVerifier{secret: secret, jwks: jwks}
+	if jwks != "" {
+		if err := verifier.loadKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return &jwtUserConfiguration{base, verifier}, nil
+}
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// ErrNotFound is returned when managing a user or group which does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Manager is implemented by user stores whose users and groups can be changed at runtime.
+// Users and groups are exchanged as JSON documents following the schema of the configuration file.
+// Secrets of users are never returned, see redactUser.
+type Manager interface {
+	ListUsers() ([]byte, error)
+	GetUser(name string) ([]byte, error)
+	PutUser(name string, data []byte) error
+	DeleteUser(name string) error
+	ListGroups() ([]byte, error)
+	GetGroup(name string) ([]byte, error)
+	PutGroup(name string, data []byte) error
+	DeleteGroup(name string) error
+}
+
+// decodeStrict decodes a JSON document, rejecting unknown keys.
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errors.New("could not decode entry: " + err.Error())
+	}
+	return nil
+}
+
+// userSecrets maps the keys of user secrets to the keys reporting whether they are set.
+// Passwords are write-only, the plain password is reported as part of the hash.
+var userSecrets = []struct{ key, flag string }{
+	{"hash", "has_password"},
+	{"password", "has_password"},
+	{"totp_secret", "has_totp"},
+	{"encryption_key", "has_encryption_key"},
+}
+
+// redactUser returns the JSON document of a user without its secrets.
+// Instead, has_password, has_totp and has_encryption_key report whether they are set.
+func redactUser(user yamlUserEntry) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for _, secret := range userSecrets {
+		value, ok := doc[secret.key]
+		delete(doc, secret.key)
+		if set := ok && string(value) != `""`; set || doc[secret.flag] == nil {
+			doc[secret.flag] = json.RawMessage(strconv.FormatBool(set))
+		}
+	}
+	return doc, nil
+}
+
+// decodeUser decodes a user document. The flags added by redactUser are ignored, so documents returned by GetUser
+// can be changed and put back. It returns the keys of the secrets present in the document.
+func decodeUser(data []byte) (yamlUserEntry, map[string]bool, error) {
+	var user yamlUserEntry
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return user, nil, errors.New("could not decode entry: " + err.Error())
+	}
+	present := make(map[string]bool)
+	for _, secret := range userSecrets {
+		delete(doc, secret.flag)
+		_, present[secret.key] = doc[secret.key]
+	}
+	stripped, err := json.Marshal(doc)
+	if err != nil {
+		return user, nil, err
+	}
+	if err := decodeStrict(stripped, &user); err != nil {
+		return user, nil, err
+	}
+	return user, present, nil
+}
+
+// keepSecrets copies the secrets of the existing user which are not present in the new document.
+// Setting a secret to "" removes it.
+func keepSecrets(user *yamlUserEntry, present map[string]bool, existing yamlUserEntry) {
+	if !present["hash"] && !present["password"] {
+		user.Hash, user.RawPassword = existing.Hash, existing.RawPassword
+	}
+	if !present["totp_secret"] {
+		user.TOTPSecret = existing.TOTPSecret
+	}
+	if !present["encryption_key"] {
+		user.Key = existing.Key
+	}
+}
+
+// update applies a change to a copy of the configuration, validates it and writes it back.
+// The active configuration is only replaced if all steps succeed.
+func (cfg *yamlUserConfiguration) update(change func(candidate *yamlUserConfiguration)) error {
+	if !cfg.writeback {
+		return ErrReadOnlyStore
+	}
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	candidate := &yamlUserConfiguration{
+		Users:     make(map[string]yamlUserEntry, len(cfg.Users)),
+		Groups:    make(map[string]yamlGroupEntry, len(cfg.Groups)),
+		Default:   cfg.Default,
+		file:      cfg.file,
+		writeback: cfg.writeback,
+		format:    cfg.format,
+	}
+	for name, user := range cfg.Users {
+		candidate.Users[name] = user
+	}
+	for name, group := range cfg.Groups {
+		candidate.Groups[name] = group
+	}
+	change(candidate)
+	if _, err := candidate.hashPasswords(); err != nil {
+		return err
+	}
+	if err := candidate.prepare(); err != nil {
+		return err
+	}
+	if err := candidate.save(); err != nil {
+		return err
+	}
+	cfg.Users, cfg.Groups, cfg.groups = candidate.Users, candidate.Groups, candidate.groups
+	return nil
+}
+
+func (cfg *yamlUserConfiguration) ListUsers() ([]byte, error) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	users := make(map[string]map[string]json.RawMessage, len(cfg.Users))
+	for name, user := range cfg.Users {
+		doc, err := redactUser(user)
+		if err != nil {
+			return nil, err
+		}
+		users[name] = doc
+	}
+	return json.Marshal(users)
+}
+
+func (cfg *yamlUserConfiguration) GetUser(name string) ([]byte, error) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	user, ok := cfg.Users[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	doc, err := redactUser(user)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func (cfg *yamlUserConfiguration) PutUser(name string, data []byte) error {
+	user, present, err := decodeUser(data)
+	if err != nil {
+		return err
+	}
+	return cfg.update(func(candidate *yamlUserConfiguration) {
+		if existing, ok := candidate.Users[name]; ok {
+			keepSecrets(&user, present, existing)
+		}
+		candidate.Users[name] = user
+	})
+}
+
+func (cfg *yamlUserConfiguration) DeleteUser(name string) error {
+	if _, err := cfg.GetUser(name); err != nil {
+		return err
+	}
+	return cfg.update(func(candidate *yamlUserConfiguration) {
+		delete(candidate.Users, name)
+	})
+}
+
+func (cfg *yamlUserConfiguration) ListGroups() ([]byte, error) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return json.Marshal(cfg.Groups)
+}
+
+func (cfg *yamlUserConfiguration) GetGroup(name string) ([]byte, error) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	group, ok := cfg.Groups[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return json.Marshal(group)
+}
+
+func (cfg *yamlUserConfiguration) PutGroup(name string, data []byte) error {
+	var group yamlGroupEntry
+	if err := decodeStrict(data, &group); err != nil {
+		return err
+	}
+	return cfg.update(func(candidate *yamlUserConfiguration) {
+		candidate.Groups[name] = group
+	})
+}
+
+func (cfg *yamlUserConfiguration) DeleteGroup(name string) error {
+	if _, err := cfg.GetGroup(name); err != nil {
+		return err
+	}
+	return cfg.update(func(candidate *yamlUserConfiguration) {
+		delete(candidate.Groups, name)
+	})
+}
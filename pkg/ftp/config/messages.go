@@ -0,0 +1,28 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+)
+
+// LoadMessages reads custom reply texts keyed by status code from a YAML, JSON or TOML file, e.g. `530: "Anmeldung fehlgeschlagen"`.
+func LoadMessages(file string) (map[int]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]string)
+	if err := detectFormat(file).unmarshal(data, &raw); err != nil {
+		return nil, errors.New("could not parse messages: " + err.Error())
+	}
+	messages := make(map[int]string, len(raw))
+	for key, text := range raw {
+		status, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, errors.New("invalid status code in messages: " + key)
+		}
+		messages[status] = text
+	}
+	return messages, nil
+}
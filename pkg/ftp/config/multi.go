@@ -0,0 +1,120 @@
+package config
+
+// Multi is a FTPUserConfig consulting several backends in order.
+// A user or group is looked up in the first backend knowing it, so earlier backends shadow later ones.
+type Multi struct {
+	backends []FTPUserConfig
+}
+
+// NewMulti chains the backends in the given order.
+func NewMulti(backends ...FTPUserConfig) *Multi {
+	return &Multi{backends}
+}
+
+func (m *Multi) FindUser(name string) FTPUser {
+	_, user := m.owner(name)
+	return user
+}
+
+func (m *Multi) FindGroup(name string) FTPGroup {
+	for _, backend := range m.backends {
+		if group := backend.FindGroup(name); group != nil {
+			return group
+		}
+	}
+	return nil
+}
+
+// owner returns the first backend knowing the user.
+func (m *Multi) owner(name string) (FTPUserConfig, FTPUser) {
+	for _, backend := range m.backends {
+		if user := backend.FindUser(name); user != nil {
+			return backend, user
+		}
+	}
+	return nil, nil
+}
+
+// ChangePassword changes the password in the backend the user has been found in.
+func (m *Multi) ChangePassword(name, password string) error {
+	backend, _ := m.owner(name)
+	changer, ok := backend.(PasswordChanger)
+	if !ok {
+		return ErrReadOnlyStore
+	}
+	return changer.ChangePassword(name, password)
+}
+
+// manager returns the first backend which can be managed.
+func (m *Multi) manager() (Manager, error) {
+	for _, backend := range m.backends {
+		if manager, ok := backend.(Manager); ok {
+			return manager, nil
+		}
+	}
+	return nil, ErrReadOnlyStore
+}
+
+func (m *Multi) ListUsers() ([]byte, error) {
+	manager, err := m.manager()
+	if err != nil {
+		return nil, err
+	}
+	return manager.ListUsers()
+}
+
+func (m *Multi) GetUser(name string) ([]byte, error) {
+	manager, err := m.manager()
+	if err != nil {
+		return nil, err
+	}
+	return manager.GetUser(name)
+}
+
+func (m *Multi) PutUser(name string, data []byte) error {
+	manager, err := m.manager()
+	if err != nil {
+		return err
+	}
+	return manager.PutUser(name, data)
+}
+
+func (m *Multi) DeleteUser(name string) error {
+	manager, err := m.manager()
+	if err != nil {
+		return err
+	}
+	return manager.DeleteUser(name)
+}
+
+func (m *Multi) ListGroups() ([]byte, error) {
+	manager, err := m.manager()
+	if err != nil {
+		return nil, err
+	}
+	return manager.ListGroups()
+}
+
+func (m *Multi) GetGroup(name string) ([]byte, error) {
+	manager, err := m.manager()
+	if err != nil {
+		return nil, err
+	}
+	return manager.GetGroup(name)
+}
+
+func (m *Multi) PutGroup(name string, data []byte) error {
+	manager, err := m.manager()
+	if err != nil {
+		return err
+	}
+	return manager.PutGroup(name, data)
+}
+
+func (m *Multi) DeleteGroup(name string) error {
+	manager, err := m.manager()
+	if err != nil {
+		return err
+	}
+	return manager.DeleteGroup(name)
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+const regexPatternPrefix = "re:"
+
+// namePattern matches file names by shell glob or, when prefixed with "re:", by regular expression.
+type namePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compileNamePatterns(raw []string) ([]namePattern, error) {
+	patterns := make([]namePattern, 0, len(raw))
+	for _, p := range raw {
+		if strings.HasPrefix(p, regexPatternPrefix) {
+			re, err := regexp.Compile(strings.TrimPrefix(p, regexPatternPrefix))
+			if err != nil {
+				return nil, err
+			}
+			patterns = append(patterns, namePattern{re: re})
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, namePattern{glob: p})
+	}
+	return patterns, nil
+}
+
+func (p namePattern) Match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+func matchAnyName(patterns []namePattern, name string) bool {
+	for _, p := range patterns {
+		if p.Match(name) {
+			return true
+		}
+	}
+	return false
+}
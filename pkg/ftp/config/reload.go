@@ -0,0 +1,166 @@
+package config
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// watchDebounce delays reloads until a burst of file events has settled.
+const watchDebounce = 200 * time.Millisecond
+
+// Reloadable is a FTPUserConfig whose underlying configuration can be replaced at runtime.
+type Reloadable struct {
+	current atomic.Value
+}
+
+type reloadableEntry struct {
+	FTPUserConfig
+}
+
+// NewReloadable wraps cfg so it can be replaced later on.
+func NewReloadable(cfg FTPUserConfig) *Reloadable {
+	r := &Reloadable{}
+	r.Swap(cfg)
+	return r
+}
+
+// Swap atomically replaces the active configuration.
+func (r *Reloadable) Swap(cfg FTPUserConfig) {
+	r.current.Store(reloadableEntry{cfg})
+}
+
+// Current returns the active configuration.
+func (r *Reloadable) Current() FTPUserConfig {
+	return r.current.Load().(reloadableEntry).FTPUserConfig
+}
+
+func (r *Reloadable) FindUser(name string) FTPUser {
+	return r.Current().FindUser(name)
+}
+
+func (r *Reloadable) FindGroup(name string) FTPGroup {
+	return r.Current().FindGroup(name)
+}
+
+func (r *Reloadable) ChangePassword(name, password string) error {
+	changer, ok := r.Current().(PasswordChanger)
+	if !ok {
+		return ErrReadOnlyStore
+	}
+	return changer.ChangePassword(name, password)
+}
+
+// manager returns the active configuration if it can be managed.
+func (r *Reloadable) manager() (Manager, error) {
+	manager, ok := r.Current().(Manager)
+	if !ok {
+		return nil, ErrReadOnlyStore
+	}
+	return manager, nil
+}
+
+func (r *Reloadable) ListUsers() ([]byte, error) {
+	manager, err := r.manager()
+	if err != nil {
+		return nil, err
+	}
+	return manager.ListUsers()
+}
+
+func (r *Reloadable) GetUser(name string) ([]byte, error) {
+	manager, err := r.manager()
+	if err != nil {
+		return nil, err
+	}
+	return manager.GetUser(name)
+}
+
+func (r *Reloadable) PutUser(name string, data []byte) error {
+	manager, err := r.manager()
+	if err != nil {
+		return err
+	}
+	return manager.PutUser(name, data)
+}
+
+func (r *Reloadable) DeleteUser(name string) error {
+	manager, err := r.manager()
+	if err != nil {
+		return err
+	}
+	return manager.DeleteUser(name)
+}
+
+func (r *Reloadable) ListGroups() ([]byte, error) {
+	manager, err := r.manager()
+	if err != nil {
+		return nil, err
+	}
+	return manager.ListGroups()
+}
+
+func (r *Reloadable) GetGroup(name string) ([]byte, error) {
+	manager, err := r.manager()
+	if err != nil {
+		return nil, err
+	}
+	return manager.GetGroup(name)
+}
+
+func (r *Reloadable) PutGroup(name string, data []byte) error {
+	manager, err := r.manager()
+	if err != nil {
+		return err
+	}
+	return manager.PutGroup(name, data)
+}
+
+func (r *Reloadable) DeleteGroup(name string) error {
+	manager, err := r.manager()
+	if err != nil {
+		return err
+	}
+	return manager.DeleteGroup(name)
+}
+
+// ReloadFile loads the configuration file and activates it if it is valid.
+// On errors the last good configuration stays active.
+func (r *Reloadable) ReloadFile(file string, rewrite bool) error {
+	cfg, err := NewFileConfig(file, rewrite)
+	if err != nil {
+		log.Println("ERROR", err, "WHILE RELOADING CONFIG, KEEPING LAST GOOD CONFIG")
+		return err
+	}
+	r.Swap(cfg)
+	log.Println("RELOADED CONFIG", file)
+	return nil
+}
+
+// WatchFile reloads the configuration file into r whenever it changes.
+func (r *Reloadable) WatchFile(file string, rewrite bool) error {
+	changes, err := watchFile(file)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range changes {
+			r.ReloadFile(file, rewrite)
+		}
+	}()
+	return nil
+}
+
+// debounce forwards a single notification once no event has arrived for watchDebounce.
+func debounce(events <-chan struct{}, changes chan<- struct{}) {
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	for {
+		select {
+		case <-events:
+			timer.Reset(watchDebounce)
+		case <-timer.C:
+			changes <- struct{}{}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathRule grants a permission for files or directories, optionally limited to paths matching a glob.
+// Rules are written as "file", "dir", "file:<glob>" or "dir:<glob>", where globs are relative to the
+// home directory and "**" matches any number of path segments.
+type pathRule struct {
+	kind string
+	glob string
+}
+
+func compilePathRules(raw []string) ([]pathRule, error) {
+	rules := make([]pathRule, 0, len(raw))
+	for _, r := range raw {
+		kind, glob := r, ""
+		if i := strings.Index(r, ":"); i >= 0 {
+			kind, glob = r[:i], path.Clean("/"+r[i+1:])
+		}
+		if kind != "file" && kind != "dir" {
+			return nil, errors.New("unknown permission " + r)
+		}
+		for _, segment := range strings.Split(glob, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, errors.New("invalid path pattern " + r + ": " + err.Error())
+			}
+		}
+		rules = append(rules, pathRule{kind, glob})
+	}
+	return rules, nil
+}
+
+// permits checks if any rule of the given kind grants access to path, a path below home.
+func permits(rules []pathRule, kind, home, p string) bool {
+	rel := ""
+	for _, rule := range rules {
+		if rule.kind != kind {
+			continue
+		}
+		if rule.glob == "" {
+			return true
+		}
+		if rel == "" {
+			var ok bool
+			if rel, ok = homeRelative(home, p); !ok {
+				return false
+			}
+		}
+		if matchPathGlob(splitPath(rule.glob), splitPath(rel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// homeRelative converts a path below home to a slash separated path starting at "/".
+func homeRelative(home, p string) (string, bool) {
+	if home == "" {
+		return path.Clean("/" + filepath.ToSlash(p)), true
+	}
+	rel, err := filepath.Rel(home, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path.Clean("/" + filepath.ToSlash(rel)), true
+}
+
+// splitPath splits a clean absolute slash separated path into its segments.
+func splitPath(p string) []string {
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p, "/")[1:]
+}
+
+// matchPathGlob matches path segments against glob segments, where "**" matches zero or more segments.
+func matchPathGlob(glob, segments []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchPathGlob(glob[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], segments[0]); !ok {
+			return false
+		}
+		glob, segments = glob[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
@@ -0,0 +1,44 @@
+package config
+
+// singleUserConfiguration serves exactly one user with full permissions on its home directory.
+type singleUserConfiguration struct {
+	name string
+	hash string
+	home defaultUserConfiguration
+}
+
+type singleUser struct {
+	context *singleUserConfiguration
+}
+
+func (user *singleUser) HomeDir() string {
+	return user.context.home.HomeDir()
+}
+
+func (user *singleUser) Auth(password string) bool {
+	return VerifyPassword(user.context.hash, password)
+}
+
+func (user *singleUser) Group() FTPGroup {
+	return &user.context.home
+}
+
+func (cfg *singleUserConfiguration) FindUser(name string) FTPUser {
+	if name != cfg.name {
+		return nil
+	}
+	return &singleUser{cfg}
+}
+
+func (cfg *singleUserConfiguration) FindGroup(name string) FTPGroup {
+	return nil
+}
+
+// NewSingleUserConfig creates a configuration with a single password protected user.
+func NewSingleUserConfig(name, password, home string) (FTPUserConfig, error) {
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return &singleUserConfiguration{name, hashed, defaultUserConfiguration(home)}, nil
+}
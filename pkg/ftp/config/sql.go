@@ -0,0 +1,299 @@
+package config
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SQLSchema is the schema expected by NewSQLConfig.
+// Hashes are bcrypt or argon2id hashes; an empty hash allows any password.
+// Name patterns are separated by newlines and use the same syntax as the YAML allow and deny lists.
+const SQLSchema = `CREATE TABLE ftp_groups (
+	name            VARCHAR(64) PRIMARY KEY,
+	can_create_file BOOLEAN NOT NULL DEFAULT FALSE,
+	can_create_dir  BOOLEAN NOT NULL DEFAULT FALSE,
+	can_edit_file   BOOLEAN NOT NULL DEFAULT FALSE,
+	can_list_dir    BOOLEAN NOT NULL DEFAULT FALSE,
+	can_delete_file BOOLEAN NOT NULL DEFAULT FALSE,
+	can_delete_dir  BOOLEAN NOT NULL DEFAULT FALSE,
+	allow_names     TEXT NOT NULL DEFAULT '',
+	deny_names      TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE ftp_users (
+	name           VARCHAR(64) PRIMARY KEY,
+	home           VARCHAR(4096) NOT NULL,
+	hash           VARCHAR(255) NOT NULL DEFAULT '',
+	group_name     VARCHAR(64) NOT NULL REFERENCES ftp_groups (name),
+	show_hidden    BOOLEAN NOT NULL DEFAULT FALSE,
+	honeypot       BOOLEAN NOT NULL DEFAULT FALSE,
+	encryption_key VARCHAR(64) NOT NULL DEFAULT '',
+	template       VARCHAR(4096) NOT NULL DEFAULT ''
+);
+`
+
+const (
+	sqlMaxOpenConns    = 16
+	sqlMaxIdleConns    = 4
+	sqlConnMaxLifetime = 5 * time.Minute
+	// sqlCacheSize caps the cached users and groups each.
+	sqlCacheSize = 1024
+)
+
+type sqlUserEntry struct {
+	home       string
+	hash       string
+	groupName  string
+	showHidden bool
+	honeypot   bool
+	key        []byte
+	template   string
+	context    *sqlUserConfiguration
+}
+
+func (user *sqlUserEntry) HomeDir() string {
+	return user.home
+}
+
+func (user *sqlUserEntry) Auth(password string) bool {
+	if user.hash == "" {
+		return true
+	}
+	return VerifyPassword(user.hash, password)
+}
+
+func (user *sqlUserEntry) Group() FTPGroup {
+	return user.context.FindGroup(user.groupName)
+}
+
+func (user *sqlUserEntry) ShowHidden() bool {
+	return user.showHidden
+}
+
+func (user *sqlUserEntry) Honeypot() bool {
+	return user.honeypot
+}
+
+func (user *sqlUserEntry) EncryptionKey() []byte {
+	return user.key
+}
+
+func (user *sqlUserEntry) Template() string {
+	return user.template
+}
+
+type sqlGroupEntry struct {
+	createFile, createDir bool
+	editFile, listDir     bool
+	deleteFile, deleteDir bool
+	allow, deny           []namePattern
+}
+
+func (group *sqlGroupEntry) CanCreateFile(path string) bool {
+	return group.createFile
+}
+
+func (group *sqlGroupEntry) CanCreateDir(path string) bool {
+	return group.createDir
+}
+
+func (group *sqlGroupEntry) CanEditFile(path string) bool {
+	return group.editFile
+}
+
+func (group *sqlGroupEntry) CanListDir(path string) bool {
+	return group.listDir
+}
+
+func (group *sqlGroupEntry) CanDeleteFile(path string) bool {
+	return group.deleteFile
+}
+
+func (group *sqlGroupEntry) CanDeleteDir(path string) bool {
+	return group.deleteDir
+}
+
+func (group *sqlGroupEntry) AllowsName(name string) bool {
+	if len(group.allow) > 0 && !matchAnyName(group.allow, name) {
+		return false
+	}
+	return !matchAnyName(group.deny, name)
+}
+
+// sqlCacheEntry is a cached lookup result. Missing groups are cached as nil.
+// Missing users are not cached, their names are sent by clients before logging in.
+type sqlCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+type sqlUserConfiguration struct {
+	db         *sql.DB
+	userQuery  string
+	groupQuery string
+	hashUpdate string
+	ttl        time.Duration
+	mu         sync.Mutex
+	users      map[string]sqlCacheEntry
+	groups     map[string]sqlCacheEntry
+}
+
+// cached returns a cached lookup result if it has not expired yet.
+func (cfg *sqlUserConfiguration) cached(cache map[string]sqlCacheEntry, name string) (interface{}, bool) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	entry, ok := cache[name]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// store caches a lookup result for the ttl. Once the cache is full, expired entries are swept
+// and if none expired, an arbitrary entry is evicted.
+func (cfg *sqlUserConfiguration) store(cache map[string]sqlCacheEntry, name string, value interface{}) {
+	if cfg.ttl <= 0 {
+		return
+	}
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if _, ok := cache[name]; !ok && len(cache) >= sqlCacheSize {
+		now := time.Now()
+		for key, entry := range cache {
+			if now.After(entry.expires) {
+				delete(cache, key)
+			}
+		}
+		for key := range cache {
+			if len(cache) < sqlCacheSize {
+				break
+			}
+			delete(cache, key)
+		}
+	}
+	cache[name] = sqlCacheEntry{value, time.Now().Add(cfg.ttl)}
+}
+
+func (cfg *sqlUserConfiguration) FindUser(name string) FTPUser {
+	if value, ok := cfg.cached(cfg.users, name); ok {
+		return value.(*sqlUserEntry)
+	}
+	user := &sqlUserEntry{context: cfg}
+	var key string
+	err := cfg.db.QueryRow(cfg.userQuery, name).Scan(&user.home, &user.hash, &user.groupName,
+		&user.showHidden, &user.honeypot, &key, &user.template)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log.Println("ERROR", err, "WHILE LOOKING UP USER", name)
+		return nil
+	}
+	user.home = expandHome(user.home, name)
+	if key != "" {
+		if user.key, err = hex.DecodeString(key); err != nil || len(user.key) != 32 {
+			log.Println("ERROR", "INVALID ENCRYPTION KEY OF USER", name)
+			return nil
+		}
+	}
+	cfg.store(cfg.users, name, user)
+	return user
+}
+
+func (cfg *sqlUserConfiguration) FindGroup(name string) FTPGroup {
+	if value, ok := cfg.cached(cfg.groups, name); ok {
+		if value == nil {
+			return nil
+		}
+		return value.(*sqlGroupEntry)
+	}
+	group := &sqlGroupEntry{}
+	var allow, deny string
+	err := cfg.db.QueryRow(cfg.groupQuery, name).Scan(&group.createFile, &group.createDir, &group.editFile,
+		&group.listDir, &group.deleteFile, &group.deleteDir, &allow, &deny)
+	if err == sql.ErrNoRows {
+		cfg.store(cfg.groups, name, nil)
+		return nil
+	} else if err != nil {
+		log.Println("ERROR", err, "WHILE LOOKING UP GROUP", name)
+		return nil
+	}
+	if group.allow, err = compileNamePatterns(splitNamePatterns(allow)); err != nil {
+		log.Println("ERROR", err, "IN ALLOW PATTERNS OF GROUP", name)
+		return nil
+	}
+	if group.deny, err = compileNamePatterns(splitNamePatterns(deny)); err != nil {
+		log.Println("ERROR", err, "IN DENY PATTERNS OF GROUP", name)
+		return nil
+	}
+	cfg.store(cfg.groups, name, group)
+	return group
+}
+
+// ChangePassword stores the hash of the new password and drops the cached user.
+func (cfg *sqlUserConfiguration) ChangePassword(name, password string) error {
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.db.Exec(cfg.hashUpdate, hashed, name); err != nil {
+		return errors.New("could not update password: " + err.Error())
+	}
+	cfg.mu.Lock()
+	delete(cfg.users, name)
+	cfg.mu.Unlock()
+	return nil
+}
+
+// splitNamePatterns splits newline separated patterns, skipping empty lines.
+func splitNamePatterns(raw string) []string {
+	var patterns []string
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns
+}
+
+// sqlPlaceholder returns the n-th bind parameter in the dialect of the driver.
+func sqlPlaceholder(driver string, n int) string {
+	switch driver {
+	case "postgres", "pgx":
+		return "$" + strconv.Itoa(n)
+	default:
+		return "?"
+	}
+}
+
+// NewSQLConfig loads users and groups from a database following SQLSchema.
+// The driver has to be registered with database/sql. Lookups are cached for ttl, a zero ttl disables caching.
+func NewSQLConfig(driver, dsn string, ttl time.Duration) (FTPUserConfig, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.New("could not open database: " + err.Error())
+	}
+	db.SetMaxOpenConns(sqlMaxOpenConns)
+	db.SetMaxIdleConns(sqlMaxIdleConns)
+	db.SetConnMaxLifetime(sqlConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.New("could not connect to database: " + err.Error())
+	}
+	return &sqlUserConfiguration{
+		db: db,
+		userQuery: "SELECT home, hash, group_name, show_hidden, honeypot, encryption_key, template FROM ftp_users WHERE name = " +
+			sqlPlaceholder(driver, 1),
+		groupQuery: "SELECT can_create_file, can_create_dir, can_edit_file, can_list_dir, can_delete_file, can_delete_dir, " +
+			"allow_names, deny_names FROM ftp_groups WHERE name = " + sqlPlaceholder(driver, 1),
+		hashUpdate: "UPDATE ftp_users SET hash = " + sqlPlaceholder(driver, 1) + " WHERE name = " + sqlPlaceholder(driver, 2),
+		ttl:        ttl,
+		users:      make(map[string]sqlCacheEntry),
+		groups:     make(map[string]sqlCacheEntry),
+	}, nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSQLCacheBounded(t *testing.T) {
+	cfg := &sqlUserConfiguration{ttl: time.Minute, users: make(map[string]sqlCacheEntry)}
+	cfg.store(cfg.users, "expired", &sqlUserEntry{})
+	cfg.users["expired"] = sqlCacheEntry{&sqlUserEntry{}, time.Now().Add(-time.Second)}
+	for i := 0; i < 2*sqlCacheSize; i++ {
+		cfg.store(cfg.users, "user-"+strconv.Itoa(i), &sqlUserEntry{})
+	}
+	if n := len(cfg.users); n > sqlCacheSize {
+		t.Fatalf("cache holds %d entries, want at most %d", n, sqlCacheSize)
+	}
+	if _, ok := cfg.users["expired"]; ok {
+		t.Error("expired entry was not swept")
+	}
+	if _, ok := cfg.cached(cfg.users, "user-"+strconv.Itoa(2*sqlCacheSize-1)); !ok {
+		t.Error("latest entry is not cached")
+	}
+}
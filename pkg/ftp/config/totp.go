@@ -0,0 +1,66 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+// SecondFactor is implemented by users which need a one-time code in addition to their password.
+type SecondFactor interface {
+	RequiresCode() bool
+	VerifyCode(code string) bool
+}
+
+var (
+	totpMu   sync.Mutex
+	totpUsed = make(map[string]int64)
+)
+
+// totpCode computes the RFC 6238 code for a time step.
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks a code against a base32 secret, allowing for clock skew of one period.
+// Codes are only accepted once, so an observed code cannot be replayed.
+func verifyTOTP(secret, code string, now time.Time) bool {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	current := now.Unix() / totpPeriod
+	totpMu.Lock()
+	defer totpMu.Unlock()
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter)), []byte(code)) != 1 {
+			continue
+		}
+		if counter <= totpUsed[secret] {
+			return false
+		}
+		totpUsed[secret] = counter
+		return true
+	}
+	return false
+}
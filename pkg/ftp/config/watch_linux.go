@@ -0,0 +1,49 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchFile notifies about changes of a file using inotify.
+// The parent directory is watched so files replaced by editors are picked up as well.
+func watchFile(file string) (<-chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, errors.New("could not watch config: " + err.Error())
+	}
+	dir, name := filepath.Split(filepath.Clean(file))
+	if dir == "" {
+		dir = "."
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE); err != nil {
+		unix.Close(fd)
+		return nil, errors.New("could not watch config: " + err.Error())
+	}
+	events := make(chan struct{})
+	changes := make(chan struct{})
+	go debounce(events, changes)
+	go func() {
+		defer unix.Close(fd)
+		buffer := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := unix.Read(fd, buffer)
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				raw := buffer[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+				if string(bytes.TrimRight(raw, "\x00")) == name {
+					events <- struct{}{}
+				}
+				offset += unix.SizeofInotifyEvent + int(event.Len)
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package config
+
+import (
+	"os"
+	"time"
+)
+
+// watchPollInterval is the interval in which the file is checked on platforms without inotify.
+const watchPollInterval = 2 * time.Second
+
+// watchFile notifies about changes of a file by polling its modification time and size.
+func watchFile(file string) (<-chan struct{}, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan struct{})
+	changes := make(chan struct{})
+	go debounce(events, changes)
+	go func() {
+		modTime, size := info.ModTime(), info.Size()
+		for range time.Tick(watchPollInterval) {
+			info, err := os.Stat(file)
+			if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			events <- struct{}{}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mergeSchema describes which keys of a configuration document the server owns.
+// Owned keys missing from the new document are removed on writeback, all other keys are preserved.
+type mergeSchema struct {
+	owned    map[string]bool
+	ownsAll  bool
+	children map[string]*mergeSchema
+	each     *mergeSchema
+}
+
+func (s *mergeSchema) owns(key string) bool {
+	return s.ownsAll || s.owned[key]
+}
+
+func (s *mergeSchema) child(key string) *mergeSchema {
+	if s.each != nil {
+		return s.each
+	}
+	return s.children[key]
+}
+
+// configSchema is the schema of user configuration files.
+var configSchema = &mergeSchema{
+	owned: fieldKeys(yamlUserConfiguration{}),
+	children: map[string]*mergeSchema{
+		"users":  {ownsAll: true, each: &mergeSchema{owned: fieldKeys(yamlUserEntry{})}},
+		"groups": {ownsAll: true, each: &mergeSchema{owned: fieldKeys(yamlGroupEntry{})}},
+	},
+}
+
+// fieldKeys returns the keys of the exported fields of a struct.
+func fieldKeys(v interface{}) map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("yaml"); tag != "" {
+			keys[strings.Split(tag, ",")[0]] = true
+		}
+	}
+	return keys
+}
+
+// mergeYAML encodes v into the previous YAML document, keeping its comments, key order and unknown keys.
+func mergeYAML(previous []byte, v interface{}) ([]byte, error) {
+	var old, updated yaml.Node
+	if err := yaml.Unmarshal(previous, &old); err != nil || len(old.Content) == 0 {
+		return marshalYAML(v)
+	}
+	if err := updated.Encode(v); err != nil {
+		return nil, err
+	}
+	old.Content[0] = mergeNode(old.Content[0], &updated, configSchema)
+	return marshalYAML(&old)
+}
+
+func mergeNode(old, updated *yaml.Node, schema *mergeSchema) *yaml.Node {
+	if updated.HeadComment == "" && updated.LineComment == "" && updated.FootComment == "" {
+		updated.HeadComment, updated.LineComment, updated.FootComment = old.HeadComment, old.LineComment, old.FootComment
+	}
+	if old.Kind == updated.Kind && old.Kind != yaml.MappingNode {
+		updated.Style = old.Style
+	}
+	if schema == nil || old.Kind != yaml.MappingNode || updated.Kind != yaml.MappingNode {
+		return updated
+	}
+	values := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(updated.Content); i += 2 {
+		values[updated.Content[i].Value] = updated.Content[i+1]
+	}
+	merged := *old
+	merged.Content = nil
+	for i := 0; i+1 < len(old.Content); i += 2 {
+		key, value := old.Content[i], old.Content[i+1]
+		if next, ok := values[key.Value]; ok {
+			merged.Content = append(merged.Content, key, mergeNode(value, next, schema.child(key.Value)))
+			delete(values, key.Value)
+		} else if !schema.owns(key.Value) {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+	for i := 0; i+1 < len(updated.Content); i += 2 {
+		if _, ok := values[updated.Content[i].Value]; ok {
+			merged.Content = append(merged.Content, updated.Content[i], updated.Content[i+1])
+		}
+	}
+	return &merged
+}
+
+// mergeGeneric creates a merge function for formats without comments, keeping unknown keys.
+func mergeGeneric(unmarshal func([]byte, interface{}) error, marshal func(interface{}) ([]byte, error)) func([]byte, interface{}) ([]byte, error) {
+	return func(previous []byte, v interface{}) ([]byte, error) {
+		var old, updated map[string]interface{}
+		if err := unmarshal(previous, &old); err != nil || old == nil {
+			return marshal(v)
+		}
+		buffer, err := marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := unmarshal(buffer, &updated); err != nil {
+			return nil, err
+		}
+		return marshal(mergeValue(old, updated, configSchema))
+	}
+}
+
+func mergeValue(old, updated interface{}, schema *mergeSchema) interface{} {
+	oldMap, ok := old.(map[string]interface{})
+	updatedMap, isMap := updated.(map[string]interface{})
+	if schema == nil || !ok || !isMap {
+		return updated
+	}
+	merged := make(map[string]interface{}, len(updatedMap))
+	for key, value := range updatedMap {
+		if previous, ok := oldMap[key]; ok {
+			value = mergeValue(previous, value, schema.child(key))
+		}
+		merged[key] = value
+	}
+	for key, value := range oldMap {
+		if _, ok := updatedMap[key]; !ok && !schema.owns(key) {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// writeFileAtomic replaces a file by writing to a temporary file in the same directory and renaming it.
+// The permissions of the replaced file are kept.
+func writeFileAtomic(file string, data []byte) error {
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(file); err == nil {
+		perm = info.Mode().Perm()
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
+
+// marshalYAML encodes v with an indentation of two spaces.
+func marshalYAML(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
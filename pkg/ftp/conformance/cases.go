@@ -0,0 +1,266 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/parser"
+)
+
+// Cases are the checks of the minimum implementation of RFC 959 section 5.1 and the command-reply sequences of section 5.4.
+// Embedders may filter them or append cases of their own commands.
+var Cases = []Case{
+	{Name: "greeting", Section: "5.4", Run: checkGreeting},
+	{Name: "login", Section: "5.4", Run: checkLogin},
+	{Name: "pass-before-user", Section: "5.4", Run: checkPassBeforeUser},
+	{Name: "not-logged-in", Section: "5.4", Run: checkNotLoggedIn},
+	{Name: "unknown-command", Section: "4.2", Login: true, Run: checkUnknownCommand},
+	{Name: "noop", Section: "5.1", Login: true, Run: checkNoop},
+	{Name: "syst", Section: "4.1.3", Login: true, Run: checkSystem},
+	{Name: "pwd", Section: "4.1.3", Login: true, Run: checkPrintDirectory},
+	{Name: "cwd", Section: "4.1.1", Login: true, Run: checkChangeDirectory},
+	{Name: "type", Section: "5.1", Login: true, Run: checkType},
+	{Name: "mode", Section: "5.1", Login: true, Run: checkMode},
+	{Name: "stru", Section: "5.1", Login: true, Run: checkStructure},
+	{Name: "pasv", Section: "4.1.2", Login: true, Run: checkPassive},
+	{Name: "port", Section: "5.1", Login: true, Run: checkPort},
+	{Name: "list", Section: "4.1.3", Login: true, Run: checkList},
+	{Name: "stor-retr", Section: "5.1", Login: true, Run: checkStoreRetrieve},
+	{Name: "retr-missing", Section: "5.4", Login: true, Run: checkRetrieveMissing},
+	{Name: "rename", Section: "4.1.3", Login: true, Run: checkRename},
+	{Name: "rnto-without-rnfr", Section: "5.4", Login: true, Run: checkRenameWithoutFrom},
+	{Name: "mkd-rmd", Section: "4.1.3", Login: true, Run: checkMakeRemoveDirectory},
+	{Name: "quit", Section: "5.1", Login: true, Run: checkQuit},
+}
+
+func checkGreeting(c *Client) error {
+	return checkCode("greeting", c.Greeting(), 220)
+}
+
+func checkLogin(c *Client) error {
+	return c.Login()
+}
+
+func checkPassBeforeUser(c *Client) error {
+	_, err := c.Expect("PASS "+c.options.Password, 503)
+	return err
+}
+
+func checkNotLoggedIn(c *Client) error {
+	_, err := c.Expect("CWD /", 530)
+	return err
+}
+
+func checkUnknownCommand(c *Client) error {
+	_, err := c.Expect("XYZZY", 500, 502)
+	return err
+}
+
+func checkNoop(c *Client) error {
+	_, err := c.Expect("NOOP", 200)
+	return err
+}
+
+func checkSystem(c *Client) error {
+	reply, err := c.Expect("SYST", 215)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply.Text()) == "" {
+		return errors.New("SYST: reply does not name a system type")
+	}
+	return nil
+}
+
+func checkPrintDirectory(c *Client) error {
+	_, err := printDirectory(c)
+	return err
+}
+
+// printDirectory returns the quoted working directory of a 257 reply, see RFC 959 appendix II.
+func printDirectory(c *Client) (string, error) {
+	reply, err := c.Expect("PWD", 257)
+	if err != nil {
+		return "", err
+	}
+	path, ok := quotedPath(reply.Text())
+	if !ok {
+		return "", errors.New("PWD: reply does not start with a quoted path: " + reply.String())
+	}
+	return path, nil
+}
+
+// quotedPath extracts the path quoted at the start of a 257 reply text.
+func quotedPath(text string) (string, bool) {
+	if !strings.HasPrefix(text, "\"") {
+		return "", false
+	}
+	for i := 1; i < len(text); i++ {
+		if text[i] != '"' {
+			continue
+		}
+		if i+1 < len(text) && text[i+1] == '"' {
+			i++
+			continue
+		}
+		return parser.UnquotePath(text[:i+1]), true
+	}
+	return "", false
+}
+
+func checkChangeDirectory(c *Client) error {
+	dir, err := printDirectory(c)
+	if err != nil {
+		return err
+	}
+	_, err = c.Expect("CWD "+dir, 250)
+	return err
+}
+
+func checkType(c *Client) error {
+	for _, cmd := range []string{"TYPE A", "TYPE A N", "TYPE I"} {
+		if _, err := c.Expect(cmd, 200); err != nil {
+			return err
+		}
+	}
+	_, err := c.Expect("TYPE Q", 501, 504)
+	return err
+}
+
+func checkMode(c *Client) error {
+	_, err := c.Expect("MODE S", 200)
+	return err
+}
+
+func checkStructure(c *Client) error {
+	_, err := c.Expect("STRU F", 200)
+	return err
+}
+
+func checkPassive(c *Client) error {
+	data, err := c.Passive()
+	if err != nil {
+		return err
+	}
+	return data.Close()
+}
+
+// checkPort lists the working directory on an active data connection to the address of the control connection.
+func checkPort(c *Client) error {
+	host, _, err := net.SplitHostPort(c.conn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host).To4() == nil {
+		return errors.New("PORT: control connection is not IPv4, use EPRT instead")
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	hostPort, err := parser.FormatHostPort(host, port)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Expect("PORT "+hostPort, 200); err != nil {
+		return err
+	}
+	if _, err := c.Expect("NLST", 125, 150); err != nil {
+		return err
+	}
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(c.options.Timeout))
+	data, err := listener.Accept()
+	if err != nil {
+		return errors.New("PORT: server did not connect: " + err.Error())
+	}
+	defer data.Close()
+	data.SetDeadline(time.Now().Add(c.options.Timeout))
+	_, err = c.finishTransfer("NLST", data, nil)
+	return err
+}
+
+func checkList(c *Client) error {
+	_, err := c.Transfer("LIST", nil)
+	return err
+}
+
+func checkStoreRetrieve(c *Client) error {
+	name := c.Name("stor-retr")
+	upload := []byte("conformance check\r\n" + strconv.FormatInt(time.Now().UnixNano(), 10) + "\r\n")
+	if _, err := c.Expect("TYPE I", 200); err != nil {
+		return err
+	}
+	if _, err := c.Transfer("STOR "+name, upload); err != nil {
+		return err
+	}
+	download, err := c.Transfer("RETR "+name, nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(download, upload) {
+		return errors.New("RETR: downloaded " + strconv.Itoa(len(download)) + " bytes, expected the " + strconv.Itoa(len(upload)) + " bytes stored")
+	}
+	_, err = c.Expect("DELE "+name, 250)
+	return err
+}
+
+func checkRetrieveMissing(c *Client) error {
+	data, err := c.Passive()
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	_, err = c.Expect("RETR "+c.Name("missing"), 450, 550)
+	return err
+}
+
+func checkRename(c *Client) error {
+	from, to := c.Name("rename-from"), c.Name("rename-to")
+	if _, err := c.Transfer("STOR "+from, []byte("rename\r\n")); err != nil {
+		return err
+	}
+	if _, err := c.Expect("RNFR "+from, 350); err != nil {
+		return err
+	}
+	if _, err := c.Expect("RNTO "+to, 250); err != nil {
+		return err
+	}
+	_, err := c.Expect("DELE "+to, 250)
+	return err
+}
+
+func checkRenameWithoutFrom(c *Client) error {
+	_, err := c.Expect("RNTO "+c.Name("rename-to"), 503)
+	return err
+}
+
+func checkMakeRemoveDirectory(c *Client) error {
+	name := c.Name("directory")
+	reply, err := c.Expect("MKD "+name, 257)
+	if err != nil {
+		return err
+	}
+	if _, ok := quotedPath(reply.Text()); !ok {
+		return errors.New("MKD: reply does not start with a quoted path: " + reply.String())
+	}
+	_, err = c.Expect("RMD "+name, 250)
+	return err
+}
+
+// checkQuit expects 221 and the server to close the control connection.
+func checkQuit(c *Client) error {
+	if _, err := c.Expect("QUIT", 221); err != nil {
+		return err
+	}
+	_, err := c.reader.ReadByte()
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		return errors.New("QUIT: server did not close the control connection")
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+// Package conformance checks an FTP server against the command sequences and replies required by RFC 959.
+// The cases talk to the server over the network, so they apply to any server including handlers customized by embedders.
+package conformance
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/parser"
+)
+
+const (
+	// DefaultTimeout limits the duration of a single case.
+	DefaultTimeout = 10 * time.Second
+	// DefaultPrefix is prepended to the names of files and directories created by the cases.
+	DefaultPrefix = "conformance-"
+)
+
+// ErrMalformedReply is returned for replies violating the format of RFC 959 section 4.2.
+var ErrMalformedReply = errors.New("conformance: malformed reply")
+
+// Options describe the server under test.
+type Options struct {
+	// Addr is the host:port of the control connection.
+	Addr string
+	// User and Password log in the cases which require it. The user must be allowed to upload and delete files.
+	User     string
+	Password string
+	// Timeout limits each case, DefaultTimeout if zero.
+	Timeout time.Duration
+	// Prefix is prepended to the names of files created in the working directory, DefaultPrefix if empty.
+	Prefix string
+}
+
+// Case is a command sequence with the replies RFC 959 allows for it.
+type Case struct {
+	// Name identifies the case, e.g. to select cases by pattern.
+	Name string
+	// Section is the section of RFC 959 requiring the behaviour.
+	Section string
+	// Login tells whether the client logs in before the case runs.
+	Login bool
+	// Run issues the commands and returns an error describing the first violation.
+	Run func(c *Client) error
+}
+
+// Result is the outcome of a case.
+type Result struct {
+	Case     Case
+	Err      error
+	Duration time.Duration
+}
+
+// Passed reports whether the server behaved as required.
+func (r Result) Passed() bool {
+	return r.Err == nil
+}
+
+func (r Result) String() string {
+	status := "PASS"
+	if r.Err != nil {
+		status = "FAIL"
+	}
+	line := status + " " + r.Case.Name + " (RFC 959 " + r.Case.Section + ")"
+	if r.Err != nil {
+		line += ": " + r.Err.Error()
+	}
+	return line
+}
+
+// Run runs the cases one after another, each on its own control connection.
+func Run(options Options, cases []Case) []Result {
+	if options.Timeout == 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.Prefix == "" {
+		options.Prefix = DefaultPrefix
+	}
+	results := make([]Result, 0, len(cases))
+	for _, test := range cases {
+		start := time.Now()
+		err := runCase(options, test)
+		results = append(results, Result{Case: test, Err: err, Duration: time.Since(start)})
+	}
+	return results
+}
+
+func runCase(options Options, test Case) (err error) {
+	client, err := Dial(options)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	defer func() {
+		if err != nil {
+			removeScratch(options, client.scratch)
+		}
+	}()
+	if test.Login {
+		if err := client.Login(); err != nil {
+			return errors.New("could not log in: " + err.Error())
+		}
+	}
+	return test.Run(client)
+}
+
+// removeScratch removes the files and directories a failed case may have left behind.
+// It uses a new control connection, as the failure may have left the one of the case unusable.
+func removeScratch(options Options, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	client, err := Dial(options)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	if client.Login() != nil {
+		return
+	}
+	for _, name := range names {
+		if reply, err := client.Command("DELE " + name); err != nil {
+			return
+		} else if reply.Code/100 != 2 {
+			client.Command("RMD " + name)
+		}
+	}
+}
+
+// Reply is a complete, possibly multi-line reply.
+type Reply struct {
+	Code  int
+	Lines []string
+}
+
+// Text returns the text of the last line after the status code.
+func (r Reply) Text() string {
+	last := r.Lines[len(r.Lines)-1]
+	if len(last) <= 4 {
+		return ""
+	}
+	return last[4:]
+}
+
+func (r Reply) String() string {
+	return strings.Join(r.Lines, " | ")
+}
+
+// Client is a control connection to the server under test. It checks the format of every reply it reads.
+type Client struct {
+	options  Options
+	conn     net.Conn
+	reader   *bufio.Reader
+	greeting Reply
+	suffix   string
+	scratch  []string
+}
+
+// Dial connects to the server and reads its greeting, waiting for 220 if the server first replies 120.
+func Dial(options Options) (*Client, error) {
+	if options.Timeout == 0 {
+		options.Timeout = DefaultTimeout
+	}
+	conn, err := net.DialTimeout("tcp", options.Addr, options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(options.Timeout))
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	client := &Client{options: options, conn: conn, reader: bufio.NewReader(conn), suffix: hex.EncodeToString(suffix)}
+	reply, err := client.ReadReply()
+	for err == nil && reply.Code == 120 {
+		reply, err = client.ReadReply()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("could not read greeting: " + err.Error())
+	}
+	client.greeting = reply
+	return client, nil
+}
+
+// Greeting returns the reply sent on connect.
+func (c *Client) Greeting() Reply {
+	return c.greeting
+}
+
+// Name returns a name for a scratch file or directory starting with the configured prefix.
+// A random suffix makes it unique to the client, so leftovers of earlier runs do not break the case.
+// Scratch entries of failed cases are removed after the case.
+func (c *Client) Name(base string) string {
+	name := c.options.Prefix + base + "-" + c.suffix
+	c.scratch = append(c.scratch, name)
+	return name
+}
+
+// ReadReply reads the next reply. Every line must end with CRLF and multi-line replies must end with the code of the first line.
+func (c *Client) ReadReply() (Reply, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return Reply{}, err
+	}
+	code, err := strconv.Atoi(line[:3])
+	if err != nil || code < 100 || code > 599 {
+		return Reply{}, ErrMalformedReply
+	}
+	reply := Reply{Code: code, Lines: []string{line}}
+	if len(line) == 3 || line[3] == ' ' {
+		return reply, nil
+	}
+	if line[3] != '-' {
+		return Reply{}, errors.New(ErrMalformedReply.Error() + ": " + line)
+	}
+	for {
+		next, err := c.readLine()
+		if err != nil {
+			return Reply{}, err
+		}
+		reply.Lines = append(reply.Lines, next)
+		if strings.HasPrefix(next, line[:3]+" ") || next == line[:3] {
+			return reply, nil
+		}
+	}
+}
+
+func (c *Client) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.New(ErrMalformedReply.Error() + ": line does not end with CRLF: " + strings.TrimSpace(line))
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) < 3 {
+		return "", errors.New(ErrMalformedReply.Error() + ": " + line)
+	}
+	return line, nil
+}
+
+// Command sends a command and returns its reply.
+func (c *Client) Command(cmd string) (Reply, error) {
+	if _, err := io.WriteString(c.conn, cmd+"\r\n"); err != nil {
+		return Reply{}, err
+	}
+	return c.ReadReply()
+}
+
+// Expect sends a command and fails unless the reply has one of the codes.
+func (c *Client) Expect(cmd string, codes ...int) (Reply, error) {
+	reply, err := c.Command(cmd)
+	if err != nil {
+		return reply, errors.New(verbOf(cmd) + ": " + err.Error())
+	}
+	return reply, checkCode(cmd, reply, codes...)
+}
+
+// Login logs in with USER and, if the server asks for it, PASS.
+func (c *Client) Login() error {
+	reply, err := c.Expect("USER "+c.options.User, 230, 331)
+	if err != nil || reply.Code == 230 {
+		return err
+	}
+	_, err = c.Expect("PASS "+c.options.Password, 230, 202)
+	return err
+}
+
+// Passive opens a data connection announced by PASV.
+func (c *Client) Passive() (net.Conn, error) {
+	reply, err := c.Expect("PASV", 227)
+	if err != nil {
+		return nil, err
+	}
+	hostPort := hostPortPattern.FindString(reply.Text())
+	addr, err := parser.ParseHostPort(hostPort)
+	if err != nil {
+		return nil, errors.New("PASV: reply does not contain h1,h2,h3,h4,p1,p2: " + reply.String())
+	}
+	return net.DialTimeout("tcp", addr, c.options.Timeout)
+}
+
+// Transfer runs a transfer command on a passive data connection. It uploads the data if it is not nil and returns
+// the downloaded data otherwise. The command must be answered by 125 or 150 and completed by 226 or 250.
+func (c *Client) Transfer(cmd string, upload []byte) ([]byte, error) {
+	data, err := c.Passive()
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	data.SetDeadline(time.Now().Add(c.options.Timeout))
+	if _, err := c.Expect(cmd, 125, 150); err != nil {
+		return nil, err
+	}
+	return c.finishTransfer(cmd, data, upload)
+}
+
+func (c *Client) finishTransfer(cmd string, data net.Conn, upload []byte) ([]byte, error) {
+	var download []byte
+	if upload != nil {
+		if _, err := data.Write(upload); err != nil {
+			return nil, errors.New(verbOf(cmd) + ": could not upload: " + err.Error())
+		}
+		data.Close()
+	} else {
+		var err error
+		if download, err = ioutil.ReadAll(data); err != nil {
+			return nil, errors.New(verbOf(cmd) + ": could not download: " + err.Error())
+		}
+	}
+	reply, err := c.ReadReply()
+	if err != nil {
+		return nil, errors.New(verbOf(cmd) + ": " + err.Error())
+	}
+	return download, checkCode(cmd, reply, 226, 250)
+}
+
+// Close closes the control connection without sending QUIT.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+var hostPortPattern = regexp.MustCompile(`\d+,\d+,\d+,\d+,\d+,\d+`)
+
+func verbOf(cmd string) string {
+	verb, _ := parser.SplitCommand(cmd)
+	return verb
+}
+
+func checkCode(cmd string, reply Reply, codes ...int) error {
+	for _, code := range codes {
+		if reply.Code == code {
+			return nil
+		}
+	}
+	expected := make([]string, len(codes))
+	for i, code := range codes {
+		expected[i] = strconv.Itoa(code)
+	}
+	return errors.New(verbOf(cmd) + ": expected " + strings.Join(expected, " or ") + ", got " + reply.String())
+}
@@ -0,0 +1,38 @@
+package ftp
+
+import "net"
+
+// AddressFilter restricts the client addresses a server talks to.
+// Denied networks take precedence. If Allow is not empty, addresses must be within one of its networks.
+// A nil filter allows every address.
+type AddressFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Allows checks an IP address or host:port pair against the filter.
+func (f *AddressFilter) Allows(addr string) bool {
+	if f == nil {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	if containsIP(f.Deny, ip) {
+		return false
+	}
+	return len(f.Allow) == 0 || containsIP(f.Allow, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,13 +1,22 @@
 package ftp
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/parser"
 )
 
 /*
@@ -41,7 +50,10 @@ const (
 	StatusTransferOpen     = 225
 	StatusTransferDone     = 226
 	StatusPassiveMode      = 227
+	StatusExtendedPassive  = 229
 	StatusAuthenticated    = 230
+	StatusCertificateLogin = 232
+	StatusSecurityExchange = 234
 	StatusActionDone       = 250
 	StatusWorkingDirectory = 257
 
@@ -61,8 +73,10 @@ const (
 	StatusNotImplemented         = 502
 	StatusBadSequence            = 503
 	StatusNotImplementedParam    = 504
+	StatusNetworkProtocol        = 522
 	StatusNotLoggedIn            = 530
 	StatusStorageAccountRequired = 532
+	StatusFileUnavailable        = 550
 	StatusUnknownPage            = 551
 	StatusInsufficientSpaceAbort = 552
 	StatusInvalidName            = 553
@@ -70,18 +84,39 @@ const (
 	CommandQuit             = "QUIT"
 	CommandUser             = "USER"
 	CommandPassword         = "PASS"
+	CommandAccount          = "ACCT"
 	CommandSystemType       = "SYST"
 	CommandPrintDirectory   = "PWD"
 	CommandChangeDirectory  = "CWD"
 	CommandModificationTime = "MDTM"
 	CommandFileSize         = "SIZE"
 	CommandStoreFile        = "STOR"
+	CommandAppendFile       = "APPE"
+	CommandRenameFrom       = "RNFR"
+	CommandRenameTo         = "RNTO"
+	CommandDelete           = "DELE"
+	CommandMakeDirectory    = "MKD"
+	CommandRemoveDirectory  = "RMD"
 	CommandRetrieveFile     = "RETR"
 	CommandDataType         = "TYPE"
 	CommandPassiveMode      = "PASV"
 	CommandPort             = "PORT"
+	CommandExtendedPassive  = "EPSV"
+	CommandExtendedPort     = "EPRT"
 	CommandListRaw          = "NLST"
 	CommandList             = "LIST"
+	CommandHash             = "HASH"
+	CommandSHA256           = "XSHA256"
+	CommandSite             = "SITE"
+	CommandAuth             = "AUTH"
+	CommandProtectionBuffer = "PBSZ"
+	CommandProtectionLevel  = "PROT"
+	CommandHost             = "HOST"
+	CommandStatus           = "STAT"
+	CommandAbort            = "ABOR"
+	CommandNoop             = "NOOP"
+	CommandTransferMode     = "MODE"
+	CommandFileStructure    = "STRU"
 )
 
 var (
@@ -104,7 +139,10 @@ var (
 		StatusTransferOpen:     "Data connection open; no transfer in progress",
 		StatusTransferDone:     "Closing data connection",
 		StatusPassiveMode:      "Entering Passive Mode (%s)",
+		StatusExtendedPassive:  "Entering Extended Passive Mode (|||%d|)",
 		StatusAuthenticated:    "User logged in, proceed",
+		StatusCertificateLogin: "User logged in, authorized by security data exchange",
+		StatusSecurityExchange: "Security data exchange complete",
 		StatusActionDone:       "Requested file action okay, completed",
 		StatusWorkingDirectory: "\"%s\" is working directory.",
 
@@ -124,19 +162,31 @@ var (
 		StatusNotImplemented:         "Command not implemented",
 		StatusBadSequence:            "Bad sequence of Commands",
 		StatusNotImplementedParam:    "Command not implemented for that parameter",
+		StatusNetworkProtocol:        "Network protocol not supported, use (1,2)",
 		StatusNotLoggedIn:            "Not logged in",
 		StatusStorageAccountRequired: "Need account for storing files",
+		StatusFileUnavailable:        "Requested action not taken; permission denied",
 		StatusUnknownPage:            "Requested action aborted; page type unknown",
 		StatusInvalidName:            "Requested action not taken; file name not allowed",
 	}
 )
 
+// ErrMalformedCommand is returned by ReadCommand for command lines with embedded NUL or CR bytes.
+// The connection stays usable, the line is discarded.
+var ErrMalformedCommand = errors.New("ftp: malformed command")
+
+// ErrCommandTooLong is returned by ReadCommand for command lines exceeding the length limit.
+// The rest of the line is not read, so the connection should be closed.
+var ErrCommandTooLong = errors.New("ftp: command line too long")
+
 // Conn handles context related user interactions.
 type Conn interface {
 	Close()
 	ReadCommand() (string, error)
 	Write([]byte) (int, error)
-	GetID() int
+	GetID() string
+	GetRemoteAddr() string
+	GetLocalAddr() string
 	GetRelativePath(string) (string, bool)
 	GetDir() string
 	ChangeDir(to string) bool
@@ -145,35 +195,76 @@ type Conn interface {
 	GetTransferType() string
 	GetPassivePort() (int, error)
 	ChangeTransferType(string)
-	Send([]byte) bool
-	Receive() ([]byte, bool)
+	Send(context.Context, io.Reader) bool
+	Receive(context.Context, io.Writer) bool
+	OpenDataConn(context.Context) (io.ReadWriteCloser, error)
+	HasDataConn() bool
 	Log(...interface{})
 	SetPassive(string)
 	SetActive(string)
 	Reset()
 	Respond(int, ...interface{}) error
+	RespondText(int, string) error
+	StartTLS(*tls.Config) error
+	Secure() bool
+	SetProtected(bool)
+	VerifiedCertificate() *x509.Certificate
+	ServerName() string
+	SetTrace(bool)
+	Trace(...interface{})
+}
+
+// transferProgressKey is the context key of the counter passed to WithTransferProgress.
+type transferProgressKey struct{}
+
+// WithTransferProgress returns a context for Send and Receive whose connection atomically adds the bytes
+// moved over the data connection to counter as they pass the socket, e.g. while the kernel sends a file.
+func WithTransferProgress(ctx context.Context, counter *int64) context.Context {
+	return context.WithValue(ctx, transferProgressKey{}, counter)
+}
+
+// TransferProgress returns the counter of a transfer set by WithTransferProgress, nil if there is none.
+func TransferProgress(ctx context.Context) *int64 {
+	counter, _ := ctx.Value(transferProgressKey{}).(*int64)
+	return counter
 }
 
 // ConnectionFactory waits for connections and matches them to a configuration.
 type ConnectionFactory interface {
 	Listen() error
-	Accept(cfg config.FTPUserConfig) (Conn, error)
+	Close() error
+	Accept(ctx context.Context, cfg config.FTPUserConfig) (Conn, error)
 }
 
 // ContextualConn stores FTP session information.
 type ContextualConn struct {
-	ID           int
+	ID           string
+	RemoteAddr   string
+	LocalAddr    string
 	Dir          string
 	User         string
 	TransferType string
 	Config       config.FTPUserConfig
+	Logger       *slog.Logger
+	LogSecrets   bool
+	trace        int32
 }
 
 // GetID retrieves the connection ID.
-func (conn *ContextualConn) GetID() int {
+func (conn *ContextualConn) GetID() string {
 	return conn.ID
 }
 
+// GetRemoteAddr returns the address of the client.
+func (conn *ContextualConn) GetRemoteAddr() string {
+	return conn.RemoteAddr
+}
+
+// GetLocalAddr returns the address the client connected to.
+func (conn *ContextualConn) GetLocalAddr() string {
+	return conn.LocalAddr
+}
+
 // GetDir returns the current working directory.
 func (conn *ContextualConn) GetDir() string {
 	return conn.Dir
@@ -189,6 +280,27 @@ func (conn *ContextualConn) ChangeUser(to string) {
 	conn.User = to
 }
 
+// SetTrace switches verbose tracing of the session on or off.
+// Tracing logs data connection events and raises debug records like requests and responses to the info level.
+func (conn *ContextualConn) SetTrace(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&conn.trace, value)
+}
+
+func (conn *ContextualConn) tracing() bool {
+	return atomic.LoadInt32(&conn.trace) == 1
+}
+
+// Trace logs information only while tracing is switched on.
+func (conn *ContextualConn) Trace(params ...interface{}) {
+	if conn.tracing() {
+		conn.Log(params...)
+	}
+}
+
 // ChangeDir changes the working directory to the target directory.
 func (conn *ContextualConn) ChangeDir(dir string) bool {
 	conn.Dir = dir
@@ -206,8 +318,15 @@ func (conn *ContextualConn) ChangeTransferType(tt string) {
 }
 
 // Log prints out logging information including the connection ID.
+// If the connection has a Logger, a structured record is emitted instead.
+// Secret arguments of requests like PASS are redacted unless LogSecrets is set.
 func (conn *ContextualConn) Log(params ...interface{}) {
-	log.Printf("[#%d] %s", conn.ID, fmt.Sprintln(params...))
+	params = conn.sanitizeParams(params)
+	if conn.Logger != nil {
+		conn.logRecord(params)
+		return
+	}
+	log.Printf("[%s] %s", conn.ID, fmt.Sprintln(params...))
 }
 
 // GetRelativePath returns the relative path from the current working directory to the target path.
@@ -229,20 +348,23 @@ func (conn *ContextualConn) GetRelativePath(p2 string) (string, bool) {
 	return p1, true
 }
 
-// ParseHost converts hostnames and ports between from the FTP to the URI format.
+// ParseHost converts IPv4 hostnames and ports from the FTP to the URI format. Malformed input yields an empty string.
+//
+// Deprecated: use parser.ParseHostPort, which reports malformed input.
 func ParseHost(ports string) string {
-	tokens := strings.Split(ports, ",")
-	host := strings.Join(tokens[:4], ".")
-	base1, _ := strconv.Atoi(tokens[4])
-	base0, _ := strconv.Atoi(tokens[5])
-	port := strconv.Itoa(base1*256 + base0)
-	return host + ":" + port
+	host, _ := parser.ParseHostPort(ports)
+	return host
 }
 
-// GenerateHost converts a URI hostport to the FTP format.
+// GenerateHost converts an IPv4 URI hostport to the FTP format. Malformed input yields an empty string.
+//
+// Deprecated: use parser.FormatHostPort, which reports malformed input.
 func GenerateHost(hostport string) string {
-	tokens := strings.Split(hostport, ":")
-	ips := strings.Split(tokens[0], ".")
-	port, _ := strconv.Atoi(tokens[1])
-	return fmt.Sprintf("%s,%d,%d", strings.Join(ips, ","), port/256, port%256)
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return ""
+	}
+	n, _ := strconv.Atoi(port)
+	ports, _ := parser.FormatHostPort(host, n)
+	return ports
 }
@@ -0,0 +1,427 @@
+// Package ftptest provides in-memory FTP connections, so handlers can be tested without sockets.
+package ftptest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+var (
+	// ErrNoDataConnection is returned by OpenDataConn without SetPassive or SetActive before.
+	ErrNoDataConnection = errors.New("ftptest: no data connection set up")
+	// ErrTLSUnsupported is returned by StartTLS, connections in memory cannot be encrypted.
+	ErrTLSUnsupported = errors.New("ftptest: TLS is not supported")
+	// errClosed is returned by Accept once the factory is closed.
+	errClosed = errors.New("ftptest: factory closed")
+)
+
+// PassivePort is the port reported for passive data connections.
+const PassivePort = 20000
+
+// Reply is a reply sent to the client.
+type Reply struct {
+	Status int
+	Text   string
+}
+
+// String formats the reply like it is sent on the control connection, without the trailing CRLF.
+func (r Reply) String() string {
+	return strconv.Itoa(r.Status) + " " + r.Text
+}
+
+// Conn is a ftp.Conn in memory. It reads the scripted command lines and records the replies.
+// The data connection is simulated: downloads are captured and uploads read from the upload data.
+// ReadCommand returns io.EOF once all commands are read, which ends the session.
+type Conn struct {
+	ftp.ContextualConn
+	// Messages optionally overrides the reply texts of status codes.
+	Messages ftp.Messages
+	// DataError makes opening data connections fail, e.g. to test 425 replies.
+	DataError error
+	// Host is the server name requested by the client.
+	Host string
+
+	mu         sync.Mutex
+	commands   []string
+	replies    []Reply
+	output     bytes.Buffer
+	logs       []string
+	upload     []byte
+	downloaded bytes.Buffer
+	passive    bool
+	active     string
+	protected  bool
+	closed     bool
+}
+
+// NewConn creates a connection which sends the command lines in order.
+func NewConn(commands ...string) *Conn {
+	return &Conn{
+		ContextualConn: ftp.ContextualConn{
+			ID:           "ftptest",
+			RemoteAddr:   "127.0.0.1:50000",
+			LocalAddr:    "127.0.0.1:21",
+			Dir:          "/",
+			TransferType: "AN",
+		},
+		commands: commands,
+	}
+}
+
+// Push appends command lines to the script.
+func (conn *Conn) Push(commands ...string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.commands = append(conn.commands, commands...)
+}
+
+// SetUpload sets the data the client sends over the data connection, e.g. for STOR.
+func (conn *Conn) SetUpload(data []byte) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.upload = data
+}
+
+// Downloaded returns the data sent to the client over data connections.
+func (conn *Conn) Downloaded() []byte {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return bytes.Clone(conn.downloaded.Bytes())
+}
+
+// Replies returns the replies sent so far.
+func (conn *Conn) Replies() []Reply {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return append([]Reply(nil), conn.replies...)
+}
+
+// Statuses returns the status codes of the replies sent so far.
+func (conn *Conn) Statuses() []int {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	statuses := make([]int, len(conn.replies))
+	for i, reply := range conn.replies {
+		statuses[i] = reply.Status
+	}
+	return statuses
+}
+
+// LastReply returns the last reply, the zero Reply if none was sent.
+func (conn *Conn) LastReply() Reply {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.replies) == 0 {
+		return Reply{}
+	}
+	return conn.replies[len(conn.replies)-1]
+}
+
+// Output returns everything written to the control connection, including raw writes.
+func (conn *Conn) Output() string {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.output.String()
+}
+
+// Logs returns the logged lines. Logs are recorded instead of written to the standard logger.
+func (conn *Conn) Logs() []string {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return append([]string(nil), conn.logs...)
+}
+
+// Closed reports whether the session closed the connection.
+func (conn *Conn) Closed() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.closed
+}
+
+// Close marks the connection as closed, further commands are not read.
+func (conn *Conn) Close() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.closed = true
+}
+
+// ReadCommand returns the next scripted command line, io.EOF once there are none left or the connection is closed.
+func (conn *Conn) ReadCommand() (string, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.closed || len(conn.commands) == 0 {
+		return "", io.EOF
+	}
+	command := conn.commands[0]
+	conn.commands = conn.commands[1:]
+	return command, nil
+}
+
+// Write records raw output. Complete replies written this way are recorded as replies as well.
+func (conn *Conn) Write(p []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.output.Write(p)
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\r\n"), "\r\n") {
+		if len(line) < 4 || line[3] != ' ' {
+			continue
+		}
+		if status, err := strconv.Atoi(line[:3]); err == nil {
+			conn.replies = append(conn.replies, Reply{status, line[4:]})
+		}
+	}
+	return len(p), nil
+}
+
+// Respond sends the reply text of a status, formatted with the parameters.
+func (conn *Conn) Respond(status int, params ...interface{}) error {
+	return conn.RespondText(status, conn.Messages.Format(status, params...))
+}
+
+// RespondText records a reply with an explicit message.
+func (conn *Conn) RespondText(status int, message string) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.output.WriteString(ftp.FormatReply(status, message))
+	conn.replies = append(conn.replies, Reply{status, message})
+	return nil
+}
+
+// Log records the parameters as a line.
+func (conn *Conn) Log(params ...interface{}) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.logs = append(conn.logs, strings.TrimSuffix(fmt.Sprintln(params...), "\n"))
+}
+
+// SetPassive sets up a passive data connection for the next transfer.
+func (conn *Conn) SetPassive(host string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.passive, conn.active = true, ""
+}
+
+// SetActive sets up an active data connection to the address for the next transfer.
+func (conn *Conn) SetActive(address string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.passive, conn.active = false, address
+}
+
+// GetPassivePort returns PassivePort once a passive data connection is set up.
+func (conn *Conn) GetPassivePort() (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if !conn.passive {
+		return 0, ErrNoDataConnection
+	}
+	return PassivePort, nil
+}
+
+// HasDataConn reports whether a data connection is set up for the next transfer.
+func (conn *Conn) HasDataConn() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.passive || conn.active != ""
+}
+
+// Reset discards the data connection set up before.
+func (conn *Conn) Reset() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.passive, conn.active = false, ""
+}
+
+// ActiveAddress returns the address set up by the last PORT or EPRT, if the data connection was not used yet.
+func (conn *Conn) ActiveAddress() string {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.active
+}
+
+// OpenDataConn opens the simulated data connection. Reads return the upload data, writes are captured as download.
+// Each setup serves a single transfer, like on real connections.
+func (conn *Conn) OpenDataConn(ctx context.Context) (io.ReadWriteCloser, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.DataError != nil {
+		conn.passive, conn.active = false, ""
+		return nil, conn.DataError
+	}
+	if !conn.passive && conn.active == "" {
+		return nil, ErrNoDataConnection
+	}
+	conn.passive, conn.active = false, ""
+	return &dataConn{ctx: ctx, conn: conn, upload: bytes.NewReader(conn.upload)}, nil
+}
+
+// Send streams the source to the client and replies with the outcome like a real connection.
+func (conn *Conn) Send(ctx context.Context, source io.Reader) bool {
+	return conn.stream(ctx, func(c io.ReadWriter) error {
+		_, err := io.Copy(c, source)
+		return err
+	})
+}
+
+// Receive streams the upload data into the sink and replies with the outcome like a real connection.
+func (conn *Conn) Receive(ctx context.Context, sink io.Writer) bool {
+	return conn.stream(ctx, func(c io.ReadWriter) error {
+		_, err := io.Copy(sink, c)
+		return err
+	})
+}
+
+// stream replies 150, runs the copy and replies 226, 425 if the data connection could not be opened or 426 if the copy failed.
+func (conn *Conn) stream(ctx context.Context, copy func(io.ReadWriter) error) bool {
+	conn.Respond(ftp.StatusTransferReady)
+	c, err := conn.OpenDataConn(ctx)
+	if err != nil {
+		conn.Respond(ftp.StatusTransferFailed)
+		return false
+	}
+	if counter := ftp.TransferProgress(ctx); counter != nil {
+		c = &progressConn{c, counter}
+	}
+	err = copy(c)
+	c.Close()
+	if err != nil {
+		conn.Respond(ftp.StatusTransferAbort)
+		return false
+	}
+	conn.Respond(ftp.StatusTransferDone)
+	return true
+}
+
+// StartTLS fails with ErrTLSUnsupported.
+func (conn *Conn) StartTLS(cfg *tls.Config) error {
+	return ErrTLSUnsupported
+}
+
+// Secure reports false, the connection is never encrypted.
+func (conn *Conn) Secure() bool {
+	return false
+}
+
+// SetProtected records the protection level requested with PROT.
+func (conn *Conn) SetProtected(protected bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.protected = protected
+}
+
+// Protected reports whether PROT P was accepted.
+func (conn *Conn) Protected() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.protected
+}
+
+// VerifiedCertificate returns nil, there are no client certificates.
+func (conn *Conn) VerifiedCertificate() *x509.Certificate {
+	return nil
+}
+
+// ServerName returns Host.
+func (conn *Conn) ServerName() string {
+	return conn.Host
+}
+
+// dataConn is a simulated data connection. It fails once the transfer is cancelled.
+type dataConn struct {
+	ctx    context.Context
+	conn   *Conn
+	upload *bytes.Reader
+}
+
+func (c *dataConn) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.upload.Read(p)
+}
+
+func (c *dataConn) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	c.conn.mu.Lock()
+	defer c.conn.mu.Unlock()
+	return c.conn.downloaded.Write(p)
+}
+
+func (c *dataConn) Close() error {
+	return nil
+}
+
+// ConnectionFactory hands out connections queued with Dial, so a server loop can run against scripted clients.
+type ConnectionFactory struct {
+	conns  chan *Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewFactory creates a factory without queued connections.
+func NewFactory() *ConnectionFactory {
+	return &ConnectionFactory{conns: make(chan *Conn, 16), closed: make(chan struct{})}
+}
+
+// Dial queues a connection sending the command lines and returns it for inspection.
+func (fac *ConnectionFactory) Dial(commands ...string) *Conn {
+	conn := NewConn(commands...)
+	fac.conns <- conn
+	return conn
+}
+
+// Listen does nothing, the factory accepts connections right away.
+func (fac *ConnectionFactory) Listen() error {
+	return nil
+}
+
+// Close stops accepting connections.
+func (fac *ConnectionFactory) Close() error {
+	fac.once.Do(func() { close(fac.closed) })
+	return nil
+}
+
+// Accept waits for the next queued connection and assigns it the user configuration.
+func (fac *ConnectionFactory) Accept(ctx context.Context, cfg config.FTPUserConfig) (ftp.Conn, error) {
+	select {
+	case conn := <-fac.conns:
+		conn.Config = cfg
+		return conn, nil
+	case <-fac.closed:
+		return nil, errClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// progressConn adds the bytes moved over a data connection to the progress counter of the transfer.
+type progressConn struct {
+	io.ReadWriteCloser
+	counter *int64
+}
+
+func (c *progressConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddInt64(c.counter, int64(n))
+	return n, err
+}
+
+func (c *progressConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddInt64(c.counter, int64(n))
+	return n, err
+}
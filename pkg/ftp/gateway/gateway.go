@@ -0,0 +1,391 @@
+/*
+Package gateway serves the files of FTP users read-only over HTTP, e.g. for downloads in a browser.
+Users log in with Basic authentication against the same user configuration as FTP and see their home directory
+as the root of the URL space, with the same permission checks as RETR and LIST.
+Users with a one-time code are rejected, since Basic authentication cannot ask for it.
+*/
+package gateway
+
+import (
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+// badLoginDelay slows down password guessing like the delay after a failed PASS.
+const badLoginDelay = 3 * time.Second
+
+// Gateway is a http.Handler serving downloads and directory indexes of the home of the authenticated user.
+type Gateway struct {
+	// UserConfig looks up the users and their groups.
+	UserConfig config.FTPUserConfig
+	// FileSystem is shared with the FTP handler, vfs.OS by default.
+	FileSystem vfs.FileSystem
+	// HideDotfiles hides dotfiles from users without show_hidden.
+	HideDotfiles bool
+	// Template is the default template directory overlaid on homes.
+	Template string
+	// EncryptionKey decrypts the files of users without an own key. EncryptNames decrypts their names as well.
+	EncryptionKey []byte
+	EncryptNames  bool
+	// AnonymousUser serves requests without credentials as this user if set. Its password is not checked.
+	AnonymousUser string
+	// Realm is announced in Basic authentication challenges.
+	Realm string
+	// Filter restricts the client addresses.
+	Filter *ftp.AddressFilter
+	// Handler shares the canaries, alerts and download hooks of the FTP sessions, if set.
+	Handler *handler.Handler
+	// Logger receives the request logs, slog.Default() if nil.
+	Logger *slog.Logger
+}
+
+// New creates a gateway for the users of cfg.
+func New(cfg config.FTPUserConfig) *Gateway {
+	return &Gateway{UserConfig: cfg, FileSystem: vfs.OS{}, Realm: "ftpd"}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.Filter.Allows(r.RemoteAddr) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, user := g.authenticate(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\""+g.Realm+"\", charset=\"UTF-8\"")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	logger := g.logger().With("user", name, "remote", r.RemoteAddr)
+	fs, err := g.userFileSystem(user)
+	if err != nil {
+		logger.Error("ERROR WHILE PREPARING FILE SYSTEM OF USER", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	urlPath := path.Clean("/" + r.URL.Path)
+	fullPath, ok := g.resolve(user, urlPath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := fs.Stat(fullPath)
+	if err != nil {
+		respondError(w, r, logger, err)
+		return
+	}
+	group := groupOf(user)
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, strings.TrimSuffix(urlPath, "/")+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !allowsCommand(user, ftp.CommandList) || !group.CanListDir(fullPath) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		g.serveIndex(w, r, logger, fs, user, urlPath, fullPath)
+		return
+	}
+	if !allowsCommand(user, ftp.CommandRetrieveFile) || !group.CanEditFile(fullPath) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	event := handler.HookEvent{Session: ftp.ULIDGenerator{}.Generate(), User: name, RemoteAddr: r.RemoteAddr, Path: fullPath}
+	g.checkCanary(logger, event)
+	event.Size, event.Err = g.serveFile(w, r, logger, fs, info, fullPath)
+	if g.Handler != nil && g.Handler.Hooks.OnDownload != nil {
+		g.Handler.Hooks.OnDownload(event)
+	}
+}
+
+// allowsCommand checks the command lists of the user, since downloads and indexes stand in for RETR and LIST.
+func allowsCommand(user config.FTPUser, command string) bool {
+	filter, ok := user.(config.CommandFilter)
+	return !ok || filter.AllowsCommand(command)
+}
+
+func isHoneypot(user config.FTPUser) bool {
+	honeypot, ok := user.(config.Honeypot)
+	return ok && honeypot.Honeypot()
+}
+
+func requiresCode(user config.FTPUser) bool {
+	factor, ok := user.(config.SecondFactor)
+	return ok && factor.RequiresCode()
+}
+
+// checkCanary raises an alert if the downloaded path is a canary, like RETR does.
+func (g *Gateway) checkCanary(logger *slog.Logger, event handler.HookEvent) {
+	if g.Handler == nil || !g.Handler.IsCanary(event.Path) {
+		return
+	}
+	message := "CANARY " + ftp.CommandRetrieveFile + " " + event.Path + " BY USER " + event.User
+	logger.Warn("ALERT", "message", message)
+	if g.Handler.Alert != nil {
+		g.Handler.Alert(event.Session, event.User, message)
+	}
+}
+
+func (g *Gateway) logger() *slog.Logger {
+	if g.Logger != nil {
+		return g.Logger
+	}
+	return slog.Default()
+}
+
+// authenticate checks the Basic credentials of the request like PASS does, falling back to the anonymous user.
+func (g *Gateway) authenticate(r *http.Request) (string, config.FTPUser) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		if g.AnonymousUser == "" {
+			return "", nil
+		}
+		user := g.UserConfig.FindUser(g.AnonymousUser)
+		if user == nil || isHoneypot(user) || requiresCode(user) {
+			return "", nil
+		}
+		if !checkAccount(user, g.logger().With("user", g.AnonymousUser, "remote", r.RemoteAddr)) {
+			return "", nil
+		}
+		return g.AnonymousUser, user
+	}
+	logger := g.logger().With("user", name, "remote", r.RemoteAddr)
+	user := g.UserConfig.FindUser(name)
+	if user == nil || isHoneypot(user) {
+		time.Sleep(badLoginDelay)
+		logger.Warn("AUTH FAILED FOR USER")
+		return "", nil
+	}
+	if !checkAccount(user, logger) {
+		return "", nil
+	}
+	if remote, isRemote := user.(config.RemoteAuthenticator); isRemote {
+		ok = remote.AuthRemote(password, r.RemoteAddr)
+	} else {
+		ok = user.Auth(password)
+	}
+	if !ok {
+		time.Sleep(badLoginDelay)
+		logger.Warn("AUTH FAILED FOR USER")
+		return "", nil
+	}
+	if requiresCode(user) {
+		logger.Warn("LOGIN REJECTED FOR USER", "reason", "one-time code required")
+		return "", nil
+	}
+	return name, user
+}
+
+// checkAccount rejects users whose account is disabled or expired.
+func checkAccount(user config.FTPUser, logger *slog.Logger) bool {
+	if account, ok := user.(config.AccountStatus); ok {
+		if err := account.CheckAccount(time.Now()); err != nil {
+			logger.Warn("LOGIN REJECTED FOR USER", "reason", err)
+			return false
+		}
+	}
+	return true
+}
+
+// userFileSystem wraps the file system with the template and encryption of the user like a FTP login does.
+func (g *Gateway) userFileSystem(user config.FTPUser) (vfs.FileSystem, error) {
+	fs := g.FileSystem
+	template := g.Template
+	if templated, ok := user.(config.Templated); ok {
+		if userTemplate := templated.Template(); userTemplate != "" {
+			template = userTemplate
+		}
+	}
+	if template != "" {
+		fs = vfs.NewOverlay(fs, user.HomeDir(), template, user.HomeDir())
+	}
+	key := g.EncryptionKey
+	if storage, ok := user.(config.EncryptedStorage); ok {
+		if userKey := storage.EncryptionKey(); userKey != nil {
+			key = userKey
+		}
+	}
+	if key != nil {
+		return vfs.NewEncrypted(fs, key, user.HomeDir(), g.EncryptNames)
+	}
+	return fs, nil
+}
+
+// resolve maps a clean URL path into the home of the user. Hidden entries are rejected unless the user may see them.
+func (g *Gateway) resolve(user config.FTPUser, urlPath string) (string, bool) {
+	if !g.showHidden(user) {
+		for _, part := range strings.Split(urlPath, "/") {
+			if isHidden(part) {
+				return "", false
+			}
+		}
+	}
+	return filepath.Join(user.HomeDir(), filepath.FromSlash(urlPath)), true
+}
+
+func (g *Gateway) showHidden(user config.FTPUser) bool {
+	if !g.HideDotfiles {
+		return true
+	}
+	hidden, ok := user.(config.HiddenFiles)
+	return ok && hidden.ShowHidden()
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// groupOf returns the group of the user, denying everything if the user has none.
+func groupOf(user config.FTPUser) config.FTPGroup {
+	if group := user.Group(); group != nil {
+		return group
+	}
+	return config.NoPermissions
+}
+
+// serveFile sends a file. Files which can seek support range requests and conditional requests.
+// It returns the number of bytes sent and the error of a failed download for the hook.
+func (g *Gateway) serveFile(w http.ResponseWriter, r *http.Request, logger *slog.Logger, fs vfs.FileSystem, info os.FileInfo, fullPath string) (int64, error) {
+	file, err := fs.Open(fullPath)
+	if err != nil {
+		respondError(w, r, logger, err)
+		return 0, err
+	}
+	defer file.Close()
+	logger.Info("HTTP DOWNLOAD", "path", fullPath)
+	// Uploaded HTML must not run scripts with the credentials of other users of the gateway.
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		counter := &countingWriter{ResponseWriter: w}
+		http.ServeContent(counter, r, info.Name(), info.ModTime(), seeker)
+		return counter.n, nil
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(info.Name()))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		return 0, nil
+	}
+	n, err := io.Copy(w, file)
+	if err != nil {
+		logger.Warn("HTTP DOWNLOAD FAILED", "path", fullPath, "error", err)
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes of a response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// indexEntry is a row of a directory index.
+type indexEntry struct {
+	Name     string
+	Href     string
+	Size     int64
+	Modified string
+	Dir      bool
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.Modified}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// serveIndex lists a directory, directories first and sorted by name.
+func (g *Gateway) serveIndex(w http.ResponseWriter, r *http.Request, logger *slog.Logger, fs vfs.FileSystem, user config.FTPUser, urlPath, fullPath string) {
+	infos, err := fs.ReadDir(fullPath)
+	if err != nil {
+		respondError(w, r, logger, err)
+		return
+	}
+	entries := make([]indexEntry, 0, len(infos))
+	for _, info := range infos {
+		if !g.showHidden(user) && isHidden(info.Name()) {
+			continue
+		}
+		href := (&url.URL{Path: info.Name()}).String()
+		if info.IsDir() {
+			href += "/"
+		}
+		entries = append(entries, indexEntry{
+			Name:     info.Name(),
+			Href:     "./" + href,
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC().Format("2006-01-02 15:04"),
+			Dir:      info.IsDir(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Dir != entries[j].Dir {
+			return entries[i].Dir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	data := struct {
+		Path    string
+		Entries []indexEntry
+	}{strings.TrimSuffix(urlPath, "/") + "/", entries}
+	if err := indexTemplate.Execute(w, data); err != nil {
+		logger.Warn("HTTP INDEX FAILED", "path", fullPath, "error", err)
+	}
+}
+
+// respondError maps file system errors to status codes. Unexpected errors are logged, not shown.
+func respondError(w http.ResponseWriter, r *http.Request, logger *slog.Logger, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.NotFound(w, r)
+	case os.IsPermission(err):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		logger.Error("ERROR WHILE SERVING", "path", r.URL.Path, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+type testUser struct {
+	disabled bool
+}
+
+func (user *testUser) HomeDir() string           { return "/home" }
+func (user *testUser) Auth(password string) bool { return true }
+func (user *testUser) Group() config.FTPGroup    { return config.NoPermissions }
+
+func (user *testUser) CheckAccount(now time.Time) error {
+	if user.disabled {
+		return config.ErrAccountDisabled
+	}
+	return nil
+}
+
+type testUserConfig map[string]*testUser
+
+func (cfg testUserConfig) FindUser(name string) config.FTPUser {
+	if user, ok := cfg[name]; ok {
+		return user
+	}
+	return nil
+}
+
+func (cfg testUserConfig) FindGroup(name string) config.FTPGroup {
+	return nil
+}
+
+func TestAnonymousAccountStatus(t *testing.T) {
+	fs := vfs.NewMemory()
+	fs.MkdirAll("/home", 0755)
+	tests := []struct {
+		name     string
+		disabled bool
+		status   int
+	}{
+		{"enabled", false, http.StatusForbidden},
+		{"disabled", true, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		g := New(testUserConfig{"anonymous": {disabled: test.disabled}})
+		g.FileSystem = fs
+		g.AnonymousUser = "anonymous"
+		recorder := httptest.NewRecorder()
+		g.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s anonymous user got status %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// lowestDataPort is the lowest port active mode connections may target, protecting privileged services (RFC 2577).
+const lowestDataPort = 1024
+
+// allowsDataAddress checks an active mode target and responds with 504 if it is not allowed.
+// Unless AllowFXP is set, the target must be the address of the client, so the server cannot be abused for bounce attacks.
+func (state *HandlerState) allowsDataAddress(hostport string) bool {
+	reason := state.checkDataAddress(hostport)
+	if reason == "" {
+		return true
+	}
+	state.conn.Log("REJECTED", reason, hostport)
+	state.conn.RespondText(ftp.StatusNotImplementedParam, "Data address not allowed")
+	return false
+}
+
+// checkDataAddress returns the reason an active mode target is rejected, or an empty string.
+func (state *HandlerState) checkDataAddress(hostport string) string {
+	host, rawPort, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "INVALID DATA ADDRESS"
+	}
+	if port, err := strconv.Atoi(rawPort); err != nil || port < lowestDataPort {
+		return "PRIVILEGED DATA PORT"
+	}
+	if !state.src.ClientFilter.Allows(host) {
+		return "DATA ADDRESS NOT ALLOWED"
+	}
+	if state.src.AllowFXP {
+		return ""
+	}
+	remote, _, err := net.SplitHostPort(state.conn.GetRemoteAddr())
+	if err != nil || !net.ParseIP(host).Equal(net.ParseIP(remote)) {
+		return "FOREIGN DATA ADDRESS"
+	}
+	return ""
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+// checkAccount rejects disabled or expired accounts, telling the client why the login failed.
+func checkAccount(state *HandlerState, user config.FTPUser) bool {
+	account, ok := user.(config.AccountStatus)
+	if !ok {
+		return true
+	}
+	err := account.CheckAccount(time.Now())
+	if err == nil {
+		return true
+	}
+	state.conn.Log("LOGIN REJECTED FOR USER", state.selectedUser, "REASON", err)
+	state.conn.RespondText(ftp.StatusNotLoggedIn, "Not logged in, "+err.Error())
+	return false
+}
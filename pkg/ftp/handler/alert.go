@@ -0,0 +1,18 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AlertFunc is called for security relevant events such as honeypot activity.
+type AlertFunc func(id, user, message string)
+
+// alert logs a security event and forwards it to the configured AlertFunc.
+func (state *HandlerState) alert(params ...interface{}) {
+	message := strings.TrimSpace(fmt.Sprintln(params...))
+	state.conn.Log("ALERT", message)
+	if state.src.Alert != nil {
+		state.src.Alert(state.conn.GetID(), state.selectedUser, message)
+	}
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// fileActions maps commands touching the file system to the action recorded in the audit log.
+var fileActions = map[string]string{
+	ftp.CommandRetrieveFile:     "download",
+	ftp.CommandStoreFile:        "upload",
+	ftp.CommandAppendFile:       "append",
+	ftp.CommandDelete:           "delete",
+	ftp.CommandMakeDirectory:    "mkdir",
+	ftp.CommandRemoveDirectory:  "rmdir",
+	ftp.CommandRenameTo:         "rename",
+	ftp.CommandHash:             "hash",
+	ftp.CommandSHA256:           "hash",
+	ftp.CommandFileSize:         "stat",
+	ftp.CommandModificationTime: "stat",
+}
+
+// AuditRecord describes a command of a session and its outcome.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session"`
+	User      string    `json:"user,omitempty"`
+	RemoteIP  string    `json:"remote_ip"`
+	Command   string    `json:"command"`
+	Arguments string    `json:"arguments,omitempty"`
+	Status    int       `json:"status"`
+	Duration  float64   `json:"duration_ms"`
+	Action    string    `json:"action,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	From      string    `json:"from,omitempty"`
+}
+
+// AuditFunc is called once a command has been answered.
+type AuditFunc func(record AuditRecord)
+
+// NewAuditLog creates an AuditFunc writing each record as a line of JSON.
+func NewAuditLog(w io.Writer) AuditFunc {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+	return func(record AuditRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		encoder.Encode(record)
+	}
+}
+
+// beginAudit records the request and returns a function completing the record once the command is answered.
+// Secret arguments are redacted and paths are resolved before the command changes the working directory.
+func (state *HandlerState) beginAudit(cmd *Command) func() {
+	record := AuditRecord{
+		Time:      cmd.ReceivedAt,
+		Session:   state.conn.GetID(),
+		RemoteIP:  state.conn.GetRemoteAddr(),
+		Command:   cmd.Verb,
+		Arguments: ftp.RedactArguments(cmd.Verb, cmd.Arg),
+		Action:    fileActions[cmd.Verb],
+	}
+	// Requests are audited before the login is checked, paths are only known once a user is logged in.
+	if record.Action != "" && state.user != nil {
+		record.Path, _ = state.relativePath(cmd.Path())
+	}
+	if host, _, err := net.SplitHostPort(record.RemoteIP); err == nil {
+		record.RemoteIP = host
+	}
+	if cmd.Verb == ftp.CommandRenameTo {
+		record.From = state.renameFrom
+	}
+	state.replies.last = 0
+	return func() {
+		record.Status = state.replies.last
+		record.Duration = float64(time.Since(record.Time).Microseconds()) / 1000
+		if record.User = state.conn.GetUser(); record.User == "" {
+			record.User = state.selectedUser
+		}
+		state.src.Audit(record)
+	}
+}
+
+// statusConn remembers the status of the last reply sent on a connection.
+type statusConn struct {
+	ftp.Conn
+	last int
+}
+
+func (conn *statusConn) Respond(status int, params ...interface{}) error {
+	conn.last = status
+	return conn.Conn.Respond(status, params...)
+}
+
+func (conn *statusConn) RespondText(status int, message string) error {
+	conn.last = status
+	return conn.Conn.RespondText(status, message)
+}
+
+// Write records the status of raw replies.
+func (conn *statusConn) Write(buffer []byte) (int, error) {
+	if len(buffer) >= 3 {
+		if status, err := strconv.Atoi(string(buffer[:3])); err == nil {
+			conn.last = status
+		}
+	}
+	return conn.Conn.Write(buffer)
+}
+
+// Send records the final reply of the transfer, which the connection sends itself.
+func (conn *statusConn) Send(ctx context.Context, source io.Reader) bool {
+	return conn.transferred(conn.Conn.Send(ctx, source))
+}
+
+func (conn *statusConn) Receive(ctx context.Context, sink io.Writer) bool {
+	return conn.transferred(conn.Conn.Receive(ctx, sink))
+}
+
+func (conn *statusConn) transferred(ok bool) bool {
+	conn.last = ftp.StatusTransferAbort
+	if ok {
+		conn.last = ftp.StatusTransferDone
+	}
+	return ok
+}
@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bannerTimeFormat is the format of the {time} placeholder.
+const bannerTimeFormat = "2006-01-02 15:04:05 MST"
+
+// expandBanner replaces the placeholders {hostname}, {time} and {connections} of a banner.
+func (h *Handler) expandBanner(banner string) string {
+	if !strings.Contains(banner, "{") {
+		return banner
+	}
+	hostname, _ := os.Hostname()
+	return strings.NewReplacer(
+		"{hostname}", hostname,
+		"{time}", time.Now().Format(bannerTimeFormat),
+		"{connections}", strconv.FormatInt(atomic.LoadInt64(&h.stats.sessionsActive), 10),
+	).Replace(banner)
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"io"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// chunkWriter buffers writes into a pooled chunk and passes full chunks on to the underlying writer.
+// The tuner only ever doubles and halves its chunk size, so few sizes are in use.
+type chunkWriter struct {
+	w     io.Writer
+	chunk *[]byte
+	n     int
+	err   error
+}
+
+func newChunkWriter(w io.Writer, size int) *chunkWriter {
+	return &chunkWriter{w: w, chunk: ftp.GetBuffer(size)}
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if cw.err != nil {
+			return written, cw.err
+		}
+		n := copy((*cw.chunk)[cw.n:], p)
+		cw.n += n
+		p = p[n:]
+		written += n
+		if cw.n == len(*cw.chunk) {
+			cw.Flush()
+		}
+	}
+	return written, cw.err
+}
+
+// Flush writes the buffered data to the underlying writer.
+func (cw *chunkWriter) Flush() error {
+	if cw.err != nil || cw.n == 0 {
+		return cw.err
+	}
+	n, err := cw.w.Write((*cw.chunk)[:cw.n])
+	if err == nil && n < cw.n {
+		err = io.ErrShortWrite
+	}
+	cw.n = 0
+	cw.err = err
+	return err
+}
+
+// Release returns the chunk to the pool, unflushed data is discarded.
+func (cw *chunkWriter) Release() {
+	if cw.chunk != nil {
+		ftp.PutBuffer(cw.chunk)
+		cw.chunk = nil
+	}
+}
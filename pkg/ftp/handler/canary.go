@@ -0,0 +1,21 @@
+package handler
+
+import "path/filepath"
+
+// IsCanary checks if a path matches one of the configured canary patterns.
+// Servers of other protocols sharing the file system use it to raise the same alerts as FTP sessions.
+func (h *Handler) IsCanary(path string) bool {
+	for _, pattern := range h.Canaries {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCanary raises an alert if the accessed path is a canary.
+func (state *HandlerState) checkCanary(action, path string) {
+	if state.src.IsCanary(path) {
+		state.alert("CANARY", action, path, "BY USER", state.selectedUser)
+	}
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+const (
+	checksumStoreSidecar  = "sidecar"
+	checksumStoreXattr    = "xattr"
+	checksumSidecarSuffix = ".sha256"
+)
+
+// checksumEntry is a cached digest of a file at a specific size and modification time.
+type checksumEntry struct {
+	sum     string
+	size    int64
+	modTime time.Time
+}
+
+type checksumKey struct {
+	fs   vfs.FileSystem
+	path string
+}
+
+// checksumCache remembers SHA-256 digests computed while files were streamed through the server.
+type checksumCache struct {
+	mu      sync.Mutex
+	entries map[checksumKey]checksumEntry
+}
+
+func newChecksumCache() *checksumCache {
+	return &checksumCache{entries: make(map[checksumKey]checksumEntry)}
+}
+
+// Store records the digest computed by h for the file at path and persists it using the given store.
+func (c *checksumCache) Store(fs vfs.FileSystem, path string, h hash.Hash, store string) error {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	entry := checksumEntry{hex.EncodeToString(h.Sum(nil)), info.Size(), info.ModTime()}
+	c.mu.Lock()
+	c.entries[checksumKey{fs, path}] = entry
+	c.mu.Unlock()
+	if _, local := fs.(vfs.OS); !local {
+		return nil
+	}
+	switch store {
+	case checksumStoreSidecar:
+		return writeChecksumSidecar(path, entry.sum)
+	case checksumStoreXattr:
+		return setChecksumXattr(path, entry)
+	}
+	return nil
+}
+
+// Invalidate forgets the digest of a file changed without computing a new one, e.g. by APPE.
+// The next Lookup computes the digest from the file again.
+func (c *checksumCache) Invalidate(fs vfs.FileSystem, path string, store string) error {
+	c.mu.Lock()
+	delete(c.entries, checksumKey{fs, path})
+	c.mu.Unlock()
+	if _, local := fs.(vfs.OS); !local {
+		return nil
+	}
+	switch store {
+	case checksumStoreSidecar:
+		if err := os.Remove(path + checksumSidecarSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	case checksumStoreXattr:
+		return removeChecksumXattr(path)
+	}
+	return nil
+}
+
+// Lookup returns the cached or persisted digest of path, computing it if the file changed.
+func (c *checksumCache) Lookup(fs vfs.FileSystem, path string, store string) (string, error) {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[checksumKey{fs, path}]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.sum, nil
+	}
+	if _, local := fs.(vfs.OS); local {
+		if sum, ok := readPersistedChecksum(path, info, store); ok {
+			return sum, nil
+		}
+	}
+	file, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	c.Store(fs, path, h, store)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeChecksumSidecar stores the digest next to the file in the format of sha256sum.
+func writeChecksumSidecar(path, sum string) error {
+	return ioutil.WriteFile(path+checksumSidecarSuffix, []byte(sum+"  "+filepath.Base(path)+"\n"), 0644)
+}
+
+// readPersistedChecksum reads a digest from a sidecar file or extended attribute if it is still valid.
+func readPersistedChecksum(path string, info os.FileInfo, store string) (string, bool) {
+	switch store {
+	case checksumStoreSidecar:
+		sidecar, err := os.Stat(path + checksumSidecarSuffix)
+		if err != nil || sidecar.ModTime().Before(info.ModTime()) {
+			return "", false
+		}
+		content, err := ioutil.ReadFile(path + checksumSidecarSuffix)
+		if err != nil {
+			return "", false
+		}
+		fields := strings.Fields(string(content))
+		if len(fields) < 1 {
+			return "", false
+		}
+		return fields[0], true
+	case checksumStoreXattr:
+		entry, err := getChecksumXattr(path)
+		if err != nil || entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+			return "", false
+		}
+		return entry.sum, true
+	}
+	return "", false
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const checksumXattrName = "user.sha256"
+
+// setChecksumXattr attaches the digest, size and modification time to the file as an extended attribute.
+func setChecksumXattr(path string, entry checksumEntry) error {
+	value := entry.sum + " " + strconv.FormatInt(entry.size, 10) + " " + strconv.FormatInt(entry.modTime.UnixNano(), 10)
+	return unix.Setxattr(path, checksumXattrName, []byte(value), 0)
+}
+
+// removeChecksumXattr removes a digest stored by setChecksumXattr. A missing attribute is not an error.
+func removeChecksumXattr(path string) error {
+	if err := unix.Removexattr(path, checksumXattrName); err != nil && err != unix.ENODATA {
+		return err
+	}
+	return nil
+}
+
+// getChecksumXattr reads a digest stored by setChecksumXattr.
+func getChecksumXattr(path string) (checksumEntry, error) {
+	buffer := make([]byte, 128)
+	n, err := unix.Getxattr(path, checksumXattrName, buffer)
+	if err != nil {
+		return checksumEntry{}, err
+	}
+	fields := strings.Fields(string(buffer[:n]))
+	if len(fields) != 3 {
+		return checksumEntry{}, errors.New("malformed checksum attribute")
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return checksumEntry{}, err
+	}
+	modTime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return checksumEntry{}, err
+	}
+	return checksumEntry{fields[0], size, time.Unix(0, modTime)}, nil
+}
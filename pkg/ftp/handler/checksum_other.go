@@ -0,0 +1,19 @@
+//go:build !linux
+
+package handler
+
+import "errors"
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+func setChecksumXattr(path string, entry checksumEntry) error {
+	return errXattrUnsupported
+}
+
+func getChecksumXattr(path string) (checksumEntry, error) {
+	return checksumEntry{}, errXattrUnsupported
+}
+
+func removeChecksumXattr(path string) error {
+	return errXattrUnsupported
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/parser"
+)
+
+// Command is a request of a client, parsed once before it is handled.
+type Command struct {
+	// Verb is the upper-case name of the command, e.g. "RETR".
+	Verb string
+	// Arg is the argument as sent by the client. It may contain spaces, e.g. in paths.
+	Arg string
+	// Args are the whitespace separated fields of Arg, for commands taking several arguments.
+	Args []string
+	// Raw is the request line without line ending.
+	Raw string
+	// ReceivedAt is the time the request was received.
+	ReceivedAt time.Time
+	// Session is the ID of the session which sent the command.
+	Session string
+}
+
+// pathCommands take a path as argument, which is kept verbatim since file names may start or end with spaces.
+var pathCommands = map[string]bool{
+	ftp.CommandChangeDirectory:  true,
+	ftp.CommandModificationTime: true,
+	ftp.CommandFileSize:         true,
+	ftp.CommandStoreFile:        true,
+	ftp.CommandAppendFile:       true,
+	ftp.CommandRenameFrom:       true,
+	ftp.CommandRenameTo:         true,
+	ftp.CommandDelete:           true,
+	ftp.CommandMakeDirectory:    true,
+	ftp.CommandRemoveDirectory:  true,
+	ftp.CommandRetrieveFile:     true,
+	ftp.CommandHash:             true,
+	ftp.CommandSHA256:           true,
+	ftp.CommandStatus:           true,
+}
+
+// parseCommand splits a request line into the verb and the rest of the line as argument, as described in RFC 959.
+// Surrounding whitespace is trimmed from arguments other than paths.
+func parseCommand(raw string, session string, receivedAt time.Time) *Command {
+	verb, arg := parser.SplitCommand(raw)
+	if !pathCommands[verb] {
+		arg = strings.TrimSpace(arg)
+	}
+	return &Command{
+		Verb:       verb,
+		Arg:        arg,
+		Args:       strings.Fields(arg),
+		Raw:        raw,
+		ReceivedAt: receivedAt,
+		Session:    session,
+	}
+}
+
+// subcommand parses the argument of a command like SITE into a command of its own.
+func (cmd *Command) subcommand() *Command {
+	sub := parseCommand(cmd.Arg, cmd.Session, cmd.ReceivedAt)
+	sub.Raw = cmd.Raw
+	return sub
+}
+
+// Path returns the argument as path. A path may be enclosed in double quotes with embedded quotes doubled,
+// the way 257 replies quote paths.
+func (cmd *Command) Path() string {
+	return parser.UnquotePath(cmd.Arg)
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// commandAbuseDuration is the time a session may be throttled without pause before it is considered abusive.
+const commandAbuseDuration = 10 * time.Second
+
+// throttleCommand delays the session once it exceeds CommandRate commands per second.
+// Sessions which keep sending commands although being throttled are ended with 421.
+func (state *HandlerState) throttleCommand(ctx context.Context) bool {
+	if state.commandLimit == nil {
+		return true
+	}
+	delay := state.commandLimit.reserve(1)
+	if delay == 0 {
+		state.throttledSince = time.Time{}
+		return true
+	}
+	if state.throttledSince.IsZero() {
+		state.throttledSince = time.Now()
+	} else if time.Since(state.throttledSince) > commandAbuseDuration {
+		state.conn.Log("COMMAND RATE EXCEEDED")
+		state.conn.RespondText(ftp.StatusServiceUnavailable, "Too many commands, closing control connection")
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
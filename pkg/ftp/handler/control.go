@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// transferCommands use the data connection set up by PASV or PORT before.
+var transferCommands = map[string]bool{
+	ftp.CommandRetrieveFile: true,
+	ftp.CommandStoreFile:    true,
+	ftp.CommandAppendFile:   true,
+	ftp.CommandList:         true,
+	ftp.CommandListRaw:      true,
+}
+
+// controlLine is a command line read from the control connection.
+type controlLine struct {
+	raw string
+	err error
+}
+
+// controlReader reads commands from the control connection on a goroutine of its own,
+// so commands sent during a data transfer are seen while it runs.
+// At most one read is in flight, so nothing is read past a command which changes the connection like AUTH TLS.
+type controlReader struct {
+	conn    ftp.Conn
+	pending chan controlLine
+	queued  []controlLine
+}
+
+// next returns the channel delivering the next line, starting a read unless one is in flight.
+func (r *controlReader) next() <-chan controlLine {
+	if r.pending == nil {
+		pending := make(chan controlLine, 1)
+		go func() {
+			raw, err := r.conn.ReadCommand()
+			pending <- controlLine{raw, err}
+		}()
+		r.pending = pending
+	}
+	return r.pending
+}
+
+// read waits for the next command. Commands queued during a transfer come first.
+func (r *controlReader) read() (string, error) {
+	if len(r.queued) > 0 {
+		line := r.queued[0]
+		r.queued = r.queued[1:]
+		return line.raw, line.err
+	}
+	line := <-r.next()
+	r.pending = nil
+	return line.raw, line.err
+}
+
+// watchTransfer handles commands sent while a transfer runs, until the returned function is called after it.
+// ABOR cancels the transfer and STAT reports its progress, as described in RFC 959.
+// Other commands, including QUIT, are queued and run once the transfer is done.
+func (state *HandlerState) watchTransfer(ctx context.Context, transferred func() int64) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	control := state.control
+	done := make(chan struct{})
+	aborted := false
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			var line controlLine
+			select {
+			case <-done:
+				return
+			case line = <-control.next():
+				control.pending = nil
+			}
+			if line.err != nil {
+				control.queued = append(control.queued, line)
+				return
+			}
+			cmd := parseCommand(line.raw, control.conn.GetID(), time.Now())
+			switch cmd.Verb {
+			case ftp.CommandAbort:
+				control.conn.Log("REQUEST", cmd.Verb, cmd.Arg)
+				aborted = true
+				cancel()
+			case ftp.CommandStatus:
+				control.conn.Log("REQUEST", cmd.Verb, cmd.Arg)
+				control.conn.RespondText(ftp.StatusSystemInfo, "Transfer in progress, "+strconv.FormatInt(transferred(), 10)+" bytes transferred")
+			default:
+				control.queued = append(control.queued, line)
+			}
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		wg.Wait()
+		cancel()
+		if aborted {
+			control.conn.Respond(ftp.StatusTransferDone)
+		}
+	}
+}
+
+// handleCommandAbort closes a data connection set up for a transfer. Running transfers are aborted by watchTransfer.
+func handleCommandAbort(ctx context.Context, state *HandlerState, cmd *Command) {
+	state.conn.Reset()
+	state.conn.Respond(ftp.StatusTransferDone)
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"sync/atomic"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// Activity of a session, used to tell idle sessions from sessions running a command.
+const (
+	sessionIdle int32 = iota
+	sessionBusy
+	sessionClosing
+)
+
+// begin marks the session as running a command. It fails if the session is being closed by Drain.
+func (state *HandlerState) begin() bool {
+	return atomic.CompareAndSwapInt32(&state.activity, sessionIdle, sessionBusy)
+}
+
+// end marks the session as idle again.
+func (state *HandlerState) end() {
+	atomic.CompareAndSwapInt32(&state.activity, sessionBusy, sessionIdle)
+}
+
+// Drain ends all idle sessions with 421 and lets running commands, including data transfers,
+// finish before their sessions are ended as well. New sessions are rejected.
+func (h *Handler) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+	h.sessions.mu.Lock()
+	states := make([]*HandlerState, 0, len(h.sessions.sessions))
+	for _, state := range h.sessions.sessions {
+		states = append(states, state)
+	}
+	h.sessions.mu.Unlock()
+	atomic.StoreInt64(&h.stats.sessionsDrained, int64(len(states)))
+	for _, state := range states {
+		if atomic.CompareAndSwapInt32(&state.activity, sessionIdle, sessionClosing) {
+			state.conn.Respond(ftp.StatusServiceUnavailable)
+			state.conn.Close()
+		}
+	}
+}
+
+// Draining reports whether the handler is draining its sessions.
+func (h *Handler) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+// useEncryption wraps the session file system with encryption if a server or user key is configured.
+// User keys take precedence over the server key.
+func (state *HandlerState) useEncryption(user config.FTPUser) error {
+	key := state.src.EncryptionKey
+	if storage, ok := user.(config.EncryptedStorage); ok {
+		if userKey := storage.EncryptionKey(); userKey != nil {
+			key = userKey
+		}
+	}
+	if key == nil {
+		return nil
+	}
+	fs, err := vfs.NewEncrypted(state.fs, key, user.HomeDir(), state.src.EncryptNames)
+	if err != nil {
+		return err
+	}
+	state.fs = fs
+	return nil
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// errorReplies maps filesystem errors to the status and text sent to the client.
+// More specific errors come first, e.g. ENOTEMPTY also matches os.ErrExist.
+var errorReplies = []struct {
+	err    error
+	status int
+	text   string
+}{
+	{syscall.ENOSPC, ftp.StatusInsufficientSpace, "No space left on device"},
+	{syscall.EDQUOT, ftp.StatusInsufficientSpaceAbort, "Disk quota exceeded"},
+	{syscall.ENAMETOOLONG, ftp.StatusInvalidName, "File name too long"},
+	{syscall.ENOTEMPTY, ftp.StatusFileUnavailable, "Directory not empty"},
+	{syscall.EISDIR, ftp.StatusFileUnavailable, "Is a directory"},
+	{syscall.ENOTDIR, ftp.StatusFileUnavailable, "Not a directory"},
+	{syscall.EROFS, ftp.StatusFileUnavailable, "Read-only file system"},
+	{os.ErrNotExist, ftp.StatusFileUnavailable, "No such file or directory"},
+	{os.ErrPermission, ftp.StatusFileUnavailable, "Permission denied"},
+	{os.ErrExist, ftp.StatusFileUnavailable, "File exists"},
+}
+
+// respondError answers a failed filesystem operation with the status matching its error,
+// so clients can tell a missing file from a full disk. Other errors are answered with 450.
+func respondError(conn ftp.Conn, err error) {
+	for _, reply := range errorReplies {
+		if errors.Is(err, reply.err) {
+			conn.RespondText(reply.status, reply.text)
+			return
+		}
+	}
+	conn.Respond(ftp.StatusActionNotTaken)
+}
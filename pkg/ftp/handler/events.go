@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// eventQueueSize is the number of events waiting for publication before new ones are dropped.
+const eventQueueSize = 1024
+
+// defaultEventHost replaces the host name in topics of sessions without virtual host.
+const defaultEventHost = "default"
+
+// Publisher sends messages to a topic of a message queue such as NATS or Kafka.
+type Publisher interface {
+	Publish(topic string, message []byte) error
+}
+
+// EventStream publishes completed uploads, downloads and deletes as JSON to a message queue.
+// Topic is the name of the topic, in which {host} is replaced with the virtual host of the session
+// and {event} with the kind of event, e.g. "ftp.{host}.{event}".
+type EventStream struct {
+	Publisher Publisher
+	Topic     string
+	queue     chan eventMessage
+}
+
+type eventMessage struct {
+	topic string
+	body  []byte
+}
+
+// NewEventStream creates an event stream and starts publishing its events in the background.
+func NewEventStream(publisher Publisher, topic string) *EventStream {
+	s := &EventStream{
+		Publisher: publisher,
+		Topic:     topic,
+		queue:     make(chan eventMessage, eventQueueSize),
+	}
+	go s.publish()
+	return s
+}
+
+// Hooks returns the hooks publishing events to the stream.
+func (s *EventStream) Hooks() Hooks {
+	return Hooks{
+		OnUpload:   s.hook("upload"),
+		OnDownload: s.hook("download"),
+		OnDelete:   s.hook("delete"),
+	}
+}
+
+// hook creates a hook queueing successful events without blocking the session.
+func (s *EventStream) hook(name string) func(HookEvent) {
+	return func(event HookEvent) {
+		if event.Err != nil {
+			return
+		}
+		body, err := json.Marshal(newEvent(name, event))
+		if err != nil {
+			return
+		}
+		select {
+		case s.queue <- eventMessage{s.topic(event.Host, name), body}:
+		default:
+			log.Println("EVENT QUEUE FULL, DROPPED EVENT", name, event.Path)
+		}
+	}
+}
+
+// topic expands the topic template for an event.
+func (s *EventStream) topic(host, event string) string {
+	if host == "" {
+		host = defaultEventHost
+	}
+	return strings.NewReplacer("{host}", host, "{event}", event).Replace(s.Topic)
+}
+
+func (s *EventStream) publish() {
+	for message := range s.queue {
+		if err := s.Publisher.Publish(message.topic, message.body); err != nil {
+			log.Println("ERROR", err, "WHILE PUBLISHING EVENT TO", message.topic)
+		}
+	}
+}
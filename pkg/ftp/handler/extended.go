@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/parser"
+)
+
+// isIPv6 reports whether the control connection uses IPv6. IPv4-mapped addresses count as IPv4.
+func (state *HandlerState) isIPv6() bool {
+	host, _, err := net.SplitHostPort(state.conn.GetLocalAddr())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// allowsLegacyDataCommand rejects PASV and PORT on IPv6 connections and after EPSV ALL.
+func (state *HandlerState) allowsLegacyDataCommand(message string) bool {
+	if state.epsvOnly {
+		state.conn.RespondText(ftp.StatusBadSequence, "Only EPSV is allowed after EPSV ALL")
+		return false
+	}
+	if state.isIPv6() {
+		state.conn.RespondText(ftp.StatusNetworkProtocol, message)
+		return false
+	}
+	return true
+}
+
+// handleCommandExtendedPassive opens a passive data connection on the address of the control connection as described in RFC 2428.
+func handleCommandExtendedPassive(ctx context.Context, state *HandlerState, cmd *Command) {
+	switch strings.ToUpper(cmd.Arg) {
+	case "":
+	case "ALL":
+		state.epsvOnly = true
+		state.conn.Respond(ftp.StatusOK, "EPSV ALL accepted")
+		return
+	case parser.ProtocolIPv4, parser.ProtocolIPv6:
+		if (cmd.Arg == parser.ProtocolIPv6) != state.isIPv6() {
+			state.conn.Respond(ftp.StatusNetworkProtocol)
+			return
+		}
+	default:
+		state.conn.Respond(ftp.StatusNetworkProtocol)
+		return
+	}
+	host, _, err := net.SplitHostPort(state.conn.GetLocalAddr())
+	if err != nil {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	state.conn.Reset()
+	state.conn.SetPassive(host)
+	port, err := state.conn.GetPassivePort()
+	if err != nil {
+		state.conn.Reset()
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	state.conn.Respond(ftp.StatusExtendedPassive, port)
+}
+
+// handleCommandExtendedPort connects to an IPv4 or IPv6 data address given as |proto|addr|port|.
+func handleCommandExtendedPort(ctx context.Context, state *HandlerState, cmd *Command) {
+	if state.epsvOnly {
+		state.conn.RespondText(ftp.StatusBadSequence, "Only EPSV is allowed after EPSV ALL")
+		return
+	}
+	hostport, err := parser.ParseExtendedAddress(cmd.Arg)
+	if errors.Is(err, parser.ErrNetworkProtocol) {
+		state.conn.Respond(ftp.StatusNetworkProtocol)
+		return
+	}
+	if err != nil {
+		state.conn.Respond(ftp.StatusSyntaxParamError)
+		return
+	}
+	if !state.allowsDataAddress(hostport) {
+		return
+	}
+	state.conn.Reset()
+	state.conn.SetActive(hostport)
+	state.conn.Respond(ftp.StatusOK, "EPRT command successful")
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+// lastLoginFormat is the format of the {last_login} placeholder.
+const lastLoginFormat = "2006-01-02 15:04:05 MST"
+
+// lastLogins remembers the time of the last login of every user since the server started.
+type lastLogins struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+func newLastLogins() *lastLogins {
+	return &lastLogins{times: make(map[string]time.Time)}
+}
+
+// swap records a login and returns the time of the previous one.
+func (l *lastLogins) swap(name string, now time.Time) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	previous, ok := l.times[name]
+	l.times[name] = now
+	return previous, ok
+}
+
+// greet confirms the login with the greeting of the user or the standard message.
+// The placeholders {user}, {home} and {last_login} of the greeting are replaced.
+func (state *HandlerState) greet(user config.FTPUser, status int) {
+	previous, seen := state.src.lastLogins.swap(state.selectedUser, time.Now())
+	greeter, ok := user.(config.Greeter)
+	if !ok || greeter.Greeting() == "" {
+		state.conn.Respond(status)
+		return
+	}
+	lastLogin := "never"
+	if seen {
+		lastLogin = previous.Format(lastLoginFormat)
+	}
+	message := strings.NewReplacer(
+		"{user}", state.selectedUser,
+		"{home}", user.HomeDir(),
+		"{last_login}", lastLogin,
+	).Replace(greeter.Greeting())
+	state.conn.RespondText(status, message)
+}
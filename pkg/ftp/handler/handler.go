@@ -1,164 +1,470 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/lnsp/ftpd/pkg/ftp"
 	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/parser"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
 )
 
-var transferTypes = map[rune]string{
-	'A': "ASCII",
-	'E': "EBCDIC",
-	'I': "BINARY",
-	'L': "LOCAL FORMAT",
-	'N': "NON PRINT",
-	'T': "TELNET",
-	'C': "ASA CARRIAGE CONTROL",
-}
-
 const (
 	modTimeFormat       = "20060102150405"
 	defaultTransferType = "AN"
-	transferBufferSize  = 4096
 	badLoginDelay       = 3 * time.Second
 )
 
-type HandleFunc func(*HandlerState, string)
+// HandleFunc handles a command of a session.
+type HandleFunc func(context.Context, *HandlerState, *Command)
 
-func handleCommandUser(state *HandlerState, cmdData string) {
-	if user := state.cfg.FindUser(cmdData); user != nil {
+func handleCommandUser(ctx context.Context, state *HandlerState, cmd *Command) {
+	state.pendingUser = nil
+	if user := state.cfg.FindUser(cmd.Arg); user != nil {
+		state.selectedUser = cmd.Arg
+		if !checkAccount(state, user) {
+			return
+		}
+		if authenticateCertificate(state, user) {
+			state.conn.Log("CERTIFICATE AUTH SUCCESS FOR USER", state.selectedUser)
+			login(state, user, ftp.StatusCertificateLogin)
+			return
+		}
 		state.conn.Respond(ftp.StatusNeedPassword)
-		state.selectedUser = cmdData
 	} else {
 		state.conn.Respond(ftp.StatusNotLoggedIn)
 	}
 }
 
-func handleCommandPassword(state *HandlerState, cmdData string) {
+func handleCommandPassword(ctx context.Context, state *HandlerState, cmd *Command) {
 	if user := state.cfg.FindUser(state.selectedUser); user != nil {
-		if user.Auth(cmdData) {
-			state.conn.Respond(ftp.StatusAuthenticated)
-			state.conn.ChangeUser(state.selectedUser)
-			state.conn.ChangeDir(user.HomeDir())
-			state.conn.Log("AUTH SUCCESS FOR USER", state.selectedUser)
+		if !checkAccount(state, user) {
+			return
+		}
+		if isHoneypot(user) {
+			enterHoneypot(state, user)
+		} else if authenticate(state, user, cmd.Arg) {
+			if requiresCode(user) {
+				state.pendingUser = user
+				state.conn.Respond(ftp.StatusNeedAccount)
+				return
+			}
+			login(state, user, ftp.StatusAuthenticated)
+		} else if authenticateWithCode(state, user, cmd.Arg) {
+			login(state, user, ftp.StatusAuthenticated)
 		} else {
 			state.conn.Log("AUTH FAILED FOR USER", state.selectedUser)
 			time.Sleep(badLoginDelay)
 			state.conn.Respond(ftp.StatusNotLoggedIn)
+			state.runHook(state.src.Hooks.OnLogin, "", 0, errLoginFailed)
 		}
 	} else {
 		state.conn.Respond(ftp.StatusNeedAccount)
 	}
 }
 
-func handleCommandSystemType(state *HandlerState, cmdData string) {
-	state.conn.Respond(ftp.StatusSystemType, state.src.SystemName, encodeTransferType(defaultTransferType))
+// login sets up the session of an authenticated user and confirms the login with status.
+func login(state *HandlerState, user config.FTPUser, status int) {
+	created, err := state.createHome(user)
+	if err != nil {
+		state.conn.Log("ERROR", err, "WHILE CREATING HOME OF USER", state.selectedUser)
+		state.conn.Respond(ftp.StatusLocalError)
+		state.runHook(state.src.Hooks.OnLogin, user.HomeDir(), 0, err)
+		return
+	}
+	if err := state.useOwner(user, created); err != nil {
+		state.conn.Log("ERROR", err, "WHILE CHANGING OWNER FOR USER", state.selectedUser)
+		state.conn.Respond(ftp.StatusLocalError)
+		state.runHook(state.src.Hooks.OnLogin, user.HomeDir(), 0, err)
+		return
+	}
+	state.useTemplate(user)
+	if err := state.useEncryption(user); err != nil {
+		state.conn.Log("ERROR", err, "WHILE ENABLING ENCRYPTION FOR USER", state.selectedUser)
+		state.conn.Respond(ftp.StatusLocalError)
+		state.runHook(state.src.Hooks.OnLogin, user.HomeDir(), 0, err)
+		return
+	}
+	if created && state.src.HomeSkeleton != "" {
+		if err := copySkeleton(state.fs, state.src.HomeSkeleton, user.HomeDir(), state.src.HomeMode); err != nil {
+			state.conn.Log("ERROR", err, "WHILE COPYING SKELETON TO HOME OF USER", state.selectedUser)
+		}
+	}
+	state.useRateLimits(user)
+	state.user = user
+	state.account.Store(state.selectedUser)
+	state.greet(user, status)
+	state.conn.ChangeUser(state.selectedUser)
+	state.conn.ChangeDir(user.HomeDir())
+	state.conn.Log("AUTH SUCCESS FOR USER", state.selectedUser)
+	state.runHook(state.src.Hooks.OnLogin, user.HomeDir(), 0, nil)
+}
+
+// authenticate checks the password, passing the client address to users that need it.
+func authenticate(state *HandlerState, user config.FTPUser, password string) bool {
+	if remote, ok := user.(config.RemoteAuthenticator); ok {
+		return remote.AuthRemote(password, state.conn.GetRemoteAddr())
+	}
+	return user.Auth(password)
+}
+
+func handleCommandSystemType(ctx context.Context, state *HandlerState, cmd *Command) {
+	name, systemType := state.src.systemType()
+	state.conn.Respond(ftp.StatusSystemType, name, systemType)
 }
 
-func handleCommandPrintDirectory(state *HandlerState, cmdData string) {
-	user := state.cfg.FindUser(state.selectedUser)
+func handleCommandPrintDirectory(ctx context.Context, state *HandlerState, cmd *Command) {
 	dir := state.conn.GetDir()
-	if !user.Group().CanListDir(dir) {
+	if !state.group().CanListDir(dir) {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	state.conn.Respond(ftp.StatusWorkingDirectory, dir)
+	state.conn.Respond(ftp.StatusWorkingDirectory, parser.QuotePath(dir))
 }
 
-func handleCommandChangeDirectory(state *HandlerState, cmdData string) {
-	path, ok := state.conn.GetRelativePath(cmdData)
+func handleCommandChangeDirectory(ctx context.Context, state *HandlerState, cmd *Command) {
+	path, ok := state.resolvePath(cmd.Path())
 	if !ok {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
+	if !state.group().CanListDir(path) {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
 	state.conn.ChangeDir(path)
-	state.conn.Respond(ftp.StatusWorkingDirectory, state.conn.GetDir())
+	state.conn.RespondText(ftp.StatusActionDone, "Directory changed to \""+parser.QuotePath(state.conn.GetDir())+"\"")
 }
 
-func handleCommandDataType(state *HandlerState, cmdData string) {
-	encodedType := encodeTransferType(cmdData)
-	if encodedType == "INVALID" {
+func handleCommandDataType(ctx context.Context, state *HandlerState, cmd *Command) {
+	code, description, err := parser.ParseTransferType(cmd.Arg)
+	if err != nil {
 		state.conn.Respond(ftp.StatusSyntaxParamError)
 		return
 	}
-	state.conn.ChangeTransferType(cmdData)
-	state.conn.Respond(ftp.StatusOK, "TYPE set to "+encodedType)
+	state.conn.ChangeTransferType(code)
+	state.conn.Respond(ftp.StatusOK, "TYPE set to "+description)
 }
 
-func handleCommandModificationTime(state *HandlerState, cmdData string) {
-	path, ok := state.conn.GetRelativePath(cmdData)
+func handleCommandModificationTime(ctx context.Context, state *HandlerState, cmd *Command) {
+	path, ok := state.resolvePath(cmd.Path())
 	if !ok {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	info, err := os.Stat(path)
-	if err != nil {
+	if !state.group().CanListDir(filepath.Dir(path)) {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
+	info, err := state.fs.Stat(path)
+	if err != nil {
+		respondError(state.conn, err)
+		return
+	}
 	state.conn.Respond(ftp.StatusFileInfo, info.ModTime().Format(modTimeFormat))
 }
 
-func handleCommandFileSize(state *HandlerState, cmdData string) {
-	path, ok := state.conn.GetRelativePath(cmdData)
+func handleCommandFileSize(ctx context.Context, state *HandlerState, cmd *Command) {
+	path, ok := state.resolvePath(cmd.Path())
 	if !ok {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	info, err := os.Stat(path)
-	if err != nil {
+	if !state.group().CanListDir(filepath.Dir(path)) {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
+	info, err := state.fs.Stat(path)
+	if err != nil {
+		respondError(state.conn, err)
+		return
+	}
 	state.conn.Respond(ftp.StatusFileInfo, strconv.FormatInt(info.Size(), 10))
 }
 
-func handleCommandRetrieveFile(state *HandlerState, cmdData string) {
-	path, ok := state.conn.GetRelativePath(cmdData)
+func handleCommandRetrieveFile(ctx context.Context, state *HandlerState, cmd *Command) {
+	path, ok := state.resolvePath(cmd.Path())
+	if !ok {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	if !state.group().CanEditFile(path) {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	state.checkCanary(ftp.CommandRetrieveFile, path)
+	file, err := openSequential(state.fs, path)
+	if err != nil {
+		respondError(state.conn, err)
+		return
+	}
+	defer file.Close()
+	var (
+		n    int64
+		sent bool
+		size int64 = -1
+	)
+	if info, err := state.fs.Stat(path); err == nil {
+		size = info.Size()
+	}
+	if local, ok := file.(*os.File); ok && isBinaryType(state.conn.GetTransferType()) {
+		n, sent = state.send(ctx, local, size)
+	} else {
+		reader := newReadAheadReader(file, state.tuner)
+		defer reader.Close()
+		n, sent = state.send(ctx, reader, size)
+	}
+	state.runHook(state.src.Hooks.OnDownload, path, n, transferError(sent))
+}
+
+func handleCommandStoreFile(ctx context.Context, state *HandlerState, cmd *Command) {
+	storeFile(ctx, state, cmd.Path(), os.O_TRUNC)
+}
+
+func handleCommandAppendFile(ctx context.Context, state *HandlerState, cmd *Command) {
+	storeFile(ctx, state, cmd.Path(), os.O_APPEND)
+}
+
+// storeFile receives data from the client and writes it to the target file opened with the given mode flag.
+func storeFile(ctx context.Context, state *HandlerState, name string, flag int) {
+	path, ok := state.resolvePath(name)
+	if !ok {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	if !state.group().CanCreateFile(path) {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	if !state.group().AllowsName(filepath.Base(path)) {
+		state.conn.Respond(ftp.StatusInvalidName)
+		return
+	}
+	file, err := state.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, state.fileMode())
+	if err != nil {
+		respondError(state.conn, err)
+		return
+	}
+	defer file.Close()
+	writer := newTunedWriter(file, state.tuner)
+	defer writer.Release()
+	checksum := sha256.New()
+	n, ok := state.receive(ctx, io.MultiWriter(writer, checksum))
+	if !ok {
+		state.runHook(state.src.Hooks.OnUpload, path, n, errTransferAborted)
+		return
+	}
+	if err := writer.Flush(); err != nil {
+		state.conn.Log("ERROR", err, "WHILE FLUSHING", path)
+		state.runHook(state.src.Hooks.OnUpload, path, n, err)
+		return
+	}
+	if hook := state.src.Hooks.OnUpload; hook != nil {
+		event := state.hookEvent(path, n, nil)
+		if flag&os.O_TRUNC != 0 {
+			event.SHA256 = hex.EncodeToString(checksum.Sum(nil))
+		}
+		hook(event)
+	}
+	if flag&os.O_TRUNC != 0 {
+		if err := state.src.checksums.Store(state.fs, path, checksum, state.src.ChecksumStore); err != nil {
+			state.conn.Log("ERROR", err, "WHILE STORING CHECKSUM OF", path)
+		}
+	} else if err := state.src.checksums.Invalidate(state.fs, path, state.src.ChecksumStore); err != nil {
+		state.conn.Log("ERROR", err, "WHILE INVALIDATING CHECKSUM OF", path)
+	}
+}
+
+func handleCommandRenameFrom(ctx context.Context, state *HandlerState, cmd *Command) {
+	path, ok := state.resolvePath(cmd.Path())
+	if !ok {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	if !state.group().CanEditFile(path) {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	if _, err := state.fs.Stat(path); err != nil {
+		respondError(state.conn, err)
+		return
+	}
+	state.renameFrom = path
+	state.conn.Respond(ftp.StatusNeedMoreInfo)
+}
+
+func handleCommandRenameTo(ctx context.Context, state *HandlerState, cmd *Command) {
+	from := state.renameFrom
+	state.renameFrom = ""
+	if from == "" {
+		state.conn.Respond(ftp.StatusBadSequence)
+		return
+	}
+	path, ok := state.resolvePath(cmd.Path())
 	if !ok {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	buffer, err := ioutil.ReadFile(path)
+	if !state.group().CanCreateFile(path) {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	if !state.group().AllowsName(filepath.Base(path)) {
+		state.conn.Respond(ftp.StatusInvalidName)
+		return
+	}
+	err := state.fs.Rename(from, path)
 	if err != nil {
+		respondError(state.conn, err)
+	} else {
+		state.conn.Respond(ftp.StatusActionDone)
+	}
+	if hook := state.src.Hooks.OnRename; hook != nil {
+		event := state.hookEvent(path, 0, err)
+		event.From = from
+		hook(event)
+	}
+}
+
+func handleCommandDelete(ctx context.Context, state *HandlerState, cmd *Command) {
+	path, ok := state.resolvePath(cmd.Path())
+	if !ok {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	if !state.group().CanDeleteFile(path) {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	state.conn.Send(buffer)
+	state.checkCanary(ftp.CommandDelete, path)
+	info, err := state.fs.Stat(path)
+	if err != nil {
+		respondError(state.conn, err)
+		return
+	}
+	if info.IsDir() {
+		respondError(state.conn, syscall.EISDIR)
+		return
+	}
+	if err := state.fs.Remove(path); err != nil {
+		respondError(state.conn, err)
+		state.runHook(state.src.Hooks.OnDelete, path, 0, err)
+		return
+	}
+	state.conn.Respond(ftp.StatusActionDone)
+	state.runHook(state.src.Hooks.OnDelete, path, info.Size(), nil)
 }
 
-func handleCommandStoreFile(state *HandlerState, cmdData string) {
-	path, ok := state.conn.GetRelativePath(cmdData)
+func handleCommandMakeDirectory(ctx context.Context, state *HandlerState, cmd *Command) {
+	path, ok := state.resolvePath(cmd.Path())
 	if !ok {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	user := state.cfg.FindUser(state.selectedUser)
-	if !user.Group().CanCreateFile(path) {
+	if !state.group().CanCreateDir(path) {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	data, success := state.conn.Receive()
-	if !success {
+	if !state.group().AllowsName(filepath.Base(path)) {
+		state.conn.Respond(ftp.StatusInvalidName)
+		return
+	}
+	if err := state.fs.Mkdir(path, state.dirMode()); err != nil {
+		respondError(state.conn, err)
+		return
+	}
+	state.conn.RespondText(ftp.StatusWorkingDirectory, "\""+parser.QuotePath(path)+"\" created")
+}
+
+func handleCommandRemoveDirectory(ctx context.Context, state *HandlerState, cmd *Command) {
+	path, ok := state.resolvePath(cmd.Path())
+	if !ok || path == filepath.Clean(state.user.HomeDir()) {
+		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+	if !state.group().CanDeleteDir(path) {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
+	state.checkCanary(ftp.CommandRemoveDirectory, path)
+	info, err := state.fs.Stat(path)
+	if err != nil {
+		respondError(state.conn, err)
+		return
+	}
+	if !info.IsDir() {
+		respondError(state.conn, syscall.ENOTDIR)
+		return
+	}
+	if err := state.fs.Remove(path); err != nil {
+		respondError(state.conn, err)
+		return
+	}
+	state.conn.Respond(ftp.StatusActionDone)
+}
+
+func handleCommandHash(ctx context.Context, state *HandlerState, cmd *Command) {
+	info, sum, ok := lookupChecksum(state, cmd.Path())
+	if !ok {
+		return
+	}
+	state.conn.Respond(ftp.StatusFileInfo, fmt.Sprintf("SHA-256 0-%d %s %s", info.Size(), sum, cmd.Arg))
+}
+
+func handleCommandSHA256(ctx context.Context, state *HandlerState, cmd *Command) {
+	_, sum, ok := lookupChecksum(state, cmd.Path())
+	if !ok {
+		return
+	}
+	state.conn.Respond(ftp.StatusFileInfo, sum)
+}
+
+// lookupChecksum resolves a file and returns its SHA-256 digest, responding with an error if that fails.
+func lookupChecksum(state *HandlerState, name string) (os.FileInfo, string, bool) {
+	path, ok := state.resolvePath(name)
+	if !ok {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return nil, "", false
+	}
+	if !state.group().CanListDir(filepath.Dir(path)) {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return nil, "", false
+	}
+	info, err := state.fs.Stat(path)
+	if err != nil {
+		respondError(state.conn, err)
+		return nil, "", false
+	}
+	if !info.Mode().IsRegular() {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return nil, "", false
+	}
+	sum, err := state.src.checksums.Lookup(state.fs, path, state.src.ChecksumStore)
+	if err != nil {
+		state.conn.Respond(ftp.StatusLocalError)
+		return nil, "", false
+	}
+	return info, sum, true
 }
 
-func handleCommandPassiveMode(state *HandlerState, cmdData string) {
+func handleCommandPassiveMode(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !state.allowsLegacyDataCommand("PASV not supported on IPv6 connections, use EPSV") {
+		return
+	}
 	state.conn.Reset()
 	state.conn.SetPassive(state.src.PassiveServerHost)
 	port, err := state.conn.GetPassivePort()
@@ -167,41 +473,56 @@ func handleCommandPassiveMode(state *HandlerState, cmdData string) {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	hostport := ftp.GenerateHost(fmt.Sprintf("%s:%d", state.src.PassiveServerHost, port))
+	hostport, err := parser.FormatHostPort(state.advertisedHost(), port)
+	if err != nil {
+		state.conn.Log("PASSIVE ADDRESS INVALID", state.advertisedHost(), err)
+		state.conn.Reset()
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
 	state.conn.Respond(ftp.StatusPassiveMode, hostport)
 }
 
-func handleCommandPort(state *HandlerState, cmdData string) {
+func handleCommandPort(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !state.allowsLegacyDataCommand("PORT not supported on IPv6 connections, use EPRT") {
+		return
+	}
+	host, err := parser.ParseHostPort(cmd.Arg)
+	if err != nil {
+		state.conn.Respond(ftp.StatusSyntaxParamError)
+		return
+	}
+	if !state.allowsDataAddress(host) {
+		return
+	}
 	state.conn.Reset()
-	state.conn.SetActive(ftp.ParseHost(cmdData))
+	state.conn.SetActive(host)
 	state.conn.Respond(ftp.StatusOK, "PORT Command successfull")
 }
 
-func handleCommandListRaw(state *HandlerState, cmdData string) {
-	user := state.cfg.FindUser(state.selectedUser)
-	if !user.Group().CanListDir(state.conn.GetDir()) {
+func handleCommandListRaw(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !state.group().CanListDir(state.conn.GetDir()) {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
-	cmd := exec.Command("/bin/ls", "-1", state.conn.GetDir())
-	output, err := cmd.Output()
+	output, err := buildNameListing(state.fs, state.conn.GetDir(), state.showHidden())
 	if err != nil {
-		state.conn.Log("ERROR", err, "WHILE RUNNING", cmd)
+		state.conn.Log("ERROR", err, "WHILE RUNNING NAME LISTING")
 		state.conn.Respond(ftp.StatusLocalError)
 		return
 	}
-	state.conn.Send(encodeText(output, state.conn.GetTransferType()))
+	listing := encodeText(output, state.conn.GetTransferType())
+	state.send(ctx, bytes.NewReader(listing), int64(len(listing)))
 }
 
-func handleCommandList(state *HandlerState, cmdData string) {
-	user := state.cfg.FindUser(state.selectedUser)
-	if !user.Group().CanListDir(state.conn.GetDir()) {
+func handleCommandList(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !state.group().CanListDir(state.conn.GetDir()) {
 		state.conn.Respond(ftp.StatusActionNotTaken)
 		return
 	}
 	var buffer []byte
 	if state.src.EnableEPLF {
-		output, err := buildEPLFListing(state.conn.GetDir())
+		output, err := buildEPLFListing(state.fs, state.conn.GetDir(), state.showHidden())
 		if err != nil {
 			state.conn.Log("ERROR", err, "WHILE RUNNING EPLF LISTING")
 			state.conn.Respond(ftp.StatusLocalError)
@@ -209,26 +530,49 @@ func handleCommandList(state *HandlerState, cmdData string) {
 		}
 		buffer = output
 	} else {
-		cmd := exec.Command("/bin/ls", "-l", state.conn.GetDir())
-		output, err := cmd.Output()
+		output, err := buildListing(state.fs, state.conn.GetDir(), state.showHidden())
 		if err != nil {
-			state.conn.Log("ERROR", err, "WHILE RUNNING", cmd)
+			state.conn.Log("ERROR", err, "WHILE RUNNING LISTING")
 			state.conn.Respond(ftp.StatusLocalError)
 			return
 		}
 		buffer = encodeText(output, state.conn.GetTransferType())
 	}
-	state.conn.Send(buffer)
+	state.send(ctx, bytes.NewReader(buffer), int64(len(buffer)))
+}
+
+func handleCommandQuit(ctx context.Context, state *HandlerState, cmd *Command) {
+	state.conn.Respond(ftp.StatusCloseConnection)
+	state.keepAlive = false
+}
+
+func handleCommandNoop(ctx context.Context, state *HandlerState, cmd *Command) {
+	state.conn.Respond(ftp.StatusOK, "NOOP ok")
+}
+
+// handleCommandTransferMode accepts the stream mode, the only mode implemented.
+func handleCommandTransferMode(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !strings.EqualFold(cmd.Arg, "S") {
+		state.conn.Respond(ftp.StatusNotImplementedParam)
+		return
+	}
+	state.conn.Respond(ftp.StatusOK, "MODE set to S")
 }
 
-func handleCommandQuit(state *HandlerState, cmdData string) {
-	state.conn.Respond(ftp.StatusOK, "Connection closing")
+// handleCommandFileStructure accepts the file structure, the only structure implemented.
+func handleCommandFileStructure(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !strings.EqualFold(cmd.Arg, "F") {
+		state.conn.Respond(ftp.StatusNotImplementedParam)
+		return
+	}
+	state.conn.Respond(ftp.StatusOK, "STRU set to F")
 }
 
 var (
 	defaultCommandHandlers = map[string]HandleFunc{
 		ftp.CommandUser:             handleCommandUser,
 		ftp.CommandPassword:         handleCommandPassword,
+		ftp.CommandAccount:          handleCommandAccount,
 		ftp.CommandSystemType:       handleCommandSystemType,
 		ftp.CommandPrintDirectory:   handleCommandPrintDirectory,
 		ftp.CommandChangeDirectory:  handleCommandChangeDirectory,
@@ -237,11 +581,43 @@ var (
 		ftp.CommandFileSize:         handleCommandFileSize,
 		ftp.CommandRetrieveFile:     handleCommandRetrieveFile,
 		ftp.CommandStoreFile:        handleCommandStoreFile,
+		ftp.CommandAppendFile:       handleCommandAppendFile,
+		ftp.CommandRenameFrom:       handleCommandRenameFrom,
+		ftp.CommandRenameTo:         handleCommandRenameTo,
+		ftp.CommandDelete:           handleCommandDelete,
+		ftp.CommandMakeDirectory:    handleCommandMakeDirectory,
+		ftp.CommandRemoveDirectory:  handleCommandRemoveDirectory,
 		ftp.CommandPassiveMode:      handleCommandPassiveMode,
 		ftp.CommandPort:             handleCommandPort,
+		ftp.CommandExtendedPassive:  handleCommandExtendedPassive,
+		ftp.CommandExtendedPort:     handleCommandExtendedPort,
 		ftp.CommandListRaw:          handleCommandListRaw,
 		ftp.CommandList:             handleCommandList,
+		ftp.CommandHash:             handleCommandHash,
+		ftp.CommandSHA256:           handleCommandSHA256,
+		ftp.CommandSite:             handleCommandSite,
 		ftp.CommandQuit:             handleCommandQuit,
+		ftp.CommandAuth:             handleCommandAuth,
+		ftp.CommandProtectionBuffer: handleCommandProtectionBuffer,
+		ftp.CommandProtectionLevel:  handleCommandProtectionLevel,
+		ftp.CommandHost:             handleCommandHost,
+		ftp.CommandStatus:           handleCommandStatus,
+		ftp.CommandAbort:            handleCommandAbort,
+		ftp.CommandNoop:             handleCommandNoop,
+		ftp.CommandTransferMode:     handleCommandTransferMode,
+		ftp.CommandFileStructure:    handleCommandFileStructure,
+	}
+
+	// preLoginCommands may be used before logging in.
+	preLoginCommands = map[string]bool{
+		ftp.CommandUser:             true,
+		ftp.CommandPassword:         true,
+		ftp.CommandAccount:          true,
+		ftp.CommandAuth:             true,
+		ftp.CommandProtectionBuffer: true,
+		ftp.CommandProtectionLevel:  true,
+		ftp.CommandHost:             true,
+		ftp.CommandQuit:             true,
 	}
 )
 
@@ -252,60 +628,298 @@ func New(name, systemName, motd string, userCfg config.FTPUserConfig, enableEPLF
 		UserConfig:        userCfg,
 		SystemName:        systemName,
 		MOTD:              motd,
+		FileSystem:        vfs.OS{},
 		cmdHandlers:       defaultCommandHandlers,
+		siteHandlers:      defaultSiteHandlers,
+		storageTuners:     newBufferTuners(),
+		checksums:         newChecksumCache(),
+		rateLimits:        newRateLimits(),
+		sessions:          newSessionRegistry(),
+		lastLogins:        newLastLogins(),
+		HomeMode:          defaultHomeMode,
+		FileMode:          defaultFileMode,
+		DirMode:           defaultDirMode,
+		stats:             &handlerStats{},
 	}
 }
 
 type Handler struct {
-	EnableEPLF        bool
-	PassiveServerHost string
-	SystemName        string
-	MOTD              string
-	UserConfig        config.FTPUserConfig
-	cmdHandlers       map[string]HandleFunc
+	EnableEPLF         bool
+	HideDotfiles       bool
+	PassiveServerHost  string
+	PassivePublicHost  string
+	SystemName         string
+	SystemType         string
+	MOTD               string
+	Stealth            bool
+	Strict             bool
+	UserConfig         config.FTPUserConfig
+	FileSystem         vfs.FileSystem
+	Alert              AlertFunc
+	Audit              AuditFunc
+	Hooks              Hooks
+	ProgressInterval   time.Duration
+	TraceUsers         []string
+	Canaries           []string
+	ChecksumStore      string
+	EncryptionKey      []byte
+	EncryptNames       bool
+	Template           string
+	CreateHomes        bool
+	HomeMode           os.FileMode
+	HomeSkeleton       string
+	FileMode           os.FileMode
+	DirMode            os.FileMode
+	CommandTimeout     time.Duration
+	IdleTimeout        time.Duration
+	ClientFilter       *ftp.AddressFilter
+	CommandRate        int64
+	BandwidthLimit     int64
+	AllowFXP           bool
+	TransferBufferSize int
+	VirtualHosts       map[string]*VirtualHost
+	TLSConfig          *tls.Config
+	middleware         []Middleware
+	cmdHandlers        map[string]HandleFunc
+	siteHandlers       map[string]HandleFunc
+	maintenance        int32
+	draining           int32
+	stats              *handlerStats
+	storageTuners      *bufferTuners
+	checksums          *checksumCache
+	rateLimits         *rateLimits
+	sessions           *sessionRegistry
+	lastLogins         *lastLogins
 }
 
 type HandlerState struct {
-	src          *Handler
-	conn         ftp.Conn
-	cfg          config.FTPUserConfig
-	keepAlive    bool
-	selectedUser string
+	src            *Handler
+	conn           ftp.Conn
+	cfg            config.FTPUserConfig
+	fs             vfs.FileSystem
+	tuner          *bufferTuner
+	keepAlive      bool
+	honeypot       bool
+	secure         bool
+	selectedUser   string
+	user           config.FTPUser
+	account        atomic.Value
+	pendingUser    config.FTPUser
+	renameFrom     string
+	lastCommand    string
+	tempDirs       []string
+	activity       int32
+	epsvOnly       bool
+	uploadLimit    *tokenBucket
+	downloadLimit  *tokenBucket
+	commandLimit   *tokenBucket
+	throttledSince time.Time
+	vhost          *VirtualHost
+	host           string
+	tracing        bool
+	replies        *statusConn
+	control        *controlReader
+	stats          sessionStats
+}
+
+// showHidden reports whether dotfiles are visible to the active user.
+func (state *HandlerState) showHidden() bool {
+	if !state.src.HideDotfiles {
+		return true
+	}
+	hidden, ok := state.user.(config.HiddenFiles)
+	return ok && hidden.ShowHidden()
+}
+
+// group returns the group of the active user, denying everything if the user has none.
+func (state *HandlerState) group() config.FTPGroup {
+	if group := state.user.Group(); group != nil {
+		return group
+	}
+	state.conn.Log("ERROR", "NO GROUP FOR USER", state.selectedUser)
+	return config.NoPermissions
+}
+
+// allowsCommand reports whether the logged in user may run the command.
+// Commands needed to log in or out are always allowed.
+func (state *HandlerState) allowsCommand(cmdName string) bool {
+	if state.user == nil || preLoginCommands[cmdName] {
+		return true
+	}
+	filter, ok := state.user.(config.CommandFilter)
+	return !ok || filter.AllowsCommand(cmdName)
+}
+
+// relativePath resolves a client supplied path against the working directory
+// and reports false if it leaves the home directory of the logged in user.
+// The home is taken from the session, as users of virtual hosts are unknown to the configuration of the connection.
+func (state *HandlerState) relativePath(p string) (string, bool) {
+	dir := state.conn.GetDir()
+	if state.user == nil {
+		return dir, false
+	}
+	path := p
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(state.user.HomeDir(), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return dir, false
+	}
+	return path, true
+}
+
+// resolvePath resolves a client supplied path and rejects hidden entries the user may not see.
+func (state *HandlerState) resolvePath(p string) (string, bool) {
+	path, ok := state.relativePath(p)
+	if !ok || state.showHidden() {
+		return path, ok
+	}
+	rel, err := filepath.Rel(state.user.HomeDir(), path)
+	if err != nil {
+		return state.conn.GetDir(), false
+	}
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if isHidden(name) {
+			return state.conn.GetDir(), false
+		}
+	}
+	return path, true
 }
 
-func (h *Handler) Handle(conn ftp.Conn) {
+// Handle serves a session until the client quits or the context is cancelled.
+func (h *Handler) Handle(ctx context.Context, conn ftp.Conn) {
 	defer conn.Close()
+	stop := context.AfterFunc(ctx, conn.Close)
+	defer stop()
 
 	state := &HandlerState{
-		h, conn, h.UserConfig, true, "",
+		src:       h,
+		conn:      conn,
+		cfg:       h.UserConfig,
+		fs:        h.FileSystem,
+		tuner:     h.storageTuners.get(h.FileSystem, h.transferBufferSize()),
+		keepAlive: true,
+		secure:    conn.Secure(),
+		stats:     sessionStats{connected: time.Now()},
+		control:   &controlReader{conn: conn},
+	}
+	if h.Audit != nil {
+		state.replies = &statusConn{Conn: conn}
+		state.conn = state.replies
+	}
+	if h.CommandRate > 0 {
+		state.commandLimit = newTokenBucket(h.CommandRate)
 	}
-	conn.Respond(ftp.StatusServiceReady, h.MOTD)
+	defer state.removeTempDirs()
+	defer state.logSessionClosed()
+	h.sessions.add(state)
+	defer h.sessions.remove(state)
+	atomic.AddInt64(&h.stats.sessionsTotal, 1)
+	atomic.AddInt64(&h.stats.sessionsActive, 1)
+	defer atomic.AddInt64(&h.stats.sessionsActive, -1)
+	if h.Draining() {
+		conn.Respond(ftp.StatusServiceUnavailable)
+		return
+	}
+	state.useServerName()
+	conn.RespondText(ftp.StatusServiceReady, state.banner())
 	for state.keepAlive {
-		rawRequest, err := conn.ReadCommand()
+		rawRequest, err := state.readCommand()
+		if errors.Is(err, ftp.ErrMalformedCommand) {
+			conn.Log("MALFORMED COMMAND REJECTED")
+			conn.Respond(ftp.StatusSyntaxError)
+			continue
+		}
+		if errors.Is(err, ftp.ErrCommandTooLong) {
+			conn.Log("COMMAND TOO LONG REJECTED")
+			conn.RespondText(ftp.StatusSyntaxError, "Command line too long")
+			return
+		}
 		if err != nil {
 			return
 		}
-		cmdTokens := strings.Split(rawRequest, " ")
-		if len(cmdTokens) < 1 {
-			conn.Respond(ftp.StatusSyntaxError)
-			continue
+		if !state.throttleCommand(ctx) {
+			return
+		}
+		if !state.begin() {
+			return
 		}
-		cmdName := strings.ToUpper(cmdTokens[0])
-		cmdData := strings.Join(cmdTokens[1:], " ")
+		h.dispatch(ctx, state, rawRequest)
+		state.end()
+		if state.keepAlive && h.Draining() {
+			conn.Respond(ftp.StatusServiceUnavailable)
+			return
+		}
+	}
+}
 
-		conn.Log("REQUEST", cmdName, cmdData)
+// dispatch parses a request and runs it through the middleware to its command handler.
+func (h *Handler) dispatch(ctx context.Context, state *HandlerState, rawRequest string) {
+	conn := state.conn
+	cmd := parseCommand(rawRequest, conn.GetID(), time.Now())
 
-		if conn.GetUser() == "" && cmdName != ftp.CommandUser && cmdName != ftp.CommandPassword {
-			conn.Respond(ftp.StatusNeedAccount)
-			continue
+	conn.Log("REQUEST", cmd.Verb, cmd.Arg)
+	// A failing command handler must not take down the other sessions, so the session is closed instead.
+	defer func() {
+		if r := recover(); r != nil {
+			conn.Log("PANIC", r, "WHILE HANDLING", cmd.Verb)
+			conn.Respond(ftp.StatusLocalError)
+			state.keepAlive = false
 		}
-		cmdHandler, ok := h.cmdHandlers[cmdName]
-		if !ok {
-			conn.Respond(ftp.StatusNotImplemented)
-			continue
+	}()
+	if h.Audit != nil {
+		defer state.beginAudit(cmd)()
+	}
+	if state.honeypot {
+		state.alert("HONEYPOT COMMAND", cmd.Verb, ftp.RedactArguments(cmd.Verb, cmd.Arg))
+	}
+
+	h.chain()(ctx, state, cmd)
+}
+
+// route checks whether the command of the session may run and runs its command handler.
+// The context of the command expires after CommandTimeout if it is set.
+func (h *Handler) route(ctx context.Context, state *HandlerState, cmd *Command) {
+	conn := state.conn
+	cmdName := cmd.Verb
+	previousCommand := state.lastCommand
+	state.lastCommand = cmdName
+	if h.Strict {
+		if status, ok := state.checkStrict(previousCommand, cmd); !ok {
+			conn.Respond(status)
+			return
 		}
-		cmdHandler(state, cmdData)
 	}
+	if conn.GetUser() == "" && !preLoginCommands[cmdName] {
+		conn.Respond(ftp.StatusNeedAccount)
+		return
+	}
+	cmdHandler, ok := h.cmdHandlers[cmdName]
+	if !ok {
+		conn.Respond(ftp.StatusNotImplemented)
+		return
+	}
+	if !state.allowsCommand(cmdName) {
+		conn.Log("COMMAND DENIED", cmdName)
+		conn.Respond(ftp.StatusFileUnavailable)
+		return
+	}
+	if writeCommands[cmdName] && h.InMaintenance() {
+		respondMaintenance(conn)
+		return
+	}
+	if transferCommands[cmdName] && !conn.HasDataConn() {
+		conn.RespondText(ftp.StatusTransferFailed, "Use PORT or PASV first")
+		return
+	}
+	if h.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.CommandTimeout)
+		defer cancel()
+	}
+	cmdHandler(ctx, state, cmd)
 }
 
 // encodeText converts strings with UNIX style lines to the FTP standard.
@@ -313,57 +927,12 @@ func encodeText(text []byte, mode string) []byte {
 	return []byte(strings.Replace(string(text), "\n", "\r\n", -1))
 }
 
-// encodeTransferType generates a string representation of a transfer type code.
-// e.g. "AN" -> "ASCII Non Print"
-func encodeTransferType(tt string) string {
-	var (
-		baseMode, extMode string
-		found             bool
-		modeRunes         = []rune(tt)
-	)
-	if baseMode, found = transferTypes[modeRunes[0]]; !found {
-		return "INVALID"
-	}
-	if len(modeRunes) == 2 {
-		if extMode, found = transferTypes[modeRunes[1]]; !found {
-			return "INVALID"
-		}
-	} else {
-		extMode = transferTypes['N']
-	}
-	return fmt.Sprintf("%s %s", baseMode, extMode)
+// isBinaryType checks if a transfer type code transfers data without conversion.
+func isBinaryType(tt string) bool {
+	return strings.HasPrefix(tt, "I") || strings.HasPrefix(tt, "L")
 }
 
-// buildEPLFListing generates a file listing.
-func buildEPLFListing(dir string) ([]byte, error) {
-	if runtime.GOOS == "windows" {
-		panic("EPLF listing does not work on Windows")
-	}
-	// This IS DIRTY. Does not work on Windows.
-	// TODO: REWORK THIS METHOD
-	output := ""
-	directory, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return []byte{}, err
-	}
-	for _, info := range directory {
-		if !info.Mode().IsDir() && !info.Mode().IsRegular() {
-			continue
-		}
-		output += "+"
-		var stat syscall.Stat_t
-		err = syscall.Stat(filepath.Join(dir, info.Name()), &stat)
-		if err != nil {
-			return []byte{}, err
-		}
-		output += "i" + strconv.FormatInt(int64(stat.Dev), 10) + "." + strconv.FormatUint(stat.Ino, 10) + ","
-		output += "m" + strconv.FormatInt(info.ModTime().Unix(), 10) + ","
-		if info.Mode().IsRegular() {
-			output += "s" + strconv.FormatInt(info.Size(), 10) + ",r,"
-		} else {
-			output += "/,"
-		}
-		output += "\x09" + info.Name() + "\x0d\x0a"
-	}
-	return []byte(output), nil
+// isHidden checks if a file name denotes a dotfile.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
 }
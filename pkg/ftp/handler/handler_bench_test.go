@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/ftptest"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testHome         = "/home"
+	testUser         = "test"
+	benchLargeFile   = 32 << 20
+	benchSmallFile   = 4 << 10
+	benchListEntries = 10000
+)
+
+// newTestConfig creates a configuration with a single user whose password is its name.
+func newTestConfig(tb testing.TB, name, home string) config.FTPUserConfig {
+	tb.Helper()
+	hasher := config.PasswordHasher
+	config.PasswordHasher = config.BcryptHasher{Cost: bcrypt.MinCost}
+	defer func() { config.PasswordHasher = hasher }()
+	cfg, err := config.NewSingleUserConfig(name, name, home)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cfg
+}
+
+// newTestHandler creates a handler serving a single user from an in-memory file system populated by setup.
+func newTestHandler(tb testing.TB, setup func(fs *vfs.Memory)) *Handler {
+	tb.Helper()
+	cfg := newTestConfig(tb, testUser, testHome)
+	fs := vfs.NewMemory()
+	fs.MkdirAll(testHome, 0755)
+	if setup != nil {
+		setup(fs)
+	}
+	h := New("127.0.0.1", "UNIX", "ftpd test", cfg, false)
+	h.FileSystem = fs
+	return h
+}
+
+// newSession creates a connection which logs in as the test user and sends the command lines.
+func newSession(commands ...string) *ftptest.Conn {
+	return ftptest.NewConn(append([]string{"USER " + testUser, "PASS " + testUser}, commands...)...)
+}
+
+// serve runs the session of the connection until its commands are used up.
+// Like ftptest.ConnectionFactory, it assigns the user configuration of the handler to the connection.
+func serve(h *Handler, conn *ftptest.Conn) *ftptest.Conn {
+	conn.Config = h.UserConfig
+	h.Handle(context.Background(), conn)
+	return conn
+}
+
+// expectTransfers fails unless n transfers completed.
+func expectTransfers(tb testing.TB, conn *ftptest.Conn, n int) {
+	tb.Helper()
+	done := 0
+	for _, status := range conn.Statuses() {
+		if status == ftp.StatusTransferDone {
+			done++
+		}
+	}
+	if done != n {
+		tb.Fatalf("%d of %d transfers completed, last reply %v, log %q", done, n, conn.LastReply(), conn.Logs())
+	}
+}
+
+// BenchmarkRetrLargeFile downloads a large file in binary mode, one session per download.
+func BenchmarkRetrLargeFile(b *testing.B) {
+	h := newTestHandler(b, func(fs *vfs.Memory) {
+		fs.WriteFile(testHome+"/large.bin", make([]byte, benchLargeFile), 0644)
+	})
+	b.SetBytes(benchLargeFile)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn := serve(h, newSession("TYPE I", "PASV", "RETR large.bin"))
+		expectTransfers(b, conn, 1)
+	}
+}
+
+// BenchmarkStorManySmallFiles uploads small files in a single session, one per iteration.
+func BenchmarkStorManySmallFiles(b *testing.B) {
+	h := newTestHandler(b, nil)
+	conn := newSession("TYPE I")
+	conn.SetUpload(make([]byte, benchSmallFile))
+	for i := 0; i < b.N; i++ {
+		conn.Push("PASV", "STOR small-"+strconv.Itoa(i))
+	}
+	b.SetBytes(benchSmallFile)
+	b.ReportAllocs()
+	b.ResetTimer()
+	serve(h, conn)
+	b.StopTimer()
+	expectTransfers(b, conn, b.N)
+}
+
+// BenchmarkList10kEntries lists a directory of 10000 files in a single session, once per iteration.
+func BenchmarkList10kEntries(b *testing.B) {
+	h := newTestHandler(b, func(fs *vfs.Memory) {
+		fs.MkdirAll(testHome+"/many", 0755)
+		for i := 0; i < benchListEntries; i++ {
+			fs.WriteFile(testHome+"/many/file-"+strconv.Itoa(i), nil, 0644)
+		}
+	})
+	conn := newSession("CWD many")
+	for i := 0; i < b.N; i++ {
+		conn.Push("PASV", "LIST")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	serve(h, conn)
+	b.StopTimer()
+	expectTransfers(b, conn, b.N)
+}
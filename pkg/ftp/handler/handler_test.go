@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/ftptest"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+// expectStatuses fails unless the session replied with the status codes in order.
+func expectStatuses(t *testing.T, conn *ftptest.Conn, statuses ...int) {
+	t.Helper()
+	got := conn.Statuses()
+	if len(got) != len(statuses) {
+		t.Fatalf("replies %v, want statuses %v", conn.Replies(), statuses)
+	}
+	for i := range statuses {
+		if got[i] != statuses[i] {
+			t.Fatalf("replies %v, want statuses %v", conn.Replies(), statuses)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	h := newTestHandler(t, nil)
+	tests := []struct {
+		name     string
+		commands []string
+		statuses []int
+	}{
+		{"valid password", []string{"USER " + testUser, "PASS " + testUser, "PWD"},
+			[]int{ftp.StatusServiceReady, ftp.StatusNeedPassword, ftp.StatusAuthenticated, ftp.StatusWorkingDirectory}},
+		{"wrong password", []string{"USER " + testUser, "PASS wrong", "PWD"},
+			[]int{ftp.StatusServiceReady, ftp.StatusNeedPassword, ftp.StatusNotLoggedIn, ftp.StatusNeedAccount}},
+		{"unknown user", []string{"USER nobody", "PASS " + testUser},
+			[]int{ftp.StatusServiceReady, ftp.StatusNotLoggedIn, ftp.StatusNeedAccount}},
+		{"no login", []string{"PASV", "LIST"},
+			[]int{ftp.StatusServiceReady, ftp.StatusNeedAccount, ftp.StatusNeedAccount}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			// Failed logins are delayed, so the cases run in parallel.
+			t.Parallel()
+			conn := serve(h, ftptest.NewConn(test.commands...))
+			expectStatuses(t, conn, test.statuses...)
+			if !conn.Closed() {
+				t.Error("session did not close the connection")
+			}
+		})
+	}
+}
+
+func TestStoreRetrieve(t *testing.T) {
+	var fs *vfs.Memory
+	h := newTestHandler(t, func(memory *vfs.Memory) { fs = memory })
+	data := []byte("hello world\n")
+
+	conn := newSession("TYPE I", "PASV", "STOR hello.txt")
+	conn.SetUpload(data)
+	serve(h, conn)
+	expectTransfers(t, conn, 1)
+	file, err := fs.Open(testHome + "/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("stored %q, %v, want %q", stored, err, data)
+	}
+
+	conn = serve(h, newSession("TYPE I", "PASV", "RETR hello.txt"))
+	expectTransfers(t, conn, 1)
+	if downloaded := conn.Downloaded(); !bytes.Equal(downloaded, data) {
+		t.Fatalf("downloaded %q, want %q", downloaded, data)
+	}
+
+	conn = serve(h, newSession("PASV", "RETR missing.txt"))
+	if reply := conn.LastReply(); reply.Status < 400 {
+		t.Fatalf("retrieving a missing file replied %v", reply)
+	}
+	expectTransfers(t, conn, 0)
+}
+
+func TestList(t *testing.T) {
+	h := newTestHandler(t, func(fs *vfs.Memory) {
+		fs.WriteFile(testHome+"/a.txt", []byte("a"), 0644)
+		fs.WriteFile(testHome+"/b.txt", []byte("bb"), 0644)
+		fs.MkdirAll(testHome+"/sub", 0755)
+	})
+	conn := serve(h, newSession("PASV", "LIST"))
+	expectTransfers(t, conn, 1)
+	lines := strings.Split(strings.TrimSuffix(string(conn.Downloaded()), "\r\n"), "\r\n")
+	if len(lines) != 3 {
+		t.Fatalf("listing %q, want 3 entries", lines)
+	}
+	for i, name := range []string{"a.txt", "b.txt", "sub"} {
+		if !strings.HasSuffix(lines[i], " "+name) {
+			t.Errorf("entry %q, want %s", lines[i], name)
+		}
+	}
+	if !strings.HasPrefix(lines[2], "d") {
+		t.Errorf("entry %q is not listed as directory", lines[2])
+	}
+}
+
+func TestVirtualHost(t *testing.T) {
+	h := newTestHandler(t, func(fs *vfs.Memory) {
+		fs.MkdirAll("/vhost/sub", 0755)
+		fs.WriteFile("/vhost/sub/hello.txt", []byte("hello"), 0644)
+	})
+	h.VirtualHosts = map[string]*VirtualHost{
+		"example.org": {UserConfig: newTestConfig(t, "vuser", "/vhost")},
+	}
+	conn := serve(h, ftptest.NewConn("HOST example.org", "USER vuser", "PASS vuser", "CWD sub", "PASV", "RETR hello.txt", "CWD /home"))
+	expectStatuses(t, conn, ftp.StatusServiceReady, ftp.StatusServiceReady, ftp.StatusNeedPassword, ftp.StatusAuthenticated,
+		ftp.StatusActionDone, ftp.StatusPassiveMode, ftp.StatusTransferReady, ftp.StatusTransferDone, ftp.StatusActionNotTaken)
+	if downloaded := string(conn.Downloaded()); downloaded != "hello" {
+		t.Fatalf("downloaded %q, want hello", downloaded)
+	}
+}
+
+func TestAuditBeforeLogin(t *testing.T) {
+	h := newTestHandler(t, func(fs *vfs.Memory) {
+		fs.WriteFile(testHome+"/x", []byte("x"), 0644)
+	})
+	var records []AuditRecord
+	h.Audit = func(record AuditRecord) { records = append(records, record) }
+	conn := serve(h, ftptest.NewConn("RETR x", "USER "+testUser, "PASS "+testUser, "SIZE x"))
+	expectStatuses(t, conn, ftp.StatusServiceReady, ftp.StatusNeedAccount, ftp.StatusNeedPassword, ftp.StatusAuthenticated, ftp.StatusFileInfo)
+	if len(records) != 4 {
+		t.Fatalf("audited %d requests, want 4", len(records))
+	}
+	if first := records[0]; first.Status != ftp.StatusNeedAccount || first.Path != "" {
+		t.Errorf("audited %+v before login", first)
+	}
+	if last := records[3]; last.Path != testHome+"/x" {
+		t.Errorf("audited path %q, want %s/x", last.Path, testHome)
+	}
+}
+
+func TestMinimumImplementation(t *testing.T) {
+	h := newTestHandler(t, func(fs *vfs.Memory) {
+		fs.MkdirAll(testHome+"/empty", 0755)
+		fs.MkdirAll(testHome+"/full/sub", 0755)
+		fs.WriteFile(testHome+"/file", nil, 0644)
+	})
+	conn := serve(h, newSession("NOOP", "MODE S", "MODE B", "STRU F", "STRU R",
+		"RMD empty", "RMD full", "RMD file", "RMD .", "QUIT", "NOOP"))
+	expectStatuses(t, conn, ftp.StatusServiceReady, ftp.StatusNeedPassword, ftp.StatusAuthenticated,
+		ftp.StatusOK, ftp.StatusOK, ftp.StatusNotImplementedParam, ftp.StatusOK, ftp.StatusNotImplementedParam,
+		ftp.StatusActionDone, ftp.StatusFileUnavailable, ftp.StatusFileUnavailable, ftp.StatusActionNotTaken,
+		ftp.StatusCloseConnection)
+
+	conn = serve(h, ftptest.NewConn("QUIT"))
+	expectStatuses(t, conn, ftp.StatusServiceReady, ftp.StatusCloseConnection)
+}
+
+func TestUploadHookChecksum(t *testing.T) {
+	h := newTestHandler(t, nil)
+	var events []HookEvent
+	h.Hooks.OnUpload = func(event HookEvent) { events = append(events, event) }
+	conn := newSession("TYPE I", "PASV", "STOR hello.txt", "PASV", "APPE hello.txt")
+	conn.SetUpload([]byte("hello world\n"))
+	serve(h, conn)
+	expectTransfers(t, conn, 2)
+	if len(events) != 2 {
+		t.Fatalf("ran %d upload hooks, want 2", len(events))
+	}
+	// sha256sum of "hello world\n"
+	if sum := events[0].SHA256; sum != "a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447" {
+		t.Errorf("STOR reported digest %q", sum)
+	}
+	if sum := events[1].SHA256; sum != "" {
+		t.Errorf("APPE reported digest %q of the appended data", sum)
+	}
+	event := newEvent("upload", events[0])
+	if event.SHA256 != events[0].SHA256 {
+		t.Errorf("event carries digest %q, want %q", event.SHA256, events[0].SHA256)
+	}
+}
+
+func TestTunedWriter(t *testing.T) {
+	h := newTestHandler(t, nil)
+	h.TransferBufferSize = 16
+	tuner := h.storageTuners.get(h.FileSystem, h.transferBufferSize())
+	if size := tuner.Size(); size != 16 {
+		t.Fatalf("tuner starts at %d bytes, want 16", size)
+	}
+	var out bytes.Buffer
+	writer := newTunedWriter(&out, tuner)
+	defer writer.Release()
+	data := []byte(strings.Repeat("0123456789", 10))
+	for _, part := range [][]byte{data[:7], data[7:40], data[40:]} {
+		if n, err := writer.Write(part); n != len(part) || err != nil {
+			t.Fatalf("wrote %d, %v, want %d", n, err, len(part))
+		}
+	}
+	if err := writer.Flush(); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("flushed %q, %v, want %q", out.Bytes(), err, data)
+	}
+}
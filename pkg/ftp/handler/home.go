@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+// defaultHomeMode is the permission of automatically created home directories.
+const defaultHomeMode os.FileMode = 0755
+
+// createHome creates the home directory of the user if it is missing and automatic creation is enabled.
+// It reports whether the directory has been created, so skeleton files are only copied once.
+func (state *HandlerState) createHome(user config.FTPUser) (bool, error) {
+	if !state.src.CreateHomes {
+		return false, nil
+	}
+	home := user.HomeDir()
+	if _, err := state.fs.Stat(home); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := mkdirAll(state.fs, home, state.src.HomeMode); err != nil {
+		return false, err
+	}
+	state.conn.Log("CREATED HOME", home)
+	return true, nil
+}
+
+// mkdirAll creates a directory and all missing parents.
+func mkdirAll(fs vfs.FileSystem, dir string, perm os.FileMode) error {
+	if _, err := fs.Stat(dir); err == nil {
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirAll(fs, parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := fs.Mkdir(dir, perm); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copySkeleton copies the files and directories of a local skeleton directory into dst.
+// Entries other than regular files and directories are skipped.
+func copySkeleton(fs vfs.FileSystem, src, dst string, perm os.FileMode) error {
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		from, to := filepath.Join(src, info.Name()), filepath.Join(dst, info.Name())
+		switch {
+		case info.IsDir():
+			if err := fs.Mkdir(to, perm); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err := copySkeleton(fs, from, to, perm); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := copySkeletonFile(fs, from, to, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func copySkeletonFile(fs vfs.FileSystem, from, to string, perm os.FileMode) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := fs.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		return err
+	}
+	return target.Close()
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"path/filepath"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+var honeypotFiles = map[string]string{
+	"backup/db-dump.sql": "-- MySQL dump 10.13\n",
+	"notes.txt":          "TODO: rotate credentials\n",
+}
+
+// isHoneypot reports whether the user is a decoy.
+func isHoneypot(user config.FTPUser) bool {
+	honeypot, ok := user.(config.Honeypot)
+	return ok && honeypot.Honeypot()
+}
+
+// enterHoneypot logs a decoy user into an isolated in-memory file system regardless of the password.
+func enterHoneypot(state *HandlerState, user config.FTPUser) {
+	state.honeypot = true
+	state.user = user
+	state.account.Store(state.selectedUser)
+	state.fs = newHoneypotFileSystem(user.HomeDir())
+	state.tuner = newBufferTuner(state.src.transferBufferSize())
+	state.conn.Respond(ftp.StatusAuthenticated)
+	state.conn.ChangeUser(state.selectedUser)
+	state.conn.ChangeDir(user.HomeDir())
+	state.alert("HONEYPOT LOGIN FOR USER", state.selectedUser)
+}
+
+// newHoneypotFileSystem creates a fake file system populated with decoy files.
+func newHoneypotFileSystem(home string) vfs.FileSystem {
+	fs := vfs.NewMemory()
+	fs.MkdirAll(home, 0755)
+	for name, content := range honeypotFiles {
+		path := filepath.Join(home, name)
+		fs.MkdirAll(filepath.Dir(path), 0755)
+		fs.WriteFile(path, []byte(content), 0644)
+	}
+	return fs
+}
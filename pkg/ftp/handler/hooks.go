@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errLoginFailed     = errors.New("authentication failed")
+	errTransferAborted = errors.New("transfer aborted")
+)
+
+// HookEvent describes a session event passed to Hooks.
+// Host is the name of the virtual host selected by the session, if any.
+// Path is the file system path of the affected file, or the home directory for logins.
+// Size is the number of bytes transferred, or the size of a deleted file.
+// From is the previous path of renamed files. SHA256 is the hex encoded digest of files stored completely by STOR.
+// Err is set if the action failed.
+type HookEvent struct {
+	Session    string
+	User       string
+	RemoteAddr string
+	Host       string
+	Path       string
+	From       string
+	Size       int64
+	SHA256     string
+	Err        error
+}
+
+// Hooks are optional callbacks invoked after session events, e.g. to index uploaded files or send notifications.
+// They run on the session goroutine after the client has been answered, so long running work should not block them.
+type Hooks struct {
+	OnLogin    func(HookEvent)
+	OnUpload   func(HookEvent)
+	OnDownload func(HookEvent)
+	OnDelete   func(HookEvent)
+	OnRename   func(HookEvent)
+}
+
+// runHook invokes the hook, if set, with an event of the session.
+func (state *HandlerState) runHook(hook func(HookEvent), path string, size int64, err error) {
+	if hook == nil {
+		return
+	}
+	hook(state.hookEvent(path, size, err))
+}
+
+// hookEvent creates an event of the session.
+func (state *HandlerState) hookEvent(path string, size int64, err error) HookEvent {
+	return HookEvent{
+		Session:    state.conn.GetID(),
+		User:       state.selectedUser,
+		RemoteAddr: state.conn.GetRemoteAddr(),
+		Host:       state.host,
+		Path:       path,
+		Size:       size,
+		Err:        err,
+	}
+}
+
+// transferError converts the outcome of a transfer into the error of a hook event.
+func transferError(ok bool) error {
+	if !ok {
+		return errTransferAborted
+	}
+	return nil
+}
+
+// CombineHooks returns hooks invoking each of the given hooks in order.
+func CombineHooks(hooks ...Hooks) Hooks {
+	combine := func(pick func(Hooks) func(HookEvent)) func(HookEvent) {
+		var funcs []func(HookEvent)
+		for _, h := range hooks {
+			if f := pick(h); f != nil {
+				funcs = append(funcs, f)
+			}
+		}
+		if len(funcs) == 0 {
+			return nil
+		}
+		return func(event HookEvent) {
+			for _, f := range funcs {
+				f(event)
+			}
+		}
+	}
+	return Hooks{
+		OnLogin:    combine(func(h Hooks) func(HookEvent) { return h.OnLogin }),
+		OnUpload:   combine(func(h Hooks) func(HookEvent) { return h.OnUpload }),
+		OnDownload: combine(func(h Hooks) func(HookEvent) { return h.OnDownload }),
+		OnDelete:   combine(func(h Hooks) func(HookEvent) { return h.OnDelete }),
+		OnRename:   combine(func(h Hooks) func(HookEvent) { return h.OnRename }),
+	}
+}
+
+// Event is the JSON representation of a hook event sent to webhooks and message queues.
+type Event struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Host       string    `json:"host,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	From       string    `json:"from,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+}
+
+func newEvent(name string, event HookEvent) Event {
+	return Event{
+		Event:      name,
+		Time:       time.Now(),
+		Session:    event.Session,
+		User:       event.User,
+		RemoteAddr: event.RemoteAddr,
+		Host:       event.Host,
+		Path:       event.Path,
+		From:       event.From,
+		Size:       event.Size,
+		SHA256:     event.SHA256,
+	}
+}
@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// readCommand waits for the next command. Sessions waiting longer than IdleTimeout are ended with 421.
+func (state *HandlerState) readCommand() (string, error) {
+	if state.src.IdleTimeout <= 0 {
+		return state.control.read()
+	}
+	timer := time.AfterFunc(state.src.IdleTimeout, func() {
+		if atomic.CompareAndSwapInt32(&state.activity, sessionIdle, sessionClosing) {
+			state.conn.Log("IDLE TIMEOUT")
+			state.conn.Respond(ftp.StatusServiceUnavailable)
+			state.conn.Close()
+		}
+	})
+	defer timer.Stop()
+	return state.control.read()
+}
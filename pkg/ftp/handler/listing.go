@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+const (
+	listingRecentFormat = "Jan _2 15:04"
+	listingOldFormat    = "Jan _2  2006"
+	listingRecentAge    = 180 * 24 * time.Hour
+)
+
+// readVisibleDir returns the directory entries visible to the user.
+func readVisibleDir(fs vfs.FileSystem, dir string, showHidden bool) ([]os.FileInfo, error) {
+	directory, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	visible := directory[:0]
+	for _, info := range directory {
+		if !showHidden && isHidden(info.Name()) {
+			continue
+		}
+		visible = append(visible, info)
+	}
+	return visible, nil
+}
+
+// buildNameListing generates a listing containing one file name per line.
+func buildNameListing(fs vfs.FileSystem, dir string, showHidden bool) ([]byte, error) {
+	directory, err := readVisibleDir(fs, dir, showHidden)
+	if err != nil {
+		return []byte{}, err
+	}
+	output := ""
+	for _, info := range directory {
+		output += info.Name() + "\n"
+	}
+	return []byte(output), nil
+}
+
+// buildListing generates a file listing in the format of ls -l.
+func buildListing(fs vfs.FileSystem, dir string, showHidden bool) ([]byte, error) {
+	directory, err := readVisibleDir(fs, dir, showHidden)
+	if err != nil {
+		return []byte{}, err
+	}
+	output := ""
+	now := time.Now()
+	for _, info := range directory {
+		timeFormat := listingRecentFormat
+		if now.Sub(info.ModTime()) > listingRecentAge {
+			timeFormat = listingOldFormat
+		}
+		output += fmt.Sprintf("%s 1 ftp ftp %12d %s %s\n",
+			info.Mode().String(), info.Size(), info.ModTime().Format(timeFormat), info.Name())
+	}
+	return []byte(output), nil
+}
+
+// buildEPLFListing generates a file listing.
+func buildEPLFListing(fs vfs.FileSystem, dir string, showHidden bool) ([]byte, error) {
+	output := ""
+	directory, err := readVisibleDir(fs, dir, showHidden)
+	if err != nil {
+		return []byte{}, err
+	}
+	for _, info := range directory {
+		if !info.Mode().IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+		output += "+"
+		output += "i" + fileID(info) + ","
+		output += "m" + strconv.FormatInt(info.ModTime().Unix(), 10) + ","
+		if info.Mode().IsRegular() {
+			output += "s" + strconv.FormatInt(info.Size(), 10) + ",r,"
+		} else {
+			output += "/,"
+		}
+		output += "\x09" + info.Name() + "\x0d\x0a"
+	}
+	return []byte(output), nil
+}
+
+// syntheticFileID derives an identifier for files without device and inode numbers.
+func syntheticFileID(info os.FileInfo) string {
+	h := fnv.New64a()
+	h.Write([]byte(info.Name()))
+	return "0." + strconv.FormatUint(h.Sum64(), 10)
+}
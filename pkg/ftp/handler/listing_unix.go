@@ -0,0 +1,18 @@
+//go:build !windows
+
+package handler
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fileID returns the unique device and inode identifier used in EPLF listings.
+func fileID(info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return syntheticFileID(info)
+	}
+	return strconv.FormatInt(int64(stat.Dev), 10) + "." + strconv.FormatUint(stat.Ino, 10)
+}
@@ -0,0 +1,8 @@
+package handler
+
+import "os"
+
+// fileID returns the identifier used in EPLF listings.
+func fileID(info os.FileInfo) string {
+	return syntheticFileID(info)
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"sync/atomic"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+const maintenanceMessage = "Server is in maintenance mode, write access is temporarily disabled"
+
+var writeCommands = map[string]bool{
+	ftp.CommandStoreFile:       true,
+	ftp.CommandAppendFile:      true,
+	ftp.CommandRenameFrom:      true,
+	ftp.CommandRenameTo:        true,
+	ftp.CommandDelete:          true,
+	ftp.CommandMakeDirectory:   true,
+	ftp.CommandRemoveDirectory: true,
+}
+
+var writeSiteCommands = map[string]bool{
+	siteCommandMakeTemp: true,
+	siteCommandPassword: true,
+}
+
+// SetMaintenance pauses or resumes all write commands server-wide.
+func (h *Handler) SetMaintenance(enabled bool) {
+	var flag int32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreInt32(&h.maintenance, flag)
+}
+
+// InMaintenance reports whether write commands are currently paused.
+func (h *Handler) InMaintenance() bool {
+	return atomic.LoadInt32(&h.maintenance) == 1
+}
+
+// respondMaintenance rejects a write command while maintenance mode is active.
+func respondMaintenance(conn ftp.Conn) {
+	conn.RespondText(ftp.StatusActionNotTaken, maintenanceMessage)
+}
@@ -0,0 +1,32 @@
+package handler
+
+import "github.com/lnsp/ftpd/pkg/ftp"
+
+// Middleware wraps the handling of commands to add cross-cutting behavior such as checks, rate limits or metrics.
+// It may answer the command itself instead of calling next.
+type Middleware func(next HandleFunc) HandleFunc
+
+// Use adds middleware applied to every command, including commands which are rejected by the handler.
+// The middleware added first runs outermost. Use must be called before the handler serves sessions.
+func (h *Handler) Use(middleware ...Middleware) {
+	h.middleware = append(h.middleware, middleware...)
+}
+
+// chain wraps the routing of commands in the middleware.
+func (h *Handler) chain() HandleFunc {
+	next := h.route
+	for i := len(h.middleware) - 1; i >= 0; i-- {
+		next = h.middleware[i](next)
+	}
+	return next
+}
+
+// Conn returns the control connection of the session.
+func (state *HandlerState) Conn() ftp.Conn {
+	return state.conn
+}
+
+// User returns the name of the logged in user, or an empty string before login.
+func (state *HandlerState) User() string {
+	return state.conn.GetUser()
+}
@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"os"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+const (
+	// defaultFileMode is the permission of uploaded files.
+	defaultFileMode os.FileMode = 0644
+	// defaultDirMode is the permission of directories created with MKD.
+	defaultDirMode os.FileMode = 0755
+)
+
+// fileMode returns the permission of files uploaded by the active user.
+func (state *HandlerState) fileMode() os.FileMode {
+	if modes, ok := state.user.(config.FileModes); ok {
+		if file, _ := modes.FileModes(); file != 0 {
+			return file
+		}
+	}
+	return state.src.FileMode
+}
+
+// dirMode returns the permission of directories created by the active user.
+func (state *HandlerState) dirMode() os.FileMode {
+	if modes, ok := state.user.(config.FileModes); ok {
+		if _, dir := modes.FileModes(); dir != 0 {
+			return dir
+		}
+	}
+	return state.src.DirMode
+}
@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"os"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+// useOwner makes files created in the session belong to the system account the user is mapped to.
+// A freshly created home directory is handed over as well.
+func (state *HandlerState) useOwner(user config.FTPUser, createdHome bool) error {
+	account, ok := user.(config.SystemAccount)
+	if !ok {
+		return nil
+	}
+	uid, gid, ok := account.SystemIDs()
+	if !ok {
+		return nil
+	}
+	if createdHome {
+		if err := os.Lchown(user.HomeDir(), uid, gid); err != nil {
+			return err
+		}
+	}
+	state.fs = vfs.NewOwned(state.fs, uid, gid)
+	return nil
+}
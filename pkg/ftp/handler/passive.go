@@ -0,0 +1,23 @@
+package handler
+
+import "net"
+
+// advertisedHost returns the address announced in PASV replies.
+// Behind NAT, clients on private networks are given the internal address and all others the public one.
+func (state *HandlerState) advertisedHost() string {
+	public := state.src.PassivePublicHost
+	if public == "" || isPrivateAddr(state.conn.GetRemoteAddr()) {
+		return state.src.PassiveServerHost
+	}
+	return public
+}
+
+// isPrivateAddr checks if a host:port pair belongs to a loopback, link-local or private network.
+func isPrivateAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast())
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"log/slog"
+	"time"
+)
+
+// trackProgress logs the progress of a transfer every ProgressInterval until the returned function is called,
+// so transfers shorter than the interval are not logged. The total size may be negative if it is unknown.
+func (state *HandlerState) trackProgress(direction string, total int64, transferred func() int64) func() {
+	interval := state.src.ProgressInterval
+	if interval <= 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		var last int64
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			n := transferred()
+			params := []interface{}{"TRANSFER PROGRESS",
+				slog.String("direction", direction),
+				slog.Int64("bytes", n),
+				slog.Int64("rate", int64(float64(n-last)/interval.Seconds())),
+			}
+			if total > 0 {
+				params = append(params, slog.Int64("percent", n*100/total))
+			}
+			state.conn.Log(params...)
+			last = n
+		}
+	}()
+	return func() { close(done) }
+}
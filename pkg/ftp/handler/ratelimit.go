@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+// tokenBucket limits throughput to rate bytes per second with a burst of one second.
+// Callers going over the limit take the tokens on credit and sleep until the debt is paid back,
+// so sessions of the same user sharing a bucket are throttled fairly.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// take consumes n tokens, blocking while the bucket is in debt.
+func (b *tokenBucket) take(n int) {
+	time.Sleep(b.reserve(n))
+}
+
+// reserve consumes n tokens and returns the time until the bucket is out of debt.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// chunk limits a buffer so that a single operation does not exceed the burst.
+// The rate is read under the lock, as other sessions of the user may update it.
+func (b *tokenBucket) chunk(p []byte) []byte {
+	b.mu.Lock()
+	rate := b.rate
+	b.mu.Unlock()
+	if int64(len(p)) > rate {
+		return p[:rate]
+	}
+	return p
+}
+
+// rateLimitedReader throttles reads from the underlying reader.
+type rateLimitedReader struct {
+	io.Reader
+	bucket *tokenBucket
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(r.bucket.chunk(p))
+	r.bucket.take(n)
+	return n, err
+}
+
+// rateLimitedWriter throttles writes to the underlying writer.
+type rateLimitedWriter struct {
+	io.Writer
+	bucket *tokenBucket
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := w.bucket.chunk(p[written:])
+		w.bucket.take(len(chunk))
+		n, err := w.Writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// rateLimits holds the token buckets shared by all sessions of a user.
+type rateLimits struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{buckets: make(map[string]*tokenBucket)}
+}
+
+// bucket returns the bucket for key, updating its rate. A non-positive rate disables limiting.
+func (l *rateLimits) bucket(key string, rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(rate)
+		l.buckets[key] = b
+		return b
+	}
+	b.mu.Lock()
+	b.rate = rate
+	b.mu.Unlock()
+	return b
+}
+
+// useRateLimits applies the bandwidth limits of the user to the session.
+func (state *HandlerState) useRateLimits(user config.FTPUser) {
+	limiter, ok := user.(config.RateLimiter)
+	if !ok {
+		return
+	}
+	upload, download := limiter.RateLimits()
+	state.uploadLimit = state.src.rateLimits.bucket("upload:"+state.selectedUser, upload)
+	state.downloadLimit = state.src.rateLimits.bucket("download:"+state.selectedUser, download)
+}
+
+// Throttle waits until a session of another protocol, e.g. SFTP, may transfer n bytes for the named user.
+// The session shares the bandwidth limits of the user with its FTP sessions and is subject to BandwidthLimit.
+func (h *Handler) Throttle(name string, user config.FTPUser, upload bool, n int) {
+	if limiter, ok := user.(config.RateLimiter); ok {
+		uploadRate, downloadRate := limiter.RateLimits()
+		key, rate := "download:"+name, downloadRate
+		if upload {
+			key, rate = "upload:"+name, uploadRate
+		}
+		if bucket := h.rateLimits.bucket(key, rate); bucket != nil {
+			bucket.take(n)
+		}
+	}
+	if global := h.rateLimits.bucket("global", h.BandwidthLimit); global != nil {
+		global.take(n)
+	}
+}
+
+// globalLimit returns the bucket shared by all transfers of the handler, or nil if BandwidthLimit is not set.
+func (state *HandlerState) globalLimit() *tokenBucket {
+	return state.src.rateLimits.bucket("global", state.src.BandwidthLimit)
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+const readAheadDepth = 4
+
+// readAheadChunk is data read ahead into a pooled buffer, which is returned once the data is consumed.
+type readAheadChunk struct {
+	buf  *[]byte
+	data []byte
+	err  error
+}
+
+// readAheadReader pipelines storage reads ahead of the consumer, so disk and network latency overlap.
+type readAheadReader struct {
+	chunks  chan readAheadChunk
+	done    chan struct{}
+	current readAheadChunk
+}
+
+// openSequential opens a file for a sequential read and hints the kernel to prefetch local files.
+func openSequential(fs vfs.FileSystem, path string) (vfs.File, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if local, ok := file.(*os.File); ok {
+		adviseSequential(local)
+	}
+	return file, nil
+}
+
+// newReadAheadReader starts reading r in the background using the chunk sizes chosen by tuner.
+func newReadAheadReader(r io.Reader, tuner *bufferTuner) *readAheadReader {
+	ra := &readAheadReader{
+		chunks: make(chan readAheadChunk, readAheadDepth),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(ra.chunks)
+		for {
+			buf := ftp.GetBuffer(tuner.Size())
+			start := time.Now()
+			n, err := io.ReadFull(r, *buf)
+			tuner.Observe(time.Since(start))
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			select {
+			case ra.chunks <- readAheadChunk{buf, (*buf)[:n], err}:
+			case <-ra.done:
+				ftp.PutBuffer(buf)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ra
+}
+
+// Read returns prefetched data.
+func (ra *readAheadReader) Read(p []byte) (int, error) {
+	for len(ra.current.data) == 0 {
+		if ra.current.err != nil {
+			return 0, ra.current.err
+		}
+		chunk, ok := <-ra.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		if ra.current.buf != nil {
+			ftp.PutBuffer(ra.current.buf)
+		}
+		ra.current = chunk
+	}
+	n := copy(p, ra.current.data)
+	ra.current.data = ra.current.data[n:]
+	return n, nil
+}
+
+// Close stops the background reader and returns the chunk in use to the pool.
+func (ra *readAheadReader) Close() error {
+	close(ra.done)
+	if ra.current.buf != nil {
+		ftp.PutBuffer(ra.current.buf)
+		ra.current = readAheadChunk{}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package handler
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequential tells the kernel that the file will be read sequentially and soon.
+func adviseSequential(file *os.File) {
+	fd := int(file.Fd())
+	unix.Fadvise(fd, 0, 0, unix.FADV_SEQUENTIAL)
+	unix.Fadvise(fd, 0, 0, unix.FADV_WILLNEED)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package handler
+
+import "os"
+
+// adviseSequential is a no-op on platforms without posix_fadvise.
+func adviseSequential(file *os.File) {}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo describes an active session.
+type SessionInfo struct {
+	ID                 string    `json:"id"`
+	User               string    `json:"user,omitempty"`
+	RemoteAddr         string    `json:"remote_addr"`
+	Connected          time.Time `json:"connected"`
+	BytesSent          int64     `json:"bytes_sent"`
+	BytesReceived      int64     `json:"bytes_received"`
+	TransfersCompleted int64     `json:"transfers_completed"`
+	TransfersAborted   int64     `json:"transfers_aborted"`
+}
+
+// sessionRegistry tracks the active sessions of a handler.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*HandlerState
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*HandlerState)}
+}
+
+func (r *sessionRegistry) add(state *HandlerState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[state.conn.GetID()] = state
+}
+
+func (r *sessionRegistry) remove(state *HandlerState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, state.conn.GetID())
+}
+
+// info returns a snapshot of the session.
+func (state *HandlerState) info() SessionInfo {
+	user, _ := state.account.Load().(string)
+	return SessionInfo{
+		ID:                 state.conn.GetID(),
+		User:               user,
+		RemoteAddr:         state.conn.GetRemoteAddr(),
+		Connected:          state.stats.connected,
+		BytesSent:          atomic.LoadInt64(&state.stats.bytesSent),
+		BytesReceived:      atomic.LoadInt64(&state.stats.bytesReceived),
+		TransfersCompleted: atomic.LoadInt64(&state.stats.transfersCompleted),
+		TransfersAborted:   atomic.LoadInt64(&state.stats.transfersAborted),
+	}
+}
+
+// Sessions lists the active sessions, oldest first.
+func (h *Handler) Sessions() []SessionInfo {
+	h.sessions.mu.Lock()
+	infos := make([]SessionInfo, 0, len(h.sessions.sessions))
+	for _, state := range h.sessions.sessions {
+		infos = append(infos, state.info())
+	}
+	h.sessions.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Connected.Before(infos[j].Connected)
+	})
+	return infos
+}
+
+// Disconnect closes the control connection of a session. It reports whether the session was found.
+func (h *Handler) Disconnect(id string) bool {
+	h.sessions.mu.Lock()
+	state, ok := h.sessions.sessions[id]
+	h.sessions.mu.Unlock()
+	if !ok {
+		return false
+	}
+	state.conn.Log("DISCONNECTED BY ADMIN")
+	state.conn.Close()
+	return true
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+const (
+	siteCommandMakeTemp = "MKTEMP"
+	siteCommandStats    = "STATS"
+	siteCommandID       = "SESSIONID"
+	siteCommandPassword = "PSWD"
+	siteCommandDebug    = "DEBUG"
+)
+
+var (
+	defaultSiteHandlers = map[string]HandleFunc{
+		siteCommandMakeTemp: handleSiteMakeTemp,
+		siteCommandStats:    handleSiteStats,
+		siteCommandID:       handleSiteSessionID,
+		siteCommandPassword: handleSitePassword,
+		siteCommandDebug:    handleSiteDebug,
+	}
+)
+
+func handleCommandSite(ctx context.Context, state *HandlerState, cmd *Command) {
+	sub := cmd.subcommand()
+	siteHandler, ok := state.src.siteHandlers[sub.Verb]
+	if !ok {
+		state.conn.Respond(ftp.StatusNotImplementedParam)
+		return
+	}
+	if writeSiteCommands[sub.Verb] && state.src.InMaintenance() {
+		respondMaintenance(state.conn)
+		return
+	}
+	siteHandler(ctx, state, sub)
+}
+
+func handleSiteMakeTemp(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !state.group().CanCreateDir(state.conn.GetDir()) {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	dir, err := state.fs.TempDir(state.conn.GetDir(), "tmp-")
+	if err != nil {
+		state.conn.Log("ERROR", err, "WHILE CREATING TEMPORARY DIRECTORY")
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	state.tempDirs = append(state.tempDirs, dir)
+	state.conn.Respond(ftp.StatusOK, "\""+dir+"\" created, removed at end of session")
+}
+
+func handleSiteStats(ctx context.Context, state *HandlerState, cmd *Command) {
+	state.conn.Respond(ftp.StatusSystemInfo, state.stats.String())
+}
+
+func handleSiteSessionID(ctx context.Context, state *HandlerState, cmd *Command) {
+	state.conn.Respond(ftp.StatusOK, "Session ID "+state.conn.GetID())
+}
+
+// handleSitePassword changes the password of the active user after verifying the old one.
+func handleSitePassword(ctx context.Context, state *HandlerState, cmd *Command) {
+	passwords := cmd.Args
+	if len(passwords) != 2 {
+		state.conn.Respond(ftp.StatusSyntaxParamError)
+		return
+	}
+	if state.honeypot {
+		state.alert("HONEYPOT PASSWORD CHANGE BY USER", state.selectedUser)
+		state.conn.Respond(ftp.StatusOK, "Password changed")
+		return
+	}
+	changer, ok := state.cfg.(config.PasswordChanger)
+	if !ok {
+		state.conn.Respond(ftp.StatusNotImplementedParam)
+		return
+	}
+	if !authenticate(state, state.user, passwords[0]) {
+		state.conn.Log("PASSWORD CHANGE FAILED FOR USER", state.selectedUser)
+		time.Sleep(badLoginDelay)
+		state.conn.Respond(ftp.StatusNotLoggedIn)
+		return
+	}
+	if err := changer.ChangePassword(state.selectedUser, passwords[1]); err != nil {
+		state.conn.Log("ERROR", err, "WHILE CHANGING PASSWORD OF USER", state.selectedUser)
+		if err == config.ErrReadOnlyStore {
+			state.conn.Respond(ftp.StatusNotImplementedParam)
+		} else {
+			state.conn.Respond(ftp.StatusLocalError)
+		}
+		return
+	}
+	state.conn.Log("PASSWORD CHANGED FOR USER", state.selectedUser)
+	state.conn.Respond(ftp.StatusOK, "Password changed")
+}
+
+// removeTempDirs deletes all scratch directories created during the session.
+func (state *HandlerState) removeTempDirs() {
+	for _, dir := range state.tempDirs {
+		if err := state.fs.RemoveAll(dir); err != nil {
+			state.conn.Log("ERROR", err, "WHILE REMOVING", dir)
+		}
+	}
+	state.tempDirs = nil
+}
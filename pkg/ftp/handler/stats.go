@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// ShutdownReport summarizes the activity of a handler when the server stops.
+type ShutdownReport struct {
+	SessionsDrained    int64         `json:"sessions_drained"`
+	SessionsTotal      int64         `json:"sessions_total"`
+	TransfersCompleted int64         `json:"transfers_completed"`
+	TransfersAborted   int64         `json:"transfers_aborted"`
+	BytesSent          int64         `json:"bytes_sent"`
+	BytesReceived      int64         `json:"bytes_received"`
+	Duration           time.Duration `json:"duration"`
+}
+
+// handlerStats holds server-wide counters updated atomically by all sessions.
+type handlerStats struct {
+	sessionsActive     int64
+	sessionsDrained    int64
+	sessionsTotal      int64
+	transfersCompleted int64
+	transfersAborted   int64
+	bytesSent          int64
+	bytesReceived      int64
+}
+
+// sessionStats holds the accounting of a single session.
+// Counters are updated atomically since they are read by the admin API.
+type sessionStats struct {
+	connected          time.Time
+	bytesSent          int64
+	bytesReceived      int64
+	transfersCompleted int64
+	transfersAborted   int64
+}
+
+// String summarizes the session statistics.
+func (s *sessionStats) String() string {
+	return fmt.Sprintf("Sent %d bytes, received %d bytes, %d transfers (%d aborted), connected %s",
+		atomic.LoadInt64(&s.bytesSent), atomic.LoadInt64(&s.bytesReceived),
+		atomic.LoadInt64(&s.transfersCompleted), atomic.LoadInt64(&s.transfersAborted),
+		time.Since(s.connected).Round(time.Second))
+}
+
+// Report generates a shutdown report from the current counters.
+func (h *Handler) Report(duration time.Duration) ShutdownReport {
+	return ShutdownReport{
+		SessionsDrained:    atomic.LoadInt64(&h.stats.sessionsDrained),
+		SessionsTotal:      atomic.LoadInt64(&h.stats.sessionsTotal),
+		TransfersCompleted: atomic.LoadInt64(&h.stats.transfersCompleted),
+		TransfersAborted:   atomic.LoadInt64(&h.stats.transfersAborted),
+		BytesSent:          atomic.LoadInt64(&h.stats.bytesSent),
+		BytesReceived:      atomic.LoadInt64(&h.stats.bytesReceived),
+		Duration:           duration,
+	}
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+// count returns the number of bytes read so far, it is safe to call during a transfer.
+func (r *countingReader) count() int64 {
+	return atomic.LoadInt64(&r.n)
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(&w.n, int64(n))
+	return n, err
+}
+
+// count returns the number of bytes written so far, it is safe to call during a transfer.
+func (w *countingWriter) count() int64 {
+	return atomic.LoadInt64(&w.n)
+}
+
+// recordTransfer updates the session and server-wide counters after a transfer finished.
+func (state *HandlerState) recordTransfer(ok bool, sent, received int64) {
+	atomic.AddInt64(&state.src.stats.bytesSent, sent)
+	atomic.AddInt64(&state.src.stats.bytesReceived, received)
+	atomic.AddInt64(&state.stats.bytesSent, sent)
+	atomic.AddInt64(&state.stats.bytesReceived, received)
+	if ok {
+		atomic.AddInt64(&state.src.stats.transfersCompleted, 1)
+		atomic.AddInt64(&state.stats.transfersCompleted, 1)
+	} else {
+		atomic.AddInt64(&state.src.stats.transfersAborted, 1)
+		atomic.AddInt64(&state.stats.transfersAborted, 1)
+	}
+}
+
+// send streams data to the client and records the transfer. It returns the number of bytes sent.
+// The size of the data is used to report the progress, it may be negative if unknown.
+// Local files are passed through unwrapped so the kernel can use sendfile, the data connection counts their progress.
+func (state *HandlerState) send(ctx context.Context, source io.Reader, size int64) (int64, bool) {
+	if state.downloadLimit != nil {
+		source = &rateLimitedReader{source, state.downloadLimit}
+	}
+	if global := state.globalLimit(); global != nil {
+		source = &rateLimitedReader{source, global}
+	}
+	var transferred func() int64
+	if _, isFile := source.(*os.File); isFile {
+		var sent int64
+		ctx = ftp.WithTransferProgress(ctx, &sent)
+		transferred = func() int64 {
+			return atomic.LoadInt64(&sent)
+		}
+	} else {
+		counter := &countingReader{Reader: source}
+		source, transferred = counter, counter.count
+	}
+	stop := state.trackProgress("send", size, transferred)
+	ctx, unwatch := state.watchTransfer(ctx, transferred)
+	ok := state.conn.Send(ctx, source)
+	unwatch()
+	stop()
+	n := transferred()
+	state.recordTransfer(ok, n, 0)
+	return n, ok
+}
+
+// receive streams data from the client into the sink and records the transfer. It returns the number of bytes received.
+func (state *HandlerState) receive(ctx context.Context, sink io.Writer) (int64, bool) {
+	if state.uploadLimit != nil {
+		sink = &rateLimitedWriter{sink, state.uploadLimit}
+	}
+	if global := state.globalLimit(); global != nil {
+		sink = &rateLimitedWriter{sink, global}
+	}
+	counter := &countingWriter{Writer: sink}
+	stop := state.trackProgress("receive", -1, counter.count)
+	ctx, unwatch := state.watchTransfer(ctx, counter.count)
+	ok := state.conn.Receive(ctx, counter)
+	unwatch()
+	stop()
+	state.recordTransfer(ok, 0, counter.count())
+	return counter.count(), ok
+}
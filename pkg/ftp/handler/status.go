@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/parser"
+)
+
+// handleCommandStatus reports the state of the session, or lists a directory over the control connection if given a path.
+func handleCommandStatus(ctx context.Context, state *HandlerState, cmd *Command) {
+	if cmd.Arg != "" {
+		handleStatusListing(state, cmd.Path())
+		return
+	}
+	var status strings.Builder
+	fmt.Fprintf(&status, "%s FTP server status:\n", state.src.SystemName)
+	fmt.Fprintf(&status, " Connected from %s\n", state.conn.GetRemoteAddr())
+	fmt.Fprintf(&status, " Logged in as %s\n", state.conn.GetUser())
+	_, transferType, _ := parser.ParseTransferType(state.conn.GetTransferType())
+	fmt.Fprintf(&status, " TYPE: %s\n", transferType)
+	fmt.Fprintf(&status, " Session secured: %t\n", state.conn.Secure())
+	fmt.Fprintf(&status, " %s\n", state.stats.String())
+	status.WriteString("End of status")
+	state.conn.RespondText(ftp.StatusSystemInfo, status.String())
+}
+
+// handleStatusListing sends the listing of a directory as multi-line reply.
+func handleStatusListing(state *HandlerState, name string) {
+	path, ok := state.resolvePath(name)
+	if !ok || !state.group().CanListDir(path) {
+		state.conn.Respond(ftp.StatusActionNotTaken)
+		return
+	}
+	listing, err := buildListing(state.fs, path, state.showHidden())
+	if err != nil {
+		respondError(state.conn, err)
+		return
+	}
+	state.conn.RespondText(ftp.StatusDirectoryInfo, "Status of "+name+":\n"+string(listing)+"End of status")
+}
+
+// logSessionClosed logs the statistics of the session once it has ended.
+func (state *HandlerState) logSessionClosed() {
+	state.conn.Log("SESSION CLOSED",
+		slog.Int64("bytes_sent", atomic.LoadInt64(&state.stats.bytesSent)),
+		slog.Int64("bytes_received", atomic.LoadInt64(&state.stats.bytesReceived)),
+		slog.Int64("files_transferred", atomic.LoadInt64(&state.stats.transfersCompleted)),
+		slog.Int64("transfers_aborted", atomic.LoadInt64(&state.stats.transfersAborted)),
+		slog.Duration("elapsed", time.Since(state.stats.connected).Round(time.Millisecond)))
+}
@@ -0,0 +1,30 @@
+package handler
+
+import "github.com/lnsp/ftpd/pkg/ftp/parser"
+
+// The stealth profile replaces every self-description of the server with generic values.
+const (
+	stealthSystemName = "UNIX"
+	stealthSystemType = "L8"
+	stealthBanner     = "FTP server ready"
+)
+
+// systemType returns the name and type reported by SYST.
+func (h *Handler) systemType() (string, string) {
+	if h.Stealth {
+		return stealthSystemName, stealthSystemType
+	}
+	if h.SystemType != "" {
+		return h.SystemName, h.SystemType
+	}
+	_, systemType, _ := parser.ParseTransferType(defaultTransferType)
+	return h.SystemName, systemType
+}
+
+// banner returns the greeting sent to new connections.
+func (h *Handler) banner() string {
+	if h.Stealth {
+		return stealthBanner
+	}
+	return h.MOTD
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/parser"
+)
+
+// commandsWithArgument require a parameter according to RFC 959.
+var commandsWithArgument = map[string]bool{
+	ftp.CommandUser:             true,
+	ftp.CommandPassword:         true,
+	ftp.CommandAccount:          true,
+	ftp.CommandChangeDirectory:  true,
+	ftp.CommandDataType:         true,
+	ftp.CommandModificationTime: true,
+	ftp.CommandFileSize:         true,
+	ftp.CommandRetrieveFile:     true,
+	ftp.CommandStoreFile:        true,
+	ftp.CommandAppendFile:       true,
+	ftp.CommandRenameFrom:       true,
+	ftp.CommandRenameTo:         true,
+	ftp.CommandDelete:           true,
+	ftp.CommandPort:             true,
+	ftp.CommandExtendedPort:     true,
+	ftp.CommandHash:             true,
+	ftp.CommandSHA256:           true,
+	ftp.CommandSite:             true,
+	ftp.CommandAuth:             true,
+	ftp.CommandProtectionBuffer: true,
+	ftp.CommandProtectionLevel:  true,
+	ftp.CommandHost:             true,
+	ftp.CommandRemoveDirectory:  true,
+	ftp.CommandTransferMode:     true,
+	ftp.CommandFileStructure:    true,
+}
+
+// commandsWithoutArgument must not carry a parameter according to RFC 959.
+var commandsWithoutArgument = map[string]bool{
+	ftp.CommandQuit:           true,
+	ftp.CommandSystemType:     true,
+	ftp.CommandPrintDirectory: true,
+	ftp.CommandPassiveMode:    true,
+	ftp.CommandNoop:           true,
+}
+
+// commandPredecessors lists commands which must immediately follow another command.
+var commandPredecessors = map[string]string{
+	ftp.CommandPassword: ftp.CommandUser,
+	ftp.CommandAccount:  ftp.CommandPassword,
+	ftp.CommandRenameTo: ftp.CommandRenameFrom,
+}
+
+// checkStrict validates a command against RFC 959 and returns the reply code for violations.
+func (state *HandlerState) checkStrict(previousCommand string, cmd *Command) (int, bool) {
+	if state.conn.GetUser() == "" && !preLoginCommands[cmd.Verb] {
+		return ftp.StatusNotLoggedIn, false
+	}
+	if commandsWithArgument[cmd.Verb] && cmd.Arg == "" {
+		return ftp.StatusSyntaxParamError, false
+	}
+	if commandsWithoutArgument[cmd.Verb] && cmd.Arg != "" {
+		return ftp.StatusSyntaxParamError, false
+	}
+	if predecessor, ok := commandPredecessors[cmd.Verb]; ok && previousCommand != predecessor {
+		return ftp.StatusBadSequence, false
+	}
+	if cmd.Verb == ftp.CommandPort {
+		if _, err := parser.ParseHostPort(cmd.Arg); err != nil {
+			return ftp.StatusSyntaxParamError, false
+		}
+	}
+	return 0, true
+}
@@ -0,0 +1,21 @@
+package handler
+
+import (
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+// useTemplate overlays the home directory on a read-only template directory if one is configured.
+// User templates take precedence over the server template.
+func (state *HandlerState) useTemplate(user config.FTPUser) {
+	template := state.src.Template
+	if templated, ok := user.(config.Templated); ok {
+		if userTemplate := templated.Template(); userTemplate != "" {
+			template = userTemplate
+		}
+	}
+	if template == "" {
+		return
+	}
+	state.fs = vfs.NewOverlay(state.fs, user.HomeDir(), template, user.HomeDir())
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+// handleCommandAuth upgrades the control connection to TLS as described in RFC 4217.
+func handleCommandAuth(ctx context.Context, state *HandlerState, cmd *Command) {
+	if state.src.TLSConfig == nil {
+		state.conn.Respond(ftp.StatusNotImplemented)
+		return
+	}
+	switch strings.ToUpper(cmd.Arg) {
+	case "TLS", "TLS-C", "SSL":
+	default:
+		state.conn.Respond(ftp.StatusNotImplementedParam)
+		return
+	}
+	if state.secure {
+		state.conn.Respond(ftp.StatusBadSequence)
+		return
+	}
+	state.conn.Respond(ftp.StatusSecurityExchange)
+	if err := state.conn.StartTLS(state.src.TLSConfig); err != nil {
+		state.conn.Log("ERROR", err, "WHILE NEGOTIATING TLS")
+		state.keepAlive = false
+		return
+	}
+	state.secure = true
+	if state.user == nil {
+		state.useServerName()
+	}
+}
+
+// handleCommandProtectionBuffer accepts the mandatory protection buffer size of zero for TLS.
+func handleCommandProtectionBuffer(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !state.secure {
+		state.conn.Respond(ftp.StatusBadSequence)
+		return
+	}
+	state.conn.Respond(ftp.StatusOK, "PBSZ=0")
+}
+
+// handleCommandProtectionLevel selects whether data connections are protected by TLS.
+func handleCommandProtectionLevel(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !state.secure {
+		state.conn.Respond(ftp.StatusBadSequence)
+		return
+	}
+	switch strings.ToUpper(cmd.Arg) {
+	case "C":
+		state.conn.SetProtected(false)
+	case "P":
+		state.conn.SetProtected(true)
+	default:
+		state.conn.Respond(ftp.StatusNotImplementedParam)
+		return
+	}
+	state.conn.Respond(ftp.StatusOK, "Protection level set to "+strings.ToUpper(cmd.Arg))
+}
+
+// authenticateCertificate checks if the verified client certificate of a TLS session belongs to the user.
+func authenticateCertificate(state *HandlerState, user config.FTPUser) bool {
+	if !state.secure || isHoneypot(user) {
+		return false
+	}
+	cert := state.conn.VerifiedCertificate()
+	if cert == nil {
+		return false
+	}
+	authenticator, ok := user.(config.CertificateAuthenticator)
+	return ok && authenticator.AuthCertificate(cert)
+}
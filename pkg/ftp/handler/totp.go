@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+// appendedCodeLength is the length of a one-time code appended to the password.
+const appendedCodeLength = 6
+
+// requiresCode reports whether the user has to provide a one-time code after the password.
+func requiresCode(user config.FTPUser) bool {
+	factor, ok := user.(config.SecondFactor)
+	return ok && factor.RequiresCode()
+}
+
+// authenticateWithCode accepts a password immediately followed by the one-time code.
+func authenticateWithCode(state *HandlerState, user config.FTPUser, password string) bool {
+	if !requiresCode(user) || len(password) <= appendedCodeLength {
+		return false
+	}
+	split := len(password) - appendedCodeLength
+	return authenticate(state, user, password[:split]) && user.(config.SecondFactor).VerifyCode(password[split:])
+}
+
+// handleCommandAccount completes a login with the one-time code requested after PASS.
+func handleCommandAccount(ctx context.Context, state *HandlerState, cmd *Command) {
+	user := state.pendingUser
+	if user == nil {
+		state.conn.Respond(ftp.StatusBadSequence)
+		return
+	}
+	state.pendingUser = nil
+	if !user.(config.SecondFactor).VerifyCode(cmd.Arg) {
+		state.conn.Log("ONE-TIME CODE FAILED FOR USER", state.selectedUser)
+		time.Sleep(badLoginDelay)
+		state.conn.Respond(ftp.StatusNotLoggedIn)
+		return
+	}
+	login(state, user, ftp.StatusAuthenticated)
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// handleSiteDebug switches verbose tracing of the session on or off, toggling it without argument.
+// It is restricted to the users in TraceUsers.
+func handleSiteDebug(ctx context.Context, state *HandlerState, cmd *Command) {
+	if !state.mayTrace() {
+		state.conn.Log("COMMAND DENIED", ftp.CommandSite, siteCommandDebug)
+		state.conn.Respond(ftp.StatusFileUnavailable)
+		return
+	}
+	switch strings.ToUpper(strings.TrimSpace(cmd.Arg)) {
+	case "":
+		state.tracing = !state.tracing
+	case "ON":
+		state.tracing = true
+	case "OFF":
+		state.tracing = false
+	default:
+		state.conn.Respond(ftp.StatusSyntaxParamError)
+		return
+	}
+	state.conn.SetTrace(state.tracing)
+	if state.tracing {
+		state.conn.Log("TRACING ENABLED")
+		state.conn.Respond(ftp.StatusOK, "Tracing enabled")
+	} else {
+		state.conn.Log("TRACING DISABLED")
+		state.conn.Respond(ftp.StatusOK, "Tracing disabled")
+	}
+}
+
+// mayTrace reports whether the logged in user may trace the session.
+func (state *HandlerState) mayTrace() bool {
+	user := state.conn.GetUser()
+	for _, name := range state.src.TraceUsers {
+		if user != "" && name == user {
+			return true
+		}
+	}
+	return false
+}
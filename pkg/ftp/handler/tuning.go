@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+const (
+	maxTransferBufferSize = 4 << 20
+	slowChunkLatency      = 5 * time.Millisecond
+	fastChunkLatency      = 500 * time.Microsecond
+)
+
+// bufferTuner adapts the chunk size used for storage I/O to the latency observed on a backend.
+// Slow backends get large chunks to amortize the cost of each operation, fast local disks stay small.
+// The chunks never shrink below the configured transfer buffer size.
+type bufferTuner struct {
+	mu      sync.Mutex
+	min     int
+	size    int
+	latency time.Duration
+}
+
+func newBufferTuner(size int) *bufferTuner {
+	return &bufferTuner{min: size, size: size}
+}
+
+// Size returns the currently preferred chunk size.
+func (t *bufferTuner) Size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size
+}
+
+// Observe records the duration of a single storage operation and adjusts the chunk size.
+func (t *bufferTuner) Observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.latency == 0 {
+		t.latency = d
+	} else {
+		t.latency = (7*t.latency + d) / 8
+	}
+	switch {
+	case t.latency > slowChunkLatency && t.size < maxTransferBufferSize:
+		t.size *= 2
+	case t.latency < fastChunkLatency && t.size > t.min:
+		t.size /= 2
+	}
+}
+
+// transferBufferSize returns the size storage chunks start at, ftp.DefaultTransferBufferSize unless configured.
+func (h *Handler) transferBufferSize() int {
+	if h.TransferBufferSize <= 0 {
+		return ftp.DefaultTransferBufferSize
+	}
+	return h.TransferBufferSize
+}
+
+// bufferTuners keeps a bufferTuner per storage backend, so a slow backend does not enlarge the chunks of the others.
+type bufferTuners struct {
+	mu     sync.Mutex
+	tuners map[vfs.FileSystem]*bufferTuner
+}
+
+func newBufferTuners() *bufferTuners {
+	return &bufferTuners{tuners: make(map[vfs.FileSystem]*bufferTuner)}
+}
+
+// get returns the tuner of a backend, starting at size. Backends which cannot be told apart by value share a tuner.
+func (t *bufferTuners) get(fs vfs.FileSystem, size int) *bufferTuner {
+	if fs != nil && !reflect.TypeOf(fs).Comparable() {
+		fs = nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tuner, ok := t.tuners[fs]
+	if !ok {
+		tuner = newBufferTuner(size)
+		t.tuners[fs] = tuner
+	}
+	return tuner
+}
+
+// tunedWriter reports the latency of each write to a bufferTuner.
+type tunedWriter struct {
+	w     io.Writer
+	tuner *bufferTuner
+}
+
+func (tw *tunedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tw.w.Write(p)
+	tw.tuner.Observe(time.Since(start))
+	return n, err
+}
+
+// newTunedWriter buffers writes to w into chunks of the size currently preferred by the tuner.
+// The chunk comes from a pool, it is returned with Release once flushed.
+func newTunedWriter(w io.Writer, tuner *bufferTuner) *chunkWriter {
+	return newChunkWriter(&tunedWriter{w, tuner}, tuner.Size())
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+// VirtualHost serves the sessions addressed to one host name with its own users, file system and banner.
+// Empty fields fall back to the settings of the handler.
+type VirtualHost struct {
+	UserConfig config.FTPUserConfig
+	FileSystem vfs.FileSystem
+	Banner     string
+}
+
+// useVirtualHost switches the session to the virtual host with the given name.
+// It reports false if the handler has no such virtual host.
+func (state *HandlerState) useVirtualHost(name string) bool {
+	host := strings.ToLower(strings.TrimSuffix(name, "."))
+	vhost, ok := state.src.VirtualHosts[host]
+	if !ok {
+		return false
+	}
+	if vhost.UserConfig != nil {
+		state.cfg = vhost.UserConfig
+	}
+	if vhost.FileSystem != nil {
+		state.fs = vhost.FileSystem
+		state.tuner = state.src.storageTuners.get(vhost.FileSystem, state.src.transferBufferSize())
+	}
+	state.vhost = vhost
+	state.host = host
+	state.conn.Log("VIRTUAL HOST", name)
+	return true
+}
+
+// useServerName selects the virtual host by the server name sent during the TLS handshake (SNI).
+func (state *HandlerState) useServerName() {
+	if name := state.conn.ServerName(); name != "" {
+		state.useVirtualHost(name)
+	}
+}
+
+// banner returns the greeting of the virtual host or handler with its placeholders replaced.
+func (state *HandlerState) banner() string {
+	if state.vhost != nil && state.vhost.Banner != "" && !state.src.Stealth {
+		return state.src.expandBanner(state.vhost.Banner)
+	}
+	return state.src.expandBanner(state.src.banner())
+}
+
+// handleCommandHost selects the virtual host before logging in as described in RFC 7151.
+// Servers without virtual hosts accept any host name.
+func handleCommandHost(ctx context.Context, state *HandlerState, cmd *Command) {
+	if state.user != nil || state.selectedUser != "" {
+		state.conn.Respond(ftp.StatusBadSequence)
+		return
+	}
+	if len(state.src.VirtualHosts) > 0 && !state.useVirtualHost(cmd.Arg) {
+		state.conn.RespondText(ftp.StatusNotImplementedParam, "Unknown host")
+		return
+	}
+	state.conn.RespondText(ftp.StatusServiceReady, state.banner())
+}
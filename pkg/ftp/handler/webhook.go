@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// webhookQueueSize is the number of events waiting for delivery before new ones are dropped.
+	webhookQueueSize = 1024
+	// webhookTimeout limits a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+	// webhookRetryDelay is the delay before the first retry, doubled for every further one.
+	webhookRetryDelay = time.Second
+)
+
+// Webhook posts completed uploads, deletes, renames and failed logins to URLs.
+// If Secret is set, each request carries the hex encoded HMAC-SHA256 of its body in the X-Ftpd-Signature header.
+// Failed deliveries are retried up to Retries times with exponential backoff.
+type Webhook struct {
+	URLs    []string
+	Secret  []byte
+	Retries int
+	client  *http.Client
+	queue   chan []byte
+}
+
+// NewWebhook creates a webhook and starts delivering its events in the background.
+func NewWebhook(urls []string, secret []byte, retries int) *Webhook {
+	w := &Webhook{
+		URLs:    urls,
+		Secret:  secret,
+		Retries: retries,
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan []byte, webhookQueueSize),
+	}
+	go w.deliver()
+	return w
+}
+
+// Hooks returns the hooks reporting events to the webhook.
+func (w *Webhook) Hooks() Hooks {
+	return Hooks{
+		OnLogin: func(event HookEvent) {
+			if event.Err != nil {
+				w.notify("login_failed", event)
+			}
+		},
+		OnUpload: func(event HookEvent) {
+			if event.Err == nil {
+				w.notify("upload", event)
+			}
+		},
+		OnDelete: func(event HookEvent) {
+			if event.Err == nil {
+				w.notify("delete", event)
+			}
+		},
+		OnRename: func(event HookEvent) {
+			if event.Err == nil {
+				w.notify("rename", event)
+			}
+		},
+	}
+}
+
+// notify queues an event without blocking the session. Events are dropped if the queue is full.
+func (w *Webhook) notify(name string, event HookEvent) {
+	body, err := json.Marshal(newEvent(name, event))
+	if err != nil {
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		log.Println("WEBHOOK QUEUE FULL, DROPPED EVENT", name, event.Path)
+	}
+}
+
+// deliver posts the queued events in order.
+func (w *Webhook) deliver() {
+	for body := range w.queue {
+		for _, url := range w.URLs {
+			w.post(url, body)
+		}
+	}
+}
+
+// post sends an event to a URL, retrying failed attempts.
+func (w *Webhook) post(url string, body []byte) {
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := w.send(url, body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.Retries {
+			log.Println("ERROR", err, "WHILE POSTING WEBHOOK TO", url)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (w *Webhook) send(url string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(w.Secret) > 0 {
+		mac := hmac.New(sha256.New, w.Secret)
+		mac.Write(body)
+		request.Header.Set("X-Ftpd-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return errors.New("webhook responded with status " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package ftp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// crockfordAlphabet is the base32 alphabet used to encode ULIDs.
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// IDGenerator creates unique session identifiers.
+type IDGenerator interface {
+	Generate() string
+}
+
+// ULIDGenerator generates lexicographically sortable identifiers which are unique across server instances.
+type ULIDGenerator struct{}
+
+// Generate returns a new ULID.
+func (ULIDGenerator) Generate() string {
+	var id [16]byte
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(id[:6], ts[2:])
+	rand.Read(id[6:])
+
+	// Encode the 128 bit value as 26 base32 characters, least significant first.
+	var out [26]byte
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// SequentialGenerator numbers sessions in the order they are accepted.
+type SequentialGenerator struct {
+	mu   sync.Mutex
+	next int
+}
+
+// Generate returns the next number in the sequence.
+func (gen *SequentialGenerator) Generate() string {
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	id := gen.next
+	gen.next++
+	return strconv.Itoa(id)
+}
@@ -0,0 +1,132 @@
+package ftp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"unicode"
+)
+
+// redacted replaces secret arguments in logs.
+const redacted = "***"
+
+// secretCommands are commands whose arguments are secrets.
+var secretCommands = map[string]bool{CommandPassword: true, CommandAccount: true}
+
+// secretSiteCommands are SITE commands whose arguments are secrets.
+var secretSiteCommands = map[string]bool{"PSWD": true}
+
+// RedactArguments hides the secret arguments of a command, e.g. the password of PASS.
+// Other arguments are returned unchanged.
+func RedactArguments(command, args string) string {
+	command = strings.ToUpper(command)
+	if secretCommands[command] && args != "" {
+		return redacted
+	}
+	if command == CommandSite {
+		tokens := strings.SplitN(args, " ", 2)
+		if len(tokens) == 2 && secretSiteCommands[strings.ToUpper(tokens[0])] {
+			return tokens[0] + " " + redacted
+		}
+	}
+	return args
+}
+
+// sanitizeParams redacts the secrets of logged requests unless LogSecrets is set
+// and escapes control characters, so clients cannot forge log lines.
+func (conn *ContextualConn) sanitizeParams(params []interface{}) []interface{} {
+	sanitized := make([]interface{}, len(params))
+	for i, param := range params {
+		if text, ok := param.(string); ok {
+			param = escapeControl(text)
+		}
+		sanitized[i] = param
+	}
+	if !conn.LogSecrets && len(params) >= 3 && params[0] == "REQUEST" {
+		command, _ := params[1].(string)
+		args, _ := sanitized[2].(string)
+		sanitized[2] = RedactArguments(command, args)
+	}
+	return sanitized
+}
+
+// escapeControl replaces control characters with their escaped form.
+func escapeControl(text string) string {
+	if strings.IndexFunc(text, unicode.IsControl) < 0 {
+		return text
+	}
+	var escaped strings.Builder
+	for _, r := range text {
+		if unicode.IsControl(r) {
+			fmt.Fprintf(&escaped, "\\x%02x", r)
+			continue
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// warningEvents are log messages which point to misbehaving clients rather than regular operation.
+var warningEvents = []string{"ALERT", "DENIED", "EXCEEDED", "FAILED", "REJECTED", "TIMEOUT"}
+
+// logRecord turns the parameters of Log into a structured record.
+// The first parameter is the message, errors become the error field, attributes are kept as fields
+// and the remaining parameters become the details.
+func (conn *ContextualConn) logRecord(params []interface{}) {
+	if len(params) == 0 {
+		return
+	}
+	msg := fmt.Sprint(params[0])
+	attrs := []slog.Attr{slog.String("conn_id", conn.ID)}
+	if conn.User != "" {
+		attrs = append(attrs, slog.String("user", conn.User))
+	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr); err == nil {
+		attrs = append(attrs, slog.String("remote_ip", host))
+	}
+	rest := params[1:]
+	if msg == "REQUEST" && len(rest) > 0 {
+		attrs = append(attrs, slog.String("command", fmt.Sprint(rest[0])))
+		rest = rest[1:]
+	}
+	var details []string
+	for _, param := range rest {
+		if attr, ok := param.(slog.Attr); ok {
+			attrs = append(attrs, attr)
+			continue
+		}
+		if err, ok := param.(error); ok {
+			attrs = append(attrs, slog.String("error", err.Error()))
+			continue
+		}
+		if text := fmt.Sprint(param); text != "" {
+			details = append(details, text)
+		}
+	}
+	if len(details) > 0 {
+		attrs = append(attrs, slog.String("details", strings.Join(details, " ")))
+	}
+	level := logLevel(msg)
+	if level < slog.LevelInfo && conn.tracing() {
+		level = slog.LevelInfo
+	}
+	conn.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// logLevel derives the level of a log message from its wording.
+func logLevel(msg string) slog.Level {
+	switch {
+	case strings.Contains(msg, "ERROR"):
+		return slog.LevelError
+	case msg == "REQUEST" || msg == "RESPONSE":
+		return slog.LevelDebug
+	}
+	for _, event := range warningEvents {
+		if strings.Contains(msg, event) {
+			return slog.LevelWarn
+		}
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,146 @@
+// Package parser parses the commands of FTP clients and formats the addresses of replies.
+// It has no dependencies on sessions or connections and returns errors instead of panicking on malformed input.
+package parser
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Network protocols of EPRT as defined in RFC 2428.
+const (
+	ProtocolIPv4 = "1"
+	ProtocolIPv6 = "2"
+)
+
+var (
+	// ErrHostPort is returned for PORT arguments which are not of the form h1,h2,h3,h4,p1,p2.
+	ErrHostPort = errors.New("parser: malformed host-port")
+	// ErrExtendedAddress is returned for malformed EPRT arguments.
+	ErrExtendedAddress = errors.New("parser: malformed extended address")
+	// ErrNetworkProtocol is returned for EPRT arguments with an unsupported network protocol.
+	ErrNetworkProtocol = errors.New("parser: unsupported network protocol")
+	// ErrPassiveAddress is returned when a passive address cannot be announced in a PASV reply.
+	ErrPassiveAddress = errors.New("parser: passive address is not an IPv4 address and port")
+	// ErrTransferType is returned for TYPE arguments which are not a known type with an optional format.
+	ErrTransferType = errors.New("parser: unknown transfer type")
+)
+
+// transferTypes names the type and format codes of TYPE as defined in RFC 959.
+var transferTypes = map[byte]string{
+	'A': "ASCII",
+	'E': "EBCDIC",
+	'I': "BINARY",
+	'L': "LOCAL FORMAT",
+	'N': "NON PRINT",
+	'T': "TELNET",
+	'C': "ASA CARRIAGE CONTROL",
+}
+
+// SplitCommand splits a request line into the upper-case verb and the rest of the line as argument, as described in RFC 959.
+// Leading spaces before the verb are ignored. The argument is returned verbatim, since paths may start or end with spaces.
+func SplitCommand(line string) (string, string) {
+	verb, arg, _ := strings.Cut(strings.TrimLeft(line, " "), " ")
+	return strings.ToUpper(verb), arg
+}
+
+// UnquotePath returns the path of an argument, which may be enclosed in double quotes with embedded quotes doubled,
+// the way 257 replies quote paths.
+func UnquotePath(arg string) string {
+	if len(arg) >= 2 && strings.HasPrefix(arg, "\"") && strings.HasSuffix(arg, "\"") {
+		return strings.ReplaceAll(arg[1:len(arg)-1], "\"\"", "\"")
+	}
+	return arg
+}
+
+// QuotePath doubles the double quotes in a path for a 257 reply, see RFC 959 appendix II.
+func QuotePath(path string) string {
+	return strings.ReplaceAll(path, "\"", "\"\"")
+}
+
+// ParseHostPort converts the h1,h2,h3,h4,p1,p2 argument of PORT into a host:port address.
+// Each field must be a decimal number from 0 to 255 and the port must not be 0.
+func ParseHostPort(arg string) (string, error) {
+	tokens := strings.Split(arg, ",")
+	if len(tokens) != 6 {
+		return "", ErrHostPort
+	}
+	var fields [6]int
+	for i, token := range tokens {
+		n, err := strconv.Atoi(token)
+		if err != nil || n < 0 || n > 255 {
+			return "", ErrHostPort
+		}
+		fields[i] = n
+	}
+	port := fields[4]*256 + fields[5]
+	if port == 0 {
+		return "", ErrHostPort
+	}
+	host := net.IPv4(byte(fields[0]), byte(fields[1]), byte(fields[2]), byte(fields[3]))
+	return net.JoinHostPort(host.String(), strconv.Itoa(port)), nil
+}
+
+// FormatHostPort formats an IPv4 address and port as h1,h2,h3,h4,p1,p2 for a PASV reply.
+func FormatHostPort(host string, port int) (string, error) {
+	ip := net.ParseIP(host).To4()
+	if ip == nil || port < 1 || port > 65535 {
+		return "", ErrPassiveAddress
+	}
+	return strconv.Itoa(int(ip[0])) + "," + strconv.Itoa(int(ip[1])) + "," + strconv.Itoa(int(ip[2])) + "," + strconv.Itoa(int(ip[3])) +
+		"," + strconv.Itoa(port/256) + "," + strconv.Itoa(port%256), nil
+}
+
+// ParseExtendedAddress converts the |proto|addr|port| argument of EPRT into a host:port address.
+// Any printable character may delimit the fields. Unknown protocols fail with ErrNetworkProtocol.
+func ParseExtendedAddress(arg string) (string, error) {
+	if len(arg) < 2 {
+		return "", ErrExtendedAddress
+	}
+	fields := strings.Split(arg, arg[:1])
+	if len(fields) != 5 || fields[0] != "" || fields[4] != "" {
+		return "", ErrExtendedAddress
+	}
+	ip := net.ParseIP(fields[2])
+	switch fields[1] {
+	case ProtocolIPv4:
+		if ip == nil || ip.To4() == nil {
+			return "", ErrExtendedAddress
+		}
+	case ProtocolIPv6:
+		if ip == nil || ip.To4() != nil {
+			return "", ErrExtendedAddress
+		}
+	default:
+		return "", ErrNetworkProtocol
+	}
+	port, err := strconv.Atoi(fields[3])
+	if err != nil || port < 1 || port > 65535 {
+		return "", ErrExtendedAddress
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+// ParseTransferType converts the argument of TYPE into a type code like "AN" and its description like "ASCII NON PRINT".
+// The argument is a type letter with an optional format letter, which may be separated by a space as in RFC 959.
+// The format defaults to NON PRINT.
+func ParseTransferType(arg string) (string, string, error) {
+	code := strings.ToUpper(strings.Replace(arg, " ", "", 1))
+	if len(code) == 1 {
+		code += "N"
+	}
+	if len(code) != 2 {
+		return "", "", ErrTransferType
+	}
+	base, ok := transferTypes[code[0]]
+	if !ok {
+		return "", "", ErrTransferType
+	}
+	format, ok := transferTypes[code[1]]
+	if !ok {
+		return "", "", ErrTransferType
+	}
+	return code, base + " " + format, nil
+}
@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func FuzzSplitCommand(f *testing.F) {
+	for _, seed := range []string{"", "USER anonymous", "  retr  file with spaces ", "TYPE", "PORT 127,0,0,1,4,1", "\xff\xfe"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		verb, arg := SplitCommand(line)
+		if strings.Contains(verb, " ") {
+			t.Fatalf("verb %q contains a space", verb)
+		}
+		if verb != strings.ToUpper(verb) {
+			t.Fatalf("verb %q is not upper-case", verb)
+		}
+		if trimmed := strings.TrimLeft(line, " "); !strings.HasSuffix(trimmed, arg) {
+			t.Fatalf("argument %q is not the rest of %q", arg, line)
+		}
+	})
+}
+
+func FuzzParseHostPort(f *testing.F) {
+	for _, seed := range []string{"127,0,0,1,4,1", "0,0,0,0,0,0", "256,0,0,1,0,1", "1,2,3,4,5", "-1,0,0,1,0,1", "1,2,3,4,5,6,7", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, arg string) {
+		addr, err := ParseHostPort(arg)
+		if err != nil {
+			if err != ErrHostPort {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		host, port := splitAddress(t, addr)
+		if net.ParseIP(host).To4() == nil {
+			t.Fatalf("host %q of %q is not IPv4", host, arg)
+		}
+		formatted, err := FormatHostPort(host, port)
+		if err != nil {
+			t.Fatalf("cannot format %q parsed from %q: %v", addr, arg, err)
+		}
+		if again, err := ParseHostPort(formatted); err != nil || again != addr {
+			t.Fatalf("%q formatted as %q parses to %q, %v", addr, formatted, again, err)
+		}
+	})
+}
+
+func FuzzParseExtendedAddress(f *testing.F) {
+	for _, seed := range []string{"|1|127.0.0.1|1025|", "|2|::1|1025|", "!1!10.0.0.1!21!", "|3|127.0.0.1|1025|", "|1|::1|1025|", "|1|127.0.0.1|0|", "|", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, arg string) {
+		addr, err := ParseExtendedAddress(arg)
+		if err != nil {
+			if err != ErrExtendedAddress && err != ErrNetworkProtocol {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		host, _ := splitAddress(t, addr)
+		ip := net.ParseIP(host)
+		if ip == nil {
+			t.Fatalf("host %q of %q is not an IP address", host, arg)
+		}
+		protocol := ProtocolIPv6
+		if ip.To4() != nil {
+			protocol = ProtocolIPv4
+		}
+		if fields := strings.Split(arg, arg[:1]); fields[1] != protocol {
+			t.Fatalf("%q parsed as %q with protocol %s", arg, addr, protocol)
+		}
+	})
+}
+
+func FuzzParseTransferType(f *testing.F) {
+	for _, seed := range []string{"", "A", "I", "a n", "L 8", "E T", "AN ", "X"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, arg string) {
+		code, description, err := ParseTransferType(arg)
+		if err != nil {
+			if err != ErrTransferType {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		if len(code) != 2 || description == "" {
+			t.Fatalf("%q parsed as code %q and description %q", arg, code, description)
+		}
+		if again, _, err := ParseTransferType(code); err != nil || again != code {
+			t.Fatalf("code %q of %q parses to %q, %v", code, arg, again, err)
+		}
+	})
+}
+
+// splitAddress splits a parsed address, which must have a valid port.
+func splitAddress(t *testing.T, addr string) (string, int) {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("cannot split %q: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 {
+		t.Fatalf("invalid port in %q", addr)
+	}
+	return host, port
+}
@@ -0,0 +1,57 @@
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Messages maps status codes to reply texts overriding StatusMessages, e.g. to localize them.
+type Messages map[int]string
+
+// NewMessages checks custom reply texts against the defaults.
+// Texts must keep the printf placeholders of the default text, since the same parameters are passed in.
+func NewMessages(custom map[int]string) (Messages, error) {
+	messages := make(Messages, len(custom))
+	for status, text := range custom {
+		defaultText, ok := StatusMessages[status]
+		if !ok {
+			return nil, errors.New("unknown status " + strconv.Itoa(status))
+		}
+		if countVerbs(text) != countVerbs(defaultText) {
+			return nil, fmt.Errorf("message of status %d must contain the placeholders of %q", status, defaultText)
+		}
+		messages[status] = text
+	}
+	return messages, nil
+}
+
+// Format creates the reply text of a status, preferring the custom text over the default one.
+func (m Messages) Format(status int, params ...interface{}) string {
+	text, ok := m[status]
+	if !ok {
+		text = StatusMessages[status]
+	}
+	return fmt.Sprintf(text, params...)
+}
+
+// countVerbs counts the printf verbs of a format string.
+func countVerbs(format string) int {
+	return strings.Count(format, "%") - 2*strings.Count(format, "%%")
+}
+
+// FormatReply creates a reply with the status and message.
+// Messages spanning several lines are formatted as multi-line reply.
+func FormatReply(status int, message string) string {
+	lines := strings.Split(strings.TrimRight(strings.Replace(message, "\r\n", "\n", -1), "\n"), "\n")
+	var reply strings.Builder
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		fmt.Fprintf(&reply, "%d%s%s\r\n", status, separator, line)
+	}
+	return reply.String()
+}
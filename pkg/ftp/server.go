@@ -0,0 +1,354 @@
+package ftp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or Close.
+var ErrServerClosed = errors.New("ftp: server closed")
+
+// shutdownPollInterval is the interval in which Shutdown checks for finished sessions.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// rejectTimeout limits the time spent on telling a client that the server is full.
+const rejectTimeout = 5 * time.Second
+
+// tooManyUsers is the reply sent to clients exceeding MaxConns.
+const tooManyUsers = "421 Too many users, try again later\r\n"
+
+// Handler serves the session on a FTP control connection.
+// The context is cancelled when the server is closed.
+type Handler interface {
+	Handle(ctx context.Context, conn Conn)
+}
+
+// Drainer is implemented by handlers which can end their sessions gracefully.
+// Drain should end idle sessions and let sessions running a command end once it has finished.
+type Drainer interface {
+	Drain()
+}
+
+// Transport turns accepted network connections into FTP connections.
+type Transport interface {
+	NewConn(ctx context.Context, c net.Conn, cfg config.FTPUserConfig) Conn
+}
+
+// ServerOptions configure a Server.
+type ServerOptions struct {
+	// Addr is the TCP address to listen on, ":21" if empty.
+	Addr string
+	// Handler serves the accepted sessions.
+	Handler Handler
+	// UserConfig looks up the users of the sessions.
+	UserConfig config.FTPUserConfig
+	// Transport creates the FTP connections, e.g. a tcp.ConnectionFactory.
+	Transport Transport
+	// BaseContext optionally returns the context all sessions derive from, e.g. to carry values.
+	BaseContext func() context.Context
+	// MaxConns limits the number of concurrent connections, 0 means no limit.
+	// Further clients are answered with 421 and closed.
+	MaxConns int
+	// MaxConnsPerIP limits the number of concurrent connections from one remote IP, 0 means no limit.
+	// It applies to the client address announced by a PROXY protocol header, if any.
+	MaxConnsPerIP int
+	// Filter optionally restricts the client addresses allowed to connect.
+	// Clients outside of it are disconnected without reply.
+	Filter *AddressFilter
+}
+
+// Server accepts FTP connections and serves them with a Handler.
+// It allows embedding a FTP endpoint into other programs.
+type Server struct {
+	opts      ServerOptions
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[Conn]struct{}
+	accepted  int
+	perIP     map[string]int
+	closed    bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewServer creates a server with the given options.
+func NewServer(opts ServerOptions) *Server {
+	ctx := context.Background()
+	if opts.BaseContext != nil {
+		ctx = opts.BaseContext()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Server{
+		opts:      opts,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[Conn]struct{}),
+		perIP:     make(map[string]int),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// ListenAndServe listens on the configured address and serves incoming connections.
+// It always returns a non-nil error, ErrServerClosed after Shutdown or Close.
+func (s *Server) ListenAndServe() error {
+	addr := s.opts.Addr
+	if addr == "" {
+		addr = ":21"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener and serves each of them in a new goroutine.
+// Serve may be called with several listeners, which share the handler.
+// The listener is closed when Serve returns. It always returns a non-nil error, ErrServerClosed after Shutdown or Close.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.serve(listener, nil)
+}
+
+// ServeTLS is like Serve, but negotiates TLS before the session starts (implicit FTPS).
+// Data connections are protected by default.
+func (s *Server) ServeTLS(listener net.Listener, config *tls.Config) error {
+	if config == nil {
+		return errors.New("ftp: implicit TLS requires a TLS config")
+	}
+	return s.serve(listener, config)
+}
+
+func (s *Server) serve(listener net.Listener, implicitTLS *tls.Config) error {
+	if !s.trackListener(listener) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(listener)
+	var delay time.Duration
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = nextAcceptDelay(delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		if !s.admit() {
+			go s.reject(c, implicitTLS)
+			continue
+		}
+		go s.serveConn(c, implicitTLS)
+	}
+}
+
+// serveConn wraps an accepted connection and runs the handler on it.
+// Creating the connection may block, e.g. while reading a PROXY protocol header, so it is done per connection.
+func (s *Server) serveConn(c net.Conn, implicitTLS *tls.Config) {
+	defer s.release()
+	ctx, cancel := context.WithCancel(s.ctx)
+	conn := s.opts.Transport.NewConn(ctx, c, s.opts.UserConfig)
+	if !s.trackConn(conn) {
+		cancel()
+		conn.Close()
+		return
+	}
+	defer s.untrackConn(conn)
+	defer cancel()
+	defer conn.Close()
+	if !s.opts.Filter.Allows(conn.GetRemoteAddr()) {
+		conn.Log("REJECTED", "ADDRESS NOT ALLOWED")
+		return
+	}
+	if implicitTLS != nil {
+		if err := conn.StartTLS(implicitTLS); err != nil {
+			conn.Log("ERROR", err, "WHILE NEGOTIATING IMPLICIT TLS")
+			return
+		}
+		conn.SetProtected(true)
+	}
+	ip := remoteIP(conn)
+	if !s.admitIP(ip) {
+		conn.Log("REJECTED", "TOO MANY CONNECTIONS FROM", ip)
+		conn.Write([]byte(tooManyUsers))
+		return
+	}
+	defer s.releaseIP(ip)
+	s.opts.Handler.Handle(ctx, conn)
+}
+
+// admit reserves a slot for an accepted connection if MaxConns permits it.
+func (s *Server) admit() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.MaxConns > 0 && s.accepted >= s.opts.MaxConns {
+		return false
+	}
+	s.accepted++
+	return true
+}
+
+// release frees the slot of a connection once its session has ended.
+func (s *Server) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accepted--
+}
+
+// admitIP reserves a slot for the remote IP if MaxConnsPerIP permits it.
+func (s *Server) admitIP(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opts.MaxConnsPerIP > 0 && s.perIP[ip] >= s.opts.MaxConnsPerIP {
+		return false
+	}
+	s.perIP[ip]++
+	return true
+}
+
+func (s *Server) releaseIP(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+// remoteIP returns the IP of the remote address without port.
+func remoteIP(conn Conn) string {
+	host, _, err := net.SplitHostPort(conn.GetRemoteAddr())
+	if err != nil {
+		return conn.GetRemoteAddr()
+	}
+	return host
+}
+
+// reject tells a client exceeding MaxConns to try again later and closes the connection.
+func (s *Server) reject(c net.Conn, implicitTLS *tls.Config) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(rejectTimeout))
+	if implicitTLS != nil {
+		c = tls.Server(c, implicitTLS)
+	}
+	c.Write([]byte(tooManyUsers))
+}
+
+// nextAcceptDelay backs off after temporary accept errors, from 5ms up to one second.
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		return time.Second
+	}
+	return delay
+}
+
+// Shutdown stops accepting connections, drains the sessions if the handler is a Drainer and waits for all sessions to end.
+// Once the context expires, the remaining sessions are closed and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+	if drainer, ok := s.opts.Handler.(Drainer); ok {
+		drainer.Drain()
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.activeConns() > 0 {
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
+// Close immediately closes all listeners and sessions.
+func (s *Server) Close() error {
+	err := s.closeListeners()
+	s.closeConns()
+	return err
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for listener := range s.listeners {
+		if cerr := listener.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, listener)
+	}
+	return err
+}
+
+// closeConns cancels the context of all sessions and closes their connections.
+func (s *Server) closeConns() {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) activeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) trackListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(listener net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.listeners[listener]; ok {
+		listener.Close()
+		delete(s.listeners, listener)
+	}
+}
+
+func (s *Server) trackConn(conn Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(conn Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
@@ -0,0 +1,203 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Packet types of SFTP version 3, see draft-ietf-secsh-filexfer-02.
+const (
+	packetInit     = 1
+	packetVersion  = 2
+	packetOpen     = 3
+	packetClose    = 4
+	packetRead     = 5
+	packetWrite    = 6
+	packetLstat    = 7
+	packetFstat    = 8
+	packetSetstat  = 9
+	packetFsetstat = 10
+	packetOpendir  = 11
+	packetReaddir  = 12
+	packetRemove   = 13
+	packetMkdir    = 14
+	packetRmdir    = 15
+	packetRealpath = 16
+	packetStat     = 17
+	packetRename   = 18
+	packetReadlink = 19
+	packetSymlink  = 20
+	packetStatus   = 101
+	packetHandle   = 102
+	packetData     = 103
+	packetName     = 104
+	packetAttrs    = 105
+)
+
+// Status codes of SSH_FXP_STATUS replies.
+const (
+	statusOK               = 0
+	statusEOF              = 1
+	statusNoSuchFile       = 2
+	statusPermissionDenied = 3
+	statusFailure          = 4
+	statusBadMessage       = 5
+	statusOpUnsupported    = 8
+)
+
+// Flags of SSH_FXP_OPEN.
+const (
+	openRead   = 0x01
+	openWrite  = 0x02
+	openAppend = 0x04
+	openCreate = 0x08
+	openTrunc  = 0x10
+	openExcl   = 0x20
+)
+
+// Flags of file attributes.
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrTimes       = 0x08
+	attrExtended    = 0x80000000
+)
+
+// Unix file type bits of the permissions attribute.
+const (
+	modeDir     = 0040000
+	modeRegular = 0100000
+	modeSymlink = 0120000
+)
+
+const (
+	// protocolVersion is the only SFTP version served.
+	protocolVersion = 3
+	// maxPacketSize limits requests, large enough for the 32 KiB writes of common clients.
+	maxPacketSize = 256 * 1024
+	// maxReadSize limits the data returned by a single read.
+	maxReadSize = 64 * 1024
+	// readDirEntries limits the entries of a single SSH_FXP_NAME reply, so it stays below the packet limit of clients.
+	readDirEntries = 100
+)
+
+// errBadMessage is returned for truncated or malformed requests.
+var errBadMessage = errors.New("sftp: malformed request")
+
+// request decodes the fields of a request packet.
+type request struct {
+	data []byte
+	err  error
+}
+
+func (r *request) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *request) uint64() uint64 {
+	if len(r.data) < 8 {
+		r.err = errBadMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *request) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < n {
+		r.err = errBadMessage
+		return nil
+	}
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *request) string() string {
+	return string(r.bytes())
+}
+
+// skipAttrs skips file attributes. Created files get the modes of the server like uploads over FTP.
+func (r *request) skipAttrs() {
+	flags := r.uint32()
+	if flags&attrSize != 0 {
+		r.uint64()
+	}
+	if flags&attrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&attrPermissions != 0 {
+		r.uint32()
+	}
+	if flags&attrTimes != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&attrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+}
+
+// reply encodes a response packet without its length prefix.
+type reply []byte
+
+func newReply(packetType byte, id uint32) reply {
+	return reply{packetType}.uint32(id)
+}
+
+func (p reply) uint32(v uint32) reply {
+	return binary.BigEndian.AppendUint32(p, v)
+}
+
+func (p reply) uint64(v uint64) reply {
+	return binary.BigEndian.AppendUint64(p, v)
+}
+
+func (p reply) bytes(v []byte) reply {
+	return append(p.uint32(uint32(len(v))), v...)
+}
+
+func (p reply) string(v string) reply {
+	return append(p.uint32(uint32(len(v))), v...)
+}
+
+// attrs encodes size, permissions and times of a file.
+func (p reply) attrs(info os.FileInfo) reply {
+	mode := uint32(info.Mode().Perm())
+	switch {
+	case info.IsDir():
+		mode |= modeDir
+	case info.Mode()&os.ModeSymlink != 0:
+		mode |= modeSymlink
+	default:
+		mode |= modeRegular
+	}
+	mtime := uint32(info.ModTime().Unix())
+	return p.uint32(attrSize | attrPermissions | attrTimes).uint64(uint64(info.Size())).uint32(mode).uint32(mtime).uint32(mtime)
+}
+
+// longName formats an entry like ls -l, as SFTP version 3 clients display it verbatim.
+func longName(info os.FileInfo) string {
+	modTime := info.ModTime()
+	timeFormat := "Jan _2 15:04"
+	if modTime.Before(time.Now().AddDate(0, -6, 0)) {
+		timeFormat = "Jan _2  2006"
+	}
+	return fmt.Sprintf("%s 1 ftp      ftp      %8d %s %s", info.Mode(), info.Size(), modTime.Format(timeFormat), info.Name())
+}
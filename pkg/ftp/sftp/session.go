@@ -0,0 +1,696 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+var (
+	// errPermissionDenied is returned for paths outside of the home and operations the group does not allow.
+	errPermissionDenied = errors.New("permission denied")
+	// errUnsupported is returned for requests the file system cannot serve.
+	errUnsupported = errors.New("operation unsupported")
+	// errInvalidHandle is returned for unknown handles and handles of the wrong kind.
+	errInvalidHandle = errors.New("invalid handle")
+	// errNonSequential is returned for reads and writes at other offsets than the current one on files which cannot seek.
+	errNonSequential = errors.New("file only supports sequential access")
+	// errTooManyHandles is returned for opens beyond maxHandles.
+	errTooManyHandles = errors.New("too many open handles")
+	// errMaintenance is returned for writes while the handler is in maintenance mode.
+	errMaintenance = errors.New("server is in maintenance mode")
+	// errNotClosed is passed to the hooks of files the client did not close before disconnecting.
+	errNotClosed = errors.New("file not closed by client")
+)
+
+// handle is an open file or directory. Read and written count the bytes transferred for the hooks.
+type handle struct {
+	path    string
+	file    vfs.File
+	offset  int64
+	append  bool
+	writing bool
+	read    int64
+	written int64
+	entries []os.FileInfo
+}
+
+// session serves the sftp requests of a logged in user.
+type session struct {
+	server  *Server
+	id      string
+	name    string
+	user    config.FTPUser
+	remote  string
+	fs      vfs.FileSystem
+	logger  *slog.Logger
+	handles map[string]*handle
+	next    int
+}
+
+// channel returns a session for an sftp channel of the connection, with handles of its own.
+func (sess *session) channel() *session {
+	c := *sess
+	c.handles = nil
+	return &c
+}
+
+// allows checks the request against the command lists of the user as the matching FTP commands.
+func (sess *session) allows(commands ...string) bool {
+	filter, ok := sess.user.(config.CommandFilter)
+	if !ok {
+		return true
+	}
+	for _, command := range commands {
+		if !filter.AllowsCommand(command) {
+			return false
+		}
+	}
+	return true
+}
+
+// inMaintenance reports whether writes are paused server-wide.
+func (sess *session) inMaintenance() bool {
+	return sess.server.Handler != nil && sess.server.Handler.InMaintenance()
+}
+
+// throttle waits until n bytes may be transferred under the bandwidth limits of the handler.
+func (sess *session) throttle(upload bool, n int) {
+	if sess.server.Handler != nil && n > 0 {
+		sess.server.Handler.Throttle(sess.name, sess.user, upload, n)
+	}
+}
+
+// checkCanary raises an alert if the accessed path is a canary, like FTP sessions do.
+func (sess *session) checkCanary(action, path string) {
+	h := sess.server.Handler
+	if h == nil || !h.IsCanary(path) {
+		return
+	}
+	message := "CANARY " + action + " " + path + " BY USER " + sess.name
+	sess.logger.Warn("ALERT", "message", message)
+	if h.Alert != nil {
+		h.Alert(sess.id, sess.name, message)
+	}
+}
+
+// hooks returns the hooks of the handler, if any.
+func (sess *session) hooks() handler.Hooks {
+	if sess.server.Handler == nil {
+		return handler.Hooks{}
+	}
+	return sess.server.Handler.Hooks
+}
+
+// runHook invokes the hook, if set, with an event of the session.
+func (sess *session) runHook(hook func(handler.HookEvent), path, from string, size int64, err error) {
+	if hook == nil {
+		return
+	}
+	hook(handler.HookEvent{
+		Session:    sess.id,
+		User:       sess.name,
+		RemoteAddr: sess.remote,
+		Path:       path,
+		From:       from,
+		Size:       size,
+		Err:        err,
+	})
+}
+
+// closed reports a closed file to the upload or download hook.
+func (sess *session) closed(h *handle, err error) {
+	if h.writing {
+		sess.runHook(sess.hooks().OnUpload, h.path, "", h.written, err)
+	} else {
+		sess.runHook(sess.hooks().OnDownload, h.path, "", h.read, err)
+	}
+}
+
+// serve reads requests from the channel and answers them in order until the client closes the channel.
+func (sess *session) serve(rw io.ReadWriter) error {
+	sess.handles = make(map[string]*handle)
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(rw, header[:]); err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length == 0 || length > maxPacketSize {
+			return errors.New("sftp: invalid packet length " + strconv.FormatUint(uint64(length), 10))
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(rw, packet); err != nil {
+			return err
+		}
+		response := sess.handle(packet[0], &request{data: packet[1:]})
+		if response == nil {
+			continue
+		}
+		if _, err := rw.Write(binary.BigEndian.AppendUint32(nil, uint32(len(response)))); err != nil {
+			return err
+		}
+		if _, err := rw.Write(response); err != nil {
+			return err
+		}
+	}
+}
+
+// closeHandles closes the handles the client left open.
+func (sess *session) closeHandles() {
+	for id, h := range sess.handles {
+		if h.file != nil {
+			h.file.Close()
+			sess.closed(h, errNotClosed)
+		}
+		delete(sess.handles, id)
+	}
+}
+
+// handle runs a request and returns the response packet.
+func (sess *session) handle(packetType byte, req *request) reply {
+	if packetType == packetInit {
+		return reply{packetVersion}.uint32(protocolVersion)
+	}
+	id := req.uint32()
+	if req.err != nil {
+		return nil
+	}
+	var response reply
+	switch packetType {
+	case packetOpen:
+		response = sess.open(id, req)
+	case packetOpendir:
+		response = sess.openDir(id, req)
+	case packetClose:
+		response = sess.close(id, req)
+	case packetRead:
+		response = sess.read(id, req)
+	case packetWrite:
+		response = sess.write(id, req)
+	case packetReaddir:
+		response = sess.readDir(id, req)
+	case packetStat, packetLstat:
+		response = sess.stat(id, req)
+	case packetFstat:
+		response = sess.fstat(id, req)
+	case packetRealpath:
+		response = sess.realPath(id, req)
+	case packetRemove:
+		response = sess.remove(id, req)
+	case packetMkdir:
+		response = sess.makeDir(id, req)
+	case packetRmdir:
+		response = sess.removeDir(id, req)
+	case packetRename:
+		response = sess.rename(id, req)
+	default:
+		return statusReply(id, errUnsupported)
+	}
+	if req.err != nil {
+		return statusReply(id, req.err)
+	}
+	return response
+}
+
+// resolve turns a client path into a clean absolute path within the home of the user.
+// Relative paths start at the home, just like the working directory of a new FTP session.
+// Hidden entries are rejected unless the user may see them.
+func (sess *session) resolve(name string) (string, error) {
+	home := sess.user.HomeDir()
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(home, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(home, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errPermissionDenied
+	}
+	if !sess.showHidden() {
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			if isHidden(part) {
+				return "", os.ErrNotExist
+			}
+		}
+	}
+	return path, nil
+}
+
+// showHidden reports whether the user may see dotfiles.
+func (sess *session) showHidden() bool {
+	if !sess.server.HideDotfiles {
+		return true
+	}
+	hidden, ok := sess.user.(config.HiddenFiles)
+	return ok && hidden.ShowHidden()
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// group returns the group of the user, denying everything if the user has none.
+func (sess *session) group() config.FTPGroup {
+	if group := sess.user.Group(); group != nil {
+		return group
+	}
+	return config.NoPermissions
+}
+
+// fileMode returns the permission of files created by the user.
+func (sess *session) fileMode() os.FileMode {
+	if modes, ok := sess.user.(config.FileModes); ok {
+		if file, _ := modes.FileModes(); file != 0 {
+			return file
+		}
+	}
+	return sess.server.FileMode
+}
+
+// dirMode returns the permission of directories created by the user.
+func (sess *session) dirMode() os.FileMode {
+	if modes, ok := sess.user.(config.FileModes); ok {
+		if _, dir := modes.FileModes(); dir != 0 {
+			return dir
+		}
+	}
+	return sess.server.DirMode
+}
+
+// canCreate checks the permission to create the file and its name, as STOR does.
+func (sess *session) canCreate(path string) bool {
+	return sess.group().CanCreateFile(path) && sess.group().AllowsName(filepath.Base(path))
+}
+
+func (sess *session) open(id uint32, req *request) reply {
+	name, flags := req.string(), req.uint32()
+	req.skipAttrs()
+	path, err := sess.resolve(name)
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if flags&(openRead|openWrite) == 0 {
+		return statusReply(id, errBadMessage)
+	}
+	if len(sess.handles) >= maxHandles {
+		return statusReply(id, errTooManyHandles)
+	}
+	writing := flags&openWrite != 0
+	if !sess.allows(openCommands(flags)...) {
+		return statusReply(id, errPermissionDenied)
+	}
+	if writing && sess.inMaintenance() {
+		return statusReply(id, errMaintenance)
+	}
+	if flags&openRead != 0 {
+		if !sess.group().CanEditFile(path) {
+			return statusReply(id, errPermissionDenied)
+		}
+		sess.checkCanary(ftp.CommandRetrieveFile, path)
+	}
+	var file vfs.File
+	if !writing {
+		file, err = sess.fs.Open(path)
+	} else {
+		if !sess.canCreate(path) {
+			return statusReply(id, errPermissionDenied)
+		}
+		file, err = sess.fs.OpenFile(path, openFlags(flags), sess.fileMode())
+	}
+	if err != nil {
+		return statusReply(id, err)
+	}
+	sess.logger.Info("SFTP OPEN", "path", path, "write", writing)
+	return sess.newHandle(id, &handle{path: path, file: file, append: flags&openAppend != 0, writing: writing})
+}
+
+// openCommands returns the FTP commands an open with the flags has to be allowed as.
+func openCommands(flags uint32) []string {
+	var commands []string
+	if flags&openRead != 0 {
+		commands = append(commands, ftp.CommandRetrieveFile)
+	}
+	if flags&openWrite != 0 && flags&openAppend != 0 {
+		commands = append(commands, ftp.CommandAppendFile)
+	} else if flags&openWrite != 0 {
+		commands = append(commands, ftp.CommandStoreFile)
+	}
+	return commands
+}
+
+// openFlags converts SSH_FXP_OPEN flags into flags of os.OpenFile.
+func openFlags(flags uint32) int {
+	osFlags := os.O_WRONLY
+	if flags&openRead != 0 {
+		osFlags = os.O_RDWR
+	}
+	if flags&openAppend != 0 {
+		osFlags |= os.O_APPEND
+	}
+	if flags&openCreate != 0 {
+		osFlags |= os.O_CREATE
+	}
+	if flags&openTrunc != 0 {
+		osFlags |= os.O_TRUNC
+	}
+	if flags&openExcl != 0 {
+		osFlags |= os.O_EXCL
+	}
+	return osFlags
+}
+
+func (sess *session) openDir(id uint32, req *request) reply {
+	path, err := sess.resolve(req.string())
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if len(sess.handles) >= maxHandles {
+		return statusReply(id, errTooManyHandles)
+	}
+	if !sess.allows(ftp.CommandList) || !sess.group().CanListDir(path) {
+		return statusReply(id, errPermissionDenied)
+	}
+	infos, err := sess.fs.ReadDir(path)
+	if err != nil {
+		return statusReply(id, err)
+	}
+	entries := infos[:0]
+	for _, info := range infos {
+		if sess.showHidden() || !isHidden(info.Name()) {
+			entries = append(entries, info)
+		}
+	}
+	return sess.newHandle(id, &handle{path: path, entries: entries})
+}
+
+func (sess *session) newHandle(id uint32, h *handle) reply {
+	sess.next++
+	name := strconv.Itoa(sess.next)
+	sess.handles[name] = h
+	return newReply(packetHandle, id).string(name)
+}
+
+// lookup returns the open handle of a request, of a file or of a directory.
+func (sess *session) lookup(req *request, file bool) (*handle, error) {
+	h, ok := sess.handles[req.string()]
+	if !ok || (h.file != nil) != file {
+		return nil, errInvalidHandle
+	}
+	return h, nil
+}
+
+func (sess *session) close(id uint32, req *request) reply {
+	name := req.string()
+	h, ok := sess.handles[name]
+	if !ok {
+		return statusReply(id, errInvalidHandle)
+	}
+	delete(sess.handles, name)
+	if h.file == nil {
+		return statusReply(id, nil)
+	}
+	err := h.file.Close()
+	sess.closed(h, err)
+	return statusReply(id, err)
+}
+
+func (sess *session) read(id uint32, req *request) reply {
+	h, err := sess.lookup(req, true)
+	offset, length := int64(req.uint64()), req.uint32()
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if length > maxReadSize {
+		length = maxReadSize
+	}
+	buffer := make([]byte, length)
+	var n int
+	if at, ok := h.file.(io.ReaderAt); ok {
+		n, err = at.ReadAt(buffer, offset)
+	} else if err = h.seek(offset); err == nil {
+		n, err = io.ReadFull(h.file, buffer)
+		h.offset += int64(n)
+	}
+	h.read += int64(n)
+	sess.throttle(false, n)
+	if n > 0 {
+		return newReply(packetData, id).bytes(buffer[:n])
+	}
+	if err == nil || err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return statusReply(id, err)
+}
+
+func (sess *session) write(id uint32, req *request) reply {
+	h, err := sess.lookup(req, true)
+	offset, data := int64(req.uint64()), req.bytes()
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if sess.inMaintenance() {
+		return statusReply(id, errMaintenance)
+	}
+	sess.throttle(true, len(data))
+	var n int
+	if at, ok := h.file.(io.WriterAt); ok && !h.append {
+		n, err = at.WriteAt(data, offset)
+	} else if h.append {
+		n, err = h.file.Write(data)
+	} else if err = h.seek(offset); err == nil {
+		n, err = h.file.Write(data)
+		h.offset += int64(n)
+	}
+	h.written += int64(n)
+	return statusReply(id, err)
+}
+
+// seek moves to the offset of a read or write on files without random access.
+func (h *handle) seek(offset int64) error {
+	if offset == h.offset {
+		return nil
+	}
+	seeker, ok := h.file.(io.Seeker)
+	if !ok {
+		return errNonSequential
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	h.offset = offset
+	return nil
+}
+
+func (sess *session) readDir(id uint32, req *request) reply {
+	h, err := sess.lookup(req, false)
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if len(h.entries) == 0 {
+		return statusReply(id, io.EOF)
+	}
+	n := min(len(h.entries), readDirEntries)
+	response := newReply(packetName, id).uint32(uint32(n))
+	for _, info := range h.entries[:n] {
+		response = response.string(info.Name()).string(longName(info)).attrs(info)
+	}
+	h.entries = h.entries[n:]
+	return response
+}
+
+func (sess *session) stat(id uint32, req *request) reply {
+	path, err := sess.resolve(req.string())
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if !sess.canStat(path) {
+		return statusReply(id, errPermissionDenied)
+	}
+	info, err := sess.fs.Stat(path)
+	if err != nil {
+		return statusReply(id, err)
+	}
+	return newReply(packetAttrs, id).attrs(info)
+}
+
+func (sess *session) fstat(id uint32, req *request) reply {
+	h, err := sess.lookup(req, true)
+	if err != nil {
+		return statusReply(id, err)
+	}
+	info, err := sess.fs.Stat(h.path)
+	if err != nil {
+		return statusReply(id, err)
+	}
+	return newReply(packetAttrs, id).attrs(info)
+}
+
+// canStat checks whether the user may list the directory containing the path, or the home itself.
+func (sess *session) canStat(path string) bool {
+	if path == filepath.Clean(sess.user.HomeDir()) {
+		return sess.group().CanListDir(path)
+	}
+	return sess.group().CanListDir(filepath.Dir(path))
+}
+
+func (sess *session) realPath(id uint32, req *request) reply {
+	path, err := sess.resolve(req.string())
+	if err != nil {
+		return statusReply(id, err)
+	}
+	return newReply(packetName, id).uint32(1).string(path).string(path).uint32(0)
+}
+
+func (sess *session) remove(id uint32, req *request) reply {
+	path, err := sess.resolve(req.string())
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if !sess.allows(ftp.CommandDelete) || !sess.group().CanDeleteFile(path) {
+		return statusReply(id, errPermissionDenied)
+	}
+	if sess.inMaintenance() {
+		return statusReply(id, errMaintenance)
+	}
+	sess.checkCanary(ftp.CommandDelete, path)
+	info, err := sess.fs.Stat(path)
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if info.IsDir() {
+		return statusReply(id, syscall.EISDIR)
+	}
+	if err := sess.fs.Remove(path); err != nil {
+		sess.runHook(sess.hooks().OnDelete, path, "", 0, err)
+		return statusReply(id, err)
+	}
+	sess.logger.Info("SFTP REMOVE", "path", path)
+	sess.runHook(sess.hooks().OnDelete, path, "", info.Size(), nil)
+	return statusReply(id, nil)
+}
+
+func (sess *session) makeDir(id uint32, req *request) reply {
+	name := req.string()
+	req.skipAttrs()
+	path, err := sess.resolve(name)
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if !sess.allows(ftp.CommandMakeDirectory) || !sess.group().CanCreateDir(path) || !sess.group().AllowsName(filepath.Base(path)) {
+		return statusReply(id, errPermissionDenied)
+	}
+	if sess.inMaintenance() {
+		return statusReply(id, errMaintenance)
+	}
+	err = sess.fs.Mkdir(path, sess.dirMode())
+	if err == nil {
+		sess.logger.Info("SFTP MKDIR", "path", path)
+	}
+	return statusReply(id, err)
+}
+
+func (sess *session) removeDir(id uint32, req *request) reply {
+	path, err := sess.resolve(req.string())
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if path == filepath.Clean(sess.user.HomeDir()) || !sess.allows(ftp.CommandRemoveDirectory) || !sess.group().CanDeleteDir(path) {
+		return statusReply(id, errPermissionDenied)
+	}
+	if sess.inMaintenance() {
+		return statusReply(id, errMaintenance)
+	}
+	info, err := sess.fs.Stat(path)
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if !info.IsDir() {
+		return statusReply(id, syscall.ENOTDIR)
+	}
+	err = sess.fs.Remove(path)
+	if err == nil {
+		sess.logger.Info("SFTP RMDIR", "path", path)
+	}
+	return statusReply(id, err)
+}
+
+// rename renames like RNFR and RNTO, but fails if the target exists as SFTP version 3 requires.
+func (sess *session) rename(id uint32, req *request) reply {
+	from, err := sess.resolve(req.string())
+	if err != nil {
+		return statusReply(id, err)
+	}
+	to, err := sess.resolve(req.string())
+	if err != nil {
+		return statusReply(id, err)
+	}
+	if !sess.allows(ftp.CommandRenameFrom, ftp.CommandRenameTo) || !sess.group().CanEditFile(from) || !sess.canCreate(to) {
+		return statusReply(id, errPermissionDenied)
+	}
+	if sess.inMaintenance() {
+		return statusReply(id, errMaintenance)
+	}
+	if _, err := sess.fs.Stat(from); err != nil {
+		return statusReply(id, err)
+	}
+	if _, err := sess.fs.Stat(to); err == nil {
+		return statusReply(id, os.ErrExist)
+	}
+	err = sess.fs.Rename(from, to)
+	if err == nil {
+		sess.logger.Info("SFTP RENAME", "from", from, "to", to)
+	}
+	sess.runHook(sess.hooks().OnRename, to, from, 0, err)
+	return statusReply(id, err)
+}
+
+// statusReply answers a request with the status code matching the error.
+func statusReply(id uint32, err error) reply {
+	var (
+		code    uint32 = statusFailure
+		message        = "Failure"
+	)
+	switch {
+	case err == nil:
+		code, message = statusOK, "Success"
+	case err == io.EOF:
+		code, message = statusEOF, "End of file"
+	case os.IsNotExist(err):
+		code, message = statusNoSuchFile, "No such file"
+	case os.IsPermission(err) || err == errPermissionDenied:
+		code, message = statusPermissionDenied, "Permission denied"
+	case err == errBadMessage:
+		code, message = statusBadMessage, "Bad message"
+	case err == errUnsupported:
+		code, message = statusOpUnsupported, "Operation unsupported"
+	case err == errInvalidHandle:
+		message = "Invalid handle"
+	case err == errNonSequential:
+		message = "File only supports sequential access"
+	case err == errTooManyHandles:
+		message = "Too many open handles"
+	case err == errMaintenance:
+		message = "Server is in maintenance mode, write access is temporarily disabled"
+	case os.IsExist(err):
+		message = "File already exists"
+	case errors.Is(err, syscall.EISDIR):
+		message = "Is a directory"
+	case errors.Is(err, syscall.ENOTDIR):
+		message = "Not a directory"
+	case errors.Is(err, syscall.ENOTEMPTY):
+		message = "Directory not empty"
+	}
+	return newReply(packetStatus, id).uint32(code).string(message).string("en")
+}
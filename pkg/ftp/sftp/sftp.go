@@ -0,0 +1,416 @@
+/*
+Package sftp serves the users of an FTP user configuration over the SFTP subsystem of SSH.
+Users log in with their passwords and work in the same home directories, with the same group permissions
+and on the same file system as over FTP. Users with a one-time code log in with keyboard-interactive authentication.
+Requests are checked against the command lists of the user as the matching FTP commands, e.g. RETR for reads.
+*/
+package sftp
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+	"github.com/lnsp/ftpd/pkg/ftp/config"
+	"github.com/lnsp/ftpd/pkg/ftp/handler"
+	"github.com/lnsp/ftpd/pkg/ftp/vfs"
+)
+
+const (
+	// badLoginDelay slows down password guessing like the delay after a failed PASS.
+	badLoginDelay = 3 * time.Second
+	// handshakeTimeout limits the SSH handshake including authentication.
+	handshakeTimeout = time.Minute
+	// maxHandles limits the files and directories a session may keep open.
+	maxHandles = 256
+)
+
+var errLoginFailed = errors.New("sftp: login failed")
+
+// Server serves SFTP sessions of the users of an FTP user configuration.
+type Server struct {
+	// UserConfig looks up the users and their groups.
+	UserConfig config.FTPUserConfig
+	// FileSystem is shared with the FTP handler, vfs.OS by default.
+	FileSystem vfs.FileSystem
+	// HideDotfiles hides dotfiles from users without show_hidden.
+	HideDotfiles bool
+	// CreateHomes creates missing home directories with HomeMode on login.
+	CreateHomes bool
+	HomeMode    os.FileMode
+	// FileMode and DirMode are the permissions of created files and directories unless the user has own modes.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// Template is the default template directory overlaid on homes.
+	Template string
+	// EncryptionKey encrypts the files of users without an own key. EncryptNames encrypts their names as well.
+	EncryptionKey []byte
+	EncryptNames  bool
+	// Filter restricts the client addresses.
+	Filter *ftp.AddressFilter
+	// Handler shares the maintenance mode, bandwidth limits, canaries, alerts and hooks of the FTP sessions, if set.
+	Handler *handler.Handler
+	// Logger receives the session logs, slog.Default() if nil.
+	Logger *slog.Logger
+
+	sshConfig     *ssh.ServerConfig
+	mu            sync.Mutex
+	listeners     map[net.Listener]struct{}
+	conns         map[net.Conn]struct{}
+	authenticated map[string]authenticatedUser
+	closed        bool
+}
+
+// authenticatedUser is passed from the authentication callbacks to the session of a connection.
+// The user is kept as returned by the configuration, since it may carry state from the login such as token grants.
+type authenticatedUser struct {
+	name string
+	user config.FTPUser
+}
+
+// NewServer creates an SFTP server for the users of cfg, identified by the host keys.
+func NewServer(cfg config.FTPUserConfig, hostKeys ...ssh.Signer) *Server {
+	s := &Server{
+		UserConfig:    cfg,
+		FileSystem:    vfs.OS{},
+		HomeMode:      0755,
+		FileMode:      0644,
+		DirMode:       0755,
+		listeners:     make(map[net.Listener]struct{}),
+		conns:         make(map[net.Conn]struct{}),
+		authenticated: make(map[string]authenticatedUser),
+	}
+	s.sshConfig = &ssh.ServerConfig{
+		PasswordCallback:            s.authenticatePassword,
+		KeyboardInteractiveCallback: s.authenticateInteractive,
+	}
+	for _, key := range hostKeys {
+		s.sshConfig.AddHostKey(key)
+	}
+	return s
+}
+
+// Serve accepts SSH connections on the listener until it fails or the server is closed.
+// It always returns a non-nil error, ftp.ErrServerClosed after Close.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.track(listener, nil) {
+		listener.Close()
+		return ftp.ErrServerClosed
+	}
+	defer s.untrack(listener, nil)
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ftp.ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(c)
+	}
+}
+
+// Close closes the listeners and all connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track registers a listener or connection, so Close can close it. It fails once the server is closed.
+func (s *Server) track(listener net.Listener, c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if listener != nil {
+		s.listeners[listener] = struct{}{}
+	}
+	if c != nil {
+		s.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (s *Server) untrack(listener net.Listener, c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, listener)
+	delete(s.conns, c)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// serveConn runs the SSH handshake and serves the sftp subsystem on the session channels of the connection.
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	if !s.track(nil, c) {
+		return
+	}
+	defer s.untrack(nil, c)
+	remote := c.RemoteAddr().String()
+	defer s.takeUser(remote)
+	if !s.Filter.Allows(remote) {
+		s.logger().Warn("CLIENT REJECTED", "remote", remote)
+		return
+	}
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	serverConn, channels, requests, err := ssh.NewServerConn(c, s.sshConfig)
+	if err != nil {
+		s.logger().Debug("SSH HANDSHAKE FAILED", "remote", remote, "error", err)
+		return
+	}
+	c.SetDeadline(time.Time{})
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+	auth, ok := s.takeUser(remote)
+	if !ok {
+		return
+	}
+	id := ftp.ULIDGenerator{}.Generate()
+	logger := s.logger().With("session", id, "user", auth.name, "remote", remote)
+	sess := &session{server: s, id: id, name: auth.name, user: auth.user, remote: remote, logger: logger}
+	fs, err := s.userFileSystem(auth.user, logger)
+	if err != nil {
+		logger.Error("ERROR WHILE PREPARING HOME OF USER", "error", err)
+		sess.runHook(sess.hooks().OnLogin, auth.user.HomeDir(), "", 0, err)
+		return
+	}
+	sess.fs = fs
+	logger.Info("AUTH SUCCESS FOR USER")
+	sess.runHook(sess.hooks().OnLogin, auth.user.HomeDir(), "", 0, nil)
+	var wg sync.WaitGroup
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveChannel(channel, requests, sess.channel())
+		}()
+	}
+	wg.Wait()
+	logger.Info("SESSION CLOSED")
+}
+
+// serveChannel waits for the sftp subsystem request of a session channel, rejecting shells and commands.
+func (s *Server) serveChannel(channel ssh.Channel, requests <-chan *ssh.Request, sess *session) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "subsystem" || string(req.Payload[min(4, len(req.Payload)):]) != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+		err := sess.serve(channel)
+		sess.closeHandles()
+		if err != nil && err != io.EOF {
+			sess.logger.Warn("SFTP SESSION FAILED", "error", err)
+		}
+		channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+		return
+	}
+}
+
+// authenticatePassword checks the password of a user like PASS does.
+// Users with a one-time code are rejected, they have to use keyboard-interactive authentication.
+func (s *Server) authenticatePassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	logger := s.logger().With("user", meta.User(), "remote", meta.RemoteAddr().String())
+	user, err := s.checkPassword(meta, string(password), logger)
+	if err != nil {
+		return nil, err
+	}
+	if requiresCode(user) {
+		logger.Warn("LOGIN REJECTED FOR USER", "reason", "one-time code required")
+		return nil, errors.New("sftp: one-time code required")
+	}
+	return s.accept(meta, user), nil
+}
+
+// authenticateInteractive asks for the password and, if the user has a second factor, for the one-time code like ACCT does.
+func (s *Server) authenticateInteractive(meta ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	logger := s.logger().With("user", meta.User(), "remote", meta.RemoteAddr().String())
+	answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, errLoginFailed
+	}
+	user, err := s.checkPassword(meta, answers[0], logger)
+	if err != nil {
+		return nil, err
+	}
+	if requiresCode(user) {
+		answers, err := challenge("", "", []string{"One-time code: "}, []bool{true})
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) != 1 || !user.(config.SecondFactor).VerifyCode(answers[0]) {
+			time.Sleep(badLoginDelay)
+			logger.Warn("ONE-TIME CODE FAILED FOR USER")
+			return nil, errLoginFailed
+		}
+	}
+	return s.accept(meta, user), nil
+}
+
+// checkPassword looks up the user and checks the account and the password like PASS does.
+func (s *Server) checkPassword(meta ssh.ConnMetadata, password string, logger *slog.Logger) (config.FTPUser, error) {
+	user := s.UserConfig.FindUser(meta.User())
+	if user == nil || isHoneypot(user) {
+		time.Sleep(badLoginDelay)
+		logger.Warn("AUTH FAILED FOR USER")
+		return nil, errLoginFailed
+	}
+	if account, ok := user.(config.AccountStatus); ok {
+		if err := account.CheckAccount(time.Now()); err != nil {
+			logger.Warn("LOGIN REJECTED FOR USER", "reason", err)
+			return nil, err
+		}
+	}
+	var ok bool
+	if remote, isRemote := user.(config.RemoteAuthenticator); isRemote {
+		ok = remote.AuthRemote(password, meta.RemoteAddr().String())
+	} else {
+		ok = user.Auth(password)
+	}
+	if !ok {
+		time.Sleep(badLoginDelay)
+		logger.Warn("AUTH FAILED FOR USER")
+		return nil, errLoginFailed
+	}
+	return user, nil
+}
+
+func isHoneypot(user config.FTPUser) bool {
+	honeypot, ok := user.(config.Honeypot)
+	return ok && honeypot.Honeypot()
+}
+
+func requiresCode(user config.FTPUser) bool {
+	factor, ok := user.(config.SecondFactor)
+	return ok && factor.RequiresCode()
+}
+
+// accept records the authenticated user for the session of the connection.
+func (s *Server) accept(meta ssh.ConnMetadata, user config.FTPUser) *ssh.Permissions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authenticated[meta.RemoteAddr().String()] = authenticatedUser{meta.User(), user}
+	return &ssh.Permissions{}
+}
+
+// takeUser returns and forgets the user authenticated on the connection from the remote address.
+func (s *Server) takeUser(remote string) (authenticatedUser, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	auth, ok := s.authenticated[remote]
+	delete(s.authenticated, remote)
+	return auth, ok
+}
+
+// userFileSystem creates the home of the user if needed and wraps the file system like a FTP login does,
+// with the ownership, template and encryption of the user.
+func (s *Server) userFileSystem(user config.FTPUser, logger *slog.Logger) (vfs.FileSystem, error) {
+	fs := s.FileSystem
+	created, err := s.createHome(user.HomeDir())
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		logger.Info("CREATED HOME", "home", user.HomeDir())
+	}
+	if account, ok := user.(config.SystemAccount); ok {
+		if uid, gid, ok := account.SystemIDs(); ok {
+			if created {
+				if err := os.Lchown(user.HomeDir(), uid, gid); err != nil {
+					return nil, err
+				}
+			}
+			fs = vfs.NewOwned(fs, uid, gid)
+		}
+	}
+	template := s.Template
+	if templated, ok := user.(config.Templated); ok {
+		if userTemplate := templated.Template(); userTemplate != "" {
+			template = userTemplate
+		}
+	}
+	if template != "" {
+		fs = vfs.NewOverlay(fs, user.HomeDir(), template, user.HomeDir())
+	}
+	key := s.EncryptionKey
+	if storage, ok := user.(config.EncryptedStorage); ok {
+		if userKey := storage.EncryptionKey(); userKey != nil {
+			key = userKey
+		}
+	}
+	if key != nil {
+		return vfs.NewEncrypted(fs, key, user.HomeDir(), s.EncryptNames)
+	}
+	return fs, nil
+}
+
+// createHome creates a missing home directory and all its parents if CreateHomes is set.
+func (s *Server) createHome(home string) (bool, error) {
+	if !s.CreateHomes {
+		return false, nil
+	}
+	if _, err := s.FileSystem.Stat(home); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	var missing []string
+	for dir := home; ; dir = filepath.Dir(dir) {
+		if _, err := s.FileSystem.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := s.FileSystem.Mkdir(missing[i], s.HomeMode); err != nil && !os.IsExist(err) {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,14 @@
+package tcp
+
+import "github.com/lnsp/ftpd/pkg/ftp"
+
+// DefaultTransferBufferSize is the size of the buffers copying data over data connections unless configured otherwise.
+const DefaultTransferBufferSize = ftp.DefaultTransferBufferSize
+
+// transferBufferSize returns the size of the copy buffers of the connection.
+func (conn *Conn) transferBufferSize() int {
+	if conn.bufferSize <= 0 {
+		return DefaultTransferBufferSize
+	}
+	return conn.bufferSize
+}
@@ -0,0 +1,338 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+var (
+	// errNoDataConnection is returned when a transfer is requested without PASV or PORT before.
+	errNoDataConnection = errors.New("no data connection set up, use PORT or PASV first")
+	// errPassiveExpired is returned when a transfer is requested after the passive listener expired.
+	errPassiveExpired = errors.New("passive listener expired")
+	// errTransferRunning is returned when a data connection is opened while another one is open.
+	errTransferRunning = errors.New("another transfer is running on the session")
+	// errForeignPeer is returned when another host than the client connected to the passive listener.
+	errForeignPeer = errors.New("passive data connection from another host than the client")
+)
+
+// dataEndpoint is the data connection set up by PASV or PORT for the next transfer:
+// a passive listener, the error of setting one up or the address of an active connection.
+// Passive listeners expire at the deadline if it is set.
+type dataEndpoint struct {
+	listener net.Listener
+	deadline time.Time
+	expiry   *time.Timer
+	err      error
+	address  string
+}
+
+// setEndpoint replaces the data connection set up before, closing its passive listener.
+func (conn *Conn) setEndpoint(endpoint dataEndpoint) {
+	conn.dataMu.Lock()
+	previous := conn.endpoint
+	conn.endpoint = endpoint
+	conn.dataMu.Unlock()
+	if previous.expiry != nil {
+		previous.expiry.Stop()
+	}
+	if previous.listener != nil {
+		previous.listener.Close()
+	}
+}
+
+// expireEndpoint closes a passive listener the client did not use in time.
+// The next transfer fails unless PASV or PORT is sent again.
+func (conn *Conn) expireEndpoint(listener net.Listener) {
+	conn.dataMu.Lock()
+	if conn.endpoint.listener != listener {
+		conn.dataMu.Unlock()
+		return
+	}
+	conn.endpoint = dataEndpoint{err: errPassiveExpired}
+	conn.dataMu.Unlock()
+	conn.Trace("PASSIVE LISTENER EXPIRED", listener.Addr())
+	listener.Close()
+}
+
+// takeEndpoint removes the data connection set up before, so each setup serves a single transfer.
+func (conn *Conn) takeEndpoint() dataEndpoint {
+	conn.dataMu.Lock()
+	defer conn.dataMu.Unlock()
+	endpoint := conn.endpoint
+	conn.endpoint = dataEndpoint{}
+	if endpoint.expiry != nil {
+		endpoint.expiry.Stop()
+	}
+	return endpoint
+}
+
+// SetPassive listens for a passive data connection on the host.
+// The port is available from GetPassivePort, the client connects to it for the next transfer.
+// The listener is closed if the client does not connect within the passive timeout.
+func (conn *Conn) SetPassive(host string) {
+	listener, err := conn.listenPassive(host)
+	if err != nil {
+		conn.setEndpoint(dataEndpoint{err: err})
+		return
+	}
+	conn.Trace("PASSIVE LISTENING ON", listener.Addr())
+	endpoint := dataEndpoint{listener: listener}
+	if conn.passiveTimeout > 0 {
+		endpoint.deadline = time.Now().Add(conn.passiveTimeout)
+		endpoint.expiry = time.AfterFunc(conn.passiveTimeout, func() { conn.expireEndpoint(listener) })
+	}
+	conn.setEndpoint(endpoint)
+}
+
+// listenPassive opens or leases the listener for a passive data connection, within the passive port range if there is one.
+func (conn *Conn) listenPassive(host string) (net.Listener, error) {
+	if conn.passivePool != nil {
+		return conn.passivePool.lease(host)
+	}
+	if conn.passivePorts != nil {
+		return conn.passivePorts.listen(host)
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, "0"))
+}
+
+// SetActive connects to the host for the next transfer.
+func (conn *Conn) SetActive(host string) {
+	conn.setEndpoint(dataEndpoint{address: host})
+}
+
+// GetPassivePort returns the port of the listener set up by SetPassive.
+func (conn *Conn) GetPassivePort() (int, error) {
+	conn.dataMu.Lock()
+	defer conn.dataMu.Unlock()
+	if conn.endpoint.err != nil {
+		return 0, conn.endpoint.err
+	}
+	if conn.endpoint.listener == nil {
+		return 0, errNoDataConnection
+	}
+	return conn.endpoint.listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// HasDataConn reports whether PASV or PORT set up a data connection for the next transfer.
+func (conn *Conn) HasDataConn() bool {
+	conn.dataMu.Lock()
+	defer conn.dataMu.Unlock()
+	return conn.endpoint.listener != nil || conn.endpoint.address != ""
+}
+
+// Reset discards the data connection set up before and frees its passive listener.
+func (conn *Conn) Reset() {
+	conn.setEndpoint(dataEndpoint{})
+}
+
+// OpenDataConn establishes the data connection set up by SetPassive or SetActive, so handlers can stream over it directly.
+// Cancelling ctx or closing the control connection closes the data connection, which aborts a running transfer.
+// The caller closes the data connection once the transfer is done. Only one data connection may be open at a time.
+func (conn *Conn) OpenDataConn(ctx context.Context) (io.ReadWriteCloser, error) {
+	return conn.openDataConn(ctx)
+}
+
+func (conn *Conn) openDataConn(ctx context.Context) (*dataConn, error) {
+	if !atomic.CompareAndSwapInt32(&conn.transferring, 0, 1) {
+		return nil, errTransferRunning
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stopSession := context.AfterFunc(conn.ctx, cancel)
+	release := func() {
+		stopSession()
+		cancel()
+		atomic.StoreInt32(&conn.transferring, 0)
+	}
+	endpoint := conn.takeEndpoint()
+	var (
+		c   net.Conn
+		err = endpoint.err
+	)
+	switch {
+	case err != nil:
+	case endpoint.listener != nil:
+		c, err = conn.acceptPassive(ctx, endpoint.listener, endpoint.deadline)
+	case endpoint.address != "":
+		c, err = conn.dialActive(ctx, endpoint.address)
+	default:
+		err = errNoDataConnection
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if conn.dataTimeout > 0 {
+		c = &timeoutConn{c, conn.dataTimeout}
+	}
+	c = conn.dataConn(c)
+	if secure, ok := c.(*tls.Conn); ok {
+		if err := conn.handshake(ctx, secure); err != nil {
+			c.Close()
+			release()
+			return nil, err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	conn.Trace("DATA CONNECTION OPENED", c.LocalAddr(), "<->", c.RemoteAddr())
+	return &dataConn{Conn: c, control: conn, release: func() {
+		stop()
+		release()
+	}}, nil
+}
+
+// acceptPassive waits for the client to connect to the passive listener, which is closed afterwards.
+// It fails once the deadline of the listener or the data timeout passed.
+// Unless FXP is allowed, connections from other hosts than the client are rejected, so they cannot steal or inject data.
+func (conn *Conn) acceptPassive(ctx context.Context, listener net.Listener, deadline time.Time) (net.Conn, error) {
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	if conn.dataTimeout > 0 {
+		if timeout := time.Now().Add(conn.dataTimeout); deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	if !deadline.IsZero() {
+		if deadliner, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+			deadliner.SetDeadline(deadline)
+		}
+	}
+	c, err := listener.Accept()
+	if err != nil {
+		conn.Trace("PASSIVE ACCEPT FAILED", err)
+		return nil, err
+	}
+	if !conn.allowFXP && !sameHost(c.RemoteAddr().String(), conn.RemoteAddr) {
+		conn.Log("PASSIVE CONNECTION REJECTED FROM", c.RemoteAddr())
+		c.Close()
+		return nil, errForeignPeer
+	}
+	conn.tuneSocket(c, conn.dataSocket)
+	return c, nil
+}
+
+// sameHost reports whether two addresses with ports belong to the same IP address.
+func sameHost(a, b string) bool {
+	hostA, _, errA := net.SplitHostPort(a)
+	hostB, _, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	ipA, ipB := net.ParseIP(hostA), net.ParseIP(hostB)
+	return ipA != nil && ipA.Equal(ipB)
+}
+
+// dialActive connects to the data address the client sent with PORT or EPRT.
+func (conn *Conn) dialActive(ctx context.Context, address string) (net.Conn, error) {
+	conn.Trace("ACTIVE CONNECTING TO", address)
+	dialer := net.Dialer{Timeout: conn.dataTimeout}
+	c, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		conn.Trace("ACTIVE CONNECT FAILED", err)
+		return nil, err
+	}
+	conn.tuneSocket(c, conn.dataSocket)
+	return c, nil
+}
+
+// dataConn is an established data connection. It counts the bytes transferred
+// and remembers the first error, which are traced once it is closed.
+// The bytes are added to the progress counter of the transfer as well, if there is one.
+type dataConn struct {
+	net.Conn
+	control  *Conn
+	release  func()
+	once     sync.Once
+	n        int64
+	progress *int64
+	err      error
+}
+
+func (c *dataConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.record(int64(n), err)
+	return n, err
+}
+
+func (c *dataConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.record(int64(n), err)
+	return n, err
+}
+
+// ReadFrom copies from the reader to the underlying connection,
+// so the kernel can send files over plain TCP data connections with sendfile.
+// Files are handed to the ReadFrom of the connection directly in chunks of sendfileChunk, as io.Copy would hide them
+// behind (*os.File).WriteTo from wrappers like timeoutConn, and each chunk is counted once it has been sent.
+// Other readers and connections, e.g. with TLS, copy through a pooled buffer.
+func (c *dataConn) ReadFrom(r io.Reader) (int64, error) {
+	if file, isFile := r.(*os.File); isFile {
+		var total int64
+		for {
+			chunk := &io.LimitedReader{R: file, N: sendfileChunk}
+			var (
+				n   int64
+				err error
+			)
+			if rf, ok := c.Conn.(io.ReaderFrom); ok {
+				n, err = rf.ReadFrom(chunk)
+			} else {
+				n, err = io.Copy(c.Conn, chunk)
+			}
+			c.record(n, err)
+			total += n
+			if err != nil || n < sendfileChunk {
+				return total, err
+			}
+		}
+	}
+	buf := ftp.GetBuffer(c.control.transferBufferSize())
+	defer ftp.PutBuffer(buf)
+	n, err := io.CopyBuffer(struct{ io.Writer }{c.Conn}, r, *buf)
+	c.record(n, err)
+	return n, err
+}
+
+// WriteTo copies the data received from the client into the writer through a pooled buffer.
+func (c *dataConn) WriteTo(w io.Writer) (int64, error) {
+	buf := ftp.GetBuffer(c.control.transferBufferSize())
+	defer ftp.PutBuffer(buf)
+	n, err := io.CopyBuffer(w, struct{ io.Reader }{c.Conn}, *buf)
+	c.record(n, err)
+	return n, err
+}
+
+func (c *dataConn) record(n int64, err error) {
+	c.n += n
+	if c.progress != nil {
+		atomic.AddInt64(c.progress, n)
+	}
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+}
+
+// Close closes the data connection. It is safe to call more than once.
+func (c *dataConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = c.Conn.Close()
+		c.release()
+		if c.err != nil {
+			c.control.Trace("DATA CONNECTION FAILED AFTER", c.n, "BYTES", c.err)
+		} else {
+			c.control.Trace("DATA CONNECTION CLOSED AFTER", c.n, "BYTES")
+		}
+	})
+	return err
+}
@@ -0,0 +1,135 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ListenerPool keeps passive listeners bound between transfers, so clients doing many small transfers
+// do not wait for a new listener each time. Listeners are leased per data connection and returned afterwards.
+// Up to size idle listeners are kept per host, taken from the port range if there is one.
+// Connections queued on an idle listener are refused when it is leased, so they never reach the next session.
+type ListenerPool struct {
+	mu    sync.Mutex
+	size  int
+	ports *PortRange
+	idle  map[string][]net.Listener
+}
+
+// NewListenerPool creates a pool keeping up to size idle listeners per host.
+func NewListenerPool(size int, ports *PortRange) *ListenerPool {
+	return &ListenerPool{size: size, ports: ports, idle: make(map[string][]net.Listener)}
+}
+
+// Prefill binds idle listeners for the host up to the pool size.
+func (p *ListenerPool) Prefill(host string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle[host]) < p.size {
+		listener, err := p.bind(host)
+		if err != nil {
+			return err
+		}
+		p.idle[host] = append(p.idle[host], listener)
+	}
+	return nil
+}
+
+// lease hands out an idle listener for the host or binds a new one.
+// Connections queued while the listener was idle are refused.
+func (p *ListenerPool) lease(host string) (net.Listener, error) {
+	p.mu.Lock()
+	var listener net.Listener
+	if idle := p.idle[host]; len(idle) > 0 {
+		listener, p.idle[host] = idle[len(idle)-1], idle[:len(idle)-1]
+	}
+	p.mu.Unlock()
+	if listener != nil {
+		drain(listener)
+	} else {
+		var err error
+		if listener, err = p.bind(host); err != nil {
+			return nil, err
+		}
+	}
+	return &pooledListener{Listener: listener, pool: p, host: host}, nil
+}
+
+func (p *ListenerPool) bind(host string) (net.Listener, error) {
+	if p.ports != nil {
+		return p.ports.listen(host)
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, "0"))
+}
+
+// put returns a listener to the pool. Connections queued in the meantime are refused.
+func (p *ListenerPool) put(host string, listener net.Listener) {
+	drain(listener)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[host]) >= p.size {
+		listener.Close()
+		return
+	}
+	p.idle[host] = append(p.idle[host], listener)
+}
+
+// drainWait is how long drain waits for queued connections. Accept fails without looking at the queue
+// once the deadline has passed, so the deadline has to lie slightly in the future.
+const drainWait = time.Millisecond
+
+// drain closes the connections queued on a listener without waiting for new ones.
+func drain(listener net.Listener) {
+	deadliner := listener.(interface{ SetDeadline(time.Time) error })
+	deadliner.SetDeadline(time.Now().Add(drainWait))
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		c.Close()
+	}
+	deadliner.SetDeadline(time.Time{})
+}
+
+// pooledListener is a leased listener. Closing it returns the listener to the pool
+// once a pending Accept has been interrupted, so it never hands out connections of the next lease.
+type pooledListener struct {
+	net.Listener
+	pool    *ListenerPool
+	host    string
+	mu      sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+}
+
+func (l *pooledListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	l.pending.Add(1)
+	l.mu.Unlock()
+	defer l.pending.Done()
+	return l.Listener.Accept()
+}
+
+func (l *pooledListener) SetDeadline(t time.Time) error {
+	return l.Listener.(interface{ SetDeadline(time.Time) error }).SetDeadline(t)
+}
+
+func (l *pooledListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+	l.SetDeadline(time.Now())
+	l.pending.Wait()
+	l.pool.put(l.host, l.Listener)
+	return nil
+}
@@ -0,0 +1,66 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var errNoPassivePort = errors.New("no free passive port")
+
+// PortRange hands out passive ports from a fixed range, so they can be opened in a firewall.
+// Ports are allocated round-robin and released once their listener is closed.
+type PortRange struct {
+	mu   sync.Mutex
+	base int
+	size int
+	next int
+	used map[int]bool
+}
+
+// NewPortRange creates a range of size ports starting at base.
+func NewPortRange(base, size int) *PortRange {
+	return &PortRange{base: base, size: size, used: make(map[int]bool)}
+}
+
+// listen opens a listener on the next free port of the range.
+// Ports taken by other programs are skipped.
+func (r *PortRange) listen(host string) (net.Listener, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < r.size; i++ {
+		port := r.base + (r.next+i)%r.size
+		if r.used[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		r.used[port] = true
+		r.next = (r.next + i + 1) % r.size
+		return &rangeListener{TCPListener: listener.(*net.TCPListener), ports: r, port: port}, nil
+	}
+	return nil, errNoPassivePort
+}
+
+func (r *PortRange) release(port int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.used, port)
+}
+
+// rangeListener returns its port to the range when closed.
+type rangeListener struct {
+	*net.TCPListener
+	ports *PortRange
+	port  int
+	once  sync.Once
+}
+
+func (l *rangeListener) Close() error {
+	err := l.TCPListener.Close()
+	l.once.Do(func() { l.ports.release(l.port) })
+	return err
+}
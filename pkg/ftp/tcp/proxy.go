@@ -0,0 +1,190 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout limits the time a peer may take to send its PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLength is the maximum length of a PROXY protocol v1 header including CRLF.
+const proxyV1MaxLength = 107
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// ProxyListener accepts connections preceded by a PROXY protocol v1 or v2 header, as sent by HAProxy
+// and many cloud load balancers. The remote address of accepted connections is the client address from the header.
+// If Trusted is not empty, only peers within these networks may send a header and all other peers are served directly.
+type ProxyListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+}
+
+// NewProxyListener wraps a listener to parse PROXY protocol headers.
+func NewProxyListener(listener net.Listener, trusted []*net.IPNet) *ProxyListener {
+	return &ProxyListener{listener, trusted}
+}
+
+// Accept waits for the next connection. The header is read on first use of the connection.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// trusts checks if the peer may send a PROXY protocol header.
+func (l *ProxyListener) trusts(addr net.Addr) bool {
+	if len(l.Trusted) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.Trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn reads the PROXY protocol header before any other data.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+// readHeader parses the header once. Connections with invalid headers fail on every read.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote, c.err = readProxyHeader(c.reader)
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address announced by the proxy, or the proxy address if there is none.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header. It returns a nil address for headers without client address.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	start, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch start[0] {
+	case 'P':
+		return readProxyV1(reader)
+	case proxyV2Signature[0]:
+		return readProxyV2(reader)
+	default:
+		return nil, errProxyHeader
+	}
+}
+
+// readProxyV1 parses a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 21\r\n".
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errProxyHeader
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses the binary header format.
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL connections are health checks of the proxy itself.
+	if header[12]&0x0F == 0 {
+		return nil, nil
+	}
+	if header[12]&0x0F != 1 {
+		return nil, errProxyHeader
+	}
+	switch header[13] {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// Unsupported address families like UNIX sockets keep the address of the proxy.
+		return nil, nil
+	}
+}
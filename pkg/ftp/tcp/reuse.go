@@ -0,0 +1,53 @@
+package tcp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// errSessionNotReused is returned for TLS data connections which did not resume the session of the control connection.
+var errSessionNotReused = errors.New("data connection did not reuse the TLS session of the control connection")
+
+// sessionConfig clones the TLS configuration with a session ticket key of its own.
+// Only connections of this session can then resume its TLS sessions.
+func sessionConfig(cfg *tls.Config) *tls.Config {
+	clone := cfg.Clone()
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err == nil {
+		clone.SetSessionTicketKeys([][32]byte{key})
+	}
+	return clone
+}
+
+// handshake completes the handshake of a TLS data connection before the transfer, so that empty transfers are encrypted as well.
+// If session reuse is required, the connection is rejected unless it resumed a session of the control connection,
+// so that a hijacker without the session cannot open data connections.
+func (conn *Conn) handshake(ctx context.Context, c *tls.Conn) error {
+	if err := c.HandshakeContext(ctx); err != nil {
+		conn.Trace("DATA CONNECTION HANDSHAKE FAILED", err)
+		return err
+	}
+	if conn.requireReuse && !c.ConnectionState().DidResume {
+		conn.Log("DATA CONNECTION REJECTED, TLS SESSION NOT REUSED")
+		return errSessionNotReused
+	}
+	return nil
+}
+
+// exempts reports whether the address is in one of the networks.
+func exempts(networks []*net.IPNet, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package tcp
+
+import (
+	"net"
+	"time"
+)
+
+// SocketOptions tune the TCP sockets of control and data connections. Zero values keep the defaults of Go and the system.
+// KeepAlive sets the interval of keep-alive probes, a negative interval disables them.
+// Nagle enables Nagle's algorithm, which Go disables with TCP_NODELAY. It saves packets of small writes on slow links.
+// ReadBuffer and WriteBuffer set the kernel receive and send buffer sizes in bytes. Links with a high bandwidth-delay product
+// need buffers of at least the bandwidth times the round-trip time for bulk transfers to fill them.
+type SocketOptions struct {
+	KeepAlive   time.Duration
+	Nagle       bool
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// apply sets the options on a TCP socket.
+func (o SocketOptions) apply(c *net.TCPConn) error {
+	if o.KeepAlive < 0 {
+		if err := c.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if o.KeepAlive > 0 {
+		if err := c.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := c.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+			return err
+		}
+	}
+	if err := c.SetNoDelay(!o.Nagle); err != nil {
+		return err
+	}
+	if o.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := c.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tcpSocket returns the TCP socket underneath connections wrapped for TLS or the PROXY protocol, nil if there is none.
+func tcpSocket(c net.Conn) *net.TCPConn {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn
+		case *proxyConn:
+			c = conn.Conn
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// tuneSocket applies the socket options to a connection, failures are logged but do not close it.
+func (conn *Conn) tuneSocket(c net.Conn, options SocketOptions) {
+	socket := tcpSocket(c)
+	if socket == nil {
+		return
+	}
+	if err := options.apply(socket); err != nil {
+		conn.Log("SOCKET OPTIONS FAILED", err)
+	}
+}
@@ -2,174 +2,209 @@ package tcp
 
 import (
 	"bufio"
-	"errors"
-	"fmt"
-	"io/ioutil"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log/slog"
 	"net"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/lnsp/ftpd/pkg/ftp"
 	"github.com/lnsp/ftpd/pkg/ftp/config"
 )
 
+// DefaultMaxCommandLength is the default limit of command lines, generous for the longest paths.
+const DefaultMaxCommandLength = 4096
+
 // Conn is a FTP connection over TCP.
 type Conn struct {
 	ftp.ContextualConn
-	backend     net.Conn
-	reader      *bufio.Reader
-	passivePort chan int
-	mode        chan bool
-	data        chan []byte
-	status      chan error
-}
-
-// Reset resets all state within the FTP connection.
-func (conn *Conn) Reset() {
-	conn.mode = make(chan bool)
-	conn.data = make(chan []byte)
-	conn.status = make(chan error)
+	backend        net.Conn
+	reader         *bufio.Reader
+	tlsConfig      *tls.Config
+	protected      bool
+	dataTimeout    time.Duration
+	passiveTimeout time.Duration
+	allowFXP       bool
+	requireReuse   bool
+	passivePorts   *PortRange
+	passivePool    *ListenerPool
+	messages       ftp.Messages
+	maxLineSize    int
+	bufferSize     int
+	dataSocket     SocketOptions
+	dataMu         sync.Mutex
+	writeMu        sync.Mutex
+	transferring   int32
+	endpoint       dataEndpoint
+	ctx            context.Context
+	cancel         context.CancelFunc
 }
 
-// Close closes the underlying TCP connection.
+// Close closes the underlying TCP connection, the data connection and a pending passive listener.
 func (conn *Conn) Close() {
+	conn.cancel()
+	conn.Reset()
 	conn.backend.Close()
 }
 
+// StartTLS upgrades the control connection to TLS.
+// Sessions required to reuse TLS sessions on data connections get a configuration of their own.
+func (conn *Conn) StartTLS(cfg *tls.Config) error {
+	if conn.requireReuse {
+		cfg = sessionConfig(cfg)
+	}
+	secure := tls.Server(conn.backend, cfg)
+	if err := secure.Handshake(); err != nil {
+		return err
+	}
+	conn.backend = secure
+	conn.reader = bufio.NewReader(secure)
+	conn.tlsConfig = cfg
+	return nil
+}
+
+// Secure reports whether the control connection is encrypted.
+func (conn *Conn) Secure() bool {
+	_, ok := conn.backend.(*tls.Conn)
+	return ok
+}
+
+// ServerName returns the host name the client asked for during the TLS handshake, if any.
+func (conn *Conn) ServerName() string {
+	secure, ok := conn.backend.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	return secure.ConnectionState().ServerName
+}
+
+// SetProtected enables or disables TLS on data connections.
+func (conn *Conn) SetProtected(protected bool) {
+	conn.protected = protected
+}
+
+// VerifiedCertificate returns the client certificate if it has been verified against the client CAs.
+func (conn *Conn) VerifiedCertificate() *x509.Certificate {
+	secure, ok := conn.backend.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := secure.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// dataConn wraps a data connection in TLS if protection is enabled.
+func (conn *Conn) dataConn(c net.Conn) net.Conn {
+	if !conn.protected || conn.tlsConfig == nil {
+		return c
+	}
+	return tls.Server(c, conn.tlsConfig)
+}
+
 // ReadCommand reads a command from the TCP connection.
+// The line is returned without its line ending, Telnet commands are stripped from it, see readTelnetLine.
 func (conn *Conn) ReadCommand() (string, error) {
-	buffer, _, err := conn.reader.ReadLine()
+	buffer, err := conn.readTelnetLine()
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(string(buffer)), nil
+	return string(buffer), nil
 }
 
 // Write writes raw bytes to the TCP connection.
+// Writes are serialized, so a STAT reply sent during a transfer does not interleave with other replies.
 func (conn *Conn) Write(buffer []byte) (int, error) {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
 	return conn.backend.Write(buffer)
 }
 
-func (conn *Conn) Receive() ([]byte, bool) {
-	conn.Respond(ftp.StatusTransferReady)
-	conn.mode <- true
-	err := <-conn.status
-	if err != nil {
-		conn.Respond(ftp.StatusTransferAbort)
-		return []byte{}, false
-	}
-	data := <-conn.data
-	conn.Respond(ftp.StatusTransferDone)
-	return data, true
+// Receive streams data from the client into the writer.
+// The transfer is aborted once the context is cancelled.
+func (conn *Conn) Receive(ctx context.Context, sink io.Writer) bool {
+	return conn.stream(ctx, func(c *dataConn) error {
+		_, err := c.WriteTo(sink)
+		return err
+	})
+}
+
+// Send streams the contents of the reader to the client.
+// The transfer is aborted once the context is cancelled.
+func (conn *Conn) Send(ctx context.Context, source io.Reader) bool {
+	return conn.stream(ctx, func(c *dataConn) error {
+		_, err := c.ReadFrom(source)
+		return err
+	})
 }
 
-func (conn *Conn) Send(data []byte) bool {
+// stream opens the data connection, runs the copy over it and replies with the outcome of the transfer,
+// 425 if the data connection could not be established and 426 if the transfer failed.
+// Completed transfers are answered with 226 and their size, duration and average rate.
+func (conn *Conn) stream(ctx context.Context, copy func(*dataConn) error) bool {
 	conn.Respond(ftp.StatusTransferReady)
-	conn.mode <- false
-	conn.data <- data
-	err := <-conn.status
+	c, err := conn.openDataConn(ctx)
+	if err != nil {
+		conn.Respond(ftp.StatusTransferFailed)
+		return false
+	}
+	c.progress = ftp.TransferProgress(ctx)
+	start := time.Now()
+	err = copy(c)
+	if closeErr := c.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		conn.Respond(ftp.StatusTransferAbort)
 		return false
 	}
-	conn.Respond(ftp.StatusTransferDone)
+	conn.RespondText(ftp.StatusTransferDone, conn.messages.Format(ftp.StatusTransferDone)+". "+transferSummary(c.n, time.Since(start)))
 	return true
 }
 
-// SetPassive passively transfers data.
-// It listens on a specific port and waits for a user to connect.
-func (conn *Conn) SetPassive(host string) {
-	go func() {
-		listener, err := net.Listen("tcp", host+":0")
-		if err != nil {
-			conn.status <- err
-			return
-		}
-		defer listener.Close()
-		listenerAddr := listener.Addr().(*net.TCPAddr)
-		conn.passivePort <- listenerAddr.Port
-		c, err := listener.Accept()
-		if err != nil {
-			conn.status <- err
-			return
-		}
-		defer c.Close()
-
-		if <-conn.mode {
-			// Receive data passively
-			buffer, err := ioutil.ReadAll(c)
-			if err != nil {
-				conn.status <- err
-				return
-			}
-			conn.status <- nil
-			conn.data <- buffer
-		} else {
-			// Send data passively
-			_, err = c.Write(<-conn.data)
-			if err != nil {
-				conn.status <- err
-				return
-			}
-			conn.status <- nil
-		}
-	}()
-}
-
-// SetActive actively transfers data.
-// It connects to the target host and reads or writes the data from the buffer channel.
-func (conn *Conn) SetActive(host string) {
-	go func() {
-		if <-conn.mode {
-			c, err := net.Dial("tcp", host)
-			if err != nil {
-				conn.status <- err
-				return
-			}
-			defer conn.Close()
-			buffer, err := ioutil.ReadAll(c)
-			if err != nil {
-				conn.status <- err
-				return
-			}
-			conn.status <- nil
-			conn.data <- buffer
-		} else {
-			object := <-conn.data
-			c, err := net.Dial("tcp", host)
-			if err != nil {
-				conn.status <- err
-				return
-			}
-			defer c.Close()
-			_, err = c.Write(object)
-			if err != nil {
-				conn.status <- err
-				return
-			}
-			conn.status <- nil
-		}
-	}()
+// transferSummary describes a transfer for humans, e.g. "10485760 bytes in 2.1s (4.9 MB/s)".
+func transferSummary(n int64, elapsed time.Duration) string {
+	seconds := elapsed.Seconds()
+	precision := 1
+	if seconds < 1 {
+		precision = 3
+	}
+	rate := "-"
+	if seconds > 0 {
+		rate = formatRate(float64(n) / seconds)
+	}
+	return strconv.FormatInt(n, 10) + " bytes in " + strconv.FormatFloat(seconds, 'f', precision, 64) + "s (" + rate + ")"
 }
 
-func (conn *Conn) Respond(status int, params ...interface{}) error {
-	response := fmt.Sprintf("%d %s\r\n", status, fmt.Sprintf(ftp.StatusMessages[status], params...))
-	_, err := conn.Write([]byte(response))
-	if err != nil {
-		return err
+// formatRate formats bytes per second with a decimal unit.
+func formatRate(rate float64) string {
+	units := []string{"B/s", "kB/s", "MB/s", "GB/s"}
+	unit := 0
+	for rate >= 1000 && unit < len(units)-1 {
+		rate /= 1000
+		unit++
 	}
-	conn.Log("RESPONSE", strings.TrimSpace(response))
-	return nil
+	return strconv.FormatFloat(rate, 'f', 1, 64) + " " + units[unit]
+}
+
+// Respond sends the reply text of a status, formatted with the parameters.
+func (conn *Conn) Respond(status int, params ...interface{}) error {
+	return conn.RespondText(status, conn.messages.Format(status, params...))
 }
 
-// GetPassivePort returns the port the handler is listening on. Blocks infinitely after first time use.
-func (conn *Conn) GetPassivePort() (int, error) {
-	select {
-	case port := <-conn.passivePort:
-		return port, nil
-	case <-time.After(time.Second):
-		return 0, errors.New("Operation timed out")
+// RespondText sends a reply with an explicit message, which is sent as multi-line reply if it spans several lines.
+func (conn *Conn) RespondText(status int, message string) error {
+	if _, err := conn.Write([]byte(ftp.FormatReply(status, message))); err != nil {
+		return err
 	}
+	conn.Log("RESPONSE", status, message)
+	return nil
 }
 
 // NewFactory instantiates a new TCP connection factory.
@@ -177,14 +212,43 @@ func NewFactory(host string) *ConnectionFactory {
 	return &ConnectionFactory{
 		listener: nil,
 		hostname: host,
-		index:    0,
+		IDs:      ftp.ULIDGenerator{},
 	}
 }
 
+// ConnectionFactory accepts FTP connections over TCP.
+// IDs generates the identifiers of accepted connections.
+// DataTimeout aborts data connections which are not established or stall for longer, 0 disables the limit.
+// PassiveTimeout closes passive listeners the client does not connect to for longer, 0 disables the limit.
+// AllowFXP accepts passive data connections from other hosts than the client, e.g. for server-to-server transfers.
+// RequireTLSReuse rejects TLS data connections which do not resume the TLS session of the control connection,
+// except for clients in the TLSReuseExempt networks.
+// PassivePorts optionally restricts passive data connections to a port range.
+// PassivePool optionally reuses passive listeners between transfers, its port range takes precedence.
+// Logger optionally replaces the plain log output of connections with structured records.
+// LogSecrets disables the redaction of passwords in logged requests, for debugging only.
+// Messages optionally overrides the reply texts of status codes.
+// MaxCommandLength limits the length of command lines in bytes, DefaultMaxCommandLength if 0.
+// TransferBufferSize sets the size of the pooled buffers copying data over data connections, DefaultTransferBufferSize if 0.
+// ControlSocket and DataSocket tune the TCP sockets of control and data connections.
 type ConnectionFactory struct {
-	listener net.Listener
-	hostname string
-	index    int
+	IDs                ftp.IDGenerator
+	DataTimeout        time.Duration
+	PassiveTimeout     time.Duration
+	AllowFXP           bool
+	RequireTLSReuse    bool
+	TLSReuseExempt     []*net.IPNet
+	PassivePorts       *PortRange
+	PassivePool        *ListenerPool
+	Logger             *slog.Logger
+	LogSecrets         bool
+	Messages           ftp.Messages
+	MaxCommandLength   int
+	TransferBufferSize int
+	ControlSocket      SocketOptions
+	DataSocket         SocketOptions
+	listener           net.Listener
+	hostname           string
 }
 
 func (fac *ConnectionFactory) Listen() error {
@@ -196,24 +260,63 @@ func (fac *ConnectionFactory) Listen() error {
 	return nil
 }
 
-func (fac *ConnectionFactory) Accept(cfg config.FTPUserConfig) (ftp.Conn, error) {
+// Close stops listening for new connections.
+func (fac *ConnectionFactory) Close() error {
+	return fac.listener.Close()
+}
+
+// Accept waits for the next connection. It returns the context error once ctx is cancelled.
+func (fac *ConnectionFactory) Accept(ctx context.Context, cfg config.FTPUserConfig) (ftp.Conn, error) {
+	if deadliner, ok := fac.listener.(interface{ SetDeadline(time.Time) error }); ok {
+		stop := context.AfterFunc(ctx, func() { deadliner.SetDeadline(time.Now()) })
+		defer stop()
+		defer deadliner.SetDeadline(time.Time{})
+	}
 	c, err := fac.listener.Accept()
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
-	defer func() { fac.index++ }()
-	return &Conn{
+	return fac.NewConn(ctx, c, cfg), nil
+}
+
+// NewConn wraps an accepted network connection, so the factory can serve as transport of a ftp.Server.
+// The connection is closed once ctx is cancelled.
+func (fac *ConnectionFactory) NewConn(ctx context.Context, c net.Conn, cfg config.FTPUserConfig) ftp.Conn {
+	ctx, cancel := context.WithCancel(ctx)
+	conn := &Conn{
 		ContextualConn: ftp.ContextualConn{
-			ID:           fac.index,
+			ID:           fac.IDs.Generate(),
+			RemoteAddr:   c.RemoteAddr().String(),
+			LocalAddr:    c.LocalAddr().String(),
 			Dir:          "/tmp",
 			User:         "",
 			TransferType: "AN",
 			Config:       cfg,
+			Logger:       fac.Logger,
+			LogSecrets:   fac.LogSecrets,
 		},
-		backend: c,
-		reader:  bufio.NewReader(c),
-		mode:    make(chan bool),
-		data:    make(chan []byte),
-		status:  make(chan error),
-	}, nil
+		backend:        c,
+		reader:         bufio.NewReader(c),
+		dataTimeout:    fac.DataTimeout,
+		passiveTimeout: fac.PassiveTimeout,
+		allowFXP:       fac.AllowFXP,
+		requireReuse:   fac.RequireTLSReuse && !exempts(fac.TLSReuseExempt, c.RemoteAddr().String()),
+		messages:       fac.Messages,
+		maxLineSize:    fac.MaxCommandLength,
+		bufferSize:     fac.TransferBufferSize,
+		dataSocket:     fac.DataSocket,
+		passivePorts:   fac.PassivePorts,
+		passivePool:    fac.PassivePool,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	if socket := tcpSocket(c); socket != nil {
+		keepUrgentInline(socket)
+	}
+	conn.tuneSocket(c, fac.ControlSocket)
+	context.AfterFunc(ctx, func() { c.Close() })
+	return conn
 }
@@ -0,0 +1,113 @@
+package tcp
+
+import (
+	"bytes"
+
+	"github.com/lnsp/ftpd/pkg/ftp"
+)
+
+// Telnet command bytes that may appear on the control connection, see RFC 854.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+// readTelnetLine reads a line from the control connection and strips Telnet commands from it,
+// such as the IAC IP and IAC DM clients send before ABOR. Option negotiations are refused,
+// since the control connection only speaks the Telnet defaults.
+// Lines with NUL or carriage return bytes other than the trailing CR are rejected with ftp.ErrMalformedCommand,
+// lines exceeding the maximum command length with ftp.ErrCommandTooLong before they are buffered completely.
+func (conn *Conn) readTelnetLine() ([]byte, error) {
+	limit := conn.maxLineSize
+	if limit <= 0 {
+		limit = DefaultMaxCommandLength
+	}
+	var line []byte
+	for {
+		// Leave room for the trailing CR, which does not count.
+		if len(line) > limit+1 {
+			return nil, ftp.ErrCommandTooLong
+		}
+		b, err := conn.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case '\n':
+			line = bytes.TrimSuffix(line, []byte{'\r'})
+			if len(line) > limit {
+				return nil, ftp.ErrCommandTooLong
+			}
+			if bytes.IndexByte(line, 0) >= 0 || bytes.IndexByte(line, '\r') >= 0 {
+				return nil, ftp.ErrMalformedCommand
+			}
+			return line, nil
+		case telnetIAC:
+			data, err := conn.readTelnetCommand()
+			if err != nil {
+				return nil, err
+			}
+			if data {
+				line = append(line, telnetIAC)
+			}
+		default:
+			line = append(line, b)
+		}
+	}
+}
+
+// readTelnetCommand consumes the Telnet command following an IAC byte.
+// It reports whether the command was an escaped IAC data byte.
+func (conn *Conn) readTelnetCommand() (bool, error) {
+	command, err := conn.reader.ReadByte()
+	if err != nil {
+		return false, err
+	}
+	if command < telnetSE {
+		// Not a command, the DM of an urgent IAC DM was taken out of the stream as out-of-band data.
+		return false, conn.reader.UnreadByte()
+	}
+	switch command {
+	case telnetIAC:
+		return true, nil
+	case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+		option, err := conn.reader.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		conn.refuseOption(command, option)
+	case telnetSB:
+		// Skip the subnegotiation up to IAC SE.
+		for previous := byte(0); ; {
+			b, err := conn.reader.ReadByte()
+			if err != nil {
+				return false, err
+			}
+			if previous == telnetIAC && b == telnetSE {
+				break
+			}
+			previous = b
+		}
+	}
+	return false, nil
+}
+
+// refuseOption declines an option the client offers or asks for.
+// Refusals of the client are not answered, so negotiations cannot loop.
+func (conn *Conn) refuseOption(command, option byte) {
+	var reply byte
+	switch command {
+	case telnetWILL:
+		reply = telnetDONT
+	case telnetDO:
+		reply = telnetWONT
+	default:
+		return
+	}
+	conn.Write([]byte{telnetIAC, reply, option})
+}
@@ -0,0 +1,49 @@
+package tcp
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// sendfileChunk is the amount of a file dataConn.ReadFrom sends with one deadline and counts at once.
+// Chunks keep the deadline and the progress meaningful for slow clients while each chunk still uses sendfile.
+const sendfileChunk = 256 * 1024
+
+// timeoutConn fails reads and writes which do not make progress within the timeout.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// ReadFrom sends a chunk of a file directly over the TCP connection with a renewed deadline,
+// so the wrapper does not prevent sendfile. Other readers are copied through Write.
+func (c *timeoutConn) ReadFrom(r io.Reader) (int64, error) {
+	tcp, isTCP := c.Conn.(*net.TCPConn)
+	if !isTCP || !isFileChunk(r) {
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+	tcp.SetWriteDeadline(time.Now().Add(c.timeout))
+	return tcp.ReadFrom(r)
+}
+
+// isFileChunk reports whether r is a chunk of a file, which the TCP connection can send with sendfile.
+func isFileChunk(r io.Reader) bool {
+	chunk, ok := r.(*io.LimitedReader)
+	if !ok {
+		return false
+	}
+	_, isFile := chunk.R.(*os.File)
+	return isFile
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package tcp
+
+import "net"
+
+// keepUrgentInline is a no-op on platforms without SO_OOBINLINE.
+func keepUrgentInline(c net.Conn) {}
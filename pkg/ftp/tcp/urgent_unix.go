@@ -0,0 +1,24 @@
+//go:build unix
+
+package tcp
+
+import (
+	"net"
+	"syscall"
+)
+
+// keepUrgentInline makes the kernel deliver urgent data inline. Clients send ABOR or the DM of IAC DM
+// with MSG_OOB, whose last byte would otherwise be taken out of the command stream.
+func keepUrgentInline(c net.Conn) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_OOBINLINE, 1)
+	})
+}
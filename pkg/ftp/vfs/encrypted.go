@@ -0,0 +1,354 @@
+package vfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	encryptedMagic     = "FTPE2"
+	encryptedChunkSize = 64 * 1024
+	encryptedNonceSize = 12
+	encryptedPrefixLen = 7
+)
+
+var (
+	errEncryptedFormat = errors.New("vfs: malformed encrypted file")
+	errEncryptedMode   = errors.New("vfs: encrypted files can only be read or written sequentially")
+)
+
+// Encrypted wraps a FileSystem and transparently encrypts file contents with AES-256-GCM.
+// Files are split into chunks which are sealed individually, so they can be streamed.
+// If names are encrypted, every path component below root is encrypted deterministically.
+// Contents, names and the nonces of names use separate subkeys derived from the key with HKDF.
+type Encrypted struct {
+	fs       FileSystem
+	aead     cipher.AEAD
+	nameAEAD cipher.AEAD
+	nonceKey []byte
+	root     string
+	names    bool
+}
+
+// NewEncrypted creates an encrypting wrapper around fs using a 32 byte key.
+func NewEncrypted(fs FileSystem, key []byte, root string, encryptNames bool) (*Encrypted, error) {
+	if len(key) != 32 {
+		return nil, errors.New("vfs: encryption key must be 32 bytes long")
+	}
+	aead, err := newSubkeyAEAD(key, "ftpd contents")
+	if err != nil {
+		return nil, err
+	}
+	nameAEAD, err := newSubkeyAEAD(key, "ftpd names")
+	if err != nil {
+		return nil, err
+	}
+	nonceKey, err := deriveSubkey(key, "ftpd name nonces")
+	if err != nil {
+		return nil, err
+	}
+	return &Encrypted{fs, aead, nameAEAD, nonceKey, filepath.Clean(root), encryptNames}, nil
+}
+
+// deriveSubkey derives a 32 byte key for a single purpose from the master key.
+func deriveSubkey(key []byte, purpose string) ([]byte, error) {
+	subkey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(purpose)), subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
+
+// newSubkeyAEAD creates an AES-256-GCM cipher with a subkey derived for the purpose.
+func newSubkeyAEAD(key []byte, purpose string) (cipher.AEAD, error) {
+	subkey, err := deriveSubkey(key, purpose)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptName deterministically encrypts a single path component.
+func (e *Encrypted) encryptName(name string) string {
+	mac := hmac.New(sha256.New, e.nonceKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:encryptedNonceSize]
+	sealed := e.nameAEAD.Seal(nil, nonce, []byte(name), nil)
+	return base64.RawURLEncoding.EncodeToString(append(nonce, sealed...))
+}
+
+// decryptName reverses encryptName.
+func (e *Encrypted) decryptName(name string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(raw) < encryptedNonceSize {
+		return "", errEncryptedFormat
+	}
+	plain, err := e.nameAEAD.Open(nil, raw[:encryptedNonceSize], raw[encryptedNonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// path maps a plaintext path to the path in the underlying file system.
+func (e *Encrypted) path(name string) string {
+	name = filepath.Clean(name)
+	if !e.names {
+		return name
+	}
+	rel, err := filepath.Rel(e.root, name)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return name
+	}
+	components := strings.Split(rel, string(filepath.Separator))
+	for i, component := range components {
+		components[i] = e.encryptName(component)
+	}
+	return filepath.Join(e.root, filepath.Join(components...))
+}
+
+// plainSize calculates the plaintext size of an encrypted file.
+func plainSize(size int64) int64 {
+	overhead := int64(len(encryptedMagic) + encryptedPrefixLen)
+	if size < overhead {
+		return 0
+	}
+	size -= overhead
+	chunk := int64(encryptedChunkSize + 16)
+	last := size % chunk
+	if last < 16 {
+		last = 16
+	}
+	return size/chunk*encryptedChunkSize + last - 16
+}
+
+type encryptedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (info *encryptedFileInfo) Name() string {
+	return info.name
+}
+
+func (info *encryptedFileInfo) Size() int64 {
+	if info.FileInfo.IsDir() {
+		return info.FileInfo.Size()
+	}
+	return plainSize(info.FileInfo.Size())
+}
+
+func (e *Encrypted) Open(name string) (File, error) {
+	return e.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (e *Encrypted) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_APPEND|os.O_RDWR) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errEncryptedMode}
+	}
+	file, err := e.fs.OpenFile(e.path(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_WRONLY != 0 {
+		return newEncryptedWriter(file, e.aead)
+	}
+	return newEncryptedReader(file, e.aead)
+}
+
+func (e *Encrypted) Stat(name string) (os.FileInfo, error) {
+	info, err := e.fs.Stat(e.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFileInfo{info, filepath.Base(name)}, nil
+}
+
+func (e *Encrypted) ReadDir(name string) ([]os.FileInfo, error) {
+	infos, err := e.fs.ReadDir(e.path(name))
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		plain := info.Name()
+		if e.names {
+			if plain, err = e.decryptName(info.Name()); err != nil {
+				continue
+			}
+		}
+		decrypted = append(decrypted, &encryptedFileInfo{info, plain})
+	}
+	return decrypted, nil
+}
+
+func (e *Encrypted) Mkdir(name string, perm os.FileMode) error {
+	return e.fs.Mkdir(e.path(name), perm)
+}
+
+func (e *Encrypted) Rename(from, to string) error {
+	return e.fs.Rename(e.path(from), e.path(to))
+}
+
+func (e *Encrypted) Remove(name string) error {
+	return e.fs.Remove(e.path(name))
+}
+
+func (e *Encrypted) RemoveAll(name string) error {
+	return e.fs.RemoveAll(e.path(name))
+}
+
+func (e *Encrypted) TempDir(dir, prefix string) (string, error) {
+	for {
+		var random [8]byte
+		rand.Read(random[:])
+		name := filepath.Join(dir, prefix+strconv.FormatUint(binary.BigEndian.Uint64(random[:]), 36))
+		err := e.Mkdir(name, 0700)
+		if os.IsExist(err) {
+			continue
+		}
+		return name, err
+	}
+}
+
+// chunkNonce derives the nonce of a chunk, marking the final chunk to detect truncation.
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, encryptedNonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptedPrefixLen:], counter)
+	if last {
+		nonce[encryptedNonceSize-1] = 1
+	}
+	return nonce
+}
+
+// encryptedWriter seals plaintext chunks and writes them to the underlying file.
+type encryptedWriter struct {
+	file    File
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buffer  []byte
+}
+
+func newEncryptedWriter(file File, aead cipher.AEAD) (*encryptedWriter, error) {
+	prefix := make([]byte, encryptedPrefixLen)
+	if _, err := rand.Read(prefix); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &encryptedWriter{file: file, aead: aead, prefix: prefix, buffer: make([]byte, 0, encryptedChunkSize)}, nil
+}
+
+func (w *encryptedWriter) seal(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter, last), w.buffer, nil)
+	w.counter++
+	w.buffer = w.buffer[:0]
+	_, err := w.file.Write(sealed)
+	return err
+}
+
+func (w *encryptedWriter) Read(p []byte) (int, error) {
+	return 0, errEncryptedMode
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buffer[len(w.buffer):cap(w.buffer)], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+		if len(w.buffer) == encryptedChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *encryptedWriter) Close() error {
+	if err := w.seal(true); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// encryptedReader reads and opens sealed chunks from the underlying file.
+type encryptedReader struct {
+	file    File
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+func newEncryptedReader(file File, aead cipher.AEAD) (*encryptedReader, error) {
+	header := make([]byte, len(encryptedMagic)+encryptedPrefixLen)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		file.Close()
+		return nil, errEncryptedFormat
+	}
+	return &encryptedReader{
+		file:   file,
+		aead:   aead,
+		prefix: header[len(encryptedMagic):],
+		chunk:  make([]byte, encryptedChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *encryptedReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.file, r.chunk)
+		last := err == io.ErrUnexpectedEOF || err == io.EOF
+		if err != nil && !last {
+			return 0, err
+		}
+		plain, err := r.aead.Open(r.chunk[:0:0], chunkNonce(r.prefix, r.counter, last), r.chunk[:n], nil)
+		if err != nil {
+			return 0, errEncryptedFormat
+		}
+		r.counter++
+		r.plain = plain
+		r.done = last
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *encryptedReader) Write(p []byte) (int, error) {
+	return 0, errEncryptedMode
+}
+
+func (r *encryptedReader) Close() error {
+	return r.file.Close()
+}
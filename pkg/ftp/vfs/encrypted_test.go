@@ -0,0 +1,53 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestEncryptedNames(t *testing.T) {
+	memory := NewMemory()
+	memory.MkdirAll("/home", 0755)
+	key := bytes.Repeat([]byte{7}, 32)
+	fs, err := NewEncrypted(memory, key, "/home", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("secret contents")
+	for _, name := range []string{"plain.txt", "..data"} {
+		file, err := fs.OpenFile("/home/"+name, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(data)
+		if err := file.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := memory.Stat("/home/" + name); !os.IsNotExist(err) {
+			t.Errorf("name %s is stored in plaintext", name)
+		}
+		file, err = fs.Open("/home/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(file)
+		file.Close()
+		if err != nil || !bytes.Equal(read, data) {
+			t.Errorf("read %q, %v from %s, want %q", read, err, name, data)
+		}
+	}
+	infos, err := fs.ReadDir("/home")
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("listed %d entries, %v, want 2", len(infos), err)
+	}
+	for _, info := range infos {
+		if info.Name() != "plain.txt" && info.Name() != "..data" {
+			t.Errorf("listed %q", info.Name())
+		}
+	}
+	if path := fs.path("/other/x"); path != "/other/x" {
+		t.Errorf("path outside of root mapped to %s", path)
+	}
+}
@@ -0,0 +1,258 @@
+package vfs
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a file system living entirely in memory.
+type Memory struct {
+	mu    sync.RWMutex
+	nodes map[string]*memoryNode
+}
+
+type memoryNode struct {
+	name    string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (node *memoryNode) info() os.FileInfo {
+	return &memoryFileInfo{node.name, int64(len(node.data)), node.mode, node.modTime}
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (info *memoryFileInfo) Name() string       { return info.name }
+func (info *memoryFileInfo) Size() int64        { return info.size }
+func (info *memoryFileInfo) Mode() os.FileMode  { return info.mode }
+func (info *memoryFileInfo) ModTime() time.Time { return info.modTime }
+func (info *memoryFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info *memoryFileInfo) Sys() interface{}   { return nil }
+
+// NewMemory creates an empty in-memory file system containing only the root directory.
+func NewMemory() *Memory {
+	return &Memory{
+		nodes: map[string]*memoryNode{
+			"/": {name: "/", mode: os.ModeDir | 0755, modTime: time.Now()},
+		},
+	}
+}
+
+// MkdirAll creates a directory and all missing parents.
+func (m *Memory) MkdirAll(name string, perm os.FileMode) error {
+	name = filepath.Clean(name)
+	if name == "/" {
+		return nil
+	}
+	if err := m.MkdirAll(filepath.Dir(name), perm); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if node, ok := m.nodes[name]; ok {
+		if !node.mode.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+		}
+		return nil
+	}
+	m.nodes[name] = &memoryNode{name: filepath.Base(name), mode: os.ModeDir | perm, modTime: time.Now()}
+	return nil
+}
+
+// WriteFile creates or replaces a file with the given contents.
+func (m *Memory) WriteFile(name string, data []byte, perm os.FileMode) error {
+	file, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	return err
+}
+
+func (m *Memory) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *Memory) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		parent, ok := m.nodes[filepath.Dir(name)]
+		if !ok || !parent.mode.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memoryNode{name: filepath.Base(name), mode: perm, modTime: time.Now()}
+		m.nodes[name] = node
+	case node.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	file := &memoryFile{fs: m, node: node}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		file.buffer = bytes.NewBuffer(nil)
+		if flag&os.O_APPEND != 0 {
+			file.buffer.Write(node.data)
+		}
+	} else {
+		file.buffer = bytes.NewBuffer(append([]byte(nil), node.data...))
+	}
+	file.write = flag&(os.O_WRONLY|os.O_RDWR) != 0
+	return file, nil
+}
+
+func (m *Memory) Stat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	node, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return node.info(), nil
+}
+
+func (m *Memory) ReadDir(name string) ([]os.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if node, ok := m.nodes[name]; !ok || !node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for path, node := range m.nodes {
+		if path != name && filepath.Dir(path) == name {
+			infos = append(infos, node.info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *Memory) Mkdir(name string, perm os.FileMode) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nodes[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if parent, ok := m.nodes[filepath.Dir(name)]; !ok || !parent.mode.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	m.nodes[name] = &memoryNode{name: filepath.Base(name), mode: os.ModeDir | perm, modTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) Rename(from, to string) error {
+	from, to = filepath.Clean(from), filepath.Clean(to)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nodes[from]; !ok {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	if parent, ok := m.nodes[filepath.Dir(to)]; !ok || !parent.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	moved := make(map[string]*memoryNode)
+	for path, node := range m.nodes {
+		if path == from || strings.HasPrefix(path, from+"/") {
+			delete(m.nodes, path)
+			moved[to+strings.TrimPrefix(path, from)] = node
+		}
+	}
+	for path, node := range moved {
+		m.nodes[path] = node
+	}
+	m.nodes[to].name = filepath.Base(to)
+	return nil
+}
+
+func (m *Memory) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nodes[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for path := range m.nodes {
+		if filepath.Dir(path) == name && path != name {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *Memory) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for path := range m.nodes {
+		if path == name || strings.HasPrefix(path, name+"/") {
+			delete(m.nodes, path)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) TempDir(dir, prefix string) (string, error) {
+	for {
+		name := filepath.Join(dir, prefix+strconv.Itoa(rand.Int()))
+		err := m.Mkdir(name, 0700)
+		if os.IsExist(err) {
+			continue
+		}
+		return name, err
+	}
+}
+
+// memoryFile is an open handle to a memory node. Writes become visible on Close.
+type memoryFile struct {
+	fs     *Memory
+	node   *memoryNode
+	buffer *bytes.Buffer
+	write  bool
+}
+
+func (file *memoryFile) Read(p []byte) (int, error) {
+	return file.buffer.Read(p)
+}
+
+func (file *memoryFile) Write(p []byte) (int, error) {
+	if !file.write {
+		return 0, os.ErrPermission
+	}
+	return file.buffer.Write(p)
+}
+
+func (file *memoryFile) Close() error {
+	if !file.write {
+		return nil
+	}
+	file.fs.mu.Lock()
+	defer file.fs.mu.Unlock()
+	file.node.data = file.buffer.Bytes()
+	file.node.modTime = time.Now()
+	file.write = false
+	return nil
+}
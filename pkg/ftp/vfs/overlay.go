@@ -0,0 +1,338 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueMarker   = ".wh..opq"
+)
+
+// Overlay presents a read-only lower directory merged with a writable upper directory at a mount point.
+// Modifications only ever touch the upper directory. Deleted lower entries are hidden by whiteout markers.
+// Paths outside of the mount point are passed through to the underlying file system.
+type Overlay struct {
+	fs    FileSystem
+	mount string
+	lower string
+	upper string
+}
+
+// NewOverlay creates an overlay of lower and upper mounted at mount.
+func NewOverlay(fs FileSystem, mount, lower, upper string) *Overlay {
+	return &Overlay{fs, filepath.Clean(mount), filepath.Clean(lower), filepath.Clean(upper)}
+}
+
+// resolve returns the path relative to the mount point.
+func (o *Overlay) resolve(name string) (string, bool) {
+	rel, err := filepath.Rel(o.mount, filepath.Clean(name))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return rel, true
+}
+
+func (o *Overlay) upperPath(rel string) string {
+	return filepath.Join(o.upper, rel)
+}
+
+func (o *Overlay) lowerPath(rel string) string {
+	return filepath.Join(o.lower, rel)
+}
+
+func (o *Overlay) whiteoutPath(rel string) string {
+	return filepath.Join(o.upper, filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel))
+}
+
+func (o *Overlay) exists(name string) bool {
+	_, err := o.fs.Stat(name)
+	return err == nil
+}
+
+// hidden checks if the entry or one of its ancestors has been removed from the lower layer.
+func (o *Overlay) hidden(rel string) bool {
+	for current := rel; current != "."; current = filepath.Dir(current) {
+		if strings.HasPrefix(filepath.Base(current), whiteoutPrefix) || o.exists(o.whiteoutPath(current)) {
+			return true
+		}
+		if o.exists(filepath.Join(o.upper, filepath.Dir(current), opaqueMarker)) && !o.exists(o.upperPath(current)) {
+			return true
+		}
+	}
+	return false
+}
+
+// inLower checks if the entry is visible in the lower layer.
+func (o *Overlay) inLower(rel string) bool {
+	return !o.hidden(rel) && o.exists(o.lowerPath(rel))
+}
+
+// copyUp creates the entry and all its parents in the upper layer, copying file contents from the lower layer.
+func (o *Overlay) copyUp(rel string) error {
+	if rel == "." || o.exists(o.upperPath(rel)) {
+		return nil
+	}
+	if err := o.copyUp(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	info, err := o.fs.Stat(o.lowerPath(rel))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return o.fs.Mkdir(o.upperPath(rel), info.Mode().Perm())
+	}
+	src, err := o.fs.Open(o.lowerPath(rel))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := o.fs.OpenFile(o.upperPath(rel), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// copyUpTree copies an entry and all of its visible descendants into the upper layer.
+func (o *Overlay) copyUpTree(rel string) error {
+	if err := o.copyUp(rel); err != nil {
+		return err
+	}
+	info, err := o.fs.Stat(o.upperPath(rel))
+	if err != nil || !info.IsDir() {
+		return err
+	}
+	children, err := o.ReadDir(filepath.Join(o.mount, rel))
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := o.copyUpTree(filepath.Join(rel, child.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markOpaque stops merging lower entries into a directory that has been moved or recreated.
+func (o *Overlay) markOpaque(rel string) error {
+	file, err := o.fs.OpenFile(filepath.Join(o.upperPath(rel), opaqueMarker), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// whiteout hides a lower entry.
+func (o *Overlay) whiteout(rel string) error {
+	if err := o.copyUp(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	file, err := o.fs.OpenFile(o.whiteoutPath(rel), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// prepareWrite makes sure the parent directory exists in the upper layer and the entry is not hidden anymore.
+func (o *Overlay) prepareWrite(rel string) error {
+	if err := o.copyUp(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	if o.exists(o.whiteoutPath(rel)) {
+		return o.fs.Remove(o.whiteoutPath(rel))
+	}
+	return nil
+}
+
+func (o *Overlay) Open(name string) (File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o *Overlay) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	rel, ok := o.resolve(name)
+	if !ok {
+		return o.fs.OpenFile(name, flag, perm)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if o.hidden(rel) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if o.exists(o.upperPath(rel)) {
+			return o.fs.OpenFile(o.upperPath(rel), flag, perm)
+		}
+		return o.fs.OpenFile(o.lowerPath(rel), flag, perm)
+	}
+	if flag&os.O_TRUNC == 0 && o.inLower(rel) {
+		if err := o.copyUp(rel); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.prepareWrite(rel); err != nil {
+		return nil, err
+	}
+	return o.fs.OpenFile(o.upperPath(rel), flag, perm)
+}
+
+func (o *Overlay) Stat(name string) (os.FileInfo, error) {
+	rel, ok := o.resolve(name)
+	if !ok {
+		return o.fs.Stat(name)
+	}
+	if o.hidden(rel) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	if info, err := o.fs.Stat(o.upperPath(rel)); err == nil {
+		return info, nil
+	}
+	return o.fs.Stat(o.lowerPath(rel))
+}
+
+func (o *Overlay) ReadDir(name string) ([]os.FileInfo, error) {
+	rel, ok := o.resolve(name)
+	if !ok {
+		return o.fs.ReadDir(name)
+	}
+	if o.hidden(rel) {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	entries := make(map[string]os.FileInfo)
+	upper, upperErr := o.fs.ReadDir(o.upperPath(rel))
+	opaque := false
+	for _, info := range upper {
+		if info.Name() == opaqueMarker {
+			opaque = true
+		}
+		if !strings.HasPrefix(info.Name(), whiteoutPrefix) {
+			entries[info.Name()] = info
+		}
+	}
+	var lowerErr error = os.ErrNotExist
+	if !opaque {
+		var lower []os.FileInfo
+		lower, lowerErr = o.fs.ReadDir(o.lowerPath(rel))
+		for _, info := range lower {
+			if _, ok := entries[info.Name()]; ok || o.exists(o.whiteoutPath(filepath.Join(rel, info.Name()))) {
+				continue
+			}
+			entries[info.Name()] = info
+		}
+	}
+	if upperErr != nil && lowerErr != nil {
+		return nil, upperErr
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, info := range entries {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (o *Overlay) Mkdir(name string, perm os.FileMode) error {
+	rel, ok := o.resolve(name)
+	if !ok {
+		return o.fs.Mkdir(name, perm)
+	}
+	if _, err := o.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	recreated := o.exists(o.whiteoutPath(rel))
+	if err := o.prepareWrite(rel); err != nil {
+		return err
+	}
+	if err := o.fs.Mkdir(o.upperPath(rel), perm); err != nil {
+		return err
+	}
+	if recreated {
+		return o.markOpaque(rel)
+	}
+	return nil
+}
+
+func (o *Overlay) Rename(from, to string) error {
+	fromRel, fromOk := o.resolve(from)
+	toRel, toOk := o.resolve(to)
+	if !fromOk || !toOk {
+		return o.fs.Rename(from, to)
+	}
+	if _, err := o.Stat(from); err != nil {
+		return err
+	}
+	if err := o.copyUpTree(fromRel); err != nil {
+		return err
+	}
+	if err := o.prepareWrite(toRel); err != nil {
+		return err
+	}
+	if err := o.fs.Rename(o.upperPath(fromRel), o.upperPath(toRel)); err != nil {
+		return err
+	}
+	if info, err := o.fs.Stat(o.upperPath(toRel)); err == nil && info.IsDir() {
+		if err := o.markOpaque(toRel); err != nil {
+			return err
+		}
+	}
+	if o.inLower(fromRel) {
+		return o.whiteout(fromRel)
+	}
+	return nil
+}
+
+func (o *Overlay) Remove(name string) error {
+	if _, ok := o.resolve(name); !ok {
+		return o.fs.Remove(name)
+	}
+	info, err := o.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		children, err := o.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+		}
+	}
+	return o.RemoveAll(name)
+}
+
+func (o *Overlay) RemoveAll(name string) error {
+	rel, ok := o.resolve(name)
+	if !ok {
+		return o.fs.RemoveAll(name)
+	}
+	if err := o.fs.RemoveAll(o.upperPath(rel)); err != nil {
+		return err
+	}
+	if o.inLower(rel) {
+		return o.whiteout(rel)
+	}
+	return nil
+}
+
+func (o *Overlay) TempDir(dir, prefix string) (string, error) {
+	for {
+		name := filepath.Join(dir, prefix+strconv.FormatInt(time.Now().UnixNano(), 36))
+		err := o.Mkdir(name, 0700)
+		if os.IsExist(err) {
+			continue
+		}
+		return name, err
+	}
+}
@@ -0,0 +1,73 @@
+package vfs
+
+import (
+	"os"
+)
+
+// Owned wraps a local FileSystem and hands files and directories it creates over to a system user.
+// Changing the owner requires the server to run as root or with CAP_CHOWN and is not supported on Windows.
+type Owned struct {
+	fs       FileSystem
+	uid, gid int
+}
+
+// NewOwned creates a wrapper around fs which changes the owner of created entries to uid and gid.
+func NewOwned(fs FileSystem, uid, gid int) *Owned {
+	return &Owned{fs, uid, gid}
+}
+
+func (o *Owned) Open(name string) (File, error) {
+	return o.fs.Open(name)
+}
+
+func (o *Owned) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	created := false
+	if flag&os.O_CREATE != 0 {
+		_, err := o.fs.Stat(name)
+		created = os.IsNotExist(err)
+	}
+	file, err := o.fs.OpenFile(name, flag, perm)
+	if err != nil || !created {
+		return file, err
+	}
+	if err := os.Lchown(name, o.uid, o.gid); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (o *Owned) Stat(name string) (os.FileInfo, error) {
+	return o.fs.Stat(name)
+}
+
+func (o *Owned) ReadDir(name string) ([]os.FileInfo, error) {
+	return o.fs.ReadDir(name)
+}
+
+func (o *Owned) Mkdir(name string, perm os.FileMode) error {
+	if err := o.fs.Mkdir(name, perm); err != nil {
+		return err
+	}
+	return os.Lchown(name, o.uid, o.gid)
+}
+
+func (o *Owned) Rename(from, to string) error {
+	return o.fs.Rename(from, to)
+}
+
+func (o *Owned) Remove(name string) error {
+	return o.fs.Remove(name)
+}
+
+func (o *Owned) RemoveAll(name string) error {
+	return o.fs.RemoveAll(name)
+}
+
+func (o *Owned) TempDir(dir, prefix string) (string, error) {
+	name, err := o.fs.TempDir(dir, prefix)
+	if err != nil {
+		return "", err
+	}
+	return name, os.Lchown(name, o.uid, o.gid)
+}
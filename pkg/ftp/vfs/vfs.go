@@ -0,0 +1,69 @@
+/*
+Package vfs abstracts the storage a FTP session operates on.
+*/
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// File is an open file handle of a FileSystem.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// FileSystem provides the file operations used by command handlers.
+type FileSystem interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	Rename(from, to string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	TempDir(dir, prefix string) (string, error)
+}
+
+// OS is the local disk file system.
+type OS struct{}
+
+func (OS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (OS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (OS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (OS) Rename(from, to string) error {
+	return os.Rename(from, to)
+}
+
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (OS) TempDir(dir, prefix string) (string, error) {
+	return ioutil.TempDir(dir, prefix)
+}